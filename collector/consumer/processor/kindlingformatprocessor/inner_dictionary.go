@@ -55,7 +55,7 @@ func (g gauges) Process(cfg *Config, relabels ...Relabel) *model.GaugeGroup {
 
 func MetricName(cfg *Config, g *gauges) {
 	for _, gauge := range g.Values {
-		if name := constlabels.ToKindlingMetricName(gauge.Name, g.Labels.GetBoolValue(constlabels.IsServer)); name != "" {
+		if name := kindlingMetricName(gauge.Name, g.Labels.GetBoolValue(constlabels.IsServer)); name != "" {
 			g.targetValues = append(g.targetValues, &model.Gauge{
 				Name:  name,
 				Value: gauge.Value,
@@ -66,6 +66,15 @@ func MetricName(cfg *Config, g *gauges) {
 	}
 }
 
+// kindlingMetricName returns the exported name of the metric. The average request latency is
+// exported as a histogram, named after constlabels.ToKindlingHistogramMetricName.
+func kindlingMetricName(origName string, isServer bool) string {
+	if origName == constvalues.RequestTotalTime+"_avg" {
+		return constlabels.ToKindlingHistogramMetricName(isServer)
+	}
+	return constlabels.ToKindlingMetricName(origName, isServer)
+}
+
 func TraceName(cfg *Config, g *gauges) {
 	var requestDuration int64
 	for i := 0; i < len(g.Values); i++ {
@@ -86,10 +95,13 @@ func SpanName(cfg *Config, g *gauges) {
 
 func ProtocolDetailMetricName(cfg *Config, g *gauges) {
 	for _, gauge := range g.Values {
-		g.targetValues = append(g.targetValues, &model.Gauge{
-			Name:  constlabels.ToKindlingDetailMetricName(gauge.Name, g.Labels.GetStringValue(constlabels.Protocol)),
-			Value: gauge.Value,
-		})
+		// the metrics of the protocols not enabled with constlabels.EnableDetailProtocol are dropped
+		if name := constlabels.ToKindlingDetailMetricName(gauge.Name, g.Labels.GetStringValue(constlabels.Protocol)); name != "" {
+			g.targetValues = append(g.targetValues, &model.Gauge{
+				Name:  name,
+				Value: gauge.Value,
+			})
+		}
 	}
 }
 
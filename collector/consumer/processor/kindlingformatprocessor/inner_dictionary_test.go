@@ -254,3 +254,26 @@ func getTopologyMetric() *model.GaugeGroup {
 
 	return &gaugesGroup
 }
+
+func TestMetricNameRequestLatencyHistogram(t *testing.T) {
+	defer func() {
+		_ = constlabels.SetRequestLatencyHistogramName(constlabels.EntityRequestLatencyAverageMetric)
+	}()
+	avgName := constvalues.RequestTotalTime + "_avg"
+	name := func() string {
+		labels := model.NewAttributeMap()
+		labels.AddBoolValue(constlabels.IsServer, true)
+		g := newGauges(model.NewGaugeGroup("test", labels, 0, &model.Gauge{Name: avgName, Value: 1}))
+		return g.Process(&Config{}, MetricName).Values[0].Name
+	}
+
+	if got, want := name(), constlabels.ToKindlingMetricName(avgName, true); got != want {
+		t.Errorf("MetricName() = %q, want %q", got, want)
+	}
+	if err := constlabels.SetRequestLatencyHistogramName("duration_nanoseconds"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := name(), "kindling_entity_request_duration_nanoseconds"; got != want {
+		t.Errorf("MetricName() = %q, want %q", got, want)
+	}
+}
@@ -32,6 +32,10 @@ func NewConntracker(config *Config) (Conntracker, error) {
 				ConntrackRateLimit:           config.ConntrackRateLimit,
 				ConntrackMaxStateSize:        config.ConntrackMaxStateSize,
 				EnableConntrackAllNamespaces: config.EnableConntrackAllNamespaces,
+				ConntrackZone:                config.ConntrackZone,
+				ConntrackLogFirstEvents:      config.ConntrackLogFirstEvents,
+				ConntrackDedupTTL:            config.ConntrackDedupTTL,
+				ConntrackDedupSize:           config.ConntrackDedupSize,
 			}
 			conntracker, err := internal.NewConntracker(cfg)
 			if err != nil {
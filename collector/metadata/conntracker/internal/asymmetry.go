@@ -0,0 +1,86 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	ct "github.com/florianl/go-conntrack"
+)
+
+// Asymmetry compares the traffic of the original direction of the connection to the traffic of
+// its reply direction, as (orig - reply) / (orig + reply): 1 for a one-way flow from the
+// initiator, 0 for a symmetric one, and -1 when only replies were counted. Packets are compared
+// when both counters have them, bytes otherwise.
+//
+// 0 is returned when the counters weren't decoded, e.g. with nf_conntrack_acct disabled, or when
+// nothing was counted, see HasCounters.
+func Asymmetry(conn *Con) float64 {
+	orig, reply, ok := directionCounts(conn)
+	if !ok || orig+reply == 0 {
+		return 0
+	}
+	return (float64(orig) - float64(reply)) / (float64(orig) + float64(reply))
+}
+
+// HasCounters returns whether both byte or both packet counters of the connection were decoded
+func HasCounters(conn *Con) bool {
+	_, _, ok := directionCounts(conn)
+	return ok
+}
+
+// directionCounts returns the packets of both directions of the connection, or their bytes when
+// the packets weren't decoded
+func directionCounts(conn *Con) (orig, reply uint64, ok bool) {
+	if conn == nil || conn.CounterOrigin == nil || conn.CounterReply == nil {
+		return 0, 0, false
+	}
+	pick := func(c *ct.Counter, packets bool) *uint64 {
+		if packets {
+			return c.Packets
+		}
+		return c.Bytes
+	}
+	for _, packets := range []bool{true, false} {
+		o, r := pick(conn.CounterOrigin, packets), pick(conn.CounterReply, packets)
+		if o != nil && r != nil {
+			return *o, *r, true
+		}
+	}
+	return 0, 0, false
+}
+
+// ScanClassifier flags the connections which look like scans: the initiator sent packets, but
+// (almost) nothing came back, as when probing filtered ports or unreachable hosts.
+type ScanClassifier struct {
+	// MinAsymmetry is the lowest Asymmetry of a scan, 1 only flagging flows without any reply
+	MinAsymmetry float64
+	// MinOrigPackets is the lowest number of original packets of a scan, to leave out the
+	// connections which just started. Byte counters are only compared when the packet
+	// counters are missing, in which case it's ignored.
+	MinOrigPackets uint64
+}
+
+// DefaultScanClassifier is the ScanClassifier used by IsLikelyScan: at least two packets from
+// the initiator, e.g. a SYN and its retransmission, and at most one reply for 19 of them.
+var DefaultScanClassifier = ScanClassifier{
+	MinAsymmetry:   0.9,
+	MinOrigPackets: 2,
+}
+
+// IsLikelyScan reports whether the connection looks like a scan, see ScanClassifier.
+// Connections without counters are never flagged.
+func (s ScanClassifier) IsLikelyScan(conn *Con) bool {
+	if !HasCounters(conn) {
+		return false
+	}
+	if p := conn.CounterOrigin.Packets; p != nil && conn.CounterReply.Packets != nil && *p < s.MinOrigPackets {
+		return false
+	}
+	return Asymmetry(conn) >= s.MinAsymmetry
+}
+
+// IsLikelyScan reports whether the connection looks like a scan with the thresholds of
+// DefaultScanClassifier
+func IsLikelyScan(conn *Con) bool {
+	return DefaultScanClassifier.IsLikelyScan(conn)
+}
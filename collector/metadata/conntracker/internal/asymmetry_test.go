@@ -0,0 +1,56 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"testing"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAsymmetry(t *testing.T) {
+	counter := func(packets, bytes uint64) *ct.Counter {
+		return &ct.Counter{Packets: &packets, Bytes: &bytes}
+	}
+	withCounters := func(orig, reply *ct.Counter) *Con {
+		return &Con{Con: ct.Con{CounterOrigin: orig, CounterReply: reply}}
+	}
+
+	// A request and its response
+	symmetric := withCounters(counter(10, 800), counter(10, 64000))
+	assert.Equal(t, 0.0, Asymmetry(symmetric))
+	assert.False(t, IsLikelyScan(symmetric))
+
+	// SYNs to a filtered port
+	oneWay := withCounters(counter(3, 180), counter(0, 0))
+	assert.Equal(t, 1.0, Asymmetry(oneWay))
+	assert.True(t, IsLikelyScan(oneWay))
+
+	// A connection which just started isn't flagged yet
+	started := withCounters(counter(1, 60), counter(0, 0))
+	assert.Equal(t, 1.0, Asymmetry(started))
+	assert.False(t, IsLikelyScan(started))
+
+	// An upload is mostly one-way in bytes, but its packets are acknowledged
+	upload := withCounters(counter(100, 150000), counter(60, 3120))
+	assert.InDelta(t, 0.25, Asymmetry(upload), 0.001)
+	assert.False(t, IsLikelyScan(upload))
+
+	// Only bytes were decoded
+	bytes := func(n uint64) *ct.Counter { return &ct.Counter{Bytes: &n} }
+	bytesOnly := withCounters(bytes(300), bytes(100))
+	assert.Equal(t, 0.5, Asymmetry(bytesOnly))
+	assert.True(t, ScanClassifier{MinAsymmetry: 0.5, MinOrigPackets: 10}.IsLikelyScan(bytesOnly))
+
+	// The threshold is configurable
+	assert.True(t, ScanClassifier{MinAsymmetry: 0.2}.IsLikelyScan(upload))
+
+	// Without counters
+	for _, conn := range []*Con{nil, {}, withCounters(counter(3, 180), nil), withCounters(counter(0, 0), counter(0, 0))} {
+		assert.Equal(t, 0.0, Asymmetry(conn))
+		assert.False(t, IsLikelyScan(conn))
+	}
+	assert.False(t, HasCounters(withCounters(counter(3, 180), nil)))
+}
@@ -211,3 +211,12 @@ func messageOffset(data []byte) int {
 	}
 	return 0
 }
+
+// messageFamily returns the address family of the nfgenmsg header of the message,
+// or AF_UNSPEC when the message has no such header
+func messageFamily(data []byte) uint8 {
+	if len(data) < 2 || messageOffset(data[:2]) == 0 {
+		return unix.AF_UNSPEC
+	}
+	return data[0]
+}
@@ -0,0 +1,41 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"io/ioutil"
+	"log"
+	"path"
+	"strings"
+)
+
+// BootID returns the boot ID of the host, read from <procRoot>/sys/kernel/random/boot_id when
+// the Consumer was created. It changes on every reboot, so it tells a new boot of the same host
+// apart from a restart of the agent. It's empty if the file couldn't be read.
+func (c *Consumer) BootID() string {
+	return c.bootID
+}
+
+// BootID returns the boot ID of the host the Event was received on. It's only set when the
+// Consumer was created with WithBootIDOnEvents.
+func (e *Event) BootID() string {
+	return e.bootID
+}
+
+// WithBootIDOnEvents stamps the boot ID of the host (see Consumer.BootID) on every Event
+func WithBootIDOnEvents() ConsumerOption {
+	return func(c *Consumer) {
+		c.bootIDOnEvents = true
+	}
+}
+
+// readBootID returns the boot ID of the host, or an empty string if it can't be read
+func readBootID(procRoot string) string {
+	b, err := ioutil.ReadFile(path.Join(procRoot, "sys/kernel/random/boot_id"))
+	if err != nil {
+		log.Printf("could not read the boot ID of the host: %s", err)
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,42 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBootID(t *testing.T) {
+	procRoot := t.TempDir()
+	dir := filepath.Join(procRoot, "sys/kernel/random")
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "boot_id"), []byte("6c3b5a0e-0a4f-4d1e-9a3c-2f5e8b7d1c90\n"), 0644))
+
+	c := NewConsumer(procRoot, -1, false)
+	defer c.Stop()
+	assert.Equal(t, "6c3b5a0e-0a4f-4d1e-9a3c-2f5e8b7d1c90", c.BootID())
+
+	// Events are only stamped when asked to
+	e := c.eventFor(nil, 0, nil)
+	assert.Empty(t, e.BootID())
+
+	stamped := NewConsumer(procRoot, -1, false, WithBootIDOnEvents())
+	defer stamped.Stop()
+	e = stamped.eventFor(nil, 0, nil)
+	assert.Equal(t, "6c3b5a0e-0a4f-4d1e-9a3c-2f5e8b7d1c90", e.BootID())
+}
+
+func TestBootIDUnreadable(t *testing.T) {
+	c := NewConsumer(t.TempDir(), -1, false, WithBootIDOnEvents())
+	defer c.Stop()
+	assert.Empty(t, c.BootID())
+	e := c.eventFor(nil, 0, nil)
+	assert.Empty(t, e.BootID())
+}
@@ -11,8 +11,13 @@ package internal
 import (
 	"errors"
 	"math"
+	"math/rand"
+	"sort"
+	"time"
 
+	"github.com/mdlayher/netlink"
 	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
 )
 
 var errInvalidSamplingRate = errors.New("sampling rate must be within (0, 1)")
@@ -32,8 +37,186 @@ func GenerateBPFSampler(samplingRate float64) ([]bpf.RawInstruction, error) {
 		// If number is lower than cutoff, we capture  message
 		bpf.JumpIf{Cond: bpf.JumpLessThan, Val: cutoff, SkipFalse: 1},
 		// Capture.
-		bpf.RetConstant{Val: 4096},
+		bpf.RetConstant{Val: bpfCapture},
 		// Ignore.
 		bpf.RetConstant{Val: 0},
 	})
 }
+
+const (
+	// bpfCapture is the number of bytes of the messages kept by the BPF samplers
+	bpfCapture = 4096
+
+	// Offsets of the nfgenmsg family and of the CTA_PROTO_NUM value of the original tuple, from
+	// the start of the netlink message. The kernel always puts CTA_TUPLE_ORIG first, with
+	// CTA_TUPLE_IP then CTA_TUPLE_PROTO, whose first attribute is CTA_PROTO_NUM, so the offset of
+	// the protocol only depends on the size of the addresses:
+	// nlmsghdr (16) + nfgenmsg (4) + CTA_TUPLE_ORIG header (4) + CTA_TUPLE_IP (4 + 2*8 for IPv4,
+	// 4 + 2*20 for IPv6) + CTA_TUPLE_PROTO header (4) + CTA_PROTO_NUM header (4)
+	bpfFamilyOffset    = 16
+	bpfIPv4ProtoOffset = 52
+	bpfIPv6ProtoOffset = 76
+
+	// maxSampledProtocols bounds the number of protocols of GenerateProtocolBPFSampler, so that
+	// every jump of the program fits in the 8 bits of its offset
+	maxSampledProtocols = 32
+)
+
+var errTooManyProtocols = errors.New("too many protocols with a dedicated sampling rate")
+
+// GenerateProtocolBPFSampler returns BPF assembly for a traffic sampler applying a distinct
+// sampling rate to each of the given IP protocols (e.g. unix.IPPROTO_UDP), and defaultRate to
+// the others. A rate of 1 keeps all the messages of a protocol.
+// Classic BPF can't iterate over netlink attributes, so the protocol is read at a fixed offset,
+// depending on the address family, which relies on the order in which the kernel lays out the
+// attributes (see bpfIPv4ProtoOffset). Messages of other families are sampled with defaultRate.
+// The program runs for every message, with a cost linear in the number of protocols: a couple of
+// loads, one comparison per protocol, and a random number for the sampled protocols.
+func GenerateProtocolBPFSampler(defaultRate float64, rates map[uint8]float64) ([]bpf.RawInstruction, error) {
+	if len(rates) > maxSampledProtocols {
+		return nil, errTooManyProtocols
+	}
+	if defaultRate < 0 || defaultRate > 1 {
+		return nil, errInvalidSamplingRate
+	}
+	protocols := make([]uint8, 0, len(rates))
+	for proto, rate := range rates {
+		if rate < 0 || rate > 1 {
+			return nil, errInvalidSamplingRate
+		}
+		protocols = append(protocols, proto)
+	}
+	sort.Slice(protocols, func(i, j int) bool { return protocols[i] < protocols[j] })
+
+	// The sampling blocks follow the dispatch: the default one first, then one per protocol
+	blocks := [][]bpf.Instruction{sampleInstructions(defaultRate)}
+	for _, proto := range protocols {
+		blocks = append(blocks, sampleInstructions(rates[proto]))
+	}
+
+	prog := []bpf.Instruction{
+		bpf.LoadAbsolute{Off: bpfFamilyOffset, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.AF_INET, SkipFalse: 2},
+		bpf.LoadAbsolute{Off: bpfIPv4ProtoOffset, Size: 1},
+		bpf.Jump{Skip: 2},
+		// Other families skip the loading of the protocol and the dispatch
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.AF_INET6, SkipFalse: uint8(1 + len(protocols))},
+		bpf.LoadAbsolute{Off: bpfIPv6ProtoOffset, Size: 1},
+	}
+
+	// Jump to the block of the protocol, or fall through to the default one
+	offset := len(blocks[0])
+	for i, proto := range protocols {
+		skip := len(protocols) - 1 - i + offset
+		prog = append(prog, bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(proto), SkipTrue: uint8(skip)})
+		offset += len(blocks[i+1])
+	}
+	for _, block := range blocks {
+		prog = append(prog, block...)
+	}
+
+	return bpf.Assemble(prog)
+}
+
+// sampleInstructions returns the instructions keeping messages with the given probability
+func sampleInstructions(rate float64) []bpf.Instruction {
+	switch {
+	case rate >= 1:
+		return []bpf.Instruction{bpf.RetConstant{Val: bpfCapture}}
+	case rate <= 0:
+		return []bpf.Instruction{bpf.RetConstant{Val: 0}}
+	}
+	return []bpf.Instruction{
+		bpf.LoadExtension{Num: bpf.ExtRand},
+		bpf.JumpIf{Cond: bpf.JumpLessThan, Val: uint32(math.Pow(2, 32) * rate), SkipFalse: 1},
+		bpf.RetConstant{Val: bpfCapture},
+		bpf.RetConstant{Val: 0},
+	}
+}
+
+// messageSampler samples messages in userspace, after they're read off the socket
+type messageSampler interface {
+	// filter removes the messages which are not sampled, reusing the given slice.
+	// netns is the nsid the messages were received from.
+	filter(msgs []netlink.Message, netns int32) []netlink.Message
+}
+
+// oneInNSampler deterministically keeps 1 message out of every n, which gives exact proportions
+// where the probabilistic BPF sampler has variance on low rates. The tradeoff is that it may
+// correlate with periodic traffic patterns, e.g. always skipping the same connection of a batch.
+// Classic BPF programs can't keep a counter between packets (their scratch memory is reset
+// for each one), so unlike GenerateBPFSampler this sampler runs in userspace, after messages
+// are read off the socket.
+type oneInNSampler struct {
+	n     uint64
+	count uint64
+}
+
+// newOneInNSampler returns a sampler keeping 1 message out of round(1/samplingRate)
+func newOneInNSampler(samplingRate float64) (*oneInNSampler, error) {
+	if samplingRate <= 0 || samplingRate > 1 {
+		return nil, errInvalidSamplingRate
+	}
+
+	return &oneInNSampler{n: uint64(math.Round(1 / samplingRate))}, nil
+}
+
+// filter removes the messages which are not sampled, reusing the given slice
+func (s *oneInNSampler) filter(msgs []netlink.Message, _ int32) []netlink.Message {
+	kept := msgs[:0]
+	for _, m := range msgs {
+		if s.count%s.n == 0 {
+			kept = append(kept, m)
+		}
+		s.count++
+	}
+	return kept
+}
+
+// minRateSampler keeps each message with probability samplingRate, like the BPF sampler, but also
+// keeps the first minPerSecond messages of every namespace each second, so that namespaces with
+// little traffic don't vanish under heavy sampling.
+// This can't be done in BPF: the program doesn't know which namespace a message comes from, and
+// can't count the messages it already let through. The sampler runs in userspace instead, so all
+// messages are read off the socket, which costs more CPU than dropping them in the kernel.
+type minRateSampler struct {
+	samplingRate float64
+	minPerSecond int
+	rand         *rand.Rand
+	now          func() time.Time
+
+	// kept is the number of messages kept per nsid since windowStart
+	kept        map[int32]int
+	windowStart time.Time
+}
+
+func newMinRateSampler(samplingRate float64, minPerSecond int) (*minRateSampler, error) {
+	if samplingRate <= 0 || samplingRate > 1 {
+		return nil, errInvalidSamplingRate
+	}
+
+	return &minRateSampler{
+		samplingRate: samplingRate,
+		minPerSecond: minPerSecond,
+		rand:         rand.New(rand.NewSource(time.Now().UnixNano())),
+		now:          time.Now,
+		kept:         make(map[int32]int),
+	}, nil
+}
+
+func (s *minRateSampler) filter(msgs []netlink.Message, netns int32) []netlink.Message {
+	if now := s.now(); now.Sub(s.windowStart) >= time.Second {
+		// the counts of namespaces which were removed don't outlive the window
+		s.windowStart = now
+		s.kept = make(map[int32]int, len(s.kept))
+	}
+
+	kept := msgs[:0]
+	for _, m := range msgs {
+		if s.kept[netns] < s.minPerSecond || s.rand.Float64() < s.samplingRate {
+			kept = append(kept, m)
+			s.kept[netns]++
+		}
+	}
+	return kept
+}
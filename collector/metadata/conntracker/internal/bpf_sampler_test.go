@@ -0,0 +1,195 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+func TestOneInNSampler(t *testing.T) {
+	sampler, err := newOneInNSampler(0.25)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), sampler.n)
+
+	// Feed 100 messages in batches of various sizes
+	var kept []uint32
+	seq := uint32(0)
+	for _, size := range []int{1, 3, 7, 10, 29, 50} {
+		msgs := make([]netlink.Message, 0, size)
+		for i := 0; i < size; i++ {
+			msgs = append(msgs, netlink.Message{Header: netlink.Header{Sequence: seq}})
+			seq++
+		}
+		for _, m := range sampler.filter(msgs, 0) {
+			kept = append(kept, m.Header.Sequence)
+		}
+	}
+
+	require.Len(t, kept, 25)
+	for i, s := range kept {
+		assert.Equal(t, uint32(i*4), s)
+	}
+}
+
+func TestOneInNSamplerInvalidRate(t *testing.T) {
+	for _, rate := range []float64{0, -0.5, 1.5} {
+		_, err := newOneInNSampler(rate)
+		assert.ErrorIs(t, err, errInvalidSamplingRate)
+	}
+}
+
+func TestMinRateSampler(t *testing.T) {
+	sampler, err := newMinRateSampler(0.001, 1)
+	require.NoError(t, err)
+	sampler.rand = rand.New(rand.NewSource(1))
+	now := time.Now()
+	sampler.now = func() time.Time { return now }
+
+	batch := func(n int) []netlink.Message {
+		return make([]netlink.Message, n)
+	}
+
+	for second := 0; second < 3; second++ {
+		// A busy namespace floods the socket while a quiet one only has a couple of events
+		busy := 0
+		for i := 0; i < 100; i++ {
+			busy += len(sampler.filter(batch(100), 1))
+		}
+		quiet := len(sampler.filter(batch(1), 2)) + len(sampler.filter(batch(1), 2))
+
+		// The quiet namespace keeps its guaranteed event, and the busy one is still sampled
+		assert.Equal(t, 1, quiet)
+		assert.GreaterOrEqual(t, busy, 1)
+		assert.Less(t, busy, 100)
+
+		now = now.Add(time.Second)
+	}
+}
+
+func TestMinRateSamplerInvalidRate(t *testing.T) {
+	for _, rate := range []float64{0, -0.5, 1.5} {
+		_, err := newMinRateSampler(rate, 1)
+		assert.ErrorIs(t, err, errInvalidSamplingRate)
+	}
+}
+
+func TestUserspaceSamplerSelection(t *testing.T) {
+	c := NewConsumer(t.TempDir(), 1000, false, WithDeterministicSampling())
+	defer c.Stop()
+	c.samplingRate = 0.1
+	sampler, err := c.newUserspaceSampler()
+	require.NoError(t, err)
+	assert.IsType(t, &oneInNSampler{}, sampler)
+
+	c = NewConsumer(t.TempDir(), 1000, false, WithDeterministicSampling(), WithMinimumSampledRate(1))
+	defer c.Stop()
+	c.samplingRate = 0.1
+	sampler, err = c.newUserspaceSampler()
+	require.NoError(t, err)
+	assert.IsType(t, &minRateSampler{}, sampler)
+}
+
+func TestGenerateProtocolBPFSampler(t *testing.T) {
+	raw, err := GenerateProtocolBPFSampler(0.5, map[uint8]float64{
+		unix.IPPROTO_UDP:  0.25,
+		unix.IPPROTO_TCP:  1,
+		unix.IPPROTO_ICMP: 0,
+	})
+	require.NoError(t, err)
+	prog, ok := bpf.Disassemble(raw)
+	require.True(t, ok)
+
+	message := func(family uint8, src, dst string, proto uint8) []byte {
+		data, err := EncodeConn(&Con{Con: ct.Con{
+			Origin: newIPTuple(src, dst, 58472, 53, proto),
+			Reply:  newIPTuple(dst, src, 53, 58472, proto),
+		}})
+		require.NoError(t, err)
+		data = append([]byte{family, unix.NFNETLINK_V0, 0, 0}, data...)
+		b, err := (&netlink.Message{
+			Header: netlink.Header{
+				Length: uint32(unix.NLMSG_HDRLEN + len(data)),
+				Type:   netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK << 8),
+			},
+			Data: data,
+		}).MarshalBinary()
+		require.NoError(t, err)
+		return b
+	}
+
+	// The VM doesn't support random numbers: run the program with evenly spread ones instead
+	keptRatio := func(msg []byte) float64 {
+		const runs = 1000
+		kept := 0
+		for i := 0; i < runs; i++ {
+			r := uint32(uint64(i) << 32 / runs)
+			withRand := make([]bpf.Instruction, len(prog))
+			for j, ins := range prog {
+				if ext, ok := ins.(bpf.LoadExtension); ok && ext.Num == bpf.ExtRand {
+					ins = bpf.LoadConstant{Dst: bpf.RegA, Val: r}
+				}
+				withRand[j] = ins
+			}
+			vm, err := bpf.NewVM(withRand)
+			require.NoError(t, err)
+			n, err := vm.Run(msg)
+			require.NoError(t, err)
+			if n > 0 {
+				kept++
+			}
+		}
+		return float64(kept) / runs
+	}
+
+	for _, family := range []struct {
+		af       uint8
+		src, dst string
+	}{
+		{unix.AF_INET, "10.0.2.15", "10.0.2.3"},
+		{unix.AF_INET6, "fd00::1", "fd00::2"},
+	} {
+		assert.Equal(t, 1.0, keptRatio(message(family.af, family.src, family.dst, unix.IPPROTO_TCP)))
+		assert.Equal(t, 0.25, keptRatio(message(family.af, family.src, family.dst, unix.IPPROTO_UDP)))
+		assert.Equal(t, 0.0, keptRatio(message(family.af, family.src, family.dst, unix.IPPROTO_ICMP)))
+		assert.Equal(t, 0.5, keptRatio(message(family.af, family.src, family.dst, unix.IPPROTO_SCTP)))
+	}
+}
+
+func TestGenerateProtocolBPFSamplerInvalid(t *testing.T) {
+	_, err := GenerateProtocolBPFSampler(1.5, nil)
+	assert.ErrorIs(t, err, errInvalidSamplingRate)
+	_, err = GenerateProtocolBPFSampler(1, map[uint8]float64{unix.IPPROTO_UDP: -1})
+	assert.ErrorIs(t, err, errInvalidSamplingRate)
+
+	rates := make(map[uint8]float64)
+	for i := 0; i <= maxSampledProtocols; i++ {
+		rates[uint8(i)] = 0.5
+	}
+	_, err = GenerateProtocolBPFSampler(1, rates)
+	assert.ErrorIs(t, err, errTooManyProtocols)
+}
+
+func TestProtocolSamplingRatesAttached(t *testing.T) {
+	c := NewConsumer(newFakeProcRoot(t, ""), 100, false, WithProtocolSamplingRates(map[uint8]float64{unix.IPPROTO_UDP: 0.1}))
+	defer c.Stop()
+
+	// The protocol rates are applied even when not throttling
+	if err := c.initNetlinkSocket(1.0); err != nil {
+		t.Skipf("could not create netlink socket: %s", err)
+	}
+	sampler, err := GenerateProtocolBPFSampler(1.0, map[uint8]float64{unix.IPPROTO_UDP: 0.1})
+	require.NoError(t, err)
+	program, err := bpf.Assemble(c.DumpSamplerProgram())
+	require.NoError(t, err)
+	assert.Equal(t, sampler, program)
+}
@@ -0,0 +1,37 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// WithByteRateLimit throttles the Consumer on the number of bytes read per second, instead of
+// the number of messages: maxBytesPerSec replaces the targetRateLimit of NewConsumer. The CPU
+// spent decoding the events is closer to their size than to their number, so this is a more
+// accurate limit when the size of the messages varies a lot, e.g. with large multi-part messages.
+// The size of a message includes its netlink header.
+func WithByteRateLimit(maxBytesPerSec int) ConsumerOption {
+	return func(c *Consumer) {
+		if maxBytesPerSec > 0 {
+			c.targetRateLimit = maxBytesPerSec
+			c.byteRateLimit = true
+		}
+	}
+}
+
+// rateLimitUnits returns the quantity of msgs counted against the rate limit: their number,
+// or their size with WithByteRateLimit
+func (c *Consumer) rateLimitUnits(msgs []netlink.Message) int {
+	if !c.byteRateLimit {
+		return len(msgs)
+	}
+
+	n := 0
+	for i := range msgs {
+		n += unix.NLMSG_HDRLEN + len(msgs[i].Data)
+	}
+	return n
+}
@@ -0,0 +1,45 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestByteRateLimit(t *testing.T) {
+	// streams 3 reads of 2 large messages, and returns whether the rate limit was exceeded
+	tripped := func(opts ...ConsumerOption) bool {
+		c := NewConsumer(t.TempDir(), 1000, false, opts...)
+		defer c.Stop()
+		c.setStreaming(true)
+		msg := netlink.Message{
+			Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK << 8)},
+			Data:   make([]byte, 4096),
+		}
+		reads := 3
+		c.readFn = func(b []byte) ([]netlink.Message, int32, error) {
+			if reads == 0 {
+				return nil, 0, errors.New("read netlink: use of closed file")
+			}
+			reads--
+			return []netlink.Message{msg, msg}, 0, nil
+		}
+		require.NoError(t, c.receive(context.Background(), make(chan Event, outputBuffer)))
+
+		c.breaker.update(time.Now().Add(time.Second))
+		return c.breaker.IsOpen()
+	}
+
+	// 6 messages per second are well below the limit, but their 24KB aren't
+	assert.False(t, tripped())
+	assert.True(t, tripped(WithByteRateLimit(1000)))
+}
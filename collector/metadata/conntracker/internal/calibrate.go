@@ -0,0 +1,157 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// calibrationHeadroom is the margin applied to the sustained rate observed by Calibrate
+	calibrationHeadroom = 1.5
+)
+
+// calibrationInterval is the interval at which Calibrate samples the message rate
+var calibrationInterval = time.Second
+
+// errNoCalibrationTraffic is returned by Calibrate when no message was received
+var errNoCalibrationTraffic = errors.New("no conntrack netlink message was received during calibration")
+
+// Calibrate streams conntrack events unsampled for the given duration, without emitting them,
+// and suggests a target rate limit for NewConsumer: the sustained message rate, averaged like
+// the circuit breaker does, with some headroom. peakRate is the highest rate observed over
+// one second, which the circuit breaker smooths out. The duration should cover a few seconds
+// of representative traffic. Like Validate, it must be called before Events() or
+// ReceiveNonBlocking().
+func (c *Consumer) Calibrate(duration time.Duration) (recommendedRateLimit int, peakRate int, err error) {
+	if c.isStreaming() {
+		return 0, 0, errors.New("conntrack consumer is already streaming events")
+	}
+
+	if err := c.initNetlinkSocket(1.0); err != nil {
+		return 0, 0, fmt.Errorf("could not initialize conntrack netlink socket: %w", err)
+	}
+	closeSocket := func() {
+		c.conn.Close()
+		c.conn = nil
+		c.socket = nil
+	}
+	if err := c.joinGroups(c.conn); err != nil {
+		closeSocket()
+		return 0, 0, err
+	}
+
+	k := newCalibrator(time.Now())
+	var stopped int32
+	var readErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for atomic.LoadInt32(&stopped) == 0 {
+			buffer := c.pool.Get().(*[]byte)
+			msgs, _, err := c.readMessages(*buffer, nil)
+			c.pool.Put(buffer)
+			if err != nil {
+				switch socketError(err) {
+				case errEOF:
+					return
+				case errENOBUF:
+					// messages were dropped, so the rates are underestimated
+					atomic.AddInt64(&c.enobufs, 1)
+					continue
+				default:
+					readErr = err
+					return
+				}
+			}
+			k.tick(len(msgs))
+		}
+	}()
+
+	ticker := time.NewTicker(calibrationInterval)
+	deadline := time.NewTimer(duration)
+Loop:
+	for {
+		select {
+		case now := <-ticker.C:
+			k.sample(now)
+		case now := <-deadline.C:
+			// the last partial interval is only sampled when it's the only one, since the
+			// circuit breaker accounts it as a full second
+			if k.samples == 0 {
+				k.sample(now)
+			}
+			break Loop
+		}
+	}
+	ticker.Stop()
+
+	// closing the socket unblocks the pending read
+	atomic.StoreInt32(&stopped, 1)
+	closeSocket()
+	wg.Wait()
+	if readErr != nil {
+		return 0, 0, fmt.Errorf("could not read conntrack netlink messages: %w", readErr)
+	}
+
+	recommendedRateLimit, peakRate = k.recommend()
+	if peakRate == 0 {
+		return 0, 0, errNoCalibrationTraffic
+	}
+	return recommendedRateLimit, peakRate, nil
+}
+
+// calibrator measures the message rate of Calibrate. The sustained rate is accounted by a
+// circuit breaker which never trips, and whose rate is updated at every sample rather than
+// by its own ticker.
+type calibrator struct {
+	breaker *CircuitBreaker
+	// count is the number of messages since the last sample
+	count int64
+	last  time.Time
+	peak  int
+	// samples is the number of samples taken
+	samples int
+}
+
+func newCalibrator(now time.Time) *calibrator {
+	breaker := &CircuitBreaker{maxEventsPerSec: math.MaxInt64}
+	breaker.Reset()
+	atomic.StoreInt64(&breaker.lastUpdate, now.UnixNano())
+	return &calibrator{breaker: breaker, last: now}
+}
+
+// tick records n received messages. It's safe to call concurrently with sample.
+func (k *calibrator) tick(n int) {
+	k.breaker.Tick(n)
+	atomic.AddInt64(&k.count, int64(n))
+}
+
+// sample updates the peak and sustained rates with the messages received since the last sample
+func (k *calibrator) sample(now time.Time) {
+	elapsed := now.Sub(k.last).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	count := atomic.SwapInt64(&k.count, 0)
+	// like the circuit breaker, intervals shorter than a second aren't extrapolated
+	if rate := int(float64(count) / math.Max(elapsed, 1)); rate > k.peak {
+		k.peak = rate
+	}
+	k.last = now
+	k.samples++
+	k.breaker.update(now)
+}
+
+// recommend returns the recommended target rate limit and the peak rate
+func (k *calibrator) recommend() (recommendedRateLimit int, peakRate int) {
+	sustained := float64(k.breaker.Rate())
+	return int(math.Ceil(sustained * calibrationHeadroom)), k.peak
+}
@@ -0,0 +1,78 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCalibratorRateProfile(t *testing.T) {
+	now := time.Now()
+	k := newCalibrator(now)
+
+	// 1000 messages/s, with a one second burst of 5000 messages
+	profile := []int{1000, 1000, 1000, 1000, 1000, 5000, 1000, 1000, 1000, 1000, 1000}
+	for _, n := range profile {
+		k.tick(n)
+		now = now.Add(time.Second)
+		k.sample(now)
+	}
+
+	recommended, peak := k.recommend()
+	assert.Equal(t, 5000, peak)
+	// the burst is amortized, but still weighs on the sustained rate of ~1260 messages/s
+	assert.Greater(t, recommended, 1500)
+	assert.Less(t, recommended, 2000)
+}
+
+func TestCalibrate(t *testing.T) {
+	calibrate := func(duration time.Duration, batch int) (int, int, error) {
+		c := NewConsumer(newFakeProcRoot(t, ""), -1, false)
+		defer c.Stop()
+		c.readFn = func(b []byte) ([]netlink.Message, int32, error) {
+			time.Sleep(time.Millisecond)
+			return make([]netlink.Message, batch), 0, nil
+		}
+		return c.Calibrate(duration)
+	}
+
+	recommended, peak, err := calibrate(1500*time.Millisecond, 10)
+	if err != nil && err != errNoCalibrationTraffic {
+		t.Skipf("could not initialize conntrack netlink socket: %s", err)
+	}
+	require.NoError(t, err)
+	assert.Greater(t, peak, 0)
+	// a single second was sampled, so the sustained rate is the peak one
+	assert.InDelta(t, math.Ceil(float64(peak)*calibrationHeadroom), recommended, 2)
+
+	_, _, err = calibrate(10*time.Millisecond, 0)
+	assert.Equal(t, errNoCalibrationTraffic, err)
+}
+
+func TestCalibrateWhileStreaming(t *testing.T) {
+	c := NewConsumer(newFakeProcRoot(t, ""), -1, false)
+	events, err := c.Events()
+	if err != nil {
+		c.Stop()
+		t.Skipf("could not initialize conntrack netlink socket: %s", err)
+	}
+
+	// the streaming flag is checked while the receive loop runs
+	errs := make(chan error)
+	go func() {
+		_, _, err := c.Calibrate(time.Millisecond)
+		errs <- err
+	}()
+	assert.EqualError(t, <-errs, "conntrack consumer is already streaming events")
+
+	c.Stop()
+	for range events {
+	}
+}
@@ -0,0 +1,113 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mdlayher/netlink"
+)
+
+// WithCIDRAllowList makes the Consumer drop the conntrack entries which don't involve any of the
+// given IPv4 or IPv6 networks, before they're emitted. Only the addresses of the origin and reply
+// tuples are decoded to filter them, and an entry is kept if any of its addresses is in the list,
+// so NATed connections are kept when either the original or the translated endpoint matches.
+// Messages whose addresses can't be decoded are kept. Dropped entries are counted in the
+// "cidr_filtered" stat.
+func WithCIDRAllowList(cidrs ...*net.IPNet) ConsumerOption {
+	return func(c *Consumer) {
+		c.cidrFilter = newCIDRFilter(cidrs)
+	}
+}
+
+// cidrFilter drops the messages of the conntrack entries none of whose addresses belong to nets
+type cidrFilter struct {
+	nets     []*net.IPNet
+	scanners sync.Pool
+}
+
+func newCIDRFilter(nets []*net.IPNet) *cidrFilter {
+	return &cidrFilter{
+		nets: append([]*net.IPNet(nil), nets...),
+		scanners: sync.Pool{
+			New: func() interface{} {
+				return NewAttributeScanner()
+			},
+		},
+	}
+}
+
+// filter removes the messages which are not allowed, reusing the given slice
+func (f *cidrFilter) filter(msgs []netlink.Message) []netlink.Message {
+	scanner := f.scanners.Get().(*AttributeScanner)
+	defer f.scanners.Put(scanner)
+
+	kept := msgs[:0]
+	for _, m := range msgs {
+		if f.allowed(scanner, m.Data) {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+// allowed reports whether any address of the origin or reply tuple of the message belongs to
+// the allowed networks, or whether no address could be found
+func (f *cidrFilter) allowed(s *AttributeScanner, data []byte) bool {
+	if err := s.ResetTo(data); err != nil {
+		return true
+	}
+
+	found, allowed := false, false
+	for !allowed && s.Next() {
+		if t := s.Type(); t != ctaTupleOrig && t != ctaTupleReply {
+			continue
+		}
+
+		s.Nested(func() error {
+			for !allowed && s.Next() {
+				if s.Type() != ctaTupleIP {
+					continue
+				}
+				s.Nested(func() error {
+					for !allowed && s.Next() {
+						switch s.Type() {
+						case ctaIPv4Src, ctaIPv4Dst, ctaIPv6Src, ctaIPv6Dst:
+							found = true
+							allowed = f.contains(s.Bytes())
+						}
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+	}
+
+	return allowed || !found
+}
+
+func (f *cidrFilter) contains(ip net.IP) bool {
+	for _, n := range f.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterCIDRs removes the messages which are not allowed by the CIDR allow-list, if any
+func (c *Consumer) filterCIDRs(msgs []netlink.Message) []netlink.Message {
+	if c.cidrFilter == nil || len(msgs) == 0 {
+		return msgs
+	}
+
+	kept := c.cidrFilter.filter(msgs)
+	if dropped := len(msgs) - len(kept); dropped > 0 {
+		atomic.AddInt64(&c.cidrFiltered, int64(dropped))
+	}
+	return kept
+}
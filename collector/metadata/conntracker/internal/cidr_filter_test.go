@@ -0,0 +1,84 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestCIDRAllowList(t *testing.T) {
+	encode := func(family uint8, src, dst, replySrc string) netlink.Message {
+		data, err := EncodeConn(&Con{Con: ct.Con{
+			Origin: newIPTuple(src, dst, 58472, 5432, uint8(unix.IPPROTO_TCP)),
+			Reply:  newIPTuple(replySrc, src, 5432, 58472, uint8(unix.IPPROTO_TCP)),
+		}})
+		require.NoError(t, err)
+		return netlink.Message{
+			Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK << 8)},
+			Data:   append([]byte{family, unix.NFNETLINK_V0, 0, 0}, data...),
+		}
+	}
+	mustParseCIDR := func(s string) *net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		require.NoError(t, err)
+		return n
+	}
+
+	c := NewConsumer(t.TempDir(), -1, false, WithCIDRAllowList(mustParseCIDR("10.96.0.0/12"), mustParseCIDR("fd00::/64")))
+	defer c.Stop()
+	c.setStreaming(true)
+
+	reads := [][]netlink.Message{
+		{
+			// A scanner probing the host
+			encode(unix.AF_INET, "203.0.113.7", "192.0.2.1", "192.0.2.1"),
+			// A client of a service
+			encode(unix.AF_INET, "192.0.2.1", "10.96.0.10", "10.96.0.10"),
+			// A NATed connection, whose translated destination is a service
+			encode(unix.AF_INET, "192.0.2.1", "198.51.100.1", "10.100.3.4"),
+			encode(unix.AF_INET6, "fd00::1", "2001:db8::1", "2001:db8::1"),
+			encode(unix.AF_INET6, "2001:db8::2", "2001:db8::1", "2001:db8::1"),
+			// Messages which can't be decoded are kept
+			{Header: netlink.Header{Type: ctNewType}, Data: []byte{unix.AF_INET, unix.NFNETLINK_V0, 0, 0, 0xff}},
+		},
+		// A read whose messages are all out of range doesn't produce an event
+		{encode(unix.AF_INET, "203.0.113.7", "192.0.2.1", "192.0.2.1")},
+	}
+	c.readFn = func(b []byte) ([]netlink.Message, int32, error) {
+		if len(reads) == 0 {
+			return nil, 0, errors.New("read netlink: use of closed file")
+		}
+		msgs := reads[0]
+		reads = reads[1:]
+		return msgs, 0, nil
+	}
+
+	output := make(chan Event, outputBuffer)
+	require.NoError(t, c.receive(context.Background(), output))
+	close(output)
+
+	var events []Event
+	for e := range output {
+		events = append(events, e)
+	}
+	require.Len(t, events, 1)
+	assert.Len(t, events[0].Messages(), 4)
+
+	conns, _ := NewDecoder().DecodeEvent(events[0])
+	var dsts []string
+	for _, conn := range conns {
+		dsts = append(dsts, conn.Origin.Dst.String())
+	}
+	assert.Equal(t, []string{"10.96.0.10", "198.51.100.1", "2001:db8::1"}, dsts)
+	assert.Equal(t, int64(3), c.GetStats()["cidr_filtered"])
+}
@@ -0,0 +1,81 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/mdlayher/netlink"
+)
+
+// WithCoalescedStats makes the receive loops count the received messages locally, and only add
+// them to the shared counters once per flushInterval and when the loop exits. Counting costs
+// an atomic operation per message otherwise, which becomes a contention point at the highest
+// event rates. The message counts of GetStatsByFamily then lag by up to flushInterval.
+func WithCoalescedStats(flushInterval time.Duration) ConsumerOption {
+	return func(c *Consumer) {
+		if flushInterval > 0 {
+			c.statsFlushInterval = flushInterval
+		}
+	}
+}
+
+// localCounters are the message counts of a single receive loop, not yet flushed into the
+// familyCounters of the Consumer. They're only accessed by the goroutine of the loop.
+type localCounters struct {
+	families familyCounters
+
+	interval  time.Duration
+	lastFlush time.Time
+	now       func() time.Time
+}
+
+// newLocalCounters returns the local counters of a receive loop, or nil when the counts aren't
+// coalesced
+func (c *Consumer) newLocalCounters() *localCounters {
+	if c.statsFlushInterval <= 0 {
+		return nil
+	}
+	return &localCounters{
+		interval:  c.statsFlushInterval,
+		lastFlush: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// countMessages attributes the received messages to their family, in the local counters when
+// set, and flushes them if the interval elapsed
+func (c *Consumer) countMessages(local *localCounters, msgs []netlink.Message) {
+	if local == nil {
+		c.familyCounters.countMessages(msgs)
+		return
+	}
+
+	for i := range msgs {
+		local.families.of(messageFamily(msgs[i].Data)).messages++
+	}
+	if now := local.now(); now.Sub(local.lastFlush) >= local.interval {
+		c.flushCounters(local)
+		local.lastFlush = now
+	}
+}
+
+// flushCounters adds the local counts to the shared counters and resets them. It's a no-op
+// when local is nil.
+func (c *Consumer) flushCounters(local *localCounters) {
+	if local == nil {
+		return
+	}
+	for _, f := range [][2]*familyStats{
+		{&local.families.ipv4, &c.familyCounters.ipv4},
+		{&local.families.ipv6, &c.familyCounters.ipv6},
+		{&local.families.unspec, &c.familyCounters.unspec},
+	} {
+		if n := f[0].messages; n != 0 {
+			atomic.AddInt64(&f[1].messages, n)
+			f[0].messages = 0
+		}
+	}
+}
@@ -0,0 +1,91 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestCoalescedStats(t *testing.T) {
+	c := NewConsumer(t.TempDir(), -1, false, WithCoalescedStats(time.Second))
+	defer c.Stop()
+	c.setStreaming(true)
+
+	now := time.Now()
+	local := c.newLocalCounters()
+	local.lastFlush, local.now = now, func() time.Time { return now }
+
+	messages := func(family uint8, n int) []netlink.Message {
+		msgs := make([]netlink.Message, n)
+		for i := range msgs {
+			msgs[i] = netlink.Message{Header: netlink.Header{Type: ctNewType}, Data: []byte{family, unix.NFNETLINK_V0, 0, 0}}
+		}
+		return msgs
+	}
+	counted := func(family string) int64 {
+		return c.GetStatsByFamily()[family]["messages"]
+	}
+
+	// The counts aren't visible until the interval elapsed
+	c.countMessages(local, messages(unix.AF_INET, 3))
+	c.countMessages(local, messages(unix.AF_INET6, 2))
+	assert.Zero(t, counted("ipv4"))
+	assert.Zero(t, counted("ipv6"))
+
+	now = now.Add(time.Second)
+	c.countMessages(local, messages(unix.AF_INET, 1))
+	assert.Equal(t, int64(4), counted("ipv4"))
+	assert.Equal(t, int64(2), counted("ipv6"))
+
+	// The receive loop flushes its counts when it exits
+	reads := 3
+	c.readFn = func(b []byte) ([]netlink.Message, int32, error) {
+		if reads == 0 {
+			return nil, 0, errors.New("read netlink: use of closed file")
+		}
+		reads--
+		return messages(unix.AF_INET, 10), 0, nil
+	}
+	output := make(chan Event, outputBuffer)
+	require.NoError(t, c.receive(context.Background(), output))
+	assert.Equal(t, int64(34), counted("ipv4"))
+}
+
+func BenchmarkCountMessages(b *testing.B) {
+	msgs := make([]netlink.Message, 64)
+	for i := range msgs {
+		family := uint8(unix.AF_INET)
+		if i%4 == 0 {
+			family = unix.AF_INET6
+		}
+		msgs[i] = netlink.Message{Data: []byte{family, unix.NFNETLINK_V0, 0, 0}}
+	}
+
+	// Several receive loops count the messages of a Consumer concurrently, e.g. the streaming
+	// loop and the epoll loop of NamespaceEvents
+	for _, interval := range []time.Duration{0, 100 * time.Millisecond} {
+		name := "atomic"
+		if interval > 0 {
+			name = "coalesced"
+		}
+		b.Run(name, func(b *testing.B) {
+			c := &Consumer{statsFlushInterval: interval}
+			b.RunParallel(func(pb *testing.PB) {
+				local := c.newLocalCounters()
+				defer c.flushCounters(local)
+				for pb.Next() {
+					c.countMessages(local, msgs)
+				}
+			})
+		})
+	}
+}
@@ -9,4 +9,12 @@ type Config struct {
 	ConntrackRateLimit           int
 	ConntrackMaxStateSize        int
 	EnableConntrackAllNamespaces bool
+	// ConntrackZone restricts the tracked entries to a single conntrack zone. All zones are tracked when nil.
+	ConntrackZone *uint16
+	// ConntrackLogFirstEvents is the number of decoded entries logged at startup, for debugging purposes
+	ConntrackLogFirstEvents int
+	// ConntrackDedupTTL is the window during which duplicate entries are dropped. Zero disables de-duplication.
+	ConntrackDedupTTL time.Duration
+	// ConntrackDedupSize is the maximum number of entries remembered for de-duplication
+	ConntrackDedupSize int
 }
@@ -0,0 +1,37 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"time"
+)
+
+// ConnectionDuration returns the duration of a connection, given its NEW and DESTROY events
+// (see WithGroups), correlated by their conntrack ID. The stop time is the CTA_TIMESTAMP_STOP of
+// the DESTROY event, and the start time its CTA_TIMESTAMP_START, or the one of the NEW event
+// when missing. Timestamps are only reported when the nf_conntrack_timestamp sysctl is enabled.
+//
+// It returns 0 when the duration can't be computed: the events have different IDs, a
+// timestamp is missing, or the connection stopped before it started.
+func ConnectionDuration(newConn, destroyConn *Con) time.Duration {
+	if newConn == nil || destroyConn == nil || newConn.ID != destroyConn.ID {
+		return 0
+	}
+	if destroyConn.Timestamp == nil || destroyConn.Timestamp.Stop == nil {
+		return 0
+	}
+
+	start := destroyConn.Timestamp.Start
+	if start == nil && newConn.Timestamp != nil {
+		start = newConn.Timestamp.Start
+	}
+	if start == nil {
+		return 0
+	}
+
+	if d := destroyConn.Timestamp.Stop.Sub(*start); d > 0 {
+		return d
+	}
+	return 0
+}
@@ -0,0 +1,70 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func encodeTimestampedConn(t *testing.T, id uint32, start, stop *time.Time) []byte {
+	return encodeTestConn(t, func(ae *netlink.AttributeEncoder) {
+		ae.ByteOrder = binary.BigEndian
+		ae.Uint32(ctaID, id)
+		ae.Nested(ctaTimestamp, func(nae *netlink.AttributeEncoder) error {
+			nae.ByteOrder = binary.BigEndian
+			if start != nil {
+				nae.Uint64(ctaTimestampStart, uint64(start.UnixNano()))
+			}
+			if stop != nil {
+				nae.Uint64(ctaTimestampStop, uint64(stop.UnixNano()))
+			}
+			return nil
+		})
+	})
+}
+
+func TestConnectionDuration(t *testing.T) {
+	start := time.Unix(1700000000, 123456789)
+	stop := start.Add(90*time.Second + 500*time.Millisecond)
+
+	destroyType := netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK<<8 | ipctnlMsgCtDelete)
+	newType := netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK<<8 | ipctnlMsgCtNew)
+	decoder := NewDecoder()
+	connections := decoder.DecodeAndReleaseEvent(Event{msgs: []netlink.Message{
+		{Header: netlink.Header{Type: newType}, Data: encodeTimestampedConn(t, 42, &start, nil)},
+		{Header: netlink.Header{Type: destroyType}, Data: encodeTimestampedConn(t, 42, nil, &stop)},
+	}})
+	require.Len(t, connections, 2)
+	newConn, destroyConn := &connections[0], &connections[1]
+	require.NotNil(t, newConn.Timestamp)
+	assert.Equal(t, start.UnixNano(), newConn.Timestamp.Start.UnixNano())
+	assert.Nil(t, newConn.Timestamp.Stop)
+	require.NotNil(t, destroyConn.Timestamp)
+	assert.Equal(t, stop.UnixNano(), destroyConn.Timestamp.Stop.UnixNano())
+
+	// The start time comes from the NEW event when the DESTROY one doesn't have it
+	assert.Equal(t, 90*time.Second+500*time.Millisecond, ConnectionDuration(newConn, destroyConn))
+
+	// ... and from the DESTROY event otherwise
+	later := start.Add(30 * time.Second)
+	destroyConn.Timestamp.Start = &later
+	assert.Equal(t, 60*time.Second+500*time.Millisecond, ConnectionDuration(newConn, destroyConn))
+
+	// Events of different connections aren't correlated
+	other := *destroyConn
+	other.ID = 43
+	assert.Zero(t, ConnectionDuration(newConn, &other))
+
+	// Missing timestamps
+	assert.Zero(t, ConnectionDuration(&Con{ID: 42}, &Con{ID: 42, Con: ct.Con{Timestamp: &ct.Timestamp{Stop: &stop}}}))
+	assert.Zero(t, ConnectionDuration(newConn, &Con{ID: 42}))
+}
@@ -0,0 +1,535 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	ct "github.com/florianl/go-conntrack"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// connectionWireVersion is the version of the wire format of MarshalConnection, see connection.proto
+const connectionWireVersion = 1
+
+var errUnsupportedWireVersion = errors.New("unsupported connection wire format version")
+
+// Field numbers of connection.proto
+const (
+	connectionVersion       = 1
+	connectionOrigin        = 2
+	connectionReply         = 3
+	connectionMaster        = 4
+	connectionNetNS         = 5
+	connectionID            = 6
+	connectionUse           = 7
+	connectionStatus        = 8
+	connectionZone          = 9
+	connectionLabels        = 10
+	connectionSeqAdjOrig    = 11
+	connectionSeqAdjReply   = 12
+	connectionTimestamp     = 13
+	connectionCounterOrigin = 14
+	connectionCounterReply  = 15
+	connectionMark          = 16
+	connectionProtoInfo     = 17
+	connectionTimeout       = 18
+	connectionTimeoutAt     = 19
+	connectionNATApplied    = 20
+	connectionPostNATReply  = 21
+
+	tupleSrc        = 1
+	tupleDst        = 2
+	tupleProto      = 3
+	tupleSrcPort    = 4
+	tupleDstPort    = 5
+	tupleIcmpID     = 6
+	tupleIcmpType   = 7
+	tupleIcmpCode   = 8
+	tupleIcmpv6ID   = 9
+	tupleIcmpv6Type = 10
+	tupleIcmpv6Code = 11
+
+	seqAdjCorrectionPos = 1
+	seqAdjOffsetBefore  = 2
+	seqAdjOffsetAfter   = 3
+
+	timestampStart = 1
+	timestampStop  = 2
+
+	counterPackets = 1
+	counterBytes   = 2
+
+	protoInfoTCP = 1
+
+	tcpInfoState = 1
+)
+
+// MarshalConnection encodes a decoded conntrack entry as a Connection protobuf message (see
+// connection.proto), so that it can be sent to another process. Every field set by the Decoder
+// is encoded, and unset optional fields stay unset once decoded by UnmarshalConnection.
+func MarshalConnection(c *Con) []byte {
+	var b []byte
+	b = appendVarint(b, connectionVersion, connectionWireVersion)
+	b = appendTuple(b, connectionOrigin, c.Origin)
+	b = appendTuple(b, connectionReply, c.Reply)
+	b = appendTuple(b, connectionMaster, c.Master)
+	if c.NetNS != 0 {
+		b = appendVarint(b, connectionNetNS, protowire.EncodeZigZag(int64(c.NetNS)))
+	}
+	if c.ID != 0 {
+		b = appendVarint(b, connectionID, uint64(c.ID))
+	}
+	if c.Use != 0 {
+		b = appendVarint(b, connectionUse, uint64(c.Use))
+	}
+	if c.Status != nil {
+		b = appendVarint(b, connectionStatus, uint64(*c.Status))
+	}
+	if c.Zone != nil {
+		b = appendVarint(b, connectionZone, uint64(*c.Zone))
+	}
+	if c.Labels != nil {
+		b = appendBytes(b, connectionLabels, c.Labels)
+	}
+	b = appendSeqAdj(b, connectionSeqAdjOrig, c.SeqAdjOrig)
+	b = appendSeqAdj(b, connectionSeqAdjReply, c.SeqAdjRepl)
+	b = appendTimestamp(b, connectionTimestamp, c.Timestamp)
+	b = appendCounter(b, connectionCounterOrigin, c.CounterOrigin)
+	b = appendCounter(b, connectionCounterReply, c.CounterReply)
+	if c.Mark != nil {
+		b = appendVarint(b, connectionMark, uint64(*c.Mark))
+	}
+	b = appendProtoInfo(b, connectionProtoInfo, c.ProtoInfo)
+	if c.Timeout != nil {
+		b = appendVarint(b, connectionTimeout, uint64(*c.Timeout))
+	}
+	if !c.TimeoutAt.IsZero() {
+		b = appendVarint(b, connectionTimeoutAt, uint64(c.TimeoutAt.UnixNano()))
+	}
+	if c.NATApplied {
+		b = appendVarint(b, connectionNATApplied, protowire.EncodeBool(true))
+	}
+	b = appendTuple(b, connectionPostNATReply, c.PostNATReply)
+	return b
+}
+
+// UnmarshalConnection decodes a Connection protobuf message encoded by MarshalConnection.
+// Unknown fields, added by newer versions of the format, are skipped.
+func UnmarshalConnection(data []byte) (Con, error) {
+	var c Con
+	var version uint64
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == connectionVersion && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			version = v
+			return n, nil
+		case (num == connectionOrigin || num == connectionReply || num == connectionMaster || num == connectionPostNATReply) && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			t, err := unmarshalTupleMessage(v)
+			switch num {
+			case connectionOrigin:
+				c.Origin = t
+			case connectionReply:
+				c.Reply = t
+			case connectionMaster:
+				c.Master = t
+			default:
+				c.PostNATReply = t
+			}
+			return n, err
+		case num == connectionNetNS && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			c.NetNS = int32(protowire.DecodeZigZag(v))
+			return n, nil
+		case num == connectionID && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			c.ID = uint32(v)
+			return n, nil
+		case num == connectionUse && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			c.Use = uint32(v)
+			return n, nil
+		case num == connectionStatus && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			status := uint32(v)
+			c.Status = &status
+			return n, nil
+		case num == connectionZone && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			zone := uint16(v)
+			c.Zone = &zone
+			return n, nil
+		case num == connectionLabels && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			c.Labels = append([]byte{}, v...)
+			return n, nil
+		case (num == connectionSeqAdjOrig || num == connectionSeqAdjReply) && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			s, err := unmarshalSeqAdjMessage(v)
+			if num == connectionSeqAdjOrig {
+				c.SeqAdjOrig = s
+			} else {
+				c.SeqAdjRepl = s
+			}
+			return n, err
+		case num == connectionTimestamp && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			ts, err := unmarshalTimestampMessage(v)
+			c.Timestamp = ts
+			return n, err
+		case (num == connectionCounterOrigin || num == connectionCounterReply) && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			counter, err := unmarshalCounterMessage(v)
+			if num == connectionCounterOrigin {
+				c.CounterOrigin = counter
+			} else {
+				c.CounterReply = counter
+			}
+			return n, err
+		case num == connectionMark && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			mark := uint32(v)
+			c.Mark = &mark
+			return n, nil
+		case num == connectionProtoInfo && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			info, err := unmarshalProtoInfoMessage(v)
+			c.ProtoInfo = info
+			return n, err
+		case num == connectionTimeout && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			timeout := uint32(v)
+			c.Timeout = &timeout
+			return n, nil
+		case num == connectionTimeoutAt && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			c.TimeoutAt = time.Unix(0, int64(v))
+			return n, nil
+		case num == connectionNATApplied && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			c.NATApplied = protowire.DecodeBool(v)
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	if err != nil {
+		return Con{}, err
+	}
+	if version != connectionWireVersion {
+		return Con{}, fmt.Errorf("%w: %d", errUnsupportedWireVersion, version)
+	}
+	return c, nil
+}
+
+func appendTuple(b []byte, num protowire.Number, t *ct.IPTuple) []byte {
+	if t == nil {
+		return b
+	}
+
+	var m []byte
+	if t.Src != nil {
+		m = appendBytes(m, tupleSrc, *t.Src)
+	}
+	if t.Dst != nil {
+		m = appendBytes(m, tupleDst, *t.Dst)
+	}
+	if t.Proto != nil {
+		if t.Proto.Number != nil {
+			m = appendVarint(m, tupleProto, uint64(*t.Proto.Number))
+		}
+		if t.Proto.SrcPort != nil {
+			m = appendVarint(m, tupleSrcPort, uint64(*t.Proto.SrcPort))
+		}
+		if t.Proto.DstPort != nil {
+			m = appendVarint(m, tupleDstPort, uint64(*t.Proto.DstPort))
+		}
+		if t.Proto.IcmpID != nil {
+			m = appendVarint(m, tupleIcmpID, uint64(*t.Proto.IcmpID))
+		}
+		if t.Proto.IcmpType != nil {
+			m = appendVarint(m, tupleIcmpType, uint64(*t.Proto.IcmpType))
+		}
+		if t.Proto.IcmpCode != nil {
+			m = appendVarint(m, tupleIcmpCode, uint64(*t.Proto.IcmpCode))
+		}
+		if t.Proto.Icmpv6ID != nil {
+			m = appendVarint(m, tupleIcmpv6ID, uint64(*t.Proto.Icmpv6ID))
+		}
+		if t.Proto.Icmpv6Type != nil {
+			m = appendVarint(m, tupleIcmpv6Type, uint64(*t.Proto.Icmpv6Type))
+		}
+		if t.Proto.Icmpv6Code != nil {
+			m = appendVarint(m, tupleIcmpv6Code, uint64(*t.Proto.Icmpv6Code))
+		}
+	}
+	return appendBytes(b, num, m)
+}
+
+func unmarshalTupleMessage(data []byte) (*ct.IPTuple, error) {
+	t := &ct.IPTuple{}
+	protoTuple := func() *ct.ProtoTuple {
+		if t.Proto == nil {
+			t.Proto = &ct.ProtoTuple{}
+		}
+		return t.Proto
+	}
+
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case (num == tupleSrc || num == tupleDst) && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			ip := net.IP(append([]byte{}, v...))
+			if num == tupleSrc {
+				t.Src = &ip
+			} else {
+				t.Dst = &ip
+			}
+			return n, nil
+		case num == tupleProto && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			number := uint8(v)
+			protoTuple().Number = &number
+			return n, nil
+		case (num == tupleSrcPort || num == tupleDstPort) && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			port := uint16(v)
+			if num == tupleSrcPort {
+				protoTuple().SrcPort = &port
+			} else {
+				protoTuple().DstPort = &port
+			}
+			return n, nil
+		case (num == tupleIcmpID || num == tupleIcmpv6ID) && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			id := uint16(v)
+			if num == tupleIcmpID {
+				protoTuple().IcmpID = &id
+			} else {
+				protoTuple().Icmpv6ID = &id
+			}
+			return n, nil
+		case (num == tupleIcmpType || num == tupleIcmpCode || num == tupleIcmpv6Type || num == tupleIcmpv6Code) && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			value := uint8(v)
+			switch num {
+			case tupleIcmpType:
+				protoTuple().IcmpType = &value
+			case tupleIcmpCode:
+				protoTuple().IcmpCode = &value
+			case tupleIcmpv6Type:
+				protoTuple().Icmpv6Type = &value
+			default:
+				protoTuple().Icmpv6Code = &value
+			}
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	return t, err
+}
+
+func appendSeqAdj(b []byte, num protowire.Number, s *ct.SeqAdj) []byte {
+	if s == nil {
+		return b
+	}
+
+	var m []byte
+	if s.CorrectionPos != nil {
+		m = appendVarint(m, seqAdjCorrectionPos, uint64(*s.CorrectionPos))
+	}
+	if s.OffsetBefore != nil {
+		m = appendVarint(m, seqAdjOffsetBefore, uint64(*s.OffsetBefore))
+	}
+	if s.OffsetAfter != nil {
+		m = appendVarint(m, seqAdjOffsetAfter, uint64(*s.OffsetAfter))
+	}
+	return appendBytes(b, num, m)
+}
+
+func unmarshalSeqAdjMessage(data []byte) (*ct.SeqAdj, error) {
+	s := &ct.SeqAdj{}
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		var field **uint32
+		switch num {
+		case seqAdjCorrectionPos:
+			field = &s.CorrectionPos
+		case seqAdjOffsetBefore:
+			field = &s.OffsetBefore
+		case seqAdjOffsetAfter:
+			field = &s.OffsetAfter
+		}
+		if field == nil || typ != protowire.VarintType {
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+		v, n := protowire.ConsumeVarint(b)
+		value := uint32(v)
+		*field = &value
+		return n, nil
+	})
+	return s, err
+}
+
+func appendTimestamp(b []byte, num protowire.Number, ts *ct.Timestamp) []byte {
+	if ts == nil {
+		return b
+	}
+
+	var m []byte
+	if ts.Start != nil {
+		m = appendVarint(m, timestampStart, uint64(ts.Start.UnixNano()))
+	}
+	if ts.Stop != nil {
+		m = appendVarint(m, timestampStop, uint64(ts.Stop.UnixNano()))
+	}
+	return appendBytes(b, num, m)
+}
+
+func unmarshalTimestampMessage(data []byte) (*ct.Timestamp, error) {
+	ts := &ct.Timestamp{}
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		var field **time.Time
+		switch num {
+		case timestampStart:
+			field = &ts.Start
+		case timestampStop:
+			field = &ts.Stop
+		}
+		if field == nil || typ != protowire.VarintType {
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+		v, n := protowire.ConsumeVarint(b)
+		t := time.Unix(0, int64(v))
+		*field = &t
+		return n, nil
+	})
+	return ts, err
+}
+
+func appendCounter(b []byte, num protowire.Number, counter *ct.Counter) []byte {
+	if counter == nil {
+		return b
+	}
+
+	var m []byte
+	if counter.Packets != nil {
+		m = appendVarint(m, counterPackets, *counter.Packets)
+	}
+	if counter.Bytes != nil {
+		m = appendVarint(m, counterBytes, *counter.Bytes)
+	}
+	return appendBytes(b, num, m)
+}
+
+func unmarshalCounterMessage(data []byte) (*ct.Counter, error) {
+	counter := &ct.Counter{}
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		var field **uint64
+		switch num {
+		case counterPackets:
+			field = &counter.Packets
+		case counterBytes:
+			field = &counter.Bytes
+		}
+		if field == nil || typ != protowire.VarintType {
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+		v, n := protowire.ConsumeVarint(b)
+		*field = &v
+		return n, nil
+	})
+	return counter, err
+}
+
+func appendProtoInfo(b []byte, num protowire.Number, info *ct.ProtoInfo) []byte {
+	if info == nil {
+		return b
+	}
+
+	var m []byte
+	if info.TCP != nil {
+		var tcp []byte
+		if info.TCP.State != nil {
+			tcp = appendVarint(tcp, tcpInfoState, uint64(*info.TCP.State))
+		}
+		m = appendBytes(m, protoInfoTCP, tcp)
+	}
+	return appendBytes(b, num, m)
+}
+
+func unmarshalProtoInfoMessage(data []byte) (*ct.ProtoInfo, error) {
+	info := &ct.ProtoInfo{}
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if num != protoInfoTCP || typ != protowire.BytesType {
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+		info.TCP = &ct.TCPInfo{}
+		return n, consumeFields(v, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+			if num != tcpInfoState || typ != protowire.VarintType {
+				return protowire.ConsumeFieldValue(num, typ, b), nil
+			}
+			v, n := protowire.ConsumeVarint(b)
+			state := uint8(v)
+			info.TCP.State = &state
+			return n, nil
+		})
+	})
+	return info, err
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// consumeFields calls fn with the number, the type and the data of each field of the message,
+// starting with its value. fn returns the length of the value, or a negative length if it's
+// malformed, see protowire.ParseError.
+func consumeFields(data []byte, fn func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return fmt.Errorf("invalid connection message: %w", protowire.ParseError(n))
+		}
+		data = data[n:]
+
+		n, err := fn(num, typ, data)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return fmt.Errorf("invalid connection message, field %d: %w", num, protowire.ParseError(n))
+		}
+		data = data[n:]
+	}
+	return nil
+}
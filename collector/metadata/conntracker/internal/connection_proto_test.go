@@ -0,0 +1,117 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"testing"
+	"time"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestConnectionRoundTrip(t *testing.T) {
+	uint32p := func(v uint32) *uint32 { return &v }
+	uint64p := func(v uint64) *uint64 { return &v }
+	zone, status, state := uint16(7), uint32(0x1ce), uint8(3)
+	start, stop := time.Unix(0, 1650000000123456789), time.Unix(1650000060, 0)
+
+	full := Con{
+		Con: ct.Con{
+			Origin: newIPTuple("10.0.2.15", "2.2.2.2", 58472, 5432, uint8(unix.IPPROTO_TCP)),
+			Reply:  newIPTuple("fd00::2", "fd00::1", 5432, 58472, uint8(unix.IPPROTO_TCP)),
+			SeqAdjOrig: &ct.SeqAdj{
+				CorrectionPos: uint32p(1000),
+				OffsetBefore:  uint32p(0),
+				OffsetAfter:   uint32p(12),
+			},
+			SeqAdjRepl: &ct.SeqAdj{CorrectionPos: uint32p(2000)},
+			Status:     &status,
+			Zone:       &zone,
+			Timestamp:  &ct.Timestamp{Start: &start, Stop: &stop},
+			CounterOrigin: &ct.Counter{
+				Packets: uint64p(12),
+				Bytes:   uint64p(1 << 40),
+			},
+			CounterReply: &ct.Counter{Bytes: uint64p(0)},
+			Mark:         uint32p(0x100),
+			ProtoInfo:    &ct.ProtoInfo{TCP: &ct.TCPInfo{State: &state}},
+			Timeout:      uint32p(431999),
+		},
+		NetNS:     -1,
+		ID:        42,
+		Use:       2,
+		Master:    newIPTuple("10.0.2.15", "2.2.2.2", 40000, 21, uint8(unix.IPPROTO_TCP)),
+		Labels:    []byte{0, 1, 0, 0},
+		TimeoutAt: time.Unix(0, 1650432000123456789),
+	}
+
+	icmpTuple := func(src, dst string, proto uint8, typ, code uint8, id uint16) *ct.IPTuple {
+		tuple := newIPTuple(src, dst, 0, 0, proto)
+		tuple.Proto.SrcPort, tuple.Proto.DstPort = nil, nil
+		if proto == unix.IPPROTO_ICMP {
+			tuple.Proto.IcmpType, tuple.Proto.IcmpCode, tuple.Proto.IcmpID = &typ, &code, &id
+		} else {
+			tuple.Proto.Icmpv6Type, tuple.Proto.Icmpv6Code, tuple.Proto.Icmpv6ID = &typ, &code, &id
+		}
+		return tuple
+	}
+
+	for name, c := range map[string]Con{
+		"full": full,
+		// an entry canonicalized in its pre-NAT form, see Decoder.CanonicalizeNAT
+		"nat": {
+			Con: ct.Con{
+				Origin: newIPTuple("10.0.2.15", "10.96.0.10", 58472, 53, uint8(unix.IPPROTO_UDP)),
+				Reply:  newIPTuple("10.96.0.10", "10.0.2.15", 53, 58472, uint8(unix.IPPROTO_UDP)),
+			},
+			NATApplied:   true,
+			PostNATReply: newIPTuple("10.244.0.5", "10.0.2.15", 53, 58472, uint8(unix.IPPROTO_UDP)),
+		},
+		"icmp": {Con: ct.Con{
+			Origin: icmpTuple("10.0.2.15", "2.2.2.2", unix.IPPROTO_ICMP, 8, 0, 1234),
+			Reply:  icmpTuple("2.2.2.2", "10.0.2.15", unix.IPPROTO_ICMP, 0, 0, 1234),
+		}},
+		"icmpv6": {Con: ct.Con{
+			Origin: icmpTuple("fd00::1", "fd00::2", unix.IPPROTO_ICMPV6, 128, 0, 42),
+			Reply:  icmpTuple("fd00::2", "fd00::1", unix.IPPROTO_ICMPV6, 129, 0, 42),
+		}},
+		"empty": {},
+		// Set but empty or zero fields are kept
+		"zero": {
+			Con:    ct.Con{Origin: &ct.IPTuple{}, Status: uint32p(0), ProtoInfo: &ct.ProtoInfo{TCP: &ct.TCPInfo{}}},
+			Labels: []byte{},
+		},
+	} {
+		decoded, err := UnmarshalConnection(MarshalConnection(&c))
+		require.NoError(t, err, name)
+		assert.Equal(t, c, decoded, name)
+	}
+}
+
+func TestUnmarshalConnectionCompatibility(t *testing.T) {
+	c := Con{Con: ct.Con{Origin: newIPTuple("10.0.2.15", "2.2.2.2", 58472, 5432, uint8(unix.IPPROTO_UDP))}, ID: 3}
+	data := MarshalConnection(&c)
+
+	// Fields added by newer versions of the format are skipped
+	withUnknown := protowire.AppendTag(append([]byte{}, data...), 100, protowire.BytesType)
+	withUnknown = protowire.AppendBytes(withUnknown, []byte("future"))
+	withUnknown = protowire.AppendTag(withUnknown, 101, protowire.Fixed64Type)
+	withUnknown = protowire.AppendFixed64(withUnknown, 1)
+	decoded, err := UnmarshalConnection(withUnknown)
+	require.NoError(t, err)
+	assert.Equal(t, c, decoded)
+
+	// Incompatible versions are rejected
+	newer := protowire.AppendTag(nil, connectionVersion, protowire.VarintType)
+	newer = protowire.AppendVarint(newer, connectionWireVersion+1)
+	_, err = UnmarshalConnection(newer)
+	assert.ErrorIs(t, err, errUnsupportedWireVersion)
+
+	_, err = UnmarshalConnection(data[:len(data)-1])
+	assert.Error(t, err)
+}
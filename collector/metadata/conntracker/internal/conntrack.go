@@ -47,13 +47,7 @@ type conntrack struct {
 }
 
 func (c *conntrack) Exists(conn *Con) (bool, error) {
-	msg := netlink.Message{
-		Header: netlink.Header{
-			Type:  netlink.HeaderType((unix.NFNL_SUBSYS_CTNETLINK << 8) | ipctnlMsgCtGet),
-			Flags: netlink.Request | netlink.Acknowledge,
-		},
-		Data: []byte{unix.AF_INET, unix.NFNETLINK_V0, 0, 0},
-	}
+	msg := newCtGetRequest(unix.AF_INET, netlink.Request|netlink.Acknowledge)
 
 	data, err := EncodeConn(conn)
 	if err != nil {
@@ -61,6 +55,9 @@ func (c *conntrack) Exists(conn *Con) (bool, error) {
 	}
 
 	msg.Data = append(msg.Data, data...)
+	if err := checkReadOnly(msg); err != nil {
+		return false, err
+	}
 
 	replies, err := c.conn.Execute(msg)
 	if err != nil {
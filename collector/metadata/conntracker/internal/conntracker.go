@@ -91,7 +91,7 @@ func NewConntracker(config *Config) (Conntracker, error) {
 	done := make(chan struct{})
 
 	go func() {
-		conntracker, err = newConntrackerOnce(config.ProcRoot, config.ConntrackMaxStateSize, config.ConntrackRateLimit, config.EnableConntrackAllNamespaces)
+		conntracker, err = newConntrackerOnce(config)
 		done <- struct{}{}
 	}()
 
@@ -103,14 +103,25 @@ func NewConntracker(config *Config) (Conntracker, error) {
 	}
 }
 
-func newConntrackerOnce(procRoot string, maxStateSize, targetRateLimit int, listenAllNamespaces bool) (Conntracker, error) {
-	consumer := NewConsumer(procRoot, targetRateLimit, listenAllNamespaces)
+func newConntrackerOnce(config *Config) (Conntracker, error) {
+	targetRateLimit := config.ConntrackRateLimit
+	consumer := NewConsumer(config.ProcRoot, targetRateLimit, config.EnableConntrackAllNamespaces)
+	decoder := NewDecoder()
+	if config.ConntrackZone != nil {
+		decoder.FilterZone(*config.ConntrackZone)
+	}
+	decoder.LogFirst(config.ConntrackLogFirstEvents)
+	if config.ConntrackDedupTTL > 0 {
+		if err := decoder.Deduplicate(config.ConntrackDedupSize, config.ConntrackDedupTTL); err != nil {
+			return nil, fmt.Errorf("could not initialize conntrack de-duplication: %w", err)
+		}
+	}
 	ctr := &realConntracker{
 		consumer:      consumer,
-		cache:         newConntrackCache(maxStateSize, defaultOrphanTimeout),
-		maxStateSize:  maxStateSize,
+		cache:         newConntrackCache(config.ConntrackMaxStateSize, defaultOrphanTimeout),
+		maxStateSize:  config.ConntrackMaxStateSize,
 		compactTicker: time.NewTicker(compactInterval),
-		decoder:       NewDecoder(),
+		decoder:       decoder,
 	}
 
 	for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
@@ -187,6 +198,13 @@ func (ctr *realConntracker) GetStats() map[string]int64 {
 		m[k] = v
 	}
 
+	// and from the kernel, when it exposes them
+	if kernelStats, err := ctr.consumer.KernelConntrackStats(); err == nil {
+		for k, v := range kernelStats.Stats() {
+			m[k] = v
+		}
+	}
+
 	return m
 }
 
@@ -420,6 +438,12 @@ func formatIPTranslation(tuple *ct.IPTuple) *IPTranslation {
 }
 
 func formatKey(tuple *ct.IPTuple) (k connKey, ok bool) {
+	if tuple.Src == nil || tuple.Dst == nil || tuple.Proto == nil ||
+		tuple.Proto.SrcPort == nil || tuple.Proto.DstPort == nil || tuple.Proto.Number == nil {
+		// attributes skipped by the lenient decoder
+		return k, false
+	}
+
 	ok = true
 	k.srcIP = AddressFromNetIP(*tuple.Src)
 	k.dstIP = AddressFromNetIP(*tuple.Dst)
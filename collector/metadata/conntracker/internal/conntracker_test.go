@@ -31,7 +31,7 @@ func TestIsNat(t *testing.T) {
 	t.Run("not nat", func(t *testing.T) {
 
 		c := Con{
-			ct.Con{
+			Con: ct.Con{
 				Origin: &ct.IPTuple{
 					Src: &src,
 					Dst: &dst,
@@ -49,14 +49,13 @@ func TestIsNat(t *testing.T) {
 					},
 				},
 			},
-			0,
 		}
 		assert.False(t, IsNAT(c))
 	})
 
 	t.Run("nil proto field", func(t *testing.T) {
 		c := Con{
-			ct.Con{
+			Con: ct.Con{
 				Origin: &ct.IPTuple{
 					Src: &src,
 					Dst: &dst,
@@ -66,7 +65,6 @@ func TestIsNat(t *testing.T) {
 					Dst: &src,
 				},
 			},
-			0,
 		}
 		assert.False(t, IsNAT(c))
 	})
@@ -74,7 +72,7 @@ func TestIsNat(t *testing.T) {
 	t.Run("nat", func(t *testing.T) {
 
 		c := Con{
-			ct.Con{
+			Con: ct.Con{
 				Origin: &ct.IPTuple{
 					Src: &src,
 					Dst: &dst,
@@ -92,7 +90,6 @@ func TestIsNat(t *testing.T) {
 					},
 				},
 			},
-			0,
 		}
 		assert.True(t, IsNAT(c))
 	})
@@ -483,7 +480,7 @@ func makeUntranslatedConn(src, dst net.IP, proto uint8, srcPort, dstPort uint16)
 func makeTranslatedConn(from, transFrom, to net.IP, proto uint8, fromPort, transFromPort, toPort uint16) Con {
 
 	return Con{
-		ct.Con{
+		Con: ct.Con{
 			Origin: &ct.IPTuple{
 				Src: &from,
 				Dst: &to,
@@ -503,7 +500,6 @@ func makeTranslatedConn(from, transFrom, to net.IP, proto uint8, fromPort, trans
 				},
 			},
 		},
-		0,
 	}
 }
 
@@ -15,17 +15,22 @@
 package internal
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"os"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/mdlayher/netlink"
 	"github.com/pkg/errors"
 	"github.com/vishvananda/netns"
+	"golang.org/x/net/bpf"
 	"golang.org/x/sys/unix"
 )
 
@@ -35,6 +40,10 @@ const (
 	// http://man7.org/linux/man-pages/man7/netlink.7.html
 	netlinkCtNew = uint32(1)
 
+	// netlinkCtUpdate and netlinkCtDestroy are the multicast groups of updated and destroyed connections
+	netlinkCtUpdate  = uint32(2)
+	netlinkCtDestroy = uint32(3)
+
 	// ipctnlMsgCtGet represents the Conntrack message type used during the initial load.
 	// This value is defined in include/uapi/linux/netfilter/nfnetlink_conntrack.h
 	ipctnlMsgCtGet = 1
@@ -56,6 +65,13 @@ const (
 )
 
 var errShortErrorMessage = errors.New("not enough data for netlink error code")
+
+// maxNonBlockingReads is the maximum number of netlink messages read by a ReceiveNonBlocking call
+var maxNonBlockingReads = outputBuffer
+
+// ErrDumpInProgress is returned by DumpTable when a previous dump is still running.
+// Dumps share the Consumer's dump state and statistics, so they can't be run concurrently.
+var ErrDumpInProgress = errors.New("conntrack table dump already in progress")
 var pre315Kernel bool
 
 func init() {
@@ -73,21 +89,153 @@ type Consumer struct {
 	procRoot string
 
 	// targetRateLimit represents the maximum number of netlink messages per second
-	// that can be read off the netlink socket. Setting it to -1 disables the limit.
+	// that can be read off the netlink socket. Setting it to -1 (or 0) disables the limit.
 	targetRateLimit int
+	// byteRateLimit makes targetRateLimit a number of bytes per second, see WithByteRateLimit
+	byteRateLimit bool
 
 	// samplingRate must be a value between 0 and 1 (inclusive) which is adjusted dynamically.
 	// this represents the amount of sampling we apply to the netlink socket via a BPF filter
 	// to reach the targetRateLimit.
 	samplingRate float64
 
+	// samplingFloor is the lowest sampling rate applied to the streaming socket.
+	// Dumps are never sampled, see newDumpSocket.
+	samplingFloor float64
+
+	// initialSamplingRate is the sampling rate the streaming socket starts with, see
+	// WithInitialSamplingRate. Zero means no sampling.
+	initialSamplingRate float64
+
+	// samplingFrozen is 1 while throttling doesn't re-create the socket, see FreezeSampling
+	samplingFrozen int32
+	// lastSamplingRecovery is the time the sampling rate was last checked by recoverSamplingRate
+	lastSamplingRecovery time.Time
+
 	// breaker is meant to ensure we never process more netlink messages than the specified targetRateLimit.
 	// when the circuit breaker trips, we close the socket and re-create a new one with the samplingRate
 	// adjusted accordingly to meet the desired targetRateLimit.
+	// It's nil when a custom RateLimiter is set with WithRateLimiter.
 	breaker *CircuitBreaker
-
-	// streaming is set to true after we finish the initial Conntrack dump.
-	streaming bool
+	// limiter is the RateLimiter in use, either the breaker or the one set with WithRateLimiter
+	limiter RateLimiter
+
+	// streaming is set to 1 after we finish the initial Conntrack dump. It's accessed atomically,
+	// since diagnostics like ShadowSample check it while the receive loop runs, see isStreaming.
+	streaming int32
+	// dumpMode makes receive read the reply of a dump request, e.g. in tests and when replaying
+	// snapshots. The loop only terminates on a multi-part Done message in this mode, so that a
+	// Done message received by the streaming socket can't end it. DumpTable doesn't set it, and
+	// passes its own receiveMode instead, see dumpTableOnce.
+	dumpMode bool
+
+	// dumping is set to 1 while a DumpTable call is running.
+	dumping int32
+
+	// epoll services the per-namespace sockets opened by NamespaceEvents. It's guarded by
+	// epollMutex, since Stop closes it.
+	epollMutex sync.Mutex
+	epoll      *epollReceiver
+
+	// caps are the kernel features detected by configureSocket
+	caps ConsumerCapabilities
+	// samplerProgram is the BPF sampler attached to the streaming socket, if any
+	samplerProgram []bpf.RawInstruction
+	capsMutex      sync.Mutex
+
+	// deterministicSampling replaces the probabilistic BPF sampler by a 1-in-N sampler
+	deterministicSampling bool
+	// minSampledRate is the number of messages per second and per namespace kept whatever the
+	// sampling rate, see WithMinimumSampledRate
+	minSampledRate int
+	// protocolSamplingRates are the sampling rates of the protocols set with
+	// WithProtocolSamplingRates, applied by the BPF sampler
+	protocolSamplingRates map[uint8]float64
+	// sampler is the userspace sampler used instead of the BPF one, if any
+	sampler messageSampler
+
+	// recorder retains the summaries of the most recent streamed events, see WithFlightRecorder
+	recorder *flightRecorder
+
+	// dumpStats are the timings of the last completed dump
+	dumpStats DumpStats
+	// dumpReport is the outcome of each namespace of the last completed dump
+	dumpReport     DumpReport
+	dumpStatsMutex sync.Mutex
+	// dumpEntries counts the entries emitted by the running dump
+	dumpEntries int
+	// dumpPacer paces the reads of dumps, see WithDumpRateLimit
+	dumpPacer *dumpPacer
+	// periodicDump dumps the tables into the Events() stream, see WithPeriodicDump
+	periodicDump *periodicDump
+
+	// maxEvents is the number of events emitted before the Consumer stops, see WithMaxEvents
+	maxEvents      int64
+	maxEventsScope MaxEventsScope
+	emittedEvents  int64
+
+	// rcvBufGrowth, when set, grows the receive buffer of the streaming socket on repeated ENOBUFS
+	rcvBufGrowth *rcvBufGrowth
+
+	// decodePolicy defines how malformed attributes of netlink replies are handled
+	decodePolicy DecodePolicy
+
+	// dumpCompleteMarker makes DumpTable emit a marker Event once all namespaces are dumped
+	dumpCompleteMarker bool
+
+	// maxDumpDuration bounds the duration of the dumps, see WithMaxDumpDuration
+	maxDumpDuration time.Duration
+
+	// dumpNS dumps the table of a single namespace. It defaults to dumpTable and is replaced in tests.
+	dumpNS func(ctx context.Context, family uint8, output chan Event, ns netns.NsHandle) error
+	// rootNSPath and rootNSInode override the root namespace, see WithRootNamespacePath
+	rootNSPath  string
+	rootNSInode uint32
+	// listNamespaces lists the network namespaces of the host. It defaults to GetNetNamespaces
+	// and is replaced in tests.
+	listNamespaces func() ([]netns.NsHandle, error)
+	// enumerationRetryDelay is the delay before listing the namespaces of a dump again after an
+	// error, see listNamespacesWithRetry
+	enumerationRetryDelay time.Duration
+
+	// skipEmptyNamespaces skips the dump of namespaces without conntrack entries
+	skipEmptyNamespaces bool
+	// tableSize returns the number of entries of a namespace. It defaults to namespaceTableSize.
+	tableSize func(ns netns.NsHandle) (int, error)
+	// namespaceStats returns the number of entries and the maximum size of the table of a
+	// namespace. It defaults to readNamespaceStats.
+	namespaceStats func(ns netns.NsHandle) (count, max int, err error)
+	// nsThreads bounds the goroutines running in another namespace, see WithMaxNamespaceThreads
+	nsThreads *nsThreadLimiter
+
+	// namespaceFilter holds the inodes of the namespaces to include, see WithNamespaceFilter
+	namespaceFilter map[uint32]struct{}
+
+	// groups are the multicast groups joined by the streaming sockets
+	groups []uint32
+
+	// dumpEOFRetries is the number of times the dump of a namespace is retried after an EOF
+	dumpEOFRetries int
+
+	// maxNamespacesPerDump caps the number of non-root namespaces dumped by a single DumpTable call
+	maxNamespacesPerDump int
+	// nsCursor is the position, in the list of namespaces, of the next namespace to dump when
+	// maxNamespacesPerDump is set. It's only accessed by the dump goroutine.
+	nsCursor int
+
+	// streamedEstimate is the estimated number of messages before sampling of the streaming
+	// socket, scaled by estimateScale. See ShadowSample.
+	streamedEstimate int64
+	// readFn replaces the reads of the socket by the receive loop. It's only set in tests.
+	readFn func(b []byte) ([]netlink.Message, int32, error)
+
+	// openShadowSocket opens the socket used by ShadowSample. It defaults to newShadowSocket.
+	openShadowSocket func() (messageReceiver, error)
+
+	// bootID is the boot ID of the host, read once at construction
+	bootID string
+	// bootIDOnEvents stamps bootID on every Event, see WithBootIDOnEvents
+	bootIDOnEvents bool
 
 	// telemetry
 	enobufs     int64
@@ -95,20 +243,133 @@ type Consumer struct {
 	samplingPct int64
 	readErrors  int64
 	msgErrors   int64
+	// samplerCheck measures the effect of the sampling rate changes on the received rate
+	samplerCheck *samplerCheck
+	// samplerEffectiveness is the observed drop of the received rate after the last sampling
+	// rate change, as a percentage of the intended drop
+	samplerEffectiveness int64
+	// rcvBufGrowths is the number of times the receive buffer was grown
+	rcvBufGrowths int64
+	// dumpValidationFailures is the number of dump requests which failed validation
+	dumpValidationFailures int64
+	// familyCounters break the main counters down by address family, see GetStatsByFamily
+	familyCounters familyCounters
+	// statsFlushInterval is the interval at which the receive loops flush their message
+	// counts, see WithCoalescedStats. They're counted as they're received when it's 0.
+	statsFlushInterval time.Duration
+	// dumpFamily is the family of the running dump
+	dumpFamily uint8
+	// firstEvent is signaled once the first event is streamed, see WaitForFirstEvent
+	firstEvent *firstEvent
+	// cidrFilter drops the entries outside of the allowed CIDRs, see WithCIDRAllowList
+	cidrFilter   *cidrFilter
+	cidrFiltered int64
+	// messageTypes are the accepted message types, see WithMessageTypes. The conntrack new and
+	// delete messages are accepted when it's nil.
+	messageTypes       map[netlink.HeaderType]struct{}
+	unexpectedMsgTypes int64
+	// periodicDumps is the number of periodic dumps merged into the Events() stream
+	periodicDumps int64
+	// staleNamespacesSkipped is the number of namespaces destroyed before they could be dumped
+	staleNamespacesSkipped int64
+	// nsidCollisions is the number of ambiguous nsid mappings found by the dumps, see checkNSID
+	nsidCollisions int64
+	// enumerationRetries is the number of times the namespaces of a dump were listed again after an error
+	enumerationRetries int64
+	// enobufsWhileChannelFull is the number of ENOBUFS errors received while the output channel
+	// was full, see countENOBUFSBackpressure
+	enobufsWhileChannelFull int64
+	// tableMonitor checks the utilization of the conntrack table, see WithTableUtilizationMonitor
+	tableMonitor *tableMonitor
+	// tableUtilization is the last utilization of the conntrack table, in percent
+	tableUtilization int64
+	// stopped is set by Stop, so that the receive loop exiting on the closed socket isn't
+	// reported as an unexpected exit
+	stopped int32
 
 	netlinkSeqNumber    uint32
 	listenAllNamespaces bool
+	// autoListenAllNamespaces falls back to dumping each namespace when the kernel doesn't
+	// support NETLINK_LISTEN_ALL_NSID, see WithAutoListenAllNamespaces
+	autoListenAllNamespaces bool
+
+	// recvLoop is the receive loop started by Events, see Shutdown
+	recvLoop *recvLoop
 
 	// for testing purposes
 	recvLoopRunning int32
 }
 
+// ConsumerCapabilities reports which kernel features are available to the Consumer.
+// Missing features silently change its behavior, e.g. no sampling is applied when throttling.
+type ConsumerCapabilities struct {
+	// KernelVersion is the version of the running kernel, or 0 if it couldn't be determined
+	KernelVersion Version
+	// Sampling is true if a BPF sampler can be attached to the socket (kernel >= 3.15)
+	Sampling bool
+	// ListenAllNamespaces is true if NETLINK_LISTEN_ALL_NSID was enabled on the socket
+	ListenAllNamespaces bool
+	// NamespaceMode is how the Consumer covers the network namespaces of the host
+	NamespaceMode NamespaceMode
+	// RcvBufForce is true if the receive buffer size could be forced with SO_RCVBUFFORCE
+	RcvBufForce bool
+	// RcvBufSize is the receive buffer size reported by the kernel
+	RcvBufSize int
+}
+
+// NamespaceMode describes which network namespaces the Consumer gets connections from
+type NamespaceMode string
+
+const (
+	// NamespaceModeRoot means that only the root namespace is streamed and dumped
+	NamespaceModeRoot NamespaceMode = "root"
+	// NamespaceModeListenAll means that the events of all namespaces are streamed, thanks to
+	// NETLINK_LISTEN_ALL_NSID, and that all of them are dumped
+	NamespaceModeListenAll NamespaceMode = "listen_all"
+	// NamespaceModePerNamespace means that NETLINK_LISTEN_ALL_NSID isn't supported: only the
+	// events of the root namespace are streamed, but every namespace is dumped
+	NamespaceModePerNamespace NamespaceMode = "per_namespace"
+)
+
+// listenAllNSIDKernelVersion is the first kernel version supporting NETLINK_LISTEN_ALL_NSID
+var listenAllNSIDKernelVersion = VersionCode(4, 2, 0)
+
+// DumpStats reports how long the last conntrack table dump took
+type DumpStats struct {
+	// Duration is the total duration of the dump, across all namespaces
+	Duration time.Duration
+	// Namespaces holds the duration of the dump of each namespace, in dump order. These are the
+	// namespaces covered by the dump, see WithMaxNamespacesPerDump.
+	Namespaces []NamespaceDumpStats
+	// Deferred is the number of namespaces left to the next dumps by WithMaxNamespacesPerDump
+	Deferred int
+}
+
+// NamespaceDumpStats is the duration of the dump of a single namespace
+type NamespaceDumpStats struct {
+	// NSInode is the inode of the namespace, or 0 if it couldn't be determined
+	NSInode  uint32
+	Duration time.Duration
+}
+
+// Multicast groups a Consumer can subscribe to, see WithGroups
+const (
+	GroupNew     = netlinkCtNew
+	GroupUpdate  = netlinkCtUpdate
+	GroupDestroy = netlinkCtDestroy
+)
+
 // Event encapsulates the result of a single netlink.Con.Receive() call
 type Event struct {
-	msgs   []netlink.Message
-	netns  int32
-	buffer *[]byte
-	pool   *sync.Pool
+	msgs    []netlink.Message
+	netns   int32
+	nsInode uint32
+	buffer  *[]byte
+	pool    *sync.Pool
+	bootID  string
+
+	dumpComplete bool
+	fromDump     bool
 }
 
 // Messages returned from the socket read
@@ -116,6 +377,18 @@ func (e *Event) Messages() []netlink.Message {
 	return e.msgs
 }
 
+// NSInode returns the inode of the network namespace the Event was received from.
+// It's only known for events emitted by NamespaceEvents, and is 0 otherwise.
+func (e *Event) NSInode() uint32 {
+	return e.nsInode
+}
+
+// IsDumpComplete reports whether the Event is the marker emitted by DumpTable after the tables
+// of all namespaces were dumped (see WithDumpCompleteMarker). Marker events carry no messages.
+func (e *Event) IsDumpComplete() bool {
+	return e.dumpComplete
+}
+
 // Done must be called after decoding events so the underlying buffers can be reclaimed.
 func (e *Event) Done() {
 	if e.buffer != nil {
@@ -123,121 +396,530 @@ func (e *Event) Done() {
 	}
 }
 
+// ConsumerOption configures optional behaviors of a Consumer
+type ConsumerOption func(c *Consumer)
+
+// WithDumpCompleteMarker makes DumpTable emit a marker Event (see Event.IsDumpComplete) after the
+// last namespace is dumped, so that consumers can tell a complete baseline from a shutdown.
+func WithDumpCompleteMarker() ConsumerOption {
+	return func(c *Consumer) {
+		c.dumpCompleteMarker = true
+	}
+}
+
+// WithDeterministicSampling makes the Consumer sample exactly 1 message out of every N when
+// throttling, N being derived from the target rate limit, instead of attaching the probabilistic
+// BPF sampler. Proportions are exact, but messages are still read off the socket before being
+// dropped, and sampling may correlate with periodic traffic patterns. See oneInNSampler.
+func WithDeterministicSampling() ConsumerOption {
+	return func(c *Consumer) {
+		c.deterministicSampling = true
+	}
+}
+
+// WithMinimumSampledRate guarantees that at least perSecond messages are kept per second for
+// every network namespace when the streaming socket is sampled, on top of the messages kept by
+// the sampling rate. This keeps namespaces with little traffic visible under heavy sampling.
+// It requires sampling in userspace rather than in BPF (see minRateSampler), so all messages
+// are read off the socket, and it takes precedence over WithDeterministicSampling.
+func WithMinimumSampledRate(perSecond int) ConsumerOption {
+	return func(c *Consumer) {
+		c.minSampledRate = perSecond
+	}
+}
+
+// WithProtocolSamplingRates applies a fixed sampling rate to the streamed events of the given IP
+// protocols (e.g. unix.IPPROTO_UDP), whether or not the target rate limit is exceeded, while the
+// other protocols are sampled according to the rate limit. For instance, {IPPROTO_UDP: 0.1}
+// samples DNS heavy UDP traffic while keeping every TCP event until throttling kicks in.
+// Rates are compiled in the BPF sampler (see GenerateProtocolBPFSampler), which requires
+// kernel 3.15+. They aren't applied when sampling in userspace, see WithDeterministicSampling
+// and WithMinimumSampledRate.
+func WithProtocolSamplingRates(rates map[uint8]float64) ConsumerOption {
+	return func(c *Consumer) {
+		c.protocolSamplingRates = make(map[uint8]float64, len(rates))
+		for proto, rate := range rates {
+			c.protocolSamplingRates[proto] = rate
+		}
+	}
+}
+
+// WithFlightRecorder makes the Consumer retain the last n streamed event messages, whose decoded
+// summaries can be inspected with RecentEvents.
+func WithFlightRecorder(n int) ConsumerOption {
+	return func(c *Consumer) {
+		c.recorder = newFlightRecorder(n)
+	}
+}
+
+// RecentEvents returns the summaries of the most recent streamed events, from the oldest
+// to the most recent. Messages are only decoded here, and the ones which can't be decoded are
+// left out. It returns nil unless the Consumer was created WithFlightRecorder.
+func (c *Consumer) RecentEvents() []ConnectionSummary {
+	if c.recorder == nil {
+		return nil
+	}
+	return c.recorder.recent()
+}
+
+// WithStreamingSamplingFloor sets the lowest sampling rate applied to the streaming socket when
+// the target rate limit is exceeded. Conntrack dumps are never sampled.
+func WithStreamingSamplingFloor(samplingRate float64) ConsumerOption {
+	return func(c *Consumer) {
+		c.samplingFloor = samplingRate
+	}
+}
+
+// WithInitialSamplingRate makes the streaming socket start with the given sampling rate, between
+// 0 (exclusive) and 1, rather than with no sampling at all. On hosts known to exceed the target
+// rate limit, this avoids the burst of ENOBUFS errors until the circuit breaker first trips;
+// the rate is then adjusted to the observed traffic on every trip, like when starting unsampled.
+// On a host which turns out to stay below the target, the rate is raised by the periodic check
+// of recoverSamplingRate.
+func WithInitialSamplingRate(samplingRate float64) ConsumerOption {
+	return func(c *Consumer) {
+		if samplingRate > 0 && samplingRate <= 1 {
+			c.initialSamplingRate = samplingRate
+		}
+	}
+}
+
+// startSamplingRate returns the sampling rate the streaming socket is created with
+func (c *Consumer) startSamplingRate() float64 {
+	if c.initialSamplingRate > 0 {
+		return c.initialSamplingRate
+	}
+	return 1.0
+}
+
+// WithSkipEmptyNamespaces makes DumpTable skip the namespaces whose nf_conntrack_count is zero,
+// saving the setns, socket and dump overhead on hosts with many sparse namespaces.
+// The count is a racy snapshot, and a namespace could gain entries right after the check.
+// The root namespace is always dumped.
+func WithSkipEmptyNamespaces() ConsumerOption {
+	return func(c *Consumer) {
+		c.skipEmptyNamespaces = true
+	}
+}
+
+// WithDecodePolicy sets how malformed attributes of the netlink replies parsed by the Consumer
+// are handled. With DecodeStrict, decoding errors are logged instead of silently ignored.
+func WithDecodePolicy(policy DecodePolicy) ConsumerOption {
+	return func(c *Consumer) {
+		c.decodePolicy = policy
+	}
+}
+
+// WithRcvBufGrowth makes the Consumer grow the receive buffer of the streaming socket when
+// ENOBUFS errors keep happening: once threshold of them occur within window, the buffer size
+// is doubled, up to maxSize bytes. This trades memory for fewer dropped messages, in addition
+// to the sampling applied when the target rate limit is exceeded.
+func WithRcvBufGrowth(threshold int, window time.Duration, maxSize int) ConsumerOption {
+	return func(c *Consumer) {
+		c.rcvBufGrowth = &rcvBufGrowth{
+			threshold: threshold,
+			window:    window,
+			maxSize:   maxSize,
+			size:      netlinkBufferSize,
+			now:       time.Now,
+		}
+	}
+}
+
+// WithGroups sets the multicast groups joined when streaming events, instead of GroupNew only.
+// For instance, WithGroups(GroupDestroy) creates a Consumer which is only notified of
+// connection teardowns, with its own rate limit and sampling.
+func WithGroups(groups ...uint32) ConsumerOption {
+	return func(c *Consumer) {
+		c.groups = append([]uint32(nil), groups...)
+	}
+}
+
+// WithMaxNamespacesPerDump caps the number of namespaces dumped by each DumpTable call, on top
+// of the root namespace which is always dumped. Namespaces are covered round-robin across calls,
+// which smooths the CPU usage of dumps on hosts with many namespaces, at the cost of staler
+// baselines for some of them. DumpStats reports the namespaces covered by the last dump.
+func WithMaxNamespacesPerDump(n int) ConsumerOption {
+	return func(c *Consumer) {
+		c.maxNamespacesPerDump = n
+	}
+}
+
+// WithDumpEOFRetries makes DumpTable retry the dump of a namespace up to n times when it's
+// interrupted by an EOF before the end of the multi-part reply, which happens spuriously on some
+// kernels, instead of returning a partial table. The entries received before the EOF are
+// emitted again by the retry. Streaming isn't affected.
+func WithDumpEOFRetries(n int) ConsumerOption {
+	return func(c *Consumer) {
+		c.dumpEOFRetries = n
+	}
+}
+
+// WithAutoListenAllNamespaces makes the Consumer listen to all namespaces when the kernel
+// supports it (4.2+), and fall back to dumping each namespace otherwise, instead of silently
+// streaming the events of the root namespace only. It's detected from the kernel version, then
+// from the result of setsockopt, when the streaming socket is initialized; Capabilities reports
+// the NamespaceMode in use. It overrides the listenAllNamespaces argument of NewConsumer.
+func WithAutoListenAllNamespaces() ConsumerOption {
+	return func(c *Consumer) {
+		c.listenAllNamespaces = true
+		c.autoListenAllNamespaces = true
+	}
+}
+
 // NewConsumer creates a new Conntrack event consumer.
-// targetRateLimit represents the maximum number of netlink messages per second that can be read off the socket
-func NewConsumer(procRoot string, targetRateLimit int, listenAllNamespaces bool) *Consumer {
+// targetRateLimit represents the maximum number of netlink messages per second that can be read off the socket.
+// Throttling is disabled when it's -1. A zero or negative targetRateLimit would stop all streaming,
+// so it's treated as -1 as well.
+func NewConsumer(procRoot string, targetRateLimit int, listenAllNamespaces bool, opts ...ConsumerOption) *Consumer {
+	if targetRateLimit <= 0 {
+		targetRateLimit = -1
+	}
+
 	c := &Consumer{
 		procRoot:            procRoot,
 		pool:                newBufferPool(),
 		targetRateLimit:     targetRateLimit,
-		breaker:             NewCircuitBreaker(int64(targetRateLimit)),
 		netlinkSeqNumber:    1,
 		listenAllNamespaces: listenAllNamespaces,
+		groups:              []uint32{netlinkCtNew},
+		bootID:              readBootID(procRoot),
+		firstEvent:          newFirstEvent(),
+		samplerCheck:        newSamplerCheck(),
+	}
+	c.dumpNS = c.dumpTable
+	c.listNamespaces = func() ([]netns.NsHandle, error) { return GetNetNamespaces(c.procRoot) }
+	c.enumerationRetryDelay = enumerationRetryDelay
+	c.tableSize = c.namespaceTableSize
+	c.namespaceStats = c.readNamespaceStats
+	c.nsThreads = newNSThreadLimiter(0)
+	c.openShadowSocket = c.newShadowSocket
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.limiter == nil {
+		c.breaker = NewCircuitBreaker(int64(c.targetRateLimit))
+		c.limiter = c.breaker
+	}
+	if c.tableMonitor != nil {
+		go c.monitorTableUtilization()
 	}
 
 	return c
 }
 
 // Events returns a channel of Event objects (wrapping netlink messages) which receives
-// all new connections added to the Conntrack table.
+// all new connections added to the Conntrack table, or the events of the groups set with WithGroups.
 func (c *Consumer) Events() (<-chan Event, error) {
-	if err := c.initNetlinkSocket(1.0); err != nil {
+	if err := c.initNetlinkSocket(c.startSamplingRate()); err != nil {
 		return nil, fmt.Errorf("could not initialize conntrack netlink socket: %w", err)
 	}
 
+	c.setStreaming(true)
+	if err := c.joinGroups(c.conn); err != nil {
+		c.conn.Close()
+		c.conn = nil
+		return nil, err
+	}
+
 	output := make(chan Event, outputBuffer)
 
-	go func() {
-		defer func() {
-			log.Println("exited conntrack netlink receive loop")
-			close(output)
+	// periodic dumps stop once the receive loop exits, before the output is closed
+	ctx, cancel := context.WithCancel(context.Background())
+	dumpsDone := make(chan struct{})
+	if c.periodicDump != nil {
+		go func() {
+			defer close(dumpsDone)
+			c.runPeriodicDumps(ctx, output)
 		}()
+	} else {
+		close(dumpsDone)
+	}
 
-		c.streaming = true
-		_ = c.conn.JoinGroup(netlinkCtNew)
-		c.receive(output)
-	}()
+	c.startReceive(output, func() {
+		// exiting on Stop or on the WithMaxEvents limit is expected, and isn't logged
+		stopped := atomic.LoadInt32(&c.stopped) == 1
+		limited := c.maxEvents > 0 && atomic.LoadInt64(&c.emittedEvents) >= c.maxEvents
+		if !stopped && !limited {
+			log.Println("conntrack netlink receive loop exited unexpectedly")
+		}
+		cancel()
+		<-dumpsDone
+		close(output)
+	})
 
 	return output, nil
 }
 
+// Validate checks that conntrack events can be collected, without streaming them: the streaming
+// socket is opened and configured, the BPF sampler is attached if throttling may require it,
+// and the multicast groups are joined, before the socket is closed again. It returns the
+// first error encountered, e.g. ErrConntrackModuleNotLoaded. It's meant for readiness checks,
+// and must be called before Events() or ReceiveNonBlocking().
+func (c *Consumer) Validate() error {
+	if c.isStreaming() {
+		return errors.New("conntrack consumer is already streaming events")
+	}
+
+	if err := c.initNetlinkSocket(1.0); err != nil {
+		return fmt.Errorf("could not initialize conntrack netlink socket: %w", err)
+	}
+	defer func() {
+		c.conn.Close()
+		c.conn = nil
+		c.socket = nil
+	}()
+
+	if c.targetRateLimit > 0 && !c.deterministicSampling && c.minSampledRate == 0 && !pre315Kernel {
+		sampler, err := GenerateBPFSampler(0.5)
+		if err != nil {
+			return err
+		}
+		if err := c.socket.SetBPF(sampler); err != nil {
+			return fmt.Errorf("failed to attach BPF filter: %w", err)
+		}
+	}
+
+	return c.joinGroups(c.conn)
+}
+
+// ReceiveNonBlocking reads all the netlink messages currently queued on the Consumer's socket
+// without blocking. It's an alternative to Events() for callers which own their event loop:
+// no goroutine is started, and the caller is responsible for polling the socket for readiness
+// (see SocketFD) and calling ReceiveNonBlocking once it's readable.
+// When no data is available, an error wrapping unix.EAGAIN is returned.
+// At most maxNonBlockingReads messages are read per call, so that a flood of events can't keep
+// it from returning: the socket is then still readable, and the next call returns the rest.
+// The events returned may be empty, with a nil error, when all the messages read were filtered.
+// Throttling is not applied, since re-creating the socket would invalidate the descriptor
+// returned by SocketFD. Events() and ReceiveNonBlocking must not be used on the same Consumer.
+func (c *Consumer) ReceiveNonBlocking() ([]Event, error) {
+	if err := c.subscribe(); err != nil {
+		return nil, err
+	}
+
+	var events []Event
+ReadLoop:
+	for reads := 0; reads < maxNonBlockingReads; reads++ {
+		buffer := c.pool.Get().(*[]byte)
+		msgs, netns, err := c.socket.TryReceiveInto(*buffer)
+		if err != nil {
+			c.pool.Put(buffer)
+			if errors.Is(err, unix.EAGAIN) {
+				if len(events) > 0 {
+					return events, nil
+				}
+				return nil, err
+			}
+
+			switch socketError(err) {
+			case errENOBUF:
+				atomic.AddInt64(&c.enobufs, 1)
+				continue
+			default:
+				atomic.AddInt64(&c.readErrors, 1)
+				return events, err
+			}
+		}
+
+		// Messages with error codes are simply skipped
+		for i := range msgs {
+			if err := checkMessage(&msgs[i]); err != nil {
+				atomic.AddInt64(&c.msgErrors, 1)
+				c.countMessageError(true)
+				c.pool.Put(buffer)
+				continue ReadLoop
+			}
+		}
+
+		if msgs = c.filterMessageTypes(msgs); len(msgs) == 0 {
+			c.pool.Put(buffer)
+			continue
+		}
+		c.familyCounters.countMessages(msgs)
+
+		if msgs = c.filterCIDRs(msgs); len(msgs) == 0 {
+			c.pool.Put(buffer)
+			continue
+		}
+
+		if c.recorder != nil {
+			c.recorder.record(msgs, netns)
+		}
+		c.recordStreamed(len(msgs))
+		c.firstEvent.signal()
+
+		events = append(events, c.eventFor(msgs, netns, buffer))
+	}
+	return events, nil
+}
+
+// SocketFD returns the file descriptor of the Consumer's netlink socket, which can be
+// registered with the caller's poller to know when ReceiveNonBlocking has data to return.
+// The socket is opened and subscribed to new connection events on the first call.
+func (c *Consumer) SocketFD() (int, error) {
+	if err := c.subscribe(); err != nil {
+		return -1, err
+	}
+	return c.socket.rawFD(), nil
+}
+
+// isStreaming reports whether the Consumer streams events, with Events() or ReceiveNonBlocking()
+func (c *Consumer) isStreaming() bool {
+	return atomic.LoadInt32(&c.streaming) == 1
+}
+
+func (c *Consumer) setStreaming(streaming bool) {
+	var v int32
+	if streaming {
+		v = 1
+	}
+	atomic.StoreInt32(&c.streaming, v)
+}
+
+// subscribe opens the streaming netlink socket used by ReceiveNonBlocking, unless already done
+func (c *Consumer) subscribe() error {
+	if c.isStreaming() && c.conn != nil {
+		return nil
+	}
+
+	if err := c.initNetlinkSocket(c.startSamplingRate()); err != nil {
+		return fmt.Errorf("could not initialize conntrack netlink socket: %w", err)
+	}
+	c.setStreaming(true)
+	return c.joinGroups(c.conn)
+}
+
+// groupJoiner is implemented by both netlink.Conn and Socket
+type groupJoiner interface {
+	JoinGroup(group uint32) error
+}
+
+// joinGroups subscribes the given socket to the configured multicast groups.
+// A group the socket is already a member of is skipped: when a Consumer is re-created right
+// after a crash, the kernel may briefly report the membership of the previous socket.
+func (c *Consumer) joinGroups(j groupJoiner) error {
+	for _, group := range c.groups {
+		if err := j.JoinGroup(group); err != nil {
+			if isAlreadyMember(err) {
+				log.Printf("already a member of conntrack multicast group %d: %s", group, err)
+				continue
+			}
+			return fmt.Errorf("could not join conntrack multicast group %d: %w", group, err)
+		}
+	}
+	return nil
+}
+
+// isAlreadyMember returns whether a JoinGroup error reports an existing membership
+func isAlreadyMember(err error) bool {
+	return errors.Is(err, unix.EADDRINUSE) || errors.Is(err, unix.EEXIST)
+}
+
 // isPeerNS determines whether the given network namespace is a peer
 // of the given netlink socket
 func (c *Consumer) isPeerNS(conn *netlink.Conn, ns netns.NsHandle) bool {
+	_, ok := c.namespaceID(conn, ns)
+	return ok
+}
+
+// namespaceID returns the nsid of the given network namespace in the namespace of the given
+// netlink socket, and whether it has one
+func (c *Consumer) namespaceID(conn *netlink.Conn, ns netns.NsHandle) (int32, bool) {
 	encoder := netlink.NewAttributeEncoder()
 	encoder.Uint32(unix.NETNSA_FD, uint32(ns))
 	data, err := encoder.Encode()
 	if err != nil {
 		log.Printf("isPeerNS: err encoding attributes netlink attributes: %s", err)
-		return false
+		return 0, false
 	}
 
-	msg := netlink.Message{
-		Header: netlink.Header{
-			Flags:    netlink.Request,
-			Type:     unix.RTM_GETNSID,
-			Sequence: c.netlinkSeqNumber,
-		},
-		Data: []byte{unix.AF_UNSPEC, 0, 0, 0},
+	msg := newGetNSIDRequest(c.netlinkSeqNumber, data)
+	if err := checkReadOnly(msg); err != nil {
+		log.Printf("isPeerNS: %s", err)
+		return 0, false
 	}
 
-	msg.Data = append(msg.Data, data...)
-
 	if msg, err = conn.Send(msg); err != nil {
 		log.Printf("isPeerNS: err sending netlink request: %s", err)
-		return false
+		return 0, false
 	}
 
 	msgs, err := conn.Receive()
 	if err != nil {
 		log.Printf("isPeerNS: error receiving netlink reply: %s", err)
-		return false
+		return 0, false
 	}
 
 	if msgs[0].Header.Type == netlink.Error {
-		return false
+		return 0, false
 	}
 
 	c.netlinkSeqNumber++
 
 	decoder, err := netlink.NewAttributeDecoder(msgs[0].Data)
 	if err != nil {
-		return false
+		if c.decodePolicy == DecodeStrict {
+			log.Printf("isPeerNS: error decoding netlink reply: %s", err)
+		}
+		return 0, false
 	}
 
 	for {
 		if decoder.Type() == unix.NETNSA_NSID {
-			return int32(decoder.Uint32()) >= 0
+			if c.decodePolicy == DecodeStrict && len(decoder.Bytes()) != 4 {
+				log.Printf("isPeerNS: %s: NETNSA_NSID has %d bytes", errShortAttribute, len(decoder.Bytes()))
+				return 0, false
+			}
+			nsid := int32(decoder.Uint32())
+			return nsid, nsid >= 0
 		}
 		if !decoder.Next() {
 			break
 		}
 	}
 
-	return false
+	if err := decoder.Err(); err != nil && c.decodePolicy == DecodeStrict {
+		log.Printf("isPeerNS: error decoding netlink reply: %s", err)
+	}
+	return 0, false
 }
 
 // DumpTable returns a channel of Event objects containing all entries
 // present in the Conntrack table. The channel is closed once all entries are read.
 // This method is meant to be used once during the process initialization of system-probe.
+// Only one dump can run at a time; ErrDumpInProgress is returned if the channel of a previous
+// call hasn't been closed yet.
 func (c *Consumer) DumpTable(family uint8) (<-chan Event, error) {
+	return c.DumpTableContext(context.Background(), family)
+}
+
+// DumpTableContext is like DumpTable, but the dump is aborted once ctx is done: the namespace
+// being dumped is interrupted, the remaining ones are skipped, and the channel is closed.
+func (c *Consumer) DumpTableContext(ctx context.Context, family uint8) (<-chan Event, error) {
+	if !atomic.CompareAndSwapInt32(&c.dumping, 0, 1) {
+		return nil, ErrDumpInProgress
+	}
+
 	var nss []netns.NsHandle
-	var err error
 	if c.listenAllNamespaces {
-		nss, err = GetNetNamespaces(c.procRoot)
-		if err != nil {
-			return nil, fmt.Errorf("error dumping conntrack table, could not get network namespaces: %w", err)
-		}
+		nss = c.listNamespacesWithRetry()
 	}
 
-	rootNS, err := GetRootNetNamespace(c.procRoot)
+	rootNS, err := c.rootNamespace()
 	if err != nil {
+		closeNamespaces(nss)
+		atomic.StoreInt32(&c.dumping, 0)
 		return nil, fmt.Errorf("error dumping conntrack table, could not get root namespace: %w", err)
 	}
 
 	conn, err := netlink.Dial(unix.AF_UNSPEC, &netlink.Config{NetNS: int(rootNS)})
 	if err != nil {
+		closeNamespaces(nss)
 		rootNS.Close()
+		atomic.StoreInt32(&c.dumping, 0)
 		return nil, fmt.Errorf("error dumping conntrack table, could not open netlink socket: %w", err)
 	}
 
@@ -245,188 +927,707 @@ func (c *Consumer) DumpTable(family uint8) (<-chan Event, error) {
 
 	go func() {
 		defer func() {
-			for _, ns := range nss {
-				_ = ns.Close()
-			}
+			closeNamespaces(nss)
 
 			close(output)
 
 			_ = rootNS.Close()
 			_ = conn.Close()
+			atomic.StoreInt32(&c.dumping, 0)
 		}()
 
-		// root ns first
-		if err := c.dumpTable(family, output, rootNS); err != nil {
-			log.Printf("error dumping conntrack table for root namespace, some NAT info may be missing: %s", err)
+		mapping := newNSIDMapping()
+		c.dumpNamespaces(ctx, family, output, rootNS, nss, func(ns netns.NsHandle) bool {
+			nsid, ok := c.namespaceID(conn, ns)
+			if ok {
+				c.checkNSID(mapping, nsid, ns)
+			}
+			return ok
+		})
+	}()
+
+	return output, nil
+}
+
+// dumpNamespaces dumps the table of the root namespace, followed by the tables of its peer namespaces
+func (c *Consumer) dumpNamespaces(ctx context.Context, family uint8, output chan Event, rootNS netns.NsHandle, nss []netns.NsHandle, isPeer func(netns.NsHandle) bool) {
+	ctx, abortErr, cancel := c.withMaxDumpDuration(ctx)
+	defer cancel()
+	c.dumpFamily = family
+	if c.dumpPacer != nil {
+		c.dumpPacer.reset()
+	}
+	stats := DumpStats{}
+	report := DumpReport{}
+	start := time.Now()
+	defer func() {
+		stats.Duration = time.Since(start)
+		c.dumpStatsMutex.Lock()
+		c.dumpStats = stats
+		c.dumpReport = report
+		c.dumpStatsMutex.Unlock()
+	}()
+
+	addReport := func(ns netns.NsHandle, outcome NamespaceDumpOutcome, entries int, err error) {
+		inode, _ := namespaceInode(ns)
+		report.Namespaces = append(report.Namespaces, NamespaceDumpReport{NSInode: inode, Outcome: outcome, Entries: entries, Err: err})
+	}
+
+	dumpNS := func(ns netns.NsHandle) error {
+		nsStart := time.Now()
+		c.dumpEntries = 0
+		err := c.dumpNS(ctx, family, output, ns)
+		inode, _ := namespaceInode(ns)
+		stats.Namespaces = append(stats.Namespaces, NamespaceDumpStats{NSInode: inode, Duration: time.Since(nsStart)})
+
+		switch {
+		case err == nil:
+			addReport(ns, NamespaceDumped, c.dumpEntries, nil)
+		case abortErr() == ErrMaxDumpDuration:
+			// the entries read until then are kept
+			report.Truncated = true
+			addReport(ns, NamespaceTruncated, c.dumpEntries, ErrMaxDumpDuration)
+			return nil
+		case errors.Is(err, ErrNamespaceGone):
+			// expected churn on dynamic hosts, the namespace was destroyed since it was listed
+			atomic.AddInt64(&c.staleNamespacesSkipped, 1)
+			addReport(ns, NamespaceGone, c.dumpEntries, err)
+		default:
+			addReport(ns, NamespaceFailed, c.dumpEntries, err)
 		}
+		return err
+	}
 
-		for _, ns := range nss {
-			if rootNS.Equal(ns) {
-				// we've already dumped the table for the root ns above
-				continue
+	// root ns first
+	if !c.includesNamespaceHandle(rootNS) {
+		addReport(rootNS, NamespaceExcluded, 0, nil)
+	} else if c.maxEventsReached() {
+		addReport(rootNS, NamespaceAborted, 0, ErrMaxEventsReached)
+	} else if err := dumpNS(rootNS); err != nil {
+		log.Printf("error dumping conntrack table for root namespace, some NAT info may be missing: %s", err)
+	}
+
+	candidates := make([]netns.NsHandle, 0, len(nss))
+	for _, ns := range nss {
+		// we've already dumped the table for the root ns above
+		if rootNS.Equal(ns) {
+			continue
+		}
+		if !c.includesNamespaceHandle(ns) {
+			addReport(ns, NamespaceExcluded, 0, nil)
+			continue
+		}
+		if !isPeer(ns) {
+			addReport(ns, NamespaceNotPeer, 0, nil)
+			continue
+		}
+		candidates = append(candidates, ns)
+	}
+	candidates, deferred := c.namespacesToDump(candidates)
+	stats.Deferred = len(deferred)
+	for _, ns := range deferred {
+		addReport(ns, NamespaceDeferred, 0, nil)
+	}
+
+	for i, ns := range candidates {
+		if err := abortErr(); err != nil {
+			log.Printf("conntrack table dump aborted: %s", err)
+			report.Truncated = err == ErrMaxDumpDuration
+			for _, ns := range candidates[i:] {
+				addReport(ns, NamespaceAborted, 0, err)
+			}
+			return
+		}
+		if c.maxEventsReached() {
+			for _, ns := range candidates[i:] {
+				addReport(ns, NamespaceAborted, 0, ErrMaxEventsReached)
 			}
+			return
+		}
 
-			if !c.isPeerNS(conn, ns) {
+		if c.skipEmptyNamespaces {
+			// The count is a racy snapshot: entries added right after the check are missed,
+			// which is acceptable as they'll be streamed anyway.
+			if n, err := c.tableSize(ns); err == nil && n == 0 {
+				addReport(ns, NamespaceEmpty, 0, nil)
 				continue
 			}
+		}
 
-			if err := c.dumpTable(family, output, ns); err != nil {
-				log.Printf("error dumping conntrack table for namespace %d: %s", ns, err)
+		if err := dumpNS(ns); err != nil {
+			if errors.Is(err, ErrNamespaceGone) {
+				// the namespace was deleted since we listed it, there's nothing to dump
+				continue
 			}
+			log.Printf("error dumping conntrack table for namespace %d: %s", ns, err)
 		}
-	}()
+	}
 
-	return output, nil
+	if c.dumpCompleteMarker && ctx.Err() == nil {
+		output <- Event{dumpComplete: true}
+	}
 }
 
-func (c *Consumer) dumpTable(family uint8, output chan Event, ns netns.NsHandle) error {
-	return WithNS(c.procRoot, ns, func() error {
+// namespacesToDump returns the namespaces to dump in this cycle, along with the namespaces
+// deferred to the next ones, according to maxNamespacesPerDump
+func (c *Consumer) namespacesToDump(nss []netns.NsHandle) (selected, deferred []netns.NsHandle) {
+	if c.maxNamespacesPerDump <= 0 || len(nss) <= c.maxNamespacesPerDump {
+		return nss, nil
+	}
 
-		sock, err := NewSocket()
-		if err != nil {
-			return fmt.Errorf("could not open netlink socket for net ns %d: %w", int(ns), err)
+	start := c.nsCursor % len(nss)
+	selected = make([]netns.NsHandle, 0, c.maxNamespacesPerDump)
+	deferred = make([]netns.NsHandle, 0, len(nss)-c.maxNamespacesPerDump)
+	for i := 0; i < len(nss); i++ {
+		ns := nss[(start+i)%len(nss)]
+		if i < c.maxNamespacesPerDump {
+			selected = append(selected, ns)
+		} else {
+			deferred = append(deferred, ns)
 		}
+	}
+	c.nsCursor = (start + c.maxNamespacesPerDump) % len(nss)
+	return selected, deferred
+}
 
-		conn := netlink.NewConn(sock, sock.pid)
+func closeNamespaces(nss []netns.NsHandle) {
+	for _, ns := range nss {
+		_ = ns.Close()
+	}
+}
 
-		defer func() {
-			_ = conn.Close()
-		}()
+// newDumpSocket returns a socket for dumping a conntrack table. The dump is the baseline of the
+// conntracker, so unlike the streaming socket it never has a BPF sampler attached, whatever
+// the current streaming sampling rate.
+func newDumpSocket() (*Socket, error) {
+	return NewSocket()
+}
 
-		req := netlink.Message{
-			Header: netlink.Header{
-				Type:  netlink.HeaderType((unix.NFNL_SUBSYS_CTNETLINK << 8) | ipctnlMsgCtGet),
-				Flags: netlink.Request | netlink.Dump,
-			},
-			Data: []byte{family, unix.NFNETLINK_V0, 0, 0},
-		}
+func (c *Consumer) dumpTable(ctx context.Context, family uint8, output chan Event, ns netns.NsHandle) error {
+	return c.withNSContext(ctx, ns, func(ctx context.Context) error {
+		return c.retryDumpOnEOF(ctx, func() error {
+			return c.dumpTableOnce(ctx, family, output, ns)
+		})
+	})
+}
 
-		verify, err := conn.Send(req)
-		if err != nil {
-			return fmt.Errorf("netlink dump error: %w", err)
+// retryDumpOnEOF runs dump again when it's interrupted by an EOF before the end of the
+// multi-part reply, up to dumpEOFRetries times (see WithDumpEOFRetries).
+func (c *Consumer) retryDumpOnEOF(ctx context.Context, dump func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := dump()
+		if !errors.Is(err, errDumpEOF) || attempt >= c.dumpEOFRetries || ctx.Err() != nil {
+			return err
 		}
+		log.Printf("conntrack table dump interrupted by EOF, retrying (%d/%d)", attempt+1, c.dumpEOFRetries)
+	}
+}
 
-		if err := netlink.Validate(req, []netlink.Message{verify}); err != nil {
-			return fmt.Errorf("netlink dump message validation error: %w", err)
-		}
+func (c *Consumer) dumpTableOnce(ctx context.Context, family uint8, output chan Event, ns netns.NsHandle) error {
+	sock, err := newDumpSocket()
+	if err != nil {
+		return fmt.Errorf("could not open netlink socket for net ns %d: %w", int(ns), err)
+	}
 
-		c.socket = sock
-		c.receive(output)
-		return nil
-	})
+	conn := netlink.NewConn(sock, sock.pid)
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	req := newCtGetRequest(family, netlink.Request|netlink.Dump)
+
+	verify, err := conn.Send(req)
+	if err != nil {
+		return fmt.Errorf("netlink dump error: %w", checkModuleError(err))
+	}
+
+	if err := c.validateDumpRequest(req, verify); err != nil {
+		return err
+	}
+
+	// closing the socket interrupts the receive loop if ctx is done while it's blocked
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+
+	// the dump has its own socket and mode, since the streaming socket may be read concurrently
+	if err := c.receiveWith(ctx, output, receiveMode{socket: sock, dump: true}); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// validateDumpRequest checks that the dump request was sent as expected. Failures are counted,
+// since they usually point at kernel compatibility issues.
+func (c *Consumer) validateDumpRequest(req, sent netlink.Message) error {
+	if err := netlink.Validate(req, []netlink.Message{sent}); err != nil {
+		atomic.AddInt64(&c.dumpValidationFailures, 1)
+		return fmt.Errorf("netlink dump message validation error: %w", err)
+	}
+	return nil
+}
+
+// Stats is the telemetry associated to a Consumer, see Consumer.Stats
+type Stats struct {
+	Enobufs     int64
+	Throttles   int64
+	SamplingPct int64
+	ReadErrors  int64
+	MsgErrors   int64
+	// SamplerEffectiveness is the observed drop of the received rate after the last sampling
+	// rate change, as a percentage of the intended drop. It's 0 until a change was measured.
+	SamplerEffectiveness int64
+
+	RcvBufGrowths          int64
+	DumpValidationFailures int64
+	CIDRFiltered           int64
+	PeriodicDumps          int64
+	StaleNamespacesSkipped int64
+	NSIDCollisions         int64
+	UnexpectedMsgTypes     int64
+	EnumerationRetries     int64
+	LastDumpDurationMs     int64
+	// TableUtilization is the utilization of the conntrack table in percent,
+	// see WithTableUtilizationMonitor
+	TableUtilization int64
+	// NSThreads is the number of goroutines currently running in another network namespace,
+	// or waiting to enter it, see WithMaxNamespaceThreads
+	NSThreads int64
+	// EnobufsWhileChannelFull is the part of Enobufs received while the output channel was full
+	EnobufsWhileChannelFull int64
 }
 
-// GetStats returns telemetry associated to the Consumer
+// Map returns the stats keyed by their names in GetStats
+func (s Stats) Map() map[string]int64 {
+	return map[string]int64{
+		"enobufs":     s.Enobufs,
+		"throttles":   s.Throttles,
+		samplingPct:   s.SamplingPct,
+		"read_errors": s.ReadErrors,
+		"msg_errors":  s.MsgErrors,
+
+		"rcvbuf_growths":           s.RcvBufGrowths,
+		"dump_validation_failures": s.DumpValidationFailures,
+		"cidr_filtered":            s.CIDRFiltered,
+		"periodic_dumps":           s.PeriodicDumps,
+		"stale_namespaces_skipped": s.StaleNamespacesSkipped,
+		"nsid_collisions":          s.NSIDCollisions,
+		"unexpected_msg_type":      s.UnexpectedMsgTypes,
+		"enumeration_retries":      s.EnumerationRetries,
+		"last_dump_duration_ms":    s.LastDumpDurationMs,
+
+		"conntrack_table_utilization": s.TableUtilization,
+		"sampler_effectiveness":       s.SamplerEffectiveness,
+		"ns_threads":                  s.NSThreads,
+
+		"enobufs_while_channel_full": s.EnobufsWhileChannelFull,
+	}
+}
+
+// Stats returns telemetry associated to the Consumer
+func (c *Consumer) Stats() Stats {
+	return Stats{
+		Enobufs:     atomic.LoadInt64(&c.enobufs),
+		Throttles:   atomic.LoadInt64(&c.throttles),
+		SamplingPct: atomic.LoadInt64(&c.samplingPct),
+		ReadErrors:  atomic.LoadInt64(&c.readErrors),
+		MsgErrors:   atomic.LoadInt64(&c.msgErrors),
+
+		RcvBufGrowths:          atomic.LoadInt64(&c.rcvBufGrowths),
+		DumpValidationFailures: atomic.LoadInt64(&c.dumpValidationFailures),
+		CIDRFiltered:           atomic.LoadInt64(&c.cidrFiltered),
+		PeriodicDumps:          atomic.LoadInt64(&c.periodicDumps),
+		StaleNamespacesSkipped: atomic.LoadInt64(&c.staleNamespacesSkipped),
+		NSIDCollisions:         atomic.LoadInt64(&c.nsidCollisions),
+		UnexpectedMsgTypes:     atomic.LoadInt64(&c.unexpectedMsgTypes),
+		EnumerationRetries:     atomic.LoadInt64(&c.enumerationRetries),
+		LastDumpDurationMs:     c.DumpStats().Duration.Milliseconds(),
+		TableUtilization:       atomic.LoadInt64(&c.tableUtilization),
+
+		SamplerEffectiveness: atomic.LoadInt64(&c.samplerEffectiveness),
+		NSThreads:            c.nsThreads.current(),
+
+		EnobufsWhileChannelFull: atomic.LoadInt64(&c.enobufsWhileChannelFull),
+	}
+}
+
+// MergeStats aggregates the stats of several Consumers, e.g. one per multicast group: counters
+// are summed, the sampling percentage and the sampler effectiveness are averaged, and the longest
+// of the last dump durations and the highest table utilization and namespace threads are kept,
+// since Consumers may share their namespace thread limit. Nil Consumers are skipped.
+func MergeStats(consumers ...*Consumer) Stats {
+	var merged Stats
+	n := int64(0)
+	for _, c := range consumers {
+		if c == nil {
+			continue
+		}
+		s := c.Stats()
+		merged.Enobufs += s.Enobufs
+		merged.Throttles += s.Throttles
+		merged.SamplingPct += s.SamplingPct
+		merged.SamplerEffectiveness += s.SamplerEffectiveness
+		merged.ReadErrors += s.ReadErrors
+		merged.MsgErrors += s.MsgErrors
+		merged.RcvBufGrowths += s.RcvBufGrowths
+		merged.DumpValidationFailures += s.DumpValidationFailures
+		merged.CIDRFiltered += s.CIDRFiltered
+		merged.PeriodicDumps += s.PeriodicDumps
+		merged.StaleNamespacesSkipped += s.StaleNamespacesSkipped
+		merged.NSIDCollisions += s.NSIDCollisions
+		merged.UnexpectedMsgTypes += s.UnexpectedMsgTypes
+		merged.EnumerationRetries += s.EnumerationRetries
+		merged.EnobufsWhileChannelFull += s.EnobufsWhileChannelFull
+		if s.LastDumpDurationMs > merged.LastDumpDurationMs {
+			merged.LastDumpDurationMs = s.LastDumpDurationMs
+		}
+		if s.TableUtilization > merged.TableUtilization {
+			merged.TableUtilization = s.TableUtilization
+		}
+		if s.NSThreads > merged.NSThreads {
+			merged.NSThreads = s.NSThreads
+		}
+		n++
+	}
+	if n > 0 {
+		merged.SamplingPct /= n
+		merged.SamplerEffectiveness /= n
+	}
+	return merged
+}
+
+// GetStats is like Stats, keyed by stat names. Prefer Stats, whose fields are checked at compile time.
 func (c *Consumer) GetStats() map[string]int64 {
+	return c.Stats().Map()
+}
+
+// SnapshotAndReset is like GetStats, but the counters are reset as they're read, so each call
+// returns the increments since the previous one. Each counter is swapped atomically, so no
+// increment is lost or counted twice across calls. Gauges (sampling_pct, last_dump_duration_ms,
+// conntrack_table_utilization, sampler_effectiveness, ns_threads) are returned as is. Since counters are reset, mixing this with
+// GetStats gives inconsistent cumulative values: use one or the other.
+func (c *Consumer) SnapshotAndReset() map[string]int64 {
+	stats := c.gauges()
+	for name, counter := range c.counters() {
+		stats[name] = atomic.SwapInt64(counter, 0)
+	}
+	return stats
+}
+
+func (c *Consumer) counters() map[string]*int64 {
+	return map[string]*int64{
+		"enobufs":     &c.enobufs,
+		"throttles":   &c.throttles,
+		"read_errors": &c.readErrors,
+		"msg_errors":  &c.msgErrors,
+
+		"rcvbuf_growths":           &c.rcvBufGrowths,
+		"dump_validation_failures": &c.dumpValidationFailures,
+		"cidr_filtered":            &c.cidrFiltered,
+		"periodic_dumps":           &c.periodicDumps,
+		"stale_namespaces_skipped": &c.staleNamespacesSkipped,
+		"nsid_collisions":          &c.nsidCollisions,
+		"unexpected_msg_type":      &c.unexpectedMsgTypes,
+		"enumeration_retries":      &c.enumerationRetries,
+
+		"enobufs_while_channel_full": &c.enobufsWhileChannelFull,
+	}
+}
+
+func (c *Consumer) gauges() map[string]int64 {
 	return map[string]int64{
-		"enobufs":     atomic.LoadInt64(&c.enobufs),
-		"throttles":   atomic.LoadInt64(&c.throttles),
-		samplingPct:   atomic.LoadInt64(&c.samplingPct),
-		"read_errors": atomic.LoadInt64(&c.readErrors),
-		"msg_errors":  atomic.LoadInt64(&c.msgErrors),
+		samplingPct:             atomic.LoadInt64(&c.samplingPct),
+		"last_dump_duration_ms": c.DumpStats().Duration.Milliseconds(),
+
+		"conntrack_table_utilization": atomic.LoadInt64(&c.tableUtilization),
+		"sampler_effectiveness":       atomic.LoadInt64(&c.samplerEffectiveness),
+		"ns_threads":                  c.nsThreads.current(),
 	}
 }
 
-// Stop the consumer
+// DumpStats returns the timings of the last conntrack table dump
+func (c *Consumer) DumpStats() DumpStats {
+	c.dumpStatsMutex.Lock()
+	defer c.dumpStatsMutex.Unlock()
+	return c.dumpStats
+}
+
+// Stop the consumer. Calling it again is a no-op.
 func (c *Consumer) Stop() {
+	if !atomic.CompareAndSwapInt32(&c.stopped, 0, 1) {
+		return
+	}
 	if c.conn != nil {
 		c.conn.Close()
 	}
-	c.breaker.Stop()
+	c.epollMutex.Lock()
+	if c.epoll != nil {
+		c.epoll.close()
+	}
+	c.epollMutex.Unlock()
+	if c.tableMonitor != nil {
+		close(c.tableMonitor.done)
+	}
+	if c.breaker != nil {
+		c.breaker.Stop()
+	}
 }
 
 func (c *Consumer) initNetlinkSocket(samplingRate float64) error {
-	err := WithRootNS(c.procRoot, func() error {
-		var err error
-		c.socket, err = NewSocket()
-		return err
-	})
-
+	var err error
+	c.socket, err = newSocketIn(c.withRootNS)
 	if err != nil {
 		return err
 	}
 
 	c.conn = netlink.NewConn(c.socket, c.socket.pid)
+	c.configureSocket(c.socket)
 
-	// We use this as opposed to netlink.Conn.SetReadBuffer because you can only
-	// set a value higher than /proc/sys/net/core/rmem_default (which is around 200kb for most systems)
-	// if you use SO_RCVBUFFORCE with CAP_NET_ADMIN (https://linux.die.net/man/7/socket).
-	if err := c.socket.SetSockoptInt(syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, netlinkBufferSize); err != nil {
-		log.Printf("error setting rcv buffer size for netlink socket: %s", err)
+	// Attach BPF sampling filter if necessary
+	c.samplingRate = samplingRate
+	atomic.StoreInt64(&c.samplingPct, int64(samplingRate*100.0))
+	c.sampler = nil
+	c.setSamplerProgram(nil)
+	protocolSampling := len(c.protocolSamplingRates) > 0
+	if protocolSampling && pre315Kernel {
+		log.Printf("per protocol sampling requires kernel 3.15+, ignoring it")
+		protocolSampling = false
 	}
-
-	if size, err := c.socket.GetSockoptInt(syscall.SOL_SOCKET, syscall.SO_RCVBUF); err == nil {
-		log.Printf("rcv buffer size for netlink socket is %d bytes", size)
+	if c.samplingRate >= 1.0 && !protocolSampling {
+		return nil
 	}
 
-	if c.listenAllNamespaces {
-		if err := c.socket.SetSockoptInt(unix.SOL_NETLINK, unix.NETLINK_LISTEN_ALL_NSID, 1); err != nil {
-			log.Printf("error enabling listen for all namespaces on netlink socket: %s", err)
+	if c.samplingRate < 1.0 && (c.minSampledRate > 0 || c.deterministicSampling) {
+		c.sampler, err = c.newUserspaceSampler()
+		if err != nil {
+			atomic.StoreInt64(&c.samplingPct, 0)
+			return fmt.Errorf("failed to create sampler: %w", err)
 		}
-	}
-
-	// Attach BPF sampling filter if necessary
-	c.samplingRate = samplingRate
-	atomic.StoreInt64(&c.samplingPct, int64(samplingRate*100.0))
-	if c.samplingRate >= 1.0 {
 		return nil
 	}
 
-	log.Printf("attaching netlink BPF filter with sampling rate: %.2f", c.samplingRate)
-	sampler, _ := GenerateBPFSampler(c.samplingRate)
+	var sampler []bpf.RawInstruction
+	if protocolSampling {
+		log.Printf("attaching netlink BPF filter with sampling rate: %.2f, and per protocol rates: %v", c.samplingRate, c.protocolSamplingRates)
+		sampler, err = GenerateProtocolBPFSampler(c.samplingRate, c.protocolSamplingRates)
+		if err != nil {
+			atomic.StoreInt64(&c.samplingPct, 0)
+			return fmt.Errorf("failed to create sampler: %w", err)
+		}
+	} else {
+		log.Printf("attaching netlink BPF filter with sampling rate: %.2f", c.samplingRate)
+		sampler, _ = GenerateBPFSampler(c.samplingRate)
+	}
 	err = c.socket.SetBPF(sampler)
 	if err != nil {
 		atomic.StoreInt64(&c.samplingPct, 0)
 		return fmt.Errorf("failed to attach BPF filter: %w", err)
 	}
+	c.setSamplerProgram(sampler)
 
 	return nil
 }
 
+func (c *Consumer) setSamplerProgram(program []bpf.RawInstruction) {
+	c.capsMutex.Lock()
+	c.samplerProgram = program
+	c.capsMutex.Unlock()
+}
+
+// DumpSamplerProgram returns the instructions of the BPF sampler attached to the streaming
+// socket, so that operators can log or audit what runs in their kernel. It's nil when no BPF
+// sampler is attached, e.g. when not throttling or when sampling in userspace.
+func (c *Consumer) DumpSamplerProgram() []bpf.Instruction {
+	c.capsMutex.Lock()
+	program := c.samplerProgram
+	c.capsMutex.Unlock()
+	if program == nil {
+		return nil
+	}
+
+	// programs generated by GenerateBPFSampler are always valid, and unknown instructions are
+	// disassembled as bpf.RawInstruction anyway
+	instructions, _ := bpf.Disassemble(program)
+	return instructions
+}
+
+// newUserspaceSampler returns the sampler applied by the receive loop instead of the BPF sampler
+func (c *Consumer) newUserspaceSampler() (messageSampler, error) {
+	if c.minSampledRate > 0 {
+		log.Printf("sampling netlink messages with rate %.2f, keeping at least %d messages/s per namespace", c.samplingRate, c.minSampledRate)
+		return newMinRateSampler(c.samplingRate, c.minSampledRate)
+	}
+
+	log.Printf("sampling 1 in every %.0f netlink messages", math.Round(1/c.samplingRate))
+	return newOneInNSampler(c.samplingRate)
+}
+
+// socketOptions is the subset of Socket used to configure it
+type socketOptions interface {
+	SetSockoptInt(level, opt, value int) error
+	GetSockoptInt(level, opt int) (int, error)
+}
+
+// configureSocket sets the options of the streaming socket, and records which of them
+// the kernel actually supports
+func (c *Consumer) configureSocket(s socketOptions) {
+	caps := ConsumerCapabilities{
+		Sampling: !pre315Kernel,
+	}
+	if vers, err := HostVersion(); err == nil {
+		caps.KernelVersion = vers
+	}
+
+	// We use this as opposed to netlink.Conn.SetReadBuffer because you can only
+	// set a value higher than /proc/sys/net/core/rmem_default (which is around 200kb for most systems)
+	// if you use SO_RCVBUFFORCE with CAP_NET_ADMIN (https://linux.die.net/man/7/socket).
+	// keep the buffer grown after repeated ENOBUFS when the socket is re-created
+	bufferSize := netlinkBufferSize
+	if c.rcvBufGrowth != nil {
+		bufferSize = c.rcvBufGrowth.size
+	}
+	if err := s.SetSockoptInt(syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, bufferSize); err != nil {
+		log.Printf("error setting rcv buffer size for netlink socket: %s", err)
+	} else {
+		caps.RcvBufForce = true
+	}
+
+	if size, err := s.GetSockoptInt(syscall.SOL_SOCKET, syscall.SO_RCVBUF); err == nil {
+		log.Printf("rcv buffer size for netlink socket is %d bytes", size)
+		caps.RcvBufSize = size
+	}
+
+	caps.NamespaceMode = NamespaceModeRoot
+	if c.listenAllNamespaces {
+		caps.NamespaceMode = NamespaceModePerNamespace
+		if c.autoListenAllNamespaces && caps.KernelVersion != 0 && caps.KernelVersion < listenAllNSIDKernelVersion {
+			log.Printf("kernel %s doesn't support listening to all namespaces, falling back to dumping each namespace", caps.KernelVersion)
+		} else if err := s.SetSockoptInt(unix.SOL_NETLINK, unix.NETLINK_LISTEN_ALL_NSID, 1); err != nil {
+			if c.autoListenAllNamespaces {
+				log.Printf("listening to all namespaces isn't supported, falling back to dumping each namespace: %s", err)
+			} else {
+				log.Printf("error enabling listen for all namespaces on netlink socket: %s", err)
+			}
+		} else {
+			caps.ListenAllNamespaces = true
+			caps.NamespaceMode = NamespaceModeListenAll
+		}
+	}
+
+	c.capsMutex.Lock()
+	c.caps = caps
+	c.capsMutex.Unlock()
+}
+
+// Capabilities returns the kernel features detected when the streaming socket was last initialized.
+// It's the zero value until Events() or ReceiveNonBlocking() are called.
+func (c *Consumer) Capabilities() ConsumerCapabilities {
+	c.capsMutex.Lock()
+	defer c.capsMutex.Unlock()
+	return c.caps
+}
+
 // receive netlink messages and flushes them to the Event channel.
 // This method gets called in two different contexts:
 //
 // - During system-probe startup, when we're loading all entries from the Conntrack table.
 // In this case c.streaming attribute is false, and once we detect the end of the multi-part
 // message we stop calling socket.Receive() and close the output channel to signal upstream
-// consumers we're done.
+// consumers we're done. Only then does a Done message end the loop, see c.dumpMode.
 //
 // - When we're streaming new connection events from the netlink socket. In this case, `c.streaming`
 // attribute is true, and only when we detect an EOF we close the output channel.
 // It's also worth noting that in the event of an ENOBUF error, we'll re-create a new netlink socket,
 // and attach a BPF sampler to it, to lower the the read throughput and save CPU.
-func (c *Consumer) receive(output chan Event) {
-	atomic.StoreInt32(&c.recvLoopRunning, 1)
+//
+// The loop also exits once ctx is done, without waiting for output to be read, and before
+// reading new messages once the Consumer is stopped, see Shutdown.
+// errDumpEOF is returned when a dump is interrupted by an EOF before the end of the multi-part
+// message, unless ctx is done; nil is returned otherwise.
+func (c *Consumer) receive(ctx context.Context, output chan Event) error {
+	return c.receiveWith(ctx, output, receiveMode{streaming: c.isStreaming(), dump: c.dumpMode})
+}
+
+// receiveMode is what a receive loop reads, and how. It's fixed for the duration of the loop,
+// so that DumpTable can run while streaming without changing the state of the streaming loop.
+type receiveMode struct {
+	// socket is the socket of a dump. Streaming loops read c.socket instead, which throttling
+	// re-creates.
+	socket *Socket
+	// streaming is set when reading the streaming socket
+	streaming bool
+	// dump makes a multi-part Done message end the loop
+	dump bool
+}
+
+// receiveWith is the receive loop, see receive
+func (c *Consumer) receiveWith(ctx context.Context, output chan Event, mode receiveMode) error {
+	if mode.streaming {
+		atomic.StoreInt32(&c.recvLoopRunning, 1)
+	}
+	local := c.newLocalCounters()
 	defer func() {
-		atomic.StoreInt32(&c.recvLoopRunning, 0)
+		c.flushCounters(local)
+		if mode.streaming {
+			atomic.StoreInt32(&c.recvLoopRunning, 0)
+		}
 	}()
 
 ReadLoop:
 	for {
+		// no new messages are read once stopped, see Shutdown
+		if atomic.LoadInt32(&c.stopped) == 1 {
+			return nil
+		}
+
 		buffer := c.pool.Get().(*[]byte)
-		msgs, netns, err := c.socket.ReceiveInto(*buffer)
+		msgs, netns, err := c.readMessages(*buffer, mode.socket)
 
+		// Socket.ReceiveInto returns no message along with an error, but custom readers (see
+		// readFn) may, e.g. ENOBUFS with the messages queued before the overrun. This guards
+		// them: the error is accounted for, and the messages are processed like those of any
+		// other read.
 		if err != nil {
 			switch socketError(err) {
 			case errEOF:
-				// EOFs are usually indicative of normal program termination, so we simply exit
-				return
+				// EOFs are usually indicative of normal program termination, so we simply exit.
+				// During a dump, they may also be spurious, see WithDumpEOFRetries.
+				c.pool.Put(buffer)
+				if !mode.streaming && ctx.Err() == nil {
+					return errDumpEOF
+				}
+				return nil
 			case errENOBUF:
+				// messages were dropped by the kernel: grow the buffer rather than re-creating the
+				// socket, which is left to the circuit breaker
 				atomic.AddInt64(&c.enobufs, 1)
+				c.countENOBUFSBackpressure(output)
+				if mode.streaming && c.socket != nil {
+					c.growRcvBuf(c.socket)
+				}
 			default:
 				atomic.AddInt64(&c.readErrors, 1)
 			}
+
+			if len(msgs) == 0 {
+				c.pool.Put(buffer)
+				continue
+			}
 		}
 
-		if err := c.throttle(len(msgs)); err != nil {
-			log.Printf("exiting conntrack netlink consumer loop due to throttling error: %s", err)
-			return
+		// We don't throttle dumps
+		if mode.streaming {
+			if err := c.throttle(c.rateLimitUnits(msgs)); err != nil {
+				log.Printf("exiting conntrack netlink consumer loop due to throttling error: %s", err)
+				return nil
+			}
 		}
 
 		// Messages with error codes are simply skipped
-		for _, m := range msgs {
-			if err := checkMessage(m); err != nil {
+		for i := range msgs {
+			if err := checkMessage(&msgs[i]); err != nil {
 				atomic.AddInt64(&c.msgErrors, 1)
+				c.countMessageError(mode.streaming)
 				continue ReadLoop
 			}
 		}
@@ -436,63 +1637,224 @@ ReadLoop:
 		if multiPartDone {
 			msgs = msgs[:len(msgs)-1]
 		}
+		if msgs = c.filterMessageTypes(msgs); len(msgs) == 0 && !multiPartDone {
+			c.pool.Put(buffer)
+			continue
+		}
+		c.countMessages(local, msgs)
 
-		output <- c.eventFor(msgs, netns, buffer)
+		if c.cidrFilter != nil && len(msgs) > 0 {
+			if msgs = c.filterCIDRs(msgs); len(msgs) == 0 && !multiPartDone {
+				c.pool.Put(buffer)
+				continue
+			}
+		}
+
+		if c.sampler != nil && mode.streaming {
+			if msgs = c.sampler.filter(msgs, netns); len(msgs) == 0 {
+				c.pool.Put(buffer)
+				continue
+			}
+		}
+
+		msgs, limitReached := c.limitEvents(msgs, mode.streaming)
+		if limitReached && len(msgs) == 0 {
+			c.pool.Put(buffer)
+			return nil
+		}
+
+		if c.recorder != nil && mode.streaming {
+			c.recorder.record(msgs, netns)
+		}
+		if mode.streaming {
+			c.recordStreamed(len(msgs))
+			c.firstEvent.signal()
+		}
+
+		if !mode.streaming {
+			c.dumpEntries += len(msgs)
+		}
+
+		select {
+		case output <- c.eventFor(msgs, netns, buffer):
+		case <-ctx.Done():
+			c.pool.Put(buffer)
+			return nil
+		}
+
+		if limitReached {
+			log.Printf("exiting conntrack netlink receive loop after %d events", c.maxEvents)
+			return nil
+		}
 
 		// If we're doing a conntrack dump we terminate after reading the multi-part message
-		if multiPartDone && !c.streaming {
-			return
+		if multiPartDone && mode.dump {
+			return nil
+		}
+
+		if !mode.streaming && c.dumpPacer != nil {
+			if err := c.dumpPacer.wait(ctx, len(msgs)); err != nil {
+				return nil
+			}
 		}
 	}
 }
 
+// readMessages reads the next batch of messages off the given socket, or off the streaming
+// socket if it's nil, or from readFn when it's set
+func (c *Consumer) readMessages(b []byte, socket *Socket) ([]netlink.Message, int32, error) {
+	if c.readFn != nil {
+		return c.readFn(b)
+	}
+	if socket == nil {
+		socket = c.socket
+	}
+	return socket.ReceiveInto(b)
+}
+
+// closeOnDone closes the closer once ctx is done. The returned function must be called to
+// release the watching goroutine.
+func closeOnDone(ctx context.Context, closer io.Closer) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = closer.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
 func (c *Consumer) eventFor(msgs []netlink.Message, netns int32, buffer *[]byte) Event {
-	return Event{
+	e := Event{
 		msgs:   msgs,
 		netns:  netns,
 		buffer: buffer,
 		pool:   c.pool,
 	}
+	if c.bootIDOnEvents {
+		e.bootID = c.bootID
+	}
+	return e
 }
 
 // throttle ensures that the read throughput from the socket stays below
-// the configured maxMessagePerSecond
-func (c *Consumer) throttle(numMessages int) error {
+// the configured maxMessagePerSecond. n is the number of messages read, or their size
+// with WithByteRateLimit.
+func (c *Consumer) throttle(n int) error {
 	// We don't throttle the socket during initialization
 	// (when we dump the whole Conntrack table)
-	if !c.streaming {
+	if !c.isStreaming() {
 		return nil
 	}
 
-	c.breaker.Tick(numMessages)
-	if !c.breaker.IsOpen() {
-		return nil
+	c.limiter.Tick(n)
+	c.checkSampler(n)
+	if !c.limiter.IsOpen() {
+		return c.recoverSamplingRate(time.Now())
 	}
 	atomic.AddInt64(&c.throttles, 1)
 
-	if pre315Kernel {
+	if atomic.LoadInt32(&c.samplingFrozen) == 1 {
+		// the rate is expected to be transient: keep the current sampling rate
+		c.limiter.Reset()
+		return nil
+	}
+	if pre315Kernel && !c.deterministicSampling {
 		log.Printf("conntrack sampling not supported on kernel versions < 3.15. Please adjust config.conntrack_rate_limit (currently set to %d) to accommodate higher conntrack update rate detected", c.targetRateLimit)
 		// Reset circuit breaker
-		c.breaker.Reset()
+		c.limiter.Reset()
 		return nil
 	}
+	// We calculate the required sampling rate to reach the target maxMessagesPersecond
+	return c.resample(c.nextSamplingRate())
+}
+
+// resample re-creates the streaming socket with the given sampling rate, and resets the limiter
+func (c *Consumer) resample(samplingRate float64) error {
 	// Close current socket
 	c.conn.Close()
 	c.conn = nil
 
 	// Create new socket with the desired sampling rate
-	// We calculate the required sampling rate to reach the target maxMessagesPersecond
-	samplingRate := (float64(c.targetRateLimit) / float64(c.breaker.Rate())) * c.samplingRate * overshootFactor
+	preRate, prevSamplingRate := c.limiter.Rate(), c.samplingRate
+	c.lastSamplingRecovery = time.Time{}
 	err := c.initNetlinkSocket(samplingRate)
 	if err != nil {
 		log.Printf("failed to re-create netlink socket. exiting conntrack: %s", err)
 		return err
 	}
+	c.samplerCheck.reset(preRate, prevSamplingRate, c.samplingRate)
 
 	// Reset circuit breaker
-	c.breaker.Reset()
-	// Re-subscribe netlinkCtNew messages
-	return c.conn.JoinGroup(netlinkCtNew)
+	c.limiter.Reset()
+	// Re-subscribe to the configured groups
+	return c.joinGroups(c.conn)
+}
+
+// rcvBufGrowth tracks the ENOBUFS errors of the streaming socket to decide when to grow its buffer
+type rcvBufGrowth struct {
+	threshold int
+	window    time.Duration
+	maxSize   int
+
+	// size is the current size of the receive buffer
+	size int
+	// count is the number of ENOBUFS errors since windowStart
+	count       int
+	windowStart time.Time
+	now         func() time.Time
+}
+
+// growRcvBuf records an ENOBUFS error, and grows the receive buffer of the socket if they
+// happened too often
+func (c *Consumer) growRcvBuf(s socketOptions) {
+	g := c.rcvBufGrowth
+	if g == nil || g.size >= g.maxSize {
+		return
+	}
+
+	now := g.now()
+	if now.Sub(g.windowStart) > g.window {
+		g.windowStart = now
+		g.count = 0
+	}
+	g.count++
+	if g.count < g.threshold {
+		return
+	}
+
+	size := g.size * 2
+	if size > g.maxSize {
+		size = g.maxSize
+	}
+	if err := s.SetSockoptInt(syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, size); err != nil {
+		log.Printf("error growing rcv buffer size for netlink socket to %d bytes: %s", size, err)
+		return
+	}
+
+	log.Printf("grew rcv buffer size for netlink socket to %d bytes after repeated ENOBUFS", size)
+	g.size = size
+	g.count = 0
+	atomic.AddInt64(&c.rcvBufGrowths, 1)
+}
+
+// nextSamplingRate returns the sampling rate required to reach the target maxMessagesPersecond,
+// bounded by the configured streaming sampling floor and by 1. The current sampling rate is kept
+// when it can't be computed, i.e. when a RateLimiter set with WithRateLimiter trips without a
+// target rate limit, or doesn't report its rate.
+func (c *Consumer) nextSamplingRate() float64 {
+	rate := c.limiter.Rate()
+	if c.targetRateLimit <= 0 || rate <= 0 {
+		return c.samplingRate
+	}
+
+	samplingRate := (float64(c.targetRateLimit) / float64(rate)) * c.samplingRate * overshootFactor
+	if samplingRate < c.samplingFloor {
+		return c.samplingFloor
+	}
+	return math.Min(samplingRate, 1)
 }
 
 func newBufferPool() *sync.Pool {
@@ -508,6 +1870,9 @@ func newBufferPool() *sync.Pool {
 var (
 	errEOF    = errors.New("EOF")
 	errENOBUF = errors.New("ENOBUF")
+
+	// errDumpEOF is returned by receive when a dump is interrupted before its end
+	errDumpEOF = errors.New("conntrack table dump interrupted by EOF")
 )
 
 // TODO: There is probably a more idiomatic way to do this
@@ -0,0 +1,77 @@
+//go:build linux && integration
+// +build linux,integration
+
+package internal
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/Kindling-project/kindling/collector/metadata/conntracker/internal/testutil"
+)
+
+// TestDumpTableIntegration opens a real netlink socket and dumps the conntrack table of
+// the running kernel. It must be run as root with `go test -tags integration`.
+func TestDumpTableIntegration(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("dumping the conntrack table requires root privileges")
+	}
+
+	defer testutil.TeardownDNAT(t)
+	testutil.SetupDNAT(t)
+
+	srv, err := net.Listen("tcp", "1.1.1.1:0")
+	require.NoError(t, err)
+	defer srv.Close()
+	go func() {
+		for {
+			conn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			// the conntrack entry outlives the connection, so there's no need to keep it open
+			conn.Close()
+		}
+	}()
+
+	port := uint16(srv.Addr().(*net.TCPAddr).Port)
+	var localPorts []uint16
+	for i := 0; i < 2; i++ {
+		conn, err := net.DialTCP("tcp", nil, &net.TCPAddr{IP: net.ParseIP("2.2.2.2"), Port: int(port)})
+		require.NoError(t, err)
+		defer conn.Close()
+		localPorts = append(localPorts, uint16(conn.LocalAddr().(*net.TCPAddr).Port))
+	}
+
+	consumer := NewConsumer("/proc", -1, false)
+	defer consumer.Stop()
+
+	events, err := consumer.DumpTable(unix.AF_INET)
+	require.NoError(t, err)
+
+	decoder := NewDecoder()
+	found := make(map[uint16]Con)
+	for e := range events {
+		for _, c := range decoder.DecodeAndReleaseEvent(e) {
+			if c.Origin.Proto == nil || c.Origin.Proto.DstPort == nil || *c.Origin.Proto.DstPort != port {
+				continue
+			}
+			found[*c.Origin.Proto.SrcPort] = c
+		}
+	}
+
+	for _, localPort := range localPorts {
+		c, ok := found[localPort]
+		require.True(t, ok, "connection from local port %d not found in conntrack dump", localPort)
+		require.True(t, net.ParseIP("2.2.2.2").Equal(*c.Origin.Dst))
+		require.True(t, net.ParseIP("1.1.1.1").Equal(*c.Reply.Src))
+		require.Equal(t, port, *c.Reply.Proto.SrcPort)
+		require.Equal(t, localPort, *c.Reply.Proto.DstPort)
+		require.Equal(t, uint8(unix.IPPROTO_TCP), *c.Origin.Proto.Number)
+		require.True(t, IsNAT(c))
+	}
+}
@@ -0,0 +1,1167 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netns"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+func TestDumpTableInProgress(t *testing.T) {
+	c := NewConsumer(t.TempDir(), -1, false)
+	defer c.Stop()
+
+	// Simulate a dump that is still running
+	atomic.StoreInt32(&c.dumping, 1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.DumpTable(unix.AF_INET)
+			assert.ErrorIs(t, err, ErrDumpInProgress)
+		}()
+	}
+	wg.Wait()
+
+	// Once the previous dump is done the guard is acquired again, and released
+	// on failure (there is no root namespace under the temporary procRoot)
+	atomic.StoreInt32(&c.dumping, 0)
+	_, err := c.DumpTable(unix.AF_INET)
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrDumpInProgress)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&c.dumping))
+}
+
+func TestDumpTableWhileStreaming(t *testing.T) {
+	c := NewConsumer(newFakeProcRoot(t, ""), -1, false)
+	events, err := c.Events()
+	if err != nil {
+		c.Stop()
+		t.Skipf("could not initialize conntrack netlink socket: %s", err)
+	}
+	streamingSocket := c.socket
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&c.recvLoopRunning) == 1
+	}, time.Second, time.Millisecond)
+
+	// the actual table is dumped once released, while the streaming loop is running
+	release := make(chan struct{})
+	dumpNS := c.dumpNS
+	c.dumpNS = func(ctx context.Context, family uint8, output chan Event, ns netns.NsHandle) error {
+		<-release
+		return dumpNS(ctx, family, output, ns)
+	}
+	dump, err := c.DumpTable(unix.AF_INET)
+	require.NoError(t, err)
+
+	_, err = c.DumpTable(unix.AF_INET)
+	assert.ErrorIs(t, err, ErrDumpInProgress)
+
+	close(release)
+	for range dump {
+	}
+	assert.Same(t, streamingSocket, c.socket)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&c.recvLoopRunning))
+
+	// the guard is released once the dump is done
+	dump, err = c.DumpTable(unix.AF_INET)
+	require.NoError(t, err)
+	for range dump {
+	}
+
+	c.Stop()
+	for range events {
+	}
+	assert.Same(t, streamingSocket, c.socket)
+}
+
+func TestReceiveNonBlocking(t *testing.T) {
+	sockets, sender := newUnicastSockets(t, 1)
+	defer unix.Close(sender)
+	defer closeSockets(sockets)
+
+	s := sockets[0]
+	c := &Consumer{
+		pool:      newBufferPool(),
+		socket:    s,
+		conn:      netlink.NewConn(s, s.pid),
+		streaming: 1,
+	}
+
+	fd, err := c.SocketFD()
+	require.NoError(t, err)
+	assert.Equal(t, s.rawFD(), fd)
+
+	_, err = c.ReceiveNonBlocking()
+	assert.ErrorIs(t, err, unix.EAGAIN)
+
+	sendTestMessage(t, sender, s)
+	sendTestMessage(t, sender, s)
+
+	events, err := c.ReceiveNonBlocking()
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	for _, e := range events {
+		assert.Len(t, e.Messages(), 1)
+		e.Done()
+	}
+
+	_, err = c.ReceiveNonBlocking()
+	assert.ErrorIs(t, err, unix.EAGAIN)
+}
+
+func TestReceiveNonBlockingMaxReads(t *testing.T) {
+	sockets, sender := newUnicastSockets(t, 1)
+	defer unix.Close(sender)
+	defer closeSockets(sockets)
+
+	defer func(n int) { maxNonBlockingReads = n }(maxNonBlockingReads)
+	maxNonBlockingReads = 2
+
+	s := sockets[0]
+	c := &Consumer{
+		pool:      newBufferPool(),
+		socket:    s,
+		conn:      netlink.NewConn(s, s.pid),
+		streaming: 1,
+	}
+
+	for i := 0; i < 3; i++ {
+		sendTestMessage(t, sender, s)
+	}
+
+	// the socket stays readable, and the next call returns the remaining message
+	for _, expected := range []int{2, 1} {
+		events, err := c.ReceiveNonBlocking()
+		require.NoError(t, err)
+		require.Len(t, events, expected)
+		for _, e := range events {
+			e.Done()
+		}
+	}
+
+	_, err := c.ReceiveNonBlocking()
+	assert.ErrorIs(t, err, unix.EAGAIN)
+}
+
+func TestDumpCompleteMarker(t *testing.T) {
+	c := &Consumer{pool: newBufferPool()}
+	WithDumpCompleteMarker()(c)
+
+	rootNS, peerNS, otherNS := netns.NsHandle(-2), netns.NsHandle(-3), netns.NsHandle(-4)
+	var dumped []netns.NsHandle
+	c.dumpNS = func(ctx context.Context, family uint8, output chan Event, ns netns.NsHandle) error {
+		dumped = append(dumped, ns)
+		for i := 0; i < 2; i++ {
+			output <- Event{msgs: []netlink.Message{{}}, netns: int32(ns)}
+		}
+		return nil
+	}
+
+	output := make(chan Event, outputBuffer)
+	c.dumpNamespaces(context.Background(), unix.AF_INET, output, rootNS, []netns.NsHandle{rootNS, peerNS, otherNS}, func(ns netns.NsHandle) bool {
+		return ns != otherNS
+	})
+	close(output)
+
+	var events []Event
+	for e := range output {
+		events = append(events, e)
+	}
+
+	assert.Equal(t, []netns.NsHandle{rootNS, peerNS}, dumped)
+	require.Len(t, events, 5)
+	for _, e := range events[:4] {
+		assert.False(t, e.IsDumpComplete())
+		assert.Len(t, e.Messages(), 1)
+	}
+	assert.True(t, events[4].IsDumpComplete())
+	assert.Empty(t, events[4].Messages())
+	events[4].Done()
+
+	// No marker is emitted unless requested
+	c.dumpCompleteMarker = false
+	output = make(chan Event, outputBuffer)
+	c.dumpNamespaces(context.Background(), unix.AF_INET, output, rootNS, nil, func(netns.NsHandle) bool { return true })
+	close(output)
+	for e := range output {
+		assert.False(t, e.IsDumpComplete())
+	}
+}
+
+type fakeSocketOptions struct {
+	errs    map[int]error
+	rcvBuf  int
+	setOpts []int
+	values  map[int]int
+}
+
+func (f *fakeSocketOptions) SetSockoptInt(level, opt, value int) error {
+	f.setOpts = append(f.setOpts, opt)
+	if f.values == nil {
+		f.values = make(map[int]int)
+	}
+	f.values[opt] = value
+	return f.errs[opt]
+}
+
+func (f *fakeSocketOptions) GetSockoptInt(level, opt int) (int, error) {
+	return f.rcvBuf, nil
+}
+
+func TestCapabilities(t *testing.T) {
+	prevPre315Kernel, prevHostVersion := pre315Kernel, hostVersion
+	defer func() {
+		pre315Kernel, hostVersion = prevPre315Kernel, prevHostVersion
+	}()
+
+	pre315Kernel, hostVersion = false, VersionCode(5, 4, 0)
+	c := &Consumer{listenAllNamespaces: true}
+	assert.Equal(t, ConsumerCapabilities{}, c.Capabilities())
+
+	c.configureSocket(&fakeSocketOptions{rcvBuf: netlinkBufferSize * 2})
+	assert.Equal(t, ConsumerCapabilities{
+		KernelVersion:       VersionCode(5, 4, 0),
+		Sampling:            true,
+		ListenAllNamespaces: true,
+		NamespaceMode:       NamespaceModeListenAll,
+		RcvBufForce:         true,
+		RcvBufSize:          netlinkBufferSize * 2,
+	}, c.Capabilities())
+
+	// An old kernel without CAP_NET_ADMIN nor NETLINK_LISTEN_ALL_NSID
+	pre315Kernel, hostVersion = true, VersionCode(3, 10, 0)
+	c.configureSocket(&fakeSocketOptions{
+		errs: map[int]error{
+			unix.SO_RCVBUFFORCE:          unix.EPERM,
+			unix.NETLINK_LISTEN_ALL_NSID: unix.ENOPROTOOPT,
+		},
+		rcvBuf: 212992,
+	})
+	assert.Equal(t, ConsumerCapabilities{
+		KernelVersion: VersionCode(3, 10, 0),
+		NamespaceMode: NamespaceModePerNamespace,
+		RcvBufSize:    212992,
+	}, c.Capabilities())
+
+	// NETLINK_LISTEN_ALL_NSID isn't requested unless listening to all namespaces
+	c.listenAllNamespaces = false
+	opts := &fakeSocketOptions{}
+	c.configureSocket(opts)
+	assert.Equal(t, []int{unix.SO_RCVBUFFORCE}, opts.setOpts)
+	assert.False(t, c.Capabilities().ListenAllNamespaces)
+	assert.Equal(t, NamespaceModeRoot, c.Capabilities().NamespaceMode)
+}
+
+func TestAutoListenAllNamespaces(t *testing.T) {
+	prevHostVersion := hostVersion
+	defer func() { hostVersion = prevHostVersion }()
+
+	hostVersion = VersionCode(5, 4, 0)
+	c := NewConsumer(t.TempDir(), -1, false, WithAutoListenAllNamespaces())
+	defer c.Stop()
+	assert.True(t, c.listenAllNamespaces)
+
+	c.configureSocket(&fakeSocketOptions{})
+	assert.True(t, c.Capabilities().ListenAllNamespaces)
+	assert.Equal(t, NamespaceModeListenAll, c.Capabilities().NamespaceMode)
+
+	// setsockopt fails although the kernel should support it: fall back to per-namespace dumps
+	c.configureSocket(&fakeSocketOptions{errs: map[int]error{unix.NETLINK_LISTEN_ALL_NSID: unix.ENOPROTOOPT}})
+	assert.False(t, c.Capabilities().ListenAllNamespaces)
+	assert.Equal(t, NamespaceModePerNamespace, c.Capabilities().NamespaceMode)
+	assert.True(t, c.listenAllNamespaces, "every namespace should still be dumped")
+
+	// The option isn't even tried on kernels known not to support it
+	hostVersion = VersionCode(3, 10, 0)
+	opts := &fakeSocketOptions{}
+	c.configureSocket(opts)
+	assert.NotContains(t, opts.setOpts, unix.NETLINK_LISTEN_ALL_NSID)
+	assert.Equal(t, NamespaceModePerNamespace, c.Capabilities().NamespaceMode)
+}
+
+func TestDumpSocketIsNotSampled(t *testing.T) {
+	c := NewConsumer(t.TempDir(), 100, false)
+	defer c.Stop()
+	// The streaming socket is heavily sampled
+	c.samplingRate = 0.1
+
+	sock, err := newDumpSocket()
+	if err != nil {
+		t.Skipf("could not create netlink socket: %s", err)
+	}
+	defer sock.Close()
+
+	n, err := sock.filterLen()
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	// Sanity check that an attached sampler would be detected
+	sampler, err := GenerateBPFSampler(c.samplingRate)
+	require.NoError(t, err)
+	require.NoError(t, sock.SetBPF(sampler))
+	n, err = sock.filterLen()
+	require.NoError(t, err)
+	assert.Equal(t, len(sampler), n)
+}
+
+func TestDumpSamplerProgram(t *testing.T) {
+	c := NewConsumer(newFakeProcRoot(t, ""), 100, false)
+	defer c.Stop()
+	assert.Nil(t, c.DumpSamplerProgram())
+
+	if err := c.initNetlinkSocket(0.25); err != nil {
+		t.Skipf("could not create netlink socket: %s", err)
+	}
+
+	sampler, err := GenerateBPFSampler(0.25)
+	require.NoError(t, err)
+	program, err := bpf.Assemble(c.DumpSamplerProgram())
+	require.NoError(t, err)
+	assert.Equal(t, sampler, program)
+
+	// No sampler is attached once the sampling rate is back to 1
+	c.conn.Close()
+	require.NoError(t, c.initNetlinkSocket(1.0))
+	assert.Nil(t, c.DumpSamplerProgram())
+}
+
+func TestStreamingSamplingFloor(t *testing.T) {
+	c := NewConsumer(t.TempDir(), 100, false)
+	defer c.Stop()
+	c.samplingRate = 1.0
+	atomic.StoreInt64(&c.breaker.eventRate, 1000)
+	unbounded := c.nextSamplingRate()
+	assert.Less(t, unbounded, 0.5)
+
+	WithStreamingSamplingFloor(0.5)(c)
+	assert.Equal(t, 0.5, c.nextSamplingRate())
+
+	WithStreamingSamplingFloor(0.0001)(c)
+	assert.Equal(t, unbounded, c.nextSamplingRate())
+}
+
+func TestNextSamplingRateBounds(t *testing.T) {
+	c := NewConsumer(t.TempDir(), 100, false)
+	defer c.Stop()
+	c.samplingRate = 0.5
+
+	// a rate below the target doesn't sample less than everything
+	atomic.StoreInt64(&c.breaker.eventRate, 10)
+	assert.Equal(t, 1.0, c.nextSamplingRate())
+
+	// without a target rate limit, the current sampling rate is kept
+	atomic.StoreInt64(&c.breaker.eventRate, 1000)
+	c.targetRateLimit = -1
+	assert.Equal(t, 0.5, c.nextSamplingRate())
+
+	// and so it is when the limiter doesn't report its rate
+	c.targetRateLimit = 100
+	WithRateLimiter(&fakeRateLimiter{open: true})(c)
+	assert.Equal(t, 0.5, c.nextSamplingRate())
+}
+
+func TestReceiveCancelled(t *testing.T) {
+	sockets, sender := newUnicastSockets(t, 1)
+	defer unix.Close(sender)
+
+	s := sockets[0]
+	c := &Consumer{pool: newBufferPool(), socket: s}
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := closeOnDone(ctx, netlink.NewConn(s, s.pid))
+	defer stop()
+
+	output := make(chan Event)
+	done := make(chan struct{})
+	go func() {
+		c.receive(ctx, output)
+		close(done)
+	}()
+
+	sendTestMessage(t, sender, s)
+	e := <-output
+	e.Done()
+
+	// The receive loop is now blocked reading the socket
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("receive didn't return after the context was cancelled")
+	}
+}
+
+func TestReceiveCancelledWhileSending(t *testing.T) {
+	sockets, sender := newUnicastSockets(t, 1)
+	defer unix.Close(sender)
+	defer closeSockets(sockets)
+
+	c := &Consumer{pool: newBufferPool(), socket: sockets[0]}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Nobody reads the output
+	output := make(chan Event)
+	done := make(chan struct{})
+	go func() {
+		c.receive(ctx, output)
+		close(done)
+	}()
+
+	sendTestMessage(t, sender, sockets[0])
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("receive didn't return after the context was cancelled")
+	}
+}
+
+func TestDumpNamespacesCancelled(t *testing.T) {
+	c := NewConsumer(t.TempDir(), -1, false, WithDumpCompleteMarker())
+	defer c.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var dumped []netns.NsHandle
+	c.dumpNS = func(ctx context.Context, family uint8, output chan Event, ns netns.NsHandle) error {
+		dumped = append(dumped, ns)
+		// The root namespace dump gets cancelled halfway
+		cancel()
+		return ctx.Err()
+	}
+
+	output := make(chan Event, outputBuffer)
+	rootNS := netns.NsHandle(-2)
+	c.dumpNamespaces(ctx, unix.AF_INET, output, rootNS, []netns.NsHandle{netns.NsHandle(-3)}, func(netns.NsHandle) bool { return true })
+	close(output)
+
+	assert.Equal(t, []netns.NsHandle{rootNS}, dumped)
+	for e := range output {
+		assert.False(t, e.IsDumpComplete(), "no marker should be emitted for an aborted dump")
+	}
+}
+
+func TestWithNSContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := WithNSContext(ctx, "/proc", netns.None(), func(context.Context) error {
+		t.Fatal("function should not run once the context is done")
+		return nil
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestDumpStats(t *testing.T) {
+	c := NewConsumer(t.TempDir(), -1, false)
+	defer c.Stop()
+	assert.Zero(t, c.DumpStats().Duration)
+
+	delays := map[netns.NsHandle]time.Duration{
+		netns.NsHandle(-2): 30 * time.Millisecond,
+		netns.NsHandle(-3): 10 * time.Millisecond,
+	}
+	c.dumpNS = func(ctx context.Context, family uint8, output chan Event, ns netns.NsHandle) error {
+		time.Sleep(delays[ns])
+		return nil
+	}
+
+	c.dumpNamespaces(context.Background(), unix.AF_INET, make(chan Event, outputBuffer), netns.NsHandle(-2), []netns.NsHandle{netns.NsHandle(-3)}, func(netns.NsHandle) bool { return true })
+
+	stats := c.DumpStats()
+	require.Len(t, stats.Namespaces, 2)
+	assert.GreaterOrEqual(t, stats.Namespaces[0].Duration, 30*time.Millisecond)
+	assert.GreaterOrEqual(t, stats.Namespaces[1].Duration, 10*time.Millisecond)
+	assert.Less(t, stats.Namespaces[1].Duration, stats.Namespaces[0].Duration)
+	assert.GreaterOrEqual(t, stats.Duration, stats.Namespaces[0].Duration+stats.Namespaces[1].Duration)
+	assert.Less(t, stats.Duration, 5*time.Second)
+	assert.Equal(t, stats.Duration.Milliseconds(), c.GetStats()["last_dump_duration_ms"])
+}
+
+func TestRcvBufGrowth(t *testing.T) {
+	c := NewConsumer(t.TempDir(), -1, false, WithRcvBufGrowth(3, time.Second, netlinkBufferSize*5))
+	defer c.Stop()
+	now := time.Now()
+	c.rcvBufGrowth.now = func() time.Time { return now }
+
+	var sizes []int
+	opts := &fakeSocketOptions{}
+	enobufs := func(n int) {
+		for i := 0; i < n; i++ {
+			opts.setOpts = nil
+			c.growRcvBuf(opts)
+			if len(opts.setOpts) > 0 {
+				sizes = append(sizes, c.rcvBufGrowth.size)
+			}
+		}
+	}
+
+	// Errors spread over multiple windows don't grow the buffer
+	for i := 0; i < 3; i++ {
+		enobufs(2)
+		now = now.Add(2 * time.Second)
+	}
+	assert.Empty(t, sizes)
+
+	// Repeated errors grow the buffer up to the cap
+	enobufs(20)
+	assert.Equal(t, []int{netlinkBufferSize * 2, netlinkBufferSize * 4, netlinkBufferSize * 5}, sizes)
+	assert.Equal(t, int64(3), c.GetStats()["rcvbuf_growths"])
+
+	// Re-created sockets keep the grown buffer
+	opts = &fakeSocketOptions{}
+	c.configureSocket(opts)
+	assert.Equal(t, netlinkBufferSize*5, opts.values[unix.SO_RCVBUFFORCE])
+}
+
+func TestZeroTargetRateLimitDisablesThrottling(t *testing.T) {
+	for _, targetRateLimit := range []int{0, -1, -10} {
+		c := NewConsumer(t.TempDir(), targetRateLimit, false)
+		assert.Equal(t, -1, c.targetRateLimit)
+
+		c.breaker.Tick(1000000)
+		c.breaker.update(time.Now().Add(time.Second))
+		assert.False(t, c.breaker.IsOpen(), "breaker should never trip with targetRateLimit=%d", targetRateLimit)
+		c.Stop()
+	}
+}
+
+type fakeGroupJoiner struct {
+	joined []uint32
+	// errs are the errors returned when joining groups, by group
+	errs map[uint32]error
+}
+
+func (f *fakeGroupJoiner) JoinGroup(group uint32) error {
+	if err := f.errs[group]; err != nil {
+		return err
+	}
+	f.joined = append(f.joined, group)
+	return nil
+}
+
+func TestJoinGroups(t *testing.T) {
+	j := &fakeGroupJoiner{}
+	require.NoError(t, NewConsumer(t.TempDir(), -1, false).joinGroups(j))
+	assert.Equal(t, []uint32{GroupNew}, j.joined)
+
+	j = &fakeGroupJoiner{}
+	require.NoError(t, NewConsumer(t.TempDir(), -1, false, WithGroups(GroupDestroy)).joinGroups(j))
+	assert.Equal(t, []uint32{GroupDestroy}, j.joined)
+}
+
+func TestJoinGroupsAlreadyMember(t *testing.T) {
+	c := NewConsumer(t.TempDir(), -1, false, WithGroups(GroupNew, GroupUpdate, GroupDestroy))
+	defer c.Stop()
+
+	// The membership of a previous socket is still held by the kernel
+	j := &fakeGroupJoiner{errs: map[uint32]error{
+		GroupNew:    os.NewSyscallError("setsockopt", unix.EADDRINUSE),
+		GroupUpdate: os.NewSyscallError("setsockopt", unix.EEXIST),
+	}}
+	require.NoError(t, c.joinGroups(j))
+	assert.Equal(t, []uint32{GroupDestroy}, j.joined)
+
+	// Genuine failures are still returned
+	j = &fakeGroupJoiner{errs: map[uint32]error{GroupUpdate: os.NewSyscallError("setsockopt", unix.EPERM)}}
+	err := c.joinGroups(j)
+	assert.ErrorIs(t, err, unix.EPERM)
+	assert.Equal(t, []uint32{GroupNew}, j.joined)
+}
+
+func TestEventsJoinsConfiguredGroups(t *testing.T) {
+	c := NewConsumer("/proc", 100, false, WithGroups(GroupDestroy))
+	events, err := c.Events()
+	if err != nil {
+		t.Skipf("could not subscribe to conntrack events: %s", err)
+	}
+	defer func() {
+		c.Stop()
+		for range events {
+		}
+	}()
+
+	// NETLINK_LIST_MEMBERSHIPS returns a bitmask of the joined groups, the first
+	// word of which covers all conntrack groups
+	memberships, err := c.socket.GetSockoptInt(unix.SOL_NETLINK, unix.NETLINK_LIST_MEMBERSHIPS)
+	require.NoError(t, err)
+	assert.Equal(t, 1<<(GroupDestroy-1), uint32(memberships))
+}
+
+func TestMaxNamespacesPerDump(t *testing.T) {
+	c := NewConsumer(t.TempDir(), -1, false, WithMaxNamespacesPerDump(3))
+	defer c.Stop()
+
+	rootNS := netns.NsHandle(-2)
+	var nss []netns.NsHandle
+	for i := 0; i < 8; i++ {
+		nss = append(nss, netns.NsHandle(-3-i))
+	}
+
+	var dumped []netns.NsHandle
+	c.dumpNS = func(ctx context.Context, family uint8, output chan Event, ns netns.NsHandle) error {
+		dumped = append(dumped, ns)
+		return nil
+	}
+
+	covered := make(map[netns.NsHandle]int)
+	for cycle := 0; cycle < 3; cycle++ {
+		dumped = nil
+		c.dumpNamespaces(context.Background(), unix.AF_INET, make(chan Event, outputBuffer), rootNS, nss, func(netns.NsHandle) bool { return true })
+
+		// The root namespace is dumped on every cycle, on top of the capped namespaces
+		require.Len(t, dumped, 4)
+		assert.Equal(t, rootNS, dumped[0])
+		for _, ns := range dumped[1:] {
+			covered[ns]++
+		}
+
+		stats := c.DumpStats()
+		assert.Len(t, stats.Namespaces, 4)
+		assert.Equal(t, 5, stats.Deferred)
+	}
+
+	// 3 cycles of 3 namespaces cover all 8 of them, wrapping around to the first one
+	assert.Len(t, covered, len(nss))
+	assert.Equal(t, 2, covered[nss[0]])
+	for _, ns := range nss[1:] {
+		assert.Equal(t, 1, covered[ns])
+	}
+}
+
+func TestReceiveDumpEOF(t *testing.T) {
+	sockets, sender := newUnicastSockets(t, 2)
+	defer unix.Close(sender)
+	defer closeSockets(sockets)
+
+	// The socket is closed in the middle of the dump
+	c := &Consumer{pool: newBufferPool(), socket: sockets[0]}
+	output := make(chan Event, outputBuffer)
+	done := make(chan error)
+	go func() {
+		done <- c.receive(context.Background(), output)
+	}()
+
+	sendTestMessage(t, sender, sockets[0])
+	e := <-output
+	e.Done()
+	require.NoError(t, sockets[0].Close())
+	assert.ErrorIs(t, <-done, errDumpEOF)
+
+	// The dump reaches the end of the multi-part message
+	c = &Consumer{pool: newBufferPool(), socket: sockets[1], dumpMode: true}
+	m := netlink.Message{
+		Header: netlink.Header{Length: 20, Type: netlink.Done, Flags: netlink.Multi},
+		Data:   []byte{0, 0, 0, 0},
+	}
+	b, err := m.MarshalBinary()
+	require.NoError(t, err)
+	require.NoError(t, unix.Sendto(sender, b, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Pid: sockets[1].pid}))
+	assert.NoError(t, c.receive(context.Background(), output))
+}
+
+func TestRetryDumpOnEOF(t *testing.T) {
+	table := []int{1, 2, 3}
+	// dump emits the entries of the table, and fails with an EOF after the first one
+	// for the given number of attempts
+	dump := func(output chan Event, eofs int) (func() error, *int) {
+		attempts := 0
+		return func() error {
+			attempts++
+			for i, entry := range table {
+				if attempts <= eofs && i == 1 {
+					return errDumpEOF
+				}
+				output <- Event{netns: int32(entry)}
+			}
+			return nil
+		}, &attempts
+	}
+	drain := func(output chan Event) []int {
+		var entries []int
+		for len(output) > 0 {
+			e := <-output
+			entries = append(entries, int(e.netns))
+		}
+		return entries
+	}
+
+	c := NewConsumer(t.TempDir(), -1, false, WithDumpEOFRetries(2))
+	defer c.Stop()
+
+	// A spurious EOF followed by a successful retry captures the whole table
+	output := make(chan Event, outputBuffer)
+	fn, attempts := dump(output, 1)
+	require.NoError(t, c.retryDumpOnEOF(context.Background(), fn))
+	assert.Equal(t, 2, *attempts)
+	assert.Equal(t, []int{1, 1, 2, 3}, drain(output))
+
+	// Retries are bounded
+	fn, attempts = dump(output, 10)
+	assert.ErrorIs(t, c.retryDumpOnEOF(context.Background(), fn), errDumpEOF)
+	assert.Equal(t, 3, *attempts)
+	drain(output)
+
+	// Without the option, the first EOF ends the dump
+	c = NewConsumer(t.TempDir(), -1, false)
+	defer c.Stop()
+	fn, attempts = dump(output, 1)
+	assert.ErrorIs(t, c.retryDumpOnEOF(context.Background(), fn), errDumpEOF)
+	assert.Equal(t, 1, *attempts)
+	assert.Equal(t, []int{1}, drain(output))
+}
+
+func TestDumpValidationFailures(t *testing.T) {
+	c := NewConsumer(t.TempDir(), -1, false)
+	defer c.Stop()
+
+	req := newCtGetRequest(unix.AF_INET, netlink.Request|netlink.Dump)
+	req.Header.Sequence = 10
+	req.Header.PID = 100
+
+	// The socket reports the request as sent
+	sent := req
+	require.NoError(t, c.validateDumpRequest(req, sent))
+	assert.Zero(t, c.GetStats()["dump_validation_failures"])
+
+	// The socket sent the request with another sequence number
+	sent.Header.Sequence = 11
+	assert.Error(t, c.validateDumpRequest(req, sent))
+	assert.Equal(t, int64(1), c.GetStats()["dump_validation_failures"])
+}
+
+func TestReceivePartialRead(t *testing.T) {
+	c := NewConsumer(t.TempDir(), -1, false, WithRcvBufGrowth(1, time.Second, netlinkBufferSize*2))
+	defer c.Stop()
+	c.setStreaming(true)
+
+	msg := netlink.Message{Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK << 8)}}
+	reads := []struct {
+		msgs []netlink.Message
+		err  error
+	}{
+		// Two messages were read before the overrun
+		{[]netlink.Message{msg, msg}, os.NewSyscallError("recvmsg", unix.ENOBUFS)},
+		// A failed read without messages doesn't produce an event
+		{nil, os.NewSyscallError("recvmsg", unix.EIO)},
+		{[]netlink.Message{msg}, nil},
+		// The error returned by reads of a closed socket
+		{nil, errors.New("read netlink: use of closed file")},
+	}
+	c.readFn = func(b []byte) ([]netlink.Message, int32, error) {
+		r := reads[0]
+		reads = reads[1:]
+		return r.msgs, 0, r.err
+	}
+
+	output := make(chan Event, outputBuffer)
+	require.NoError(t, c.receive(context.Background(), output))
+	close(output)
+
+	var sizes []int
+	for e := range output {
+		sizes = append(sizes, len(e.Messages()))
+		e.Done()
+	}
+	assert.Equal(t, []int{2, 1}, sizes)
+
+	stats := c.GetStats()
+	assert.Equal(t, int64(1), stats["enobufs"])
+	assert.Equal(t, int64(1), stats["read_errors"])
+	// Without an actual socket, the receive buffer can't be grown
+	assert.Zero(t, stats["rcvbuf_growths"])
+}
+
+func TestReceiveStreamingIgnoresDone(t *testing.T) {
+	c := NewConsumer(t.TempDir(), -1, false)
+	defer c.Stop()
+	c.setStreaming(true)
+
+	msg := netlink.Message{Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK << 8)}}
+	done := netlink.Message{Header: netlink.Header{Type: netlink.Done, Flags: netlink.Multi}, Data: []byte{0, 0, 0, 0}}
+	reads := [][]netlink.Message{
+		{msg},
+		// A stray Done message, e.g. from an interleaved dump response
+		{msg, done},
+		{msg, msg},
+	}
+	c.readFn = func(b []byte) ([]netlink.Message, int32, error) {
+		if len(reads) == 0 {
+			return nil, 0, errors.New("read netlink: use of closed file")
+		}
+		msgs := reads[0]
+		reads = reads[1:]
+		return msgs, 0, nil
+	}
+
+	output := make(chan Event, outputBuffer)
+	require.NoError(t, c.receive(context.Background(), output))
+	close(output)
+
+	var sizes []int
+	for e := range output {
+		sizes = append(sizes, len(e.Messages()))
+		e.Done()
+	}
+	// The loop only exited on EOF, after reading every batch
+	assert.Empty(t, reads)
+	assert.Equal(t, []int{1, 1, 2}, sizes)
+}
+
+func TestValidateSocketErrors(t *testing.T) {
+	prev := openSocket
+	t.Cleanup(func() { openSocket = prev })
+
+	c := NewConsumer(newFakeProcRoot(t, ""), 1000, false)
+	defer c.Stop()
+
+	openSocket = func(domain, typ, proto int) (int, error) {
+		return -1, unix.EPROTONOSUPPORT
+	}
+	err := c.Validate()
+	assert.ErrorIs(t, err, ErrConntrackModuleNotLoaded)
+	assert.Nil(t, c.conn)
+
+	openSocket = func(domain, typ, proto int) (int, error) {
+		return -1, unix.EMFILE
+	}
+	assert.ErrorIs(t, c.Validate(), unix.EMFILE)
+
+	c.setStreaming(true)
+	assert.Error(t, c.Validate())
+}
+
+func TestGetStatsByFamily(t *testing.T) {
+	c := NewConsumer(t.TempDir(), -1, false)
+	defer c.Stop()
+
+	message := func(family uint8) netlink.Message {
+		return netlink.Message{
+			Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK << 8)},
+			Data:   []byte{family, unix.NFNETLINK_V0, 0, 0},
+		}
+	}
+	errorMessage := netlink.Message{Header: netlink.Header{Type: netlink.Error}, Data: []byte{0xfe, 0xff, 0xff, 0xff}}
+
+	batches := [][]netlink.Message{
+		{message(unix.AF_INET), message(unix.AF_INET6), message(unix.AF_INET)},
+		{errorMessage},
+		{message(unix.AF_INET6)},
+	}
+	run := func() {
+		reads := append([][]netlink.Message(nil), batches...)
+		c.readFn = func(b []byte) ([]netlink.Message, int32, error) {
+			if len(reads) == 0 {
+				return nil, 0, errors.New("read netlink: use of closed file")
+			}
+			msgs := reads[0]
+			reads = reads[1:]
+			return msgs, 0, nil
+		}
+		output := make(chan Event, outputBuffer)
+		_ = c.receive(context.Background(), output)
+		close(output)
+		for e := range output {
+			e.Done()
+		}
+	}
+
+	// While streaming, errors can't be attributed to a family
+	c.setStreaming(true)
+	run()
+	stats := c.GetStatsByFamily()
+	assert.Equal(t, map[string]int64{"messages": 2, "msg_errors": 0}, stats["ipv4"])
+	assert.Equal(t, map[string]int64{"messages": 2, "msg_errors": 0}, stats["ipv6"])
+	assert.Equal(t, map[string]int64{"messages": 0, "msg_errors": 1}, stats["unspec"])
+
+	// During a dump, they're attributed to the dumped family
+	c.setStreaming(false)
+	c.dumpFamily = unix.AF_INET6
+	run()
+	stats = c.GetStatsByFamily()
+	assert.Equal(t, map[string]int64{"messages": 4, "msg_errors": 0}, stats["ipv4"])
+	assert.Equal(t, map[string]int64{"messages": 4, "msg_errors": 1}, stats["ipv6"])
+	assert.Equal(t, map[string]int64{"messages": 0, "msg_errors": 1}, stats["unspec"])
+}
+
+func TestSnapshotAndReset(t *testing.T) {
+	c := NewConsumer(t.TempDir(), -1, false)
+	defer c.Stop()
+	atomic.StoreInt64(&c.samplingPct, 100)
+
+	const writers, increments = 8, 10000
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				atomic.AddInt64(&c.enobufs, 1)
+				atomic.AddInt64(&c.msgErrors, 1)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	var enobufs, msgErrors int64
+	go func() {
+		defer close(done)
+		for {
+			stats := c.SnapshotAndReset()
+			enobufs += stats["enobufs"]
+			msgErrors += stats["msg_errors"]
+			assert.Equal(t, int64(100), stats[samplingPct])
+			if enobufs == writers*increments && msgErrors == writers*increments {
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("increments were lost")
+	}
+	assert.Equal(t, int64(writers*increments), enobufs)
+	assert.Equal(t, int64(writers*increments), msgErrors)
+
+	// Counters were reset, gauges weren't
+	stats := c.GetStats()
+	assert.Zero(t, stats["enobufs"])
+	assert.Zero(t, stats["msg_errors"])
+	assert.Equal(t, int64(100), stats[samplingPct])
+}
+
+func TestDumpReport(t *testing.T) {
+	rootNS, peerNS, otherNS, failingNS, goneNS, deferredNS := netns.NsHandle(-2), netns.NsHandle(-3), netns.NsHandle(-4), netns.NsHandle(-5), netns.NsHandle(-6), netns.NsHandle(-7)
+	c := NewConsumer(t.TempDir(), -1, false, WithMaxNamespacesPerDump(3))
+	defer c.Stop()
+	assert.Empty(t, c.DumpReport().Namespaces)
+
+	dumpErr := errors.New("dump failed")
+	c.dumpNS = func(ctx context.Context, family uint8, output chan Event, ns netns.NsHandle) error {
+		switch ns {
+		case failingNS:
+			c.dumpEntries = 2
+			return dumpErr
+		case goneNS:
+			return ErrNamespaceGone
+		case rootNS:
+			c.dumpEntries = 10
+		default:
+			c.dumpEntries = 5
+		}
+		return nil
+	}
+
+	nss := []netns.NsHandle{rootNS, peerNS, otherNS, failingNS, goneNS, deferredNS}
+	c.dumpNamespaces(context.Background(), unix.AF_INET, make(chan Event, outputBuffer), rootNS, nss, func(ns netns.NsHandle) bool {
+		return ns != otherNS
+	})
+
+	report := c.DumpReport()
+	var outcomes []NamespaceDumpOutcome
+	var entries []int
+	for _, ns := range report.Namespaces {
+		outcomes = append(outcomes, ns.Outcome)
+		entries = append(entries, ns.Entries)
+	}
+	assert.Equal(t, []NamespaceDumpOutcome{NamespaceDumped, NamespaceNotPeer, NamespaceDeferred, NamespaceDumped, NamespaceFailed, NamespaceGone}, outcomes)
+	assert.Equal(t, []int{10, 0, 0, 5, 2, 0}, entries)
+	assert.ErrorIs(t, report.Namespaces[4].Err, dumpErr)
+	assert.False(t, report.Complete())
+	assert.Equal(t, 2, report.Count(NamespaceDumped))
+	assert.Equal(t, 1, c.DumpStats().Deferred)
+
+	// Namespaces left when the dump is aborted are reported as such
+	ctx, cancel := context.WithCancel(context.Background())
+	c.dumpNS = func(context.Context, uint8, chan Event, netns.NsHandle) error {
+		cancel()
+		return nil
+	}
+	c.maxNamespacesPerDump = 0
+	c.dumpNamespaces(ctx, unix.AF_INET, make(chan Event, outputBuffer), rootNS, []netns.NsHandle{peerNS, deferredNS}, func(netns.NsHandle) bool { return true })
+	report = c.DumpReport()
+	assert.Equal(t, 2, report.Count(NamespaceAborted))
+	assert.False(t, report.Complete())
+}
+
+func TestInitNetlinkSocketRestoreFailure(t *testing.T) {
+	// A root namespace which differs from the current one, so that it's switched to
+	procRoot := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(procRoot, "1/ns"), 0o755))
+	require.NoError(t, os.Symlink("/proc/self/ns/uts", filepath.Join(procRoot, "1/ns/net")))
+
+	calls := 0
+	prev := setNS
+	t.Cleanup(func() { setNS = prev })
+	setNS = func(netns.NsHandle) error {
+		calls++
+		if calls > 1 {
+			return unix.EPERM
+		}
+		return nil
+	}
+
+	c := NewConsumer(procRoot, -1, false)
+	defer c.Stop()
+	errs := make(chan error)
+	go func() {
+		_, err := c.Events()
+		errs <- err
+	}()
+	assert.ErrorIs(t, <-errs, ErrNamespaceRestore)
+	assert.Nil(t, c.socket)
+	assert.Nil(t, c.conn)
+}
+
+func TestStatsMatchGetStats(t *testing.T) {
+	// Every field of Stats has its own key in the map
+	var stats Stats
+	v := reflect.ValueOf(&stats).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		v.Field(i).SetInt(int64(i + 1))
+	}
+	values := make(map[int64]string)
+	for name, value := range stats.Map() {
+		values[value] = name
+	}
+	assert.Len(t, values, v.NumField())
+
+	// ... and the map has the counters and gauges of the Consumer
+	c := NewConsumer(t.TempDir(), -1, false)
+	defer c.Stop()
+	i := int64(1)
+	for _, counter := range c.counters() {
+		atomic.StoreInt64(counter, i)
+		i++
+	}
+	atomic.StoreInt64(&c.samplingPct, i)
+	c.dumpStats.Duration = time.Duration(i+1) * time.Millisecond
+
+	stats = c.Stats()
+	assert.Equal(t, stats.Map(), c.GetStats())
+	assert.Len(t, c.GetStats(), len(c.counters())+len(c.gauges()))
+	for name, counter := range c.counters() {
+		assert.Equal(t, *counter, c.GetStats()[name], name)
+	}
+	for name, gauge := range c.gauges() {
+		assert.Equal(t, gauge, c.GetStats()[name], name)
+	}
+	assert.Equal(t, i, stats.SamplingPct)
+	assert.Equal(t, i+1, stats.LastDumpDurationMs)
+}
+
+func TestMergeStats(t *testing.T) {
+	a := NewConsumer(t.TempDir(), -1, false)
+	defer a.Stop()
+	a.enobufs, a.readErrors, a.cidrFiltered = 1, 2, 3
+	a.samplingPct = 100
+	a.dumpStats.Duration = 40 * time.Millisecond
+
+	b := NewConsumer(t.TempDir(), -1, false)
+	defer b.Stop()
+	b.enobufs, b.throttles, b.msgErrors, b.periodicDumps = 10, 20, 30, 4
+	b.samplingPct = 50
+	b.dumpStats.Duration = 25 * time.Millisecond
+
+	assert.Equal(t, Stats{
+		Enobufs:            11,
+		Throttles:          20,
+		SamplingPct:        75,
+		ReadErrors:         2,
+		MsgErrors:          30,
+		CIDRFiltered:       3,
+		PeriodicDumps:      4,
+		LastDumpDurationMs: 40,
+	}, MergeStats(a, nil, b))
+
+	assert.Equal(t, a.Stats(), MergeStats(a))
+	assert.Equal(t, Stats{}, MergeStats(nil))
+	assert.Equal(t, Stats{}, MergeStats())
+}
+
+func TestDumpSkipsStaleNamespace(t *testing.T) {
+	c := NewConsumer(t.TempDir(), -1, false)
+	defer c.Stop()
+
+	// The namespace is listed, but its handle is stale by the time it's dumped
+	rootNS, staleNS := netns.NsHandle(-2), netns.None()
+	calls := fakeSetNS(t, staleNS, unix.EBADF)
+	c.dumpNS = func(ctx context.Context, family uint8, output chan Event, ns netns.NsHandle) error {
+		if ns == rootNS {
+			return nil
+		}
+		return c.dumpTable(ctx, family, output, ns)
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	c.dumpNamespaces(context.Background(), unix.AF_INET, make(chan Event, outputBuffer), rootNS, []netns.NsHandle{staleNS}, func(netns.NsHandle) bool { return true })
+
+	// The stale handle isn't retried, and isn't reported as an error
+	assert.Equal(t, 1, *calls)
+	assert.Empty(t, logs.String())
+	assert.Equal(t, int64(1), c.Stats().StaleNamespacesSkipped)
+	report := c.DumpReport()
+	assert.Equal(t, 1, report.Count(NamespaceGone))
+	assert.True(t, report.Complete())
+}
+
+func TestEventsCleanStopIsQuiet(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	// run consumes the events of a Consumer until its receive loop exits on a closed socket,
+	// after stop is called
+	run := func(stop func(c *Consumer)) {
+		c := NewConsumer(newFakeProcRoot(t, ""), -1, false)
+		defer c.Stop()
+		closed := make(chan struct{})
+		c.readFn = func(b []byte) ([]netlink.Message, int32, error) {
+			<-closed
+			return nil, 0, errors.New("read netlink: use of closed file")
+		}
+
+		events, err := c.Events()
+		if err != nil {
+			t.Skipf("could not initialize conntrack netlink socket: %s", err)
+		}
+		stop(c)
+		close(closed)
+		for range events {
+		}
+	}
+
+	// A supervisor recycling its consumers
+	for i := 0; i < 5; i++ {
+		run(func(c *Consumer) { c.Stop() })
+	}
+	assert.NotContains(t, logs.String(), "receive loop exited")
+
+	// The socket is closed without Stop
+	run(func(*Consumer) {})
+	assert.Contains(t, logs.String(), "conntrack netlink receive loop exited unexpectedly")
+}
@@ -12,10 +12,16 @@ package internal
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"log"
 	"net"
+	"time"
 
 	ct "github.com/florianl/go-conntrack"
+	"github.com/hashicorp/go-multierror"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -24,6 +30,44 @@ const (
 	ctaTupleReply
 )
 
+const (
+	ctaStatus        = 3
+	ctaProtoInfo     = 4
+	ctaTimeout       = 7
+	ctaMark          = 8
+	ctaCountersOrig  = 9
+	ctaCountersReply = 10
+	ctaUse           = 11
+	ctaID            = 12
+	ctaTupleMaster   = 14
+	ctaSeqAdjOrig    = 15
+	ctaSeqAdjReply   = 16
+	ctaZone          = 18
+	ctaTimestamp     = 20
+	ctaLabels        = 22
+)
+
+const (
+	ctaTimestampStart = 1
+	ctaTimestampStop  = 2
+)
+
+const (
+	ctaCountersPackets = 1
+	ctaCountersBytes   = 2
+)
+
+const (
+	ctaProtoInfoTCP      = 1
+	ctaProtoInfoTCPState = 1
+)
+
+const (
+	ctaSeqAdjCorrectionPos = 1
+	ctaSeqAdjOffsetBefore  = 2
+	ctaSeqAdjOffsetAfter   = 3
+)
+
 const (
 	ctaTupleIP    = 1
 	ctaTupleProto = 2
@@ -38,49 +82,300 @@ const (
 )
 
 const (
-	ctaProtoNum     = 1
-	ctaProtoSrcPort = 2
-	ctaProtoDstPort = 3
+	ctaProtoNum        = 1
+	ctaProtoSrcPort    = 2
+	ctaProtoDstPort    = 3
+	ctaProtoIcmpID     = 4
+	ctaProtoIcmpType   = 5
+	ctaProtoIcmpCode   = 6
+	ctaProtoIcmpv6ID   = 7
+	ctaProtoIcmpv6Type = 8
+	ctaProtoIcmpv6Code = 9
 )
 
 // Con represents a conntrack entry, along with any network namespace info (nsid)
 type Con struct {
 	ct.Con
 	NetNS int32
+
+	// ID is the conntrack ID of the entry (CTA_ID), or zero when it wasn't reported.
+	// It shadows the pointer field of the embedded ct.Con.
+	ID uint32
+
+	// Use is the reference count of the entry (CTA_USE), or zero when it wasn't reported.
+	// It shadows the pointer field of the embedded ct.Con.
+	Use uint32
+
+	// Master is the tuple of the master connection (CTA_TUPLE_MASTER) of an expected
+	// connection spawned by a helper, e.g. the control channel of an FTP data channel.
+	// It's nil for connections without a master.
+	Master *ct.IPTuple
+
+	// Labels is the connlabel bitmask (CTA_LABELS) attached to the entry.
+	// It's nil when the kernel didn't report any label.
+	Labels []byte
+
+	// TimeoutAt is when the entry times out unless it's refreshed, i.e. the time it was decoded
+	// plus its remaining timeout (CTA_TIMEOUT, also set in Timeout). It's zero when the timeout
+	// wasn't reported.
+	TimeoutAt time.Time
+
+	// NATApplied is set on translated entries decoded in their pre-NAT form, whose actual reply
+	// tuple is PostNATReply, see Decoder.CanonicalizeNAT
+	NATApplied   bool
+	PostNATReply *ct.IPTuple
 }
 
 func (c Con) String() string {
+	if isICMPTuple(c.Origin) && isICMPTuple(c.Reply) {
+		return fmt.Sprintf("netns=%d src=%s dst=%s %s src=%s dst=%s %s proto=%d", c.NetNS, c.Origin.Src, c.Origin.Dst, formatICMP(c.Origin.Proto), c.Reply.Src, c.Reply.Dst, formatICMP(c.Reply.Proto), *c.Con.Origin.Proto.Number)
+	}
 	return fmt.Sprintf("netns=%d src=%s dst=%s sport=%d dport=%d src=%s dst=%s sport=%d dport=%d proto=%d", c.NetNS, c.Origin.Src, c.Origin.Dst, *c.Origin.Proto.SrcPort, *c.Origin.Proto.DstPort, c.Reply.Src, c.Reply.Dst, *c.Reply.Proto.SrcPort, *c.Reply.Proto.DstPort, *c.Con.Origin.Proto.Number)
 }
 
+// DecodePolicy defines how the Decoder handles malformed attributes
+type DecodePolicy int
+
+const (
+	// DecodeLenient skips attributes which are too short, and messages which can't be parsed
+	DecodeLenient DecodePolicy = iota
+	// DecodeStrict reports an error on any short attribute or unparsable message, which helps
+	// detecting kernels encoding attributes unexpectedly rather than silently mis-decoding them
+	DecodeStrict
+)
+
+// DecodeField is a set of attribute categories decoded by the Decoder, see Decoder.SetFields
+type DecodeField uint32
+
+const (
+	// DecodeTuples decodes the origin and reply tuples (CTA_TUPLE_ORIG, CTA_TUPLE_REPLY)
+	DecodeTuples DecodeField = 1 << iota
+	// DecodeMaster decodes the tuple of the master connection (CTA_TUPLE_MASTER)
+	DecodeMaster
+	// DecodeSeqAdj decodes the sequence number adjustments (CTA_SEQ_ADJ_ORIG, CTA_SEQ_ADJ_REPLY)
+	DecodeSeqAdj
+	// DecodeID decodes the conntrack ID (CTA_ID)
+	DecodeID
+	// DecodeStatus decodes the status bits (CTA_STATUS)
+	DecodeStatus
+	// DecodeUse decodes the reference count (CTA_USE)
+	DecodeUse
+	// DecodeZone decodes the conntrack zone (CTA_ZONE)
+	DecodeZone
+	// DecodeTimestamp decodes the start and stop times (CTA_TIMESTAMP)
+	DecodeTimestamp
+	// DecodeLabels decodes the connlabels (CTA_LABELS)
+	DecodeLabels
+	// DecodeCounters decodes the packet and byte counters (CTA_COUNTERS_ORIG, CTA_COUNTERS_REPLY)
+	DecodeCounters
+	// DecodeMark decodes the connmark (CTA_MARK)
+	DecodeMark
+	// DecodeProtoInfo decodes the state of TCP connections (CTA_PROTOINFO)
+	DecodeProtoInfo
+	// DecodeTimeout decodes the remaining timeout of the entry (CTA_TIMEOUT)
+	DecodeTimeout
+
+	// DecodeAllFields decodes every supported attribute, which is the default
+	DecodeAllFields DecodeField = 1<<iota - 1
+)
+
+// attributeFields maps the top-level conntrack attributes to their DecodeField
+var attributeFields = [...]DecodeField{
+	ctaTupleOrig:     DecodeTuples,
+	ctaTupleReply:    DecodeTuples,
+	ctaTupleMaster:   DecodeMaster,
+	ctaSeqAdjOrig:    DecodeSeqAdj,
+	ctaSeqAdjReply:   DecodeSeqAdj,
+	ctaID:            DecodeID,
+	ctaStatus:        DecodeStatus,
+	ctaProtoInfo:     DecodeProtoInfo,
+	ctaTimeout:       DecodeTimeout,
+	ctaMark:          DecodeMark,
+	ctaCountersOrig:  DecodeCounters,
+	ctaCountersReply: DecodeCounters,
+	ctaUse:           DecodeUse,
+	ctaZone:          DecodeZone,
+	ctaTimestamp:     DecodeTimestamp,
+	ctaLabels:        DecodeLabels,
+}
+
+// attributeField returns the DecodeField of the given top-level attribute, or 0 if it's not decoded
+func attributeField(typ uint16) DecodeField {
+	if int(typ) < len(attributeFields) {
+		return attributeFields[typ]
+	}
+	return 0
+}
+
+var (
+	errShortAttribute     = errors.New("netlink attribute is too short")
+	errMissingIPAttribute = errors.New("missing IP attribute")
+	errInvalidIPLength    = errors.New("invalid IP attribute length")
+)
+
 // Decoder is responsible for decoding netlink messages
 type Decoder struct {
 	scanner *AttributeScanner
+	policy  DecodePolicy
+	// family is the address family of the message being decoded, which determines the
+	// IP attributes of its tuples. With AF_UNSPEC, both IPv4 and IPv6 attributes are accepted.
+	family uint8
+	// zone, when set, drops every entry that doesn't belong to this conntrack zone
+	zone *uint16
+
+	// dedup, when set, drops entries already decoded within a short TTL
+	dedup *deduplicator
+
+	// fields are the attribute categories to decode, see SetFields
+	fields DecodeField
+
+	// logRemaining is the number of decoded entries still to be logged, see LogFirst
+	logRemaining int
+	logf         func(format string, args ...interface{})
+
+	// canonicalizeNAT emits the entries in their pre-NAT form, see CanonicalizeNAT
+	canonicalizeNAT bool
+
+	// tee, when set, writes the decoded entries as JSON, see TeeJSON
+	tee *jsonTee
 }
 
 // NewDecoder returns a new netlink message Decoder
 func NewDecoder() *Decoder {
 	return &Decoder{
 		scanner: NewAttributeScanner(),
+		fields:  DecodeAllFields,
+		logf:    log.Printf,
+	}
+}
+
+// SetFields restricts decoding to the given attribute categories, e.g. DecodeTuples when only the
+// 5-tuple is needed: the other attributes are skipped without being parsed, which saves CPU on
+// busy hosts, and the corresponding fields of the entries are left zero (nil tuples included).
+// The fields needed by FilterZone and Deduplicate are decoded whatever the mask.
+func (d *Decoder) SetFields(fields DecodeField) {
+	d.fields = fields
+}
+
+// decodedFields returns the attribute categories to decode, including the ones the filters need
+func (d *Decoder) decodedFields() DecodeField {
+	fields := d.fields
+	if d.zone != nil {
+		fields |= DecodeZone
+	}
+	if d.dedup != nil {
+		fields |= DecodeID | DecodeTuples
+	}
+	return fields
+}
+
+// SetPolicy sets how malformed attributes are handled. The default is DecodeLenient.
+func (d *Decoder) SetPolicy(policy DecodePolicy) {
+	d.policy = policy
+}
+
+// Deduplicate makes the decoder drop entries already decoded within the given TTL.
+// Entries are identified by their conntrack ID, or by their origin tuple when the ID is
+// not reported. At most size entries are remembered.
+func (d *Decoder) Deduplicate(size int, ttl time.Duration) error {
+	dedup, err := newDeduplicator(size, ttl)
+	if err != nil {
+		return err
 	}
+	d.dedup = dedup
+	return nil
+}
+
+// LogFirst makes the decoder log a summary of the first n decoded entries, and then go quiet.
+// It's meant to check that events look sane when onboarding a new host.
+func (d *Decoder) LogFirst(n int) {
+	d.logRemaining = n
+}
+
+// FilterZone makes the decoder drop every entry which is not part of the given conntrack zone.
+// Entries without CTA_ZONE belong to the default zone 0.
+// The zone attribute isn't at a fixed offset of the message, so this can't be done by the
+// BPF sampler and happens in userspace instead.
+func (d *Decoder) FilterZone(zone uint16) {
+	d.zone = &zone
 }
 
 // DecodeAndReleaseEvent decodes a single Event into a slice of []ct.Con objects and
 // releases the underlying buffer.
 // TODO: Replace the intermediate ct.Con object by the same format we use in the cache
 func (d *Decoder) DecodeAndReleaseEvent(e Event) []Con {
-	msgs := e.Messages()
-	conns := make([]Con, 0, len(msgs))
+	conns, _ := d.DecodeEvent(e)
+	return conns
+}
 
-	for _, msg := range msgs {
-		c := &Con{NetNS: e.netns}
-		if err := d.scanner.ResetTo(msg.Data); err != nil {
+// DecodeEvent is like DecodeAndReleaseEvent, but with the DecodeStrict policy it also returns
+// the first error encountered. Malformed messages are skipped either way, and the entries of
+// the other messages are returned.
+func (d *Decoder) DecodeEvent(e Event) ([]Con, error) {
+	var decodeErr error
+	conns := d.decodeEvent(e, make([]Con, 0, len(e.Messages())), false, func(_ int, err error) {
+		if d.policy == DecodeStrict && decodeErr == nil {
+			decodeErr = err
+		}
+	})
+	return conns, decodeErr
+}
+
+// DecodeEvents decodes the messages of all the given events into a flat slice of entries, and
+// releases the underlying buffers. Messages which aren't conntrack entries (e.g. netlink control
+// messages) are skipped. Malformed messages are skipped as well, whatever the decode policy, and
+// their errors are collected in the returned *multierror.Error, along with the entries decoded
+// from the other messages.
+func (d *Decoder) DecodeEvents(events []Event) ([]Con, error) {
+	var conns []Con
+	var decodeErr *multierror.Error
+	for i, e := range events {
+		conns = d.decodeEvent(e, conns, true, func(msg int, err error) {
+			decodeErr = multierror.Append(decodeErr, fmt.Errorf("event %d, message %d: %w", i, msg, err))
+		})
+	}
+	return conns, decodeErr.ErrorOrNil()
+}
+
+// DecodeEventMessages is the single event form of DecodeEvents
+func (d *Decoder) DecodeEventMessages(e Event) ([]Con, error) {
+	return d.DecodeEvents([]Event{e})
+}
+
+// decodeEvent appends the entries decoded from the messages of e to conns, and releases e.
+// onError is called with the index and the error of each malformed message.
+func (d *Decoder) decodeEvent(e Event, conns []Con, skipOthers bool, onError func(msg int, err error)) []Con {
+	for i, msg := range e.Messages() {
+		if skipOthers && !isConntrackMessage(msg) {
 			continue
 		}
-		err := d.unmarshalCon(c)
+
+		c := &Con{NetNS: e.netns}
+		err := d.scanner.ResetTo(msg.Data)
+		if err == nil {
+			d.family = messageFamily(msg.Data)
+			err = d.unmarshalCon(c)
+		}
 		if err != nil {
+			onError(i, err)
+			continue
+		}
+		if !d.inZone(c) {
+			continue
+		}
+		if d.dedup != nil && d.dedup.isDuplicate(c) {
 			continue
 		}
+		if d.canonicalizeNAT {
+			canonicalize(c)
+		}
+		if d.logRemaining > 0 {
+			d.logRemaining--
+			d.logf("decoded conntrack entry: %s", summarizeCon(c))
+		}
+		if d.tee != nil {
+			d.tee.send(c)
+		}
 		conns = append(conns, *c)
 	}
 
@@ -90,28 +385,263 @@ func (d *Decoder) DecodeAndReleaseEvent(e Event) []Con {
 	return conns
 }
 
+// isConntrackMessage reports whether the message belongs to the ctnetlink subsystem.
+// Messages without a type, as stored in snapshots, are assumed to be conntrack entries.
+func isConntrackMessage(m netlink.Message) bool {
+	return m.Header.Type == 0 || m.Header.Type>>8 == unix.NFNL_SUBSYS_CTNETLINK
+}
+
+// attributeData returns the data of the current attribute if it holds at least size bytes.
+// Otherwise, it returns nil so the attribute is skipped, or an error with the strict policy.
+func (d *Decoder) attributeData(size int) ([]byte, error) {
+	b := d.scanner.Bytes()
+	if len(b) >= size {
+		return b, nil
+	}
+	if d.policy == DecodeStrict {
+		return nil, fmt.Errorf("%w: attribute %d has %d bytes, expected %d", errShortAttribute, d.scanner.Type(), len(b), size)
+	}
+	return nil, nil
+}
+
 func (d *Decoder) unmarshalCon(c *Con) error {
-	c.Origin = &ct.IPTuple{}
-	c.Reply = &ct.IPTuple{}
+	fields := d.decodedFields()
+	if fields&DecodeTuples != 0 {
+		c.Origin = &ct.IPTuple{}
+		c.Reply = &ct.IPTuple{}
+	}
+
+	for d.scanner.Next() {
+		if fields&attributeField(d.scanner.Type()) == 0 {
+			continue
+		}
 
-	for toDecode := 2; toDecode > 0 && d.scanner.Next(); {
 		switch d.scanner.Type() {
 		case ctaTupleOrig:
-			toDecode--
 			d.scanner.Nested(func() error {
 				return d.unmarshalTuple(c.Origin)
 			})
 		case ctaTupleReply:
-			toDecode--
 			d.scanner.Nested(func() error {
 				return d.unmarshalTuple(c.Reply)
 			})
+		case ctaTupleMaster:
+			c.Master = &ct.IPTuple{}
+			d.scanner.Nested(func() error {
+				return d.unmarshalTuple(c.Master)
+			})
+		case ctaSeqAdjOrig:
+			c.SeqAdjOrig = &ct.SeqAdj{}
+			d.scanner.Nested(func() error {
+				return d.unmarshalSeqAdj(c.SeqAdjOrig)
+			})
+		case ctaSeqAdjReply:
+			c.SeqAdjRepl = &ct.SeqAdj{}
+			d.scanner.Nested(func() error {
+				return d.unmarshalSeqAdj(c.SeqAdjRepl)
+			})
+		case ctaID:
+			b, err := d.attributeData(4)
+			if err != nil {
+				return err
+			}
+			if b != nil {
+				c.ID = binary.BigEndian.Uint32(b)
+			}
+		case ctaStatus:
+			b, err := d.attributeData(4)
+			if err != nil {
+				return err
+			}
+			if b != nil {
+				status := binary.BigEndian.Uint32(b)
+				c.Status = &status
+			}
+		case ctaUse:
+			b, err := d.attributeData(4)
+			if err != nil {
+				return err
+			}
+			if b != nil {
+				c.Use = binary.BigEndian.Uint32(b)
+			}
+		case ctaZone:
+			b, err := d.attributeData(2)
+			if err != nil {
+				return err
+			}
+			if b != nil {
+				zone := binary.BigEndian.Uint16(b)
+				c.Zone = &zone
+			}
+		case ctaTimestamp:
+			c.Timestamp = &ct.Timestamp{}
+			d.scanner.Nested(func() error {
+				return d.unmarshalTimestamp(c.Timestamp)
+			})
+		case ctaLabels:
+			c.Labels = copySlice(d.scanner.Bytes())
+		case ctaCountersOrig:
+			c.CounterOrigin = &ct.Counter{}
+			d.scanner.Nested(func() error {
+				return d.unmarshalCounter(c.CounterOrigin)
+			})
+		case ctaCountersReply:
+			c.CounterReply = &ct.Counter{}
+			d.scanner.Nested(func() error {
+				return d.unmarshalCounter(c.CounterReply)
+			})
+		case ctaMark:
+			b, err := d.attributeData(4)
+			if err != nil {
+				return err
+			}
+			if b != nil {
+				mark := binary.BigEndian.Uint32(b)
+				c.Mark = &mark
+			}
+		case ctaTimeout:
+			b, err := d.attributeData(4)
+			if err != nil {
+				return err
+			}
+			if b != nil {
+				timeout := binary.BigEndian.Uint32(b)
+				c.Timeout = &timeout
+				c.TimeoutAt = time.Now().Add(time.Duration(timeout) * time.Second)
+			}
+		case ctaProtoInfo:
+			c.ProtoInfo = &ct.ProtoInfo{}
+			d.scanner.Nested(func() error {
+				return d.unmarshalProtoInfo(c.ProtoInfo)
+			})
+		}
+	}
+
+	return d.scanner.Err()
+}
+
+// unmarshalTimestamp decodes the start and stop times of the entry, which are only reported when
+// the nf_conntrack_timestamp sysctl is enabled. The stop time is only set on DESTROY events.
+func (d *Decoder) unmarshalTimestamp(ts *ct.Timestamp) error {
+	for d.scanner.Next() {
+		var field **time.Time
+		switch d.scanner.Type() {
+		case ctaTimestampStart:
+			field = &ts.Start
+		case ctaTimestampStop:
+			field = &ts.Stop
+		default:
+			continue
+		}
+
+		b, err := d.attributeData(8)
+		if err != nil {
+			return err
+		}
+		if b != nil {
+			t := time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+			*field = &t
 		}
 	}
 
 	return d.scanner.Err()
 }
 
+// unmarshalCounter decodes the packets and bytes of a direction of the entry, which are only
+// reported when the nf_conntrack_acct sysctl is enabled
+func (d *Decoder) unmarshalCounter(counter *ct.Counter) error {
+	for d.scanner.Next() {
+		var field **uint64
+		switch d.scanner.Type() {
+		case ctaCountersPackets:
+			field = &counter.Packets
+		case ctaCountersBytes:
+			field = &counter.Bytes
+		default:
+			continue
+		}
+
+		b, err := d.attributeData(8)
+		if err != nil {
+			return err
+		}
+		if b != nil {
+			v := binary.BigEndian.Uint64(b)
+			*field = &v
+		}
+	}
+
+	return d.scanner.Err()
+}
+
+// unmarshalProtoInfo decodes the protocol specific info of the entry. Only the state of TCP
+// connections is decoded.
+func (d *Decoder) unmarshalProtoInfo(info *ct.ProtoInfo) error {
+	for d.scanner.Next() {
+		if d.scanner.Type() != ctaProtoInfoTCP {
+			continue
+		}
+		info.TCP = &ct.TCPInfo{}
+		d.scanner.Nested(func() error {
+			for d.scanner.Next() {
+				if d.scanner.Type() != ctaProtoInfoTCPState {
+					continue
+				}
+				b, err := d.attributeData(1)
+				if err != nil {
+					return err
+				}
+				if b != nil {
+					state := b[0]
+					info.TCP.State = &state
+				}
+			}
+			return d.scanner.Err()
+		})
+	}
+
+	return d.scanner.Err()
+}
+
+// unmarshalSeqAdj decodes the sequence number adjustment applied by NAT helpers rewriting payloads
+func (d *Decoder) unmarshalSeqAdj(s *ct.SeqAdj) error {
+	for d.scanner.Next() {
+		var field **uint32
+		switch d.scanner.Type() {
+		case ctaSeqAdjCorrectionPos:
+			field = &s.CorrectionPos
+		case ctaSeqAdjOffsetBefore:
+			field = &s.OffsetBefore
+		case ctaSeqAdjOffsetAfter:
+			field = &s.OffsetAfter
+		default:
+			continue
+		}
+
+		b, err := d.attributeData(4)
+		if err != nil {
+			return err
+		}
+		if b != nil {
+			v := binary.BigEndian.Uint32(b)
+			*field = &v
+		}
+	}
+
+	return d.scanner.Err()
+}
+
+func (d *Decoder) inZone(c *Con) bool {
+	if d.zone == nil {
+		return true
+	}
+	if c.Zone == nil {
+		return *d.zone == 0
+	}
+	return *c.Zone == *d.zone
+}
+
 func (d *Decoder) unmarshalTuple(t *ct.IPTuple) error {
 	for toDecode := 2; toDecode > 0 && d.scanner.Next(); {
 		switch d.scanner.Type() {
@@ -130,49 +660,183 @@ func (d *Decoder) unmarshalTuple(t *ct.IPTuple) error {
 	return d.scanner.Err()
 }
 
+// unmarshalTupleIP decodes the addresses of a tuple. Only the attributes of the message family
+// are decoded, so IPv4 addresses are 4 bytes long and IPv6 ones 16 bytes long, and an error is
+// returned when the tuple lacks them. Any other attribute is skipped.
+//
+// The addresses are all conntrack exposes at the IP level: the tuples of nf_conntrack only hold
+// the addresses, ports and protocol of a connection, so the IPv6 flow label and the traffic class
+// of its packets aren't recorded by the kernel and can't be decoded from its entries.
 // We might also want to consider deferring the allocation of the IP byte slice
 func (d *Decoder) unmarshalTupleIP(t *ct.IPTuple) error {
-	for toDecode := 2; toDecode > 0 && d.scanner.Next(); {
+	for d.scanner.Next() {
+		var field **net.IP
+		var size int
 		switch d.scanner.Type() {
-		case ctaIPv4Src, ctaIPv6Src:
-			toDecode--
-			data := copySlice(d.scanner.Bytes())
-			ip := net.IP(data)
-			t.Src = &ip
-		case ctaIPv4Dst, ctaIPv6Dst:
-			toDecode--
-			data := copySlice(d.scanner.Bytes())
-			ip := net.IP(data)
-			t.Dst = &ip
+		case ctaIPv4Src:
+			field, size = &t.Src, net.IPv4len
+		case ctaIPv4Dst:
+			field, size = &t.Dst, net.IPv4len
+		case ctaIPv6Src:
+			field, size = &t.Src, net.IPv6len
+		case ctaIPv6Dst:
+			field, size = &t.Dst, net.IPv6len
+		default:
+			continue
+		}
+
+		if !familyHasIPLength(d.family, size) {
+			continue
+		}
+		b := d.scanner.Bytes()
+		if len(b) != size {
+			return fmt.Errorf("%w: attribute %d has %d bytes, expected %d", errInvalidIPLength, d.scanner.Type(), len(b), size)
 		}
+		ip := net.IP(copySlice(b))
+		*field = &ip
 	}
 
-	return d.scanner.Err()
+	if err := d.scanner.Err(); err != nil {
+		return err
+	}
+	if t.Src == nil || t.Dst == nil {
+		return fmt.Errorf("%w for address family %d", errMissingIPAttribute, d.family)
+	}
+	return nil
+}
+
+// familyHasIPLength reports whether addresses of the given length belong to the address family
+func familyHasIPLength(family uint8, length int) bool {
+	switch family {
+	case unix.AF_INET:
+		return length == net.IPv4len
+	case unix.AF_INET6:
+		return length == net.IPv6len
+	default:
+		return true
+	}
 }
 
+// unmarshalProto decodes the protocol of a tuple, and its layer 4 identifiers, which depend on
+// the protocol: the ID, type and code for ICMP and ICMPv6, whose ports are left nil rather than
+// zero, and the ports for the others, e.g. TCP, UDP, SCTP and DCCP (GRE keys are reported as ports).
 func (d *Decoder) unmarshalProto(t *ct.IPTuple) error {
 	t.Proto = &ct.ProtoTuple{}
 
+	// the protocol number comes first, followed by its identifiers
 	for toDecode := 3; toDecode > 0 && d.scanner.Next(); {
 		switch d.scanner.Type() {
 		case ctaProtoNum:
-			toDecode--
-			protoNum := d.scanner.Bytes()[0]
-			t.Proto.Number = &protoNum
+			b, err := d.attributeData(1)
+			if err != nil {
+				return err
+			}
+			if b != nil {
+				protoNum := b[0]
+				t.Proto.Number = &protoNum
+				toDecode = protoAttributes(protoNum)
+			} else {
+				toDecode--
+			}
 		case ctaProtoSrcPort:
 			toDecode--
-			port := binary.BigEndian.Uint16(d.scanner.Bytes())
-			t.Proto.SrcPort = &port
+			b, err := d.attributeData(2)
+			if err != nil {
+				return err
+			}
+			if b != nil {
+				port := binary.BigEndian.Uint16(b)
+				t.Proto.SrcPort = &port
+			}
 		case ctaProtoDstPort:
 			toDecode--
-			port := binary.BigEndian.Uint16(d.scanner.Bytes())
-			t.Proto.DstPort = &port
+			b, err := d.attributeData(2)
+			if err != nil {
+				return err
+			}
+			if b != nil {
+				port := binary.BigEndian.Uint16(b)
+				t.Proto.DstPort = &port
+			}
+		case ctaProtoIcmpID, ctaProtoIcmpv6ID:
+			toDecode--
+			b, err := d.attributeData(2)
+			if err != nil {
+				return err
+			}
+			if b != nil {
+				id := binary.BigEndian.Uint16(b)
+				if d.scanner.Type() == ctaProtoIcmpID {
+					t.Proto.IcmpID = &id
+				} else {
+					t.Proto.Icmpv6ID = &id
+				}
+			}
+		case ctaProtoIcmpType, ctaProtoIcmpCode, ctaProtoIcmpv6Type, ctaProtoIcmpv6Code:
+			toDecode--
+			b, err := d.attributeData(1)
+			if err != nil {
+				return err
+			}
+			if b != nil {
+				v := b[0]
+				switch d.scanner.Type() {
+				case ctaProtoIcmpType:
+					t.Proto.IcmpType = &v
+				case ctaProtoIcmpCode:
+					t.Proto.IcmpCode = &v
+				case ctaProtoIcmpv6Type:
+					t.Proto.Icmpv6Type = &v
+				case ctaProtoIcmpv6Code:
+					t.Proto.Icmpv6Code = &v
+				}
+			}
 		}
 	}
 
 	return d.scanner.Err()
 }
 
+// protoAttributes returns the number of layer 4 identifiers conntrack reports for the protocol
+func protoAttributes(proto uint8) int {
+	switch proto {
+	case unix.IPPROTO_ICMP, unix.IPPROTO_ICMPV6:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// isICMPTuple returns whether the tuple identifies an ICMP or ICMPv6 flow by its type and code
+func isICMPTuple(t *ct.IPTuple) bool {
+	if t == nil || t.Proto == nil {
+		return false
+	}
+	return (t.Proto.IcmpType != nil && t.Proto.IcmpCode != nil && t.Proto.IcmpID != nil) ||
+		(t.Proto.Icmpv6Type != nil && t.Proto.Icmpv6Code != nil && t.Proto.Icmpv6ID != nil)
+}
+
+// formatICMP formats the identifiers of an ICMP tuple, see isICMPTuple
+func formatICMP(p *ct.ProtoTuple) string {
+	if p.IcmpType != nil {
+		return fmt.Sprintf("type=%d code=%d id=%d", *p.IcmpType, *p.IcmpCode, *p.IcmpID)
+	}
+	return fmt.Sprintf("type=%d code=%d id=%d", *p.Icmpv6Type, *p.Icmpv6Code, *p.Icmpv6ID)
+}
+
+// summarizeCon formats the entry like Con.String, without panicking on incomplete tuples
+func summarizeCon(c *Con) string {
+	if isICMPTuple(c.Origin) && isICMPTuple(c.Reply) && c.Origin.Proto.Number != nil {
+		return c.String()
+	}
+	if c.Origin == nil || c.Origin.Proto == nil || c.Reply == nil || c.Reply.Proto == nil ||
+		c.Origin.Proto.SrcPort == nil || c.Origin.Proto.DstPort == nil || c.Origin.Proto.Number == nil ||
+		c.Reply.Proto.SrcPort == nil || c.Reply.Proto.DstPort == nil {
+		return fmt.Sprintf("netns=%d (incomplete tuples)", c.NetNS)
+	}
+	return c.String()
+}
+
 func copySlice(src []byte) []byte {
 	dst := make([]byte, len(src))
 	copy(dst, src)
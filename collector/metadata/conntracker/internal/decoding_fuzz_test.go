@@ -0,0 +1,58 @@
+//go:build go1.18 && linux && !android
+// +build go1.18,linux,!android
+
+package internal
+
+import (
+	"testing"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// FuzzDecodeConnection feeds arbitrary message payloads to the decoder, which must never panic:
+// they come from the kernel at a high rate. Each payload is either decoded into a single entry,
+// or rejected with an error.
+func FuzzDecodeConnection(f *testing.F) {
+	v6Origin := newIPTuple("fd00::1", "fd00::2", 58472, 5432, uint8(unix.IPPROTO_TCP))
+	v6Reply := newIPTuple("fd00::2", "fd00::1", 5432, 58472, uint8(unix.IPPROTO_TCP))
+	v6, err := EncodeConn(&Con{Con: ct.Con{Origin: v6Origin, Reply: v6Reply}})
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	v4 := encodeTestConn(f, nil)
+	f.Add(v4)
+	f.Add(encodeTestConn(f, func(ae *netlink.AttributeEncoder) {
+		ae.Uint32(ctaStatus, 0x1)
+		ae.Uint32(ctaUse, 1)
+		ae.Uint32(ctaID, 42)
+		ae.Uint16(ctaZone, 3)
+		ae.Bytes(ctaLabels, make([]byte, 16))
+	}))
+	f.Add(append([]byte{unix.AF_INET6, unix.NFNETLINK_V0, 0, 0}, v6...))
+	// without nfgenmsg header
+	f.Add(v6)
+	// truncated, and with a wrong family
+	f.Add(v4[:len(v4)/2])
+	f.Add(append([]byte{unix.AF_INET, unix.NFNETLINK_V0, 0, 0}, v6...))
+	f.Add([]byte{})
+	f.Add([]byte{unix.AF_INET})
+
+	decoder := NewDecoder()
+	decoder.SetPolicy(DecodeStrict)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		conns, err := decoder.DecodeEventMessages(Event{msgs: []netlink.Message{{Data: data}}})
+		if len(data) < 2 && err == nil {
+			t.Fatalf("no error decoding a %d bytes message", len(data))
+		}
+		if err == nil && len(conns) != 1 {
+			t.Fatalf("decoded %d entries out of a valid message", len(conns))
+		}
+		if err != nil && len(conns) != 0 {
+			t.Fatalf("decoded %d entries out of an invalid message: %s", len(conns), err)
+		}
+	})
+}
@@ -10,15 +10,20 @@ package internal
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"testing"
+	"time"
 
+	ct "github.com/florianl/go-conntrack"
+	"github.com/hashicorp/go-multierror"
 	"github.com/mdlayher/netlink"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
 )
 
 func TestDecodeAndReleaseEvent(t *testing.T) {
@@ -51,6 +56,413 @@ func TestDecodeAndReleaseEvent(t *testing.T) {
 	assert.Equal(t, uint8(6), *c.Reply.Proto.Number)
 }
 
+func TestDecodeLabels(t *testing.T) {
+	labels := []byte{0x1, 0x0, 0x0, 0x80, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x2}
+	data := encodeTestConn(t, func(ae *netlink.AttributeEncoder) {
+		ae.Bytes(ctaLabels, labels)
+	})
+
+	decoder := NewDecoder()
+	connections := decoder.DecodeAndReleaseEvent(Event{msgs: []netlink.Message{{Data: data}}})
+	require.Len(t, connections, 1)
+	assert.Equal(t, labels, connections[0].Labels)
+	assert.Equal(t, uint16(5432), *connections[0].Origin.Proto.DstPort)
+
+	// Absent labels are left nil
+	connections = decoder.DecodeAndReleaseEvent(Event{msgs: []netlink.Message{{Data: encodeTestConn(t, nil)}}})
+	require.Len(t, connections, 1)
+	assert.Nil(t, connections[0].Labels)
+}
+
+func TestDecodeUse(t *testing.T) {
+	data := encodeTestConn(t, func(ae *netlink.AttributeEncoder) {
+		ae.ByteOrder = binary.BigEndian
+		ae.Uint32(ctaUse, 3)
+	})
+
+	decoder := NewDecoder()
+	connections := decoder.DecodeAndReleaseEvent(Event{msgs: []netlink.Message{{Data: data}}})
+	require.Len(t, connections, 1)
+	assert.Equal(t, uint32(3), connections[0].Use)
+
+	// An absent use count is decoded as zero
+	connections = decoder.DecodeAndReleaseEvent(Event{msgs: []netlink.Message{{Data: encodeTestConn(t, nil)}}})
+	require.Len(t, connections, 1)
+	assert.Zero(t, connections[0].Use)
+}
+
+func TestDecodeMaster(t *testing.T) {
+	// FTP data channel spawned by the control channel 10.0.2.15:58471 -> 2.2.2.2:21
+	master := newIPTuple("10.0.2.15", "2.2.2.2", 58471, 21, uint8(unix.IPPROTO_TCP))
+	data := encodeTestConn(t, func(ae *netlink.AttributeEncoder) {
+		ae.Nested(ctaTupleMaster, func(nae *netlink.AttributeEncoder) error {
+			return marshalIPTuple(nae, master)
+		})
+	})
+
+	decoder := NewDecoder()
+	connections := decoder.DecodeAndReleaseEvent(Event{msgs: []netlink.Message{{Data: data}}})
+	require.Len(t, connections, 1)
+	require.NotNil(t, connections[0].Master)
+	assert.Equal(t, master.Src.To4(), connections[0].Master.Src.To4())
+	assert.Equal(t, master.Dst.To4(), connections[0].Master.Dst.To4())
+	assert.Equal(t, uint16(58471), *connections[0].Master.Proto.SrcPort)
+	assert.Equal(t, uint16(21), *connections[0].Master.Proto.DstPort)
+	assert.Equal(t, uint16(5432), *connections[0].Origin.Proto.DstPort)
+
+	// Connections without a master are left untouched
+	connections = decoder.DecodeAndReleaseEvent(Event{msgs: []netlink.Message{{Data: encodeTestConn(t, nil)}}})
+	require.Len(t, connections, 1)
+	assert.Nil(t, connections[0].Master)
+}
+
+func TestDecodeSeqAdj(t *testing.T) {
+	data := encodeTestConn(t, func(ae *netlink.AttributeEncoder) {
+		ae.Nested(ctaSeqAdjOrig, func(nae *netlink.AttributeEncoder) error {
+			nae.ByteOrder = binary.BigEndian
+			nae.Uint32(ctaSeqAdjCorrectionPos, 1000)
+			nae.Uint32(ctaSeqAdjOffsetBefore, 0)
+			nae.Uint32(ctaSeqAdjOffsetAfter, 12)
+			return nil
+		})
+		ae.Nested(ctaSeqAdjReply, func(nae *netlink.AttributeEncoder) error {
+			nae.ByteOrder = binary.BigEndian
+			nae.Uint32(ctaSeqAdjOffsetAfter, 4)
+			return nil
+		})
+	})
+
+	decoder := NewDecoder()
+	connections := decoder.DecodeAndReleaseEvent(Event{msgs: []netlink.Message{{Data: data}}})
+	require.Len(t, connections, 1)
+	c := connections[0]
+	require.NotNil(t, c.SeqAdjOrig)
+	assert.Equal(t, uint32(1000), *c.SeqAdjOrig.CorrectionPos)
+	assert.Equal(t, uint32(0), *c.SeqAdjOrig.OffsetBefore)
+	assert.Equal(t, uint32(12), *c.SeqAdjOrig.OffsetAfter)
+	require.NotNil(t, c.SeqAdjRepl)
+	assert.Nil(t, c.SeqAdjRepl.CorrectionPos)
+	assert.Equal(t, uint32(4), *c.SeqAdjRepl.OffsetAfter)
+	assert.Equal(t, uint16(5432), *c.Origin.Proto.DstPort)
+
+	// Most connections have no sequence adjustment
+	connections = decoder.DecodeAndReleaseEvent(Event{msgs: []netlink.Message{{Data: encodeTestConn(t, nil)}}})
+	require.Len(t, connections, 1)
+	assert.Nil(t, connections[0].SeqAdjOrig)
+	assert.Nil(t, connections[0].SeqAdjRepl)
+}
+
+func TestDecodeFilterZone(t *testing.T) {
+	zoned := func(zone uint16) netlink.Message {
+		return netlink.Message{Data: encodeTestConn(t, func(ae *netlink.AttributeEncoder) {
+			ae.ByteOrder = binary.BigEndian
+			ae.Uint16(ctaZone, zone)
+		})}
+	}
+	event := func() Event {
+		return Event{msgs: []netlink.Message{zoned(1), zoned(2), {Data: encodeTestConn(t, nil)}, zoned(2)}}
+	}
+
+	decoder := NewDecoder()
+	connections := decoder.DecodeAndReleaseEvent(event())
+	require.Len(t, connections, 4)
+	assert.Equal(t, uint16(1), *connections[0].Zone)
+	assert.Nil(t, connections[2].Zone)
+
+	decoder.FilterZone(2)
+	connections = decoder.DecodeAndReleaseEvent(event())
+	require.Len(t, connections, 2)
+	for _, c := range connections {
+		assert.Equal(t, uint16(2), *c.Zone)
+	}
+
+	// Entries without a zone attribute are part of the default zone
+	decoder.FilterZone(0)
+	connections = decoder.DecodeAndReleaseEvent(event())
+	require.Len(t, connections, 1)
+	assert.Nil(t, connections[0].Zone)
+}
+
+// encodeFullTestConn encodes an entry carrying every attribute supported by the Decoder
+func encodeFullTestConn(t testing.TB) []byte {
+	return encodeTestConn(t, func(ae *netlink.AttributeEncoder) {
+		ae.Nested(ctaTupleMaster, func(nae *netlink.AttributeEncoder) error {
+			return marshalIPTuple(nae, newIPTuple("10.0.2.15", "2.2.2.2", 58471, 21, uint8(unix.IPPROTO_TCP)))
+		})
+		ae.Nested(ctaSeqAdjOrig, func(nae *netlink.AttributeEncoder) error {
+			nae.ByteOrder = binary.BigEndian
+			nae.Uint32(ctaSeqAdjOffsetAfter, 12)
+			return nil
+		})
+		ae.Nested(ctaTimestamp, func(nae *netlink.AttributeEncoder) error {
+			nae.ByteOrder = binary.BigEndian
+			nae.Uint64(ctaTimestampStart, 1700000000000000000)
+			return nil
+		})
+		ae.Nested(ctaCountersOrig, func(nae *netlink.AttributeEncoder) error {
+			nae.ByteOrder = binary.BigEndian
+			nae.Uint64(ctaCountersPackets, 10)
+			nae.Uint64(ctaCountersBytes, 1200)
+			return nil
+		})
+		ae.Nested(ctaCountersReply, func(nae *netlink.AttributeEncoder) error {
+			nae.ByteOrder = binary.BigEndian
+			nae.Uint64(ctaCountersPackets, 50)
+			nae.Uint64(ctaCountersBytes, 64000)
+			return nil
+		})
+		ae.Nested(ctaProtoInfo, func(nae *netlink.AttributeEncoder) error {
+			nae.Nested(ctaProtoInfoTCP, func(tae *netlink.AttributeEncoder) error {
+				tae.Uint8(ctaProtoInfoTCPState, 3)
+				return nil
+			})
+			return nil
+		})
+		ae.ByteOrder = binary.BigEndian
+		ae.Uint32(ctaMark, 7)
+		ae.Uint32(ctaTimeout, 120)
+		ae.Uint32(ctaID, 42)
+		ae.Uint32(ctaStatus, 0x8)
+		ae.Uint32(ctaUse, 1)
+		ae.Uint16(ctaZone, 3)
+		ae.Bytes(ctaLabels, []byte{0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	})
+}
+
+func TestDecodeFields(t *testing.T) {
+	event := func() Event {
+		return Event{msgs: []netlink.Message{{Data: encodeFullTestConn(t)}}}
+	}
+
+	decoder := NewDecoder()
+	connections := decoder.DecodeAndReleaseEvent(event())
+	require.Len(t, connections, 1)
+	full := connections[0]
+	assert.NotNil(t, full.Master)
+	assert.NotNil(t, full.SeqAdjOrig)
+	assert.NotNil(t, full.Timestamp)
+	assert.NotNil(t, full.Status)
+	assert.NotNil(t, full.Zone)
+	assert.NotNil(t, full.Labels)
+	require.NotNil(t, full.CounterOrigin)
+	require.NotNil(t, full.CounterReply)
+	assert.Equal(t, uint64(1200), *full.CounterOrigin.Bytes)
+	assert.Equal(t, uint64(50), *full.CounterReply.Packets)
+	require.NotNil(t, full.Mark)
+	assert.Equal(t, uint32(7), *full.Mark)
+	require.NotNil(t, full.ProtoInfo)
+	require.NotNil(t, full.ProtoInfo.TCP)
+	assert.Equal(t, uint8(3), *full.ProtoInfo.TCP.State)
+	require.NotNil(t, full.Timeout)
+	assert.Equal(t, uint32(120), *full.Timeout)
+	assert.WithinDuration(t, time.Now().Add(2*time.Minute), full.TimeoutAt, time.Minute)
+	assert.Equal(t, uint32(42), full.ID)
+	assert.Equal(t, uint32(1), full.Use)
+
+	decoder.SetFields(DecodeTuples)
+	connections = decoder.DecodeAndReleaseEvent(event())
+	require.Len(t, connections, 1)
+	assert.Equal(t, Con{Con: ct.Con{Origin: full.Origin, Reply: full.Reply}}, connections[0])
+
+	decoder.SetFields(DecodeID | DecodeStatus)
+	connections = decoder.DecodeAndReleaseEvent(event())
+	require.Len(t, connections, 1)
+	assert.Equal(t, Con{ID: 42, Con: ct.Con{Status: full.Status}}, connections[0])
+
+	// The zone is decoded when filtering on it
+	decoder.FilterZone(3)
+	connections = decoder.DecodeAndReleaseEvent(event())
+	require.Len(t, connections, 1)
+	assert.Equal(t, uint16(3), *connections[0].Zone)
+	assert.Nil(t, connections[0].Origin)
+}
+
+func TestDecodeLogFirst(t *testing.T) {
+	var logged []string
+	decoder := NewDecoder()
+	decoder.logf = func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}
+	decoder.LogFirst(3)
+
+	for i := 0; i < 3; i++ {
+		msgs := []netlink.Message{{Data: encodeTestConn(t, nil)}, {Data: encodeTestConn(t, nil)}}
+		connections := decoder.DecodeAndReleaseEvent(Event{msgs: msgs})
+		require.Len(t, connections, 2)
+	}
+
+	require.Len(t, logged, 3)
+	assert.Contains(t, logged[0], "src=10.0.2.15 dst=2.2.2.2 sport=58472 dport=5432")
+}
+
+func TestDecodePolicy(t *testing.T) {
+	// A 16 bits zone truncated to a single byte
+	short := netlink.Message{Data: encodeTestConn(t, func(ae *netlink.AttributeEncoder) {
+		ae.Bytes(ctaZone, []byte{1})
+	})}
+	// An attribute header announcing more data than the buffer holds
+	truncated := netlink.Message{Data: append(encodeTestConn(t, nil), 0x10, 0x00, ctaLabels, 0x00, 0x01)}
+	valid := netlink.Message{Data: encodeTestConn(t, nil)}
+	event := func() Event {
+		return Event{msgs: []netlink.Message{short, truncated, valid}}
+	}
+
+	// The lenient policy skips the short attribute, and the message which can't be parsed
+	decoder := NewDecoder()
+	connections, err := decoder.DecodeEvent(event())
+	require.NoError(t, err)
+	require.Len(t, connections, 2)
+	assert.Nil(t, connections[0].Zone)
+	assert.Equal(t, uint16(5432), *connections[0].Origin.Proto.DstPort)
+
+	// The strict policy reports the first error and only returns the valid entry
+	decoder.SetPolicy(DecodeStrict)
+	connections, err = decoder.DecodeEvent(event())
+	assert.ErrorIs(t, err, errShortAttribute)
+	require.Len(t, connections, 1)
+
+	connections, err = decoder.DecodeEvent(Event{msgs: []netlink.Message{truncated, valid}})
+	assert.ErrorIs(t, err, errInvalidAttribute)
+	require.Len(t, connections, 1)
+
+	// DecodeAndReleaseEvent ignores the errors
+	assert.Len(t, decoder.DecodeAndReleaseEvent(event()), 1)
+}
+
+func TestDecodeIPv6TupleAttributes(t *testing.T) {
+	// Conntrack doesn't record the flow label nor the traffic class of IPv6 connections: only the
+	// addresses are decoded, and attributes the kernel might add to the tuples are skipped
+	const ctaIPUnknown = 5
+	encodeTuple := func(ae *netlink.AttributeEncoder, tuple *ct.IPTuple) error {
+		ae.Nested(ctaTupleIP, func(nae *netlink.AttributeEncoder) error {
+			nae.Bytes(ctaIPv6Src, *tuple.Src)
+			nae.Uint32(ctaIPUnknown, 0x12345)
+			nae.Bytes(ctaIPv6Dst, *tuple.Dst)
+			return nil
+		})
+		ae.Nested(ctaTupleProto, func(nae *netlink.AttributeEncoder) error {
+			return marshalProto(nae, tuple.Proto)
+		})
+		return nil
+	}
+	origin := newIPTuple("fd00::1", "fd00::2", 58472, 5432, uint8(unix.IPPROTO_TCP))
+	reply := newIPTuple("fd00::2", "fd00::1", 5432, 58472, uint8(unix.IPPROTO_TCP))
+	ae := netlink.NewAttributeEncoder()
+	ae.Nested(ctaTupleOrig, func(nae *netlink.AttributeEncoder) error { return encodeTuple(nae, origin) })
+	ae.Nested(ctaTupleReply, func(nae *netlink.AttributeEncoder) error { return encodeTuple(nae, reply) })
+	data, err := ae.Encode()
+	require.NoError(t, err)
+
+	decoder := NewDecoder()
+	decoder.SetPolicy(DecodeStrict)
+	connections, err := decoder.DecodeEvent(Event{msgs: []netlink.Message{{Data: append([]byte{unix.AF_INET6, unix.NFNETLINK_V0, 0, 0}, data...)}}})
+	require.NoError(t, err)
+	require.Len(t, connections, 1)
+	assert.Equal(t, "fd00::1", connections[0].Origin.Src.String())
+	assert.Equal(t, "fd00::2", connections[0].Origin.Dst.String())
+	assert.Equal(t, "fd00::1", connections[0].Reply.Dst.String())
+	assert.Equal(t, uint16(5432), *connections[0].Origin.Proto.DstPort)
+}
+
+// encodeTestConn returns the netlink payload of a conntrack entry for
+// 10.0.2.15:58472 -> 2.2.2.2:5432 (DNAT to 1.1.1.1:5432), followed by any
+// top-level attributes added by fn.
+func TestDecodeFamily(t *testing.T) {
+	encode := func(family uint8, origin, reply *ct.IPTuple) netlink.Message {
+		data, err := EncodeConn(&Con{Con: ct.Con{Origin: origin, Reply: reply}})
+		require.NoError(t, err)
+		return netlink.Message{Data: append([]byte{family, unix.NFNETLINK_V0, 0, 0}, data...)}
+	}
+	v4Origin := newIPTuple("10.0.2.15", "2.2.2.2", 58472, 5432, uint8(unix.IPPROTO_TCP))
+	v4Reply := newIPTuple("2.2.2.2", "10.0.2.15", 5432, 58472, uint8(unix.IPPROTO_TCP))
+	v6Origin := newIPTuple("fd00::1", "fd00::2", 58472, 5432, uint8(unix.IPPROTO_TCP))
+	v6Reply := newIPTuple("fd00::2", "fd00::1", 5432, 58472, uint8(unix.IPPROTO_TCP))
+
+	decoder := NewDecoder()
+	decoder.SetPolicy(DecodeStrict)
+
+	connections, err := decoder.DecodeEvent(Event{msgs: []netlink.Message{encode(unix.AF_INET, v4Origin, v4Reply)}})
+	require.NoError(t, err)
+	require.Len(t, connections, 1)
+	assert.Len(t, *connections[0].Origin.Src, net.IPv4len)
+	assert.Equal(t, "10.0.2.15", connections[0].Origin.Src.String())
+	assert.Equal(t, "10.0.2.15", connections[0].Reply.Dst.String())
+
+	connections, err = decoder.DecodeEvent(Event{msgs: []netlink.Message{encode(unix.AF_INET6, v6Origin, v6Reply)}})
+	require.NoError(t, err)
+	require.Len(t, connections, 1)
+	assert.Len(t, *connections[0].Origin.Src, net.IPv6len)
+	assert.Equal(t, "fd00::1", connections[0].Origin.Src.String())
+	assert.Equal(t, "fd00::1", connections[0].Reply.Dst.String())
+
+	// An IPv4 message with IPv6 addresses only is rejected instead of being mis-decoded
+	connections, err = decoder.DecodeEvent(Event{msgs: []netlink.Message{encode(unix.AF_INET, v6Origin, v6Reply)}})
+	assert.ErrorIs(t, err, errMissingIPAttribute)
+	assert.Empty(t, connections)
+
+	// Messages without a nfgenmsg header are decoded with both kinds of attributes
+	data, err := EncodeConn(&Con{Con: ct.Con{Origin: v6Origin, Reply: v6Reply}})
+	require.NoError(t, err)
+	connections, err = decoder.DecodeEvent(Event{msgs: []netlink.Message{{Data: data}}})
+	require.NoError(t, err)
+	require.Len(t, connections, 1)
+	assert.Equal(t, "fd00::2", connections[0].Origin.Dst.String())
+}
+
+func TestDecodeEvents(t *testing.T) {
+	ctType := netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK << 8)
+	valid := netlink.Message{Header: netlink.Header{Type: ctType}, Data: encodeTestConn(t, nil)}
+	// An IPv4 entry whose master tuple lacks its addresses
+	invalid := netlink.Message{Header: netlink.Header{Type: ctType}, Data: encodeTestConn(t, func(ae *netlink.AttributeEncoder) {
+		ae.Nested(ctaTupleMaster, func(nae *netlink.AttributeEncoder) error {
+			nae.Nested(ctaTupleIP, func(*netlink.AttributeEncoder) error { return nil })
+			return nil
+		})
+	})}
+	done := netlink.Message{Header: netlink.Header{Type: netlink.Done}, Data: []byte{0, 0, 0, 0}}
+
+	events := []Event{
+		{msgs: []netlink.Message{valid, invalid}},
+		{msgs: []netlink.Message{valid, done}},
+		{msgs: []netlink.Message{invalid}},
+	}
+
+	connections, err := NewDecoder().DecodeEvents(events)
+	assert.Len(t, connections, 2)
+	var merr *multierror.Error
+	require.True(t, errors.As(err, &merr))
+	require.Len(t, merr.Errors, 2)
+	assert.ErrorIs(t, merr.Errors[0], errMissingIPAttribute)
+	assert.Contains(t, merr.Errors[0].Error(), "event 0, message 1")
+	assert.Contains(t, merr.Errors[1].Error(), "event 2, message 0")
+
+	connections, err = NewDecoder().DecodeEventMessages(Event{msgs: []netlink.Message{valid, done}})
+	assert.NoError(t, err)
+	assert.Len(t, connections, 1)
+}
+
+func encodeTestConn(t testing.TB, fn func(ae *netlink.AttributeEncoder)) []byte {
+	conn := Con{
+		Con: ct.Con{
+			Origin: newIPTuple("10.0.2.15", "2.2.2.2", 58472, 5432, uint8(unix.IPPROTO_TCP)),
+			Reply:  newIPTuple("1.1.1.1", "10.0.2.15", 5432, 58472, uint8(unix.IPPROTO_TCP)),
+		},
+	}
+
+	data, err := EncodeConn(&conn)
+	require.NoError(t, err)
+
+	if fn != nil {
+		ae := netlink.NewAttributeEncoder()
+		fn(ae)
+		extra, err := ae.Encode()
+		require.NoError(t, err)
+		data = append(data, extra...)
+	}
+
+	return append([]byte{unix.AF_INET, unix.NFNETLINK_V0, 0, 0}, data...)
+}
+
 func BenchmarkDecodeSingleMessage(b *testing.B) {
 	b.ReportAllocs()
 	messages, err := loadDumpData()
@@ -67,6 +479,27 @@ func BenchmarkDecodeSingleMessage(b *testing.B) {
 	}
 }
 
+func BenchmarkDecodeFields(b *testing.B) {
+	e := Event{msgs: []netlink.Message{{Data: encodeFullTestConn(b)}}}
+	for _, bb := range []struct {
+		name   string
+		fields DecodeField
+	}{
+		{"all", DecodeAllFields},
+		{"tuples", DecodeTuples},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			b.ReportAllocs()
+			decoder := NewDecoder()
+			decoder.SetFields(bb.fields)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				decoder.DecodeAndReleaseEvent(e)
+			}
+		})
+	}
+}
+
 func BenchmarkDecodeMultipleMessages(b *testing.B) {
 	b.ReportAllocs()
 	messages, err := loadDumpData()
@@ -91,23 +524,65 @@ func loadDumpData() ([]netlink.Message, error) {
 	defer os.Remove(f.Name())
 	defer f.Close()
 
-	var messages []netlink.Message
-	sizeBuffer := make([]byte, 4)
-	for {
-		_, err := io.ReadFull(f, sizeBuffer)
-		if err != nil {
-			break
-		}
+	return readSnapshot(f)
+}
 
-		size := binary.LittleEndian.Uint32(sizeBuffer)
-		m := netlink.Message{Data: make([]byte, size)}
-		_, err = io.ReadFull(f, m.Data)
-		if err != nil {
-			return nil, fmt.Errorf("couldn't read enough data")
+func TestDecodeProtocolIdentifiers(t *testing.T) {
+	decode := func(family uint8, origin, reply *ct.IPTuple) Con {
+		data, err := EncodeConn(&Con{Con: ct.Con{Origin: origin, Reply: reply}})
+		require.NoError(t, err)
+		msg := netlink.Message{Data: append([]byte{family, unix.NFNETLINK_V0, 0, 0}, data...)}
+		connections, err := NewDecoder().DecodeEvent(Event{msgs: []netlink.Message{msg}})
+		require.NoError(t, err)
+		require.Len(t, connections, 1)
+		return connections[0]
+	}
+	icmpTuple := func(src, dst string, proto uint8, typ, code uint8, id uint16) *ct.IPTuple {
+		tuple := newIPTuple(src, dst, 0, 0, proto)
+		tuple.Proto.SrcPort, tuple.Proto.DstPort = nil, nil
+		if proto == unix.IPPROTO_ICMP {
+			tuple.Proto.IcmpType, tuple.Proto.IcmpCode, tuple.Proto.IcmpID = &typ, &code, &id
+		} else {
+			tuple.Proto.Icmpv6Type, tuple.Proto.Icmpv6Code, tuple.Proto.Icmpv6ID = &typ, &code, &id
 		}
-
-		messages = append(messages, m)
+		return tuple
 	}
 
-	return messages, nil
+	// an echo request, and its reply
+	conn := decode(unix.AF_INET,
+		icmpTuple("10.0.2.15", "2.2.2.2", unix.IPPROTO_ICMP, 8, 0, 1234),
+		icmpTuple("2.2.2.2", "10.0.2.15", unix.IPPROTO_ICMP, 0, 0, 1234))
+	proto := conn.Origin.Proto
+	assert.Nil(t, proto.SrcPort)
+	assert.Nil(t, proto.DstPort)
+	require.NotNil(t, proto.IcmpType)
+	assert.Equal(t, uint8(8), *proto.IcmpType)
+	assert.Equal(t, uint8(0), *proto.IcmpCode)
+	assert.Equal(t, uint16(1234), *proto.IcmpID)
+	assert.Equal(t, uint8(0), *conn.Reply.Proto.IcmpType)
+	assert.Equal(t, "netns=0 src=10.0.2.15 dst=2.2.2.2 type=8 code=0 id=1234 src=2.2.2.2 dst=10.0.2.15 type=0 code=0 id=1234 proto=1", conn.String())
+	assert.Equal(t, conn.String(), summarizeCon(&conn))
+
+	conn = decode(unix.AF_INET6,
+		icmpTuple("fd00::1", "fd00::2", unix.IPPROTO_ICMPV6, 128, 0, 42),
+		icmpTuple("fd00::2", "fd00::1", unix.IPPROTO_ICMPV6, 129, 0, 42))
+	proto = conn.Origin.Proto
+	assert.Nil(t, proto.SrcPort)
+	assert.Nil(t, proto.IcmpType)
+	require.NotNil(t, proto.Icmpv6Type)
+	assert.Equal(t, uint8(128), *proto.Icmpv6Type)
+	assert.Equal(t, uint8(0), *proto.Icmpv6Code)
+	assert.Equal(t, uint16(42), *proto.Icmpv6ID)
+
+	// SCTP and DCCP have ports
+	for _, p := range []uint8{unix.IPPROTO_SCTP, unix.IPPROTO_DCCP} {
+		conn = decode(unix.AF_INET,
+			newIPTuple("10.0.2.15", "2.2.2.2", 58472, 5432, p),
+			newIPTuple("2.2.2.2", "10.0.2.15", 5432, 58472, p))
+		require.NotNil(t, conn.Origin.Proto.SrcPort)
+		assert.Equal(t, uint16(58472), *conn.Origin.Proto.SrcPort)
+		assert.Equal(t, uint16(5432), *conn.Origin.Proto.DstPort)
+		assert.Nil(t, conn.Origin.Proto.IcmpType)
+		assert.Equal(t, p, *conn.Origin.Proto.Number)
+	}
 }
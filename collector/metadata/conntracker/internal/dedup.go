@@ -0,0 +1,64 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+// deduplicator suppresses conntrack entries already seen within a short TTL.
+// Under listen-all-namespaces the same NEW event may be received on multiple nsids when
+// a connection traverses namespaces, which would otherwise be counted more than once.
+// Memory usage is bounded by keeping the most recently seen entries in an LRU.
+type deduplicator struct {
+	seen *simplelru.LRU
+	ttl  time.Duration
+	now  func() time.Time
+}
+
+// dedupKey identifies an entry by its conntrack ID, or by its origin tuple if the ID is unknown
+type dedupKey struct {
+	id    uint32
+	tuple connKey
+}
+
+func newDeduplicator(size int, ttl time.Duration) (*deduplicator, error) {
+	seen, err := simplelru.NewLRU(size, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &deduplicator{
+		seen: seen,
+		ttl:  ttl,
+		now:  time.Now,
+	}, nil
+}
+
+// isDuplicate records the entry and returns whether it was already seen within the TTL
+func (d *deduplicator) isDuplicate(c *Con) bool {
+	var k dedupKey
+	if c.ID != 0 {
+		k.id = c.ID
+	} else {
+		if c.Origin == nil || c.Origin.Src == nil || c.Origin.Dst == nil || c.Origin.Proto == nil {
+			return false
+		}
+		tuple, ok := formatKey(c.Origin)
+		if !ok {
+			return false
+		}
+		k.tuple = tuple
+	}
+
+	now := d.now()
+	if v, ok := d.seen.Get(k); ok && now.Sub(v.(time.Time)) < d.ttl {
+		return true
+	}
+
+	d.seen.Add(k, now)
+	return false
+}
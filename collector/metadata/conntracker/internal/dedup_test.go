@@ -0,0 +1,58 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeDeduplicate(t *testing.T) {
+	withID := func(id uint32) netlink.Message {
+		return netlink.Message{Data: encodeTestConn(t, func(ae *netlink.AttributeEncoder) {
+			ae.ByteOrder = binary.BigEndian
+			ae.Uint32(ctaID, id)
+		})}
+	}
+
+	decoder := NewDecoder()
+	require.NoError(t, decoder.Deduplicate(16, time.Minute))
+
+	// The same entry received on two nsids, along with a distinct one
+	connections := decoder.DecodeAndReleaseEvent(Event{msgs: []netlink.Message{withID(1), withID(2)}, netns: 1})
+	require.Len(t, connections, 2)
+	assert.Equal(t, uint32(1), connections[0].ID)
+	connections = decoder.DecodeAndReleaseEvent(Event{msgs: []netlink.Message{withID(1)}, netns: 2})
+	assert.Empty(t, connections)
+
+	// Without an ID, entries are identified by their origin tuple
+	noID := netlink.Message{Data: encodeTestConn(t, nil)}
+	connections = decoder.DecodeAndReleaseEvent(Event{msgs: []netlink.Message{noID, noID}})
+	assert.Len(t, connections, 1)
+}
+
+func TestDeduplicatorTTL(t *testing.T) {
+	d, err := newDeduplicator(2, time.Second)
+	require.NoError(t, err)
+	now := time.Now()
+	d.now = func() time.Time { return now }
+
+	c := &Con{ID: 1}
+	assert.False(t, d.isDuplicate(c))
+	assert.True(t, d.isDuplicate(c))
+
+	now = now.Add(2 * time.Second)
+	assert.False(t, d.isDuplicate(c), "entries are no longer duplicates once the TTL expired")
+
+	// Memory is bounded: older entries are evicted
+	assert.False(t, d.isDuplicate(&Con{ID: 2}))
+	assert.False(t, d.isDuplicate(&Con{ID: 3}))
+	assert.Equal(t, 2, d.seen.Len())
+	assert.False(t, d.isDuplicate(c))
+}
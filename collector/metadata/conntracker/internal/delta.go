@@ -0,0 +1,108 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+// ConnectionDelta describes how a conntrack entry changed between two events carrying the
+// same conntrack ID, typically a NEW event followed by an UPDATE.
+//
+// Only the states observed by the tracker are compared: updates the tracker didn't receive
+// (e.g. dropped by sampling, or the entry evicted from the tracker) are folded into the delta,
+// and entries created before the tracker started have no prior state. Counters (CTA_COUNTERS_*),
+// protocol state (CTA_PROTOINFO) and timeouts (CTA_TIMEOUT) aren't part of the delta.
+type ConnectionDelta struct {
+	// Previous and Current are the prior observed state of the entry and its new state
+	Previous, Current Con
+	// Elapsed is the time between the two observations
+	Elapsed time.Duration
+
+	// StatusSet and StatusCleared are the status bits (IPS_*) set and cleared in between
+	StatusSet, StatusCleared uint32
+	// UseDelta is the change of the reference count of the entry
+	UseDelta int64
+	// ReplyChanged is true when the reply tuple changed, e.g. once NAT is set up
+	ReplyChanged bool
+	// LabelsChanged is true when the connlabels of the entry changed
+	LabelsChanged bool
+}
+
+// DeltaTracker retains the last observed state of recent conntrack entries, keyed by their
+// conntrack ID, to turn UPDATE events into ConnectionDelta values.
+// Memory usage is bounded by keeping the most recently observed entries in an LRU.
+// It's not safe for concurrent use.
+type DeltaTracker struct {
+	states *simplelru.LRU
+	now    func() time.Time
+}
+
+type observedState struct {
+	con  Con
+	time time.Time
+}
+
+// NewDeltaTracker returns a DeltaTracker retaining the state of at most size entries
+func NewDeltaTracker(size int) (*DeltaTracker, error) {
+	states, err := simplelru.NewLRU(size, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeltaTracker{
+		states: states,
+		now:    time.Now,
+	}, nil
+}
+
+// Observe records the new state of the entry. If a prior state of the same entry was observed,
+// the delta between both is returned. Entries without a conntrack ID can't be correlated and
+// are ignored.
+func (t *DeltaTracker) Observe(c Con) (ConnectionDelta, bool) {
+	if c.ID == 0 {
+		return ConnectionDelta{}, false
+	}
+
+	now := t.now()
+	v, found := t.states.Get(c.ID)
+	t.states.Add(c.ID, observedState{con: c, time: now})
+	if !found {
+		return ConnectionDelta{}, false
+	}
+
+	prev := v.(observedState)
+	return deltaOf(prev.con, c, now.Sub(prev.time)), true
+}
+
+// Forget drops the state of the entry, e.g. once it's destroyed
+func (t *DeltaTracker) Forget(id uint32) {
+	t.states.Remove(id)
+}
+
+func deltaOf(prev, cur Con, elapsed time.Duration) ConnectionDelta {
+	d := ConnectionDelta{
+		Previous:      prev,
+		Current:       cur,
+		Elapsed:       elapsed,
+		UseDelta:      int64(cur.Use) - int64(prev.Use),
+		LabelsChanged: !bytes.Equal(prev.Labels, cur.Labels),
+	}
+
+	if prev.Status != nil && cur.Status != nil {
+		d.StatusSet = *cur.Status &^ *prev.Status
+		d.StatusCleared = *prev.Status &^ *cur.Status
+	}
+
+	if prev.Reply != nil && cur.Reply != nil {
+		prevKey, prevOK := formatKey(prev.Reply)
+		curKey, curOK := formatKey(cur.Reply)
+		d.ReplyChanged = prevOK && curOK && prevKey != curKey
+	}
+
+	return d
+}
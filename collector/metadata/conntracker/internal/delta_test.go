@@ -0,0 +1,86 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestDeltaTracker(t *testing.T) {
+	const (
+		ipsSeenReply = 1 << 1
+		ipsAssured   = 1 << 2
+		ipsConfirmed = 1 << 3
+	)
+	event := func(id, status, use uint32) Con {
+		data := encodeTestConn(t, func(ae *netlink.AttributeEncoder) {
+			ae.ByteOrder = binary.BigEndian
+			ae.Uint32(ctaID, id)
+			ae.Uint32(ctaStatus, status)
+			ae.Uint32(ctaUse, use)
+		})
+		connections := NewDecoder().DecodeAndReleaseEvent(Event{msgs: []netlink.Message{{Data: data}}})
+		require.Len(t, connections, 1)
+		return connections[0]
+	}
+
+	tracker, err := NewDeltaTracker(16)
+	require.NoError(t, err)
+	now := time.Now()
+	tracker.now = func() time.Time { return now }
+
+	// NEW: there's no prior state
+	_, ok := tracker.Observe(event(7, ipsConfirmed, 1))
+	assert.False(t, ok)
+
+	// UPDATE of the same entry once the reply was seen
+	now = now.Add(2 * time.Second)
+	delta, ok := tracker.Observe(event(7, ipsConfirmed|ipsSeenReply|ipsAssured, 2))
+	require.True(t, ok)
+	assert.Equal(t, uint32(7), delta.Previous.ID)
+	assert.Equal(t, uint32(7), delta.Current.ID)
+	assert.Equal(t, 2*time.Second, delta.Elapsed)
+	assert.Equal(t, uint32(ipsSeenReply|ipsAssured), delta.StatusSet)
+	assert.Zero(t, delta.StatusCleared)
+	assert.Equal(t, int64(1), delta.UseDelta)
+	assert.False(t, delta.ReplyChanged)
+	assert.False(t, delta.LabelsChanged)
+
+	// Another entry isn't correlated with the first one
+	_, ok = tracker.Observe(event(8, ipsConfirmed, 1))
+	assert.False(t, ok)
+
+	// Nor is a destroyed entry
+	tracker.Forget(7)
+	_, ok = tracker.Observe(event(7, ipsConfirmed, 1))
+	assert.False(t, ok)
+
+	// Entries without an ID are ignored
+	_, ok = tracker.Observe(event(0, ipsConfirmed, 1))
+	assert.False(t, ok)
+	_, ok = tracker.Observe(event(0, ipsConfirmed, 1))
+	assert.False(t, ok)
+}
+
+func TestDeltaReplyChanged(t *testing.T) {
+	origin := newIPTuple("10.0.2.15", "2.2.2.2", 58472, 5432, uint8(unix.IPPROTO_TCP))
+	prev := Con{Con: ct.Con{Origin: origin, Reply: newIPTuple("2.2.2.2", "10.0.2.15", 5432, 58472, uint8(unix.IPPROTO_TCP))}, ID: 1}
+	// DNAT to 1.1.1.1 was set up
+	cur := Con{Con: ct.Con{Origin: origin, Reply: newIPTuple("1.1.1.1", "10.0.2.15", 5432, 58472, uint8(unix.IPPROTO_TCP))}, ID: 1, Labels: []byte{1}}
+
+	delta := deltaOf(prev, cur, time.Second)
+	assert.True(t, delta.ReplyChanged)
+	assert.True(t, delta.LabelsChanged)
+	// The status is unknown
+	assert.Zero(t, delta.StatusSet)
+	assert.Zero(t, delta.StatusCleared)
+}
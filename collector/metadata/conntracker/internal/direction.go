@@ -0,0 +1,82 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"net"
+)
+
+// Direction is the direction of a connection relative to the host
+type Direction int
+
+const (
+	// DirectionUnknown means that the tuples of the connection weren't decoded
+	DirectionUnknown Direction = iota
+	// DirectionInbound is a connection initiated by a remote peer to the host
+	DirectionInbound
+	// DirectionOutbound is a connection initiated by the host to a remote peer
+	DirectionOutbound
+	// DirectionLocal is a connection between two endpoints of the host
+	DirectionLocal
+	// DirectionTransit is a connection forwarded by the host, e.g. on a router,
+	// neither endpoint of which is local
+	DirectionTransit
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirectionInbound:
+		return "inbound"
+	case DirectionOutbound:
+		return "outbound"
+	case DirectionLocal:
+		return "local"
+	case DirectionTransit:
+		return "transit"
+	default:
+		return "unknown"
+	}
+}
+
+// IsServer reports whether the host serves the connection, which is the isServer distinction of
+// the metric names (see constlabels.ToKindlingMetricName): entity metrics for the connections
+// served by the host, topology metrics otherwise. Local connections are served by the host.
+func (d Direction) IsServer() bool {
+	return d == DirectionInbound || d == DirectionLocal
+}
+
+// ConnectionDirection returns the direction of the connection relative to the host, whose
+// addresses are localIPs. The original tuple goes from the initiator to the responder of the
+// connection. The reply tuple is checked as well, since NAT may rewrite the local endpoint,
+// e.g. the address of a pod masqueraded to the address of the host.
+func ConnectionDirection(conn *Con, localIPs []net.IP) Direction {
+	if conn == nil || conn.Origin == nil || conn.Reply == nil {
+		return DirectionUnknown
+	}
+
+	initiator := isLocalIP(conn.Origin.Src, localIPs) || isLocalIP(conn.Reply.Dst, localIPs)
+	responder := isLocalIP(conn.Origin.Dst, localIPs) || isLocalIP(conn.Reply.Src, localIPs)
+	switch {
+	case initiator && responder:
+		return DirectionLocal
+	case responder:
+		return DirectionInbound
+	case initiator:
+		return DirectionOutbound
+	default:
+		return DirectionTransit
+	}
+}
+
+func isLocalIP(ip *net.IP, localIPs []net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, local := range localIPs {
+		if local.Equal(*ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"net"
+	"testing"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestConnectionDirection(t *testing.T) {
+	localIPs := []net.IP{net.ParseIP("10.0.2.15"), net.ParseIP("172.17.0.1"), net.ParseIP("fd00::1")}
+	conn := func(origSrc, origDst, replySrc, replyDst string) *Con {
+		return &Con{Con: ct.Con{
+			Origin: newIPTuple(origSrc, origDst, 58472, 80, unix.IPPROTO_TCP),
+			Reply:  newIPTuple(replySrc, replyDst, 80, 58472, unix.IPPROTO_TCP),
+		}}
+	}
+
+	tests := []struct {
+		name string
+		conn *Con
+		want Direction
+	}{
+		{"inbound", conn("1.1.1.1", "10.0.2.15", "10.0.2.15", "1.1.1.1"), DirectionInbound},
+		{"inbound ipv6", conn("fd00::2", "fd00::1", "fd00::1", "fd00::2"), DirectionInbound},
+		// a NodePort connection forwarded to a local pod
+		{"inbound dnat", conn("1.1.1.1", "10.0.2.15", "172.17.0.2", "1.1.1.1"), DirectionInbound},
+		{"outbound", conn("10.0.2.15", "1.1.1.1", "1.1.1.1", "10.0.2.15"), DirectionOutbound},
+		// a pod masqueraded to the address of the host
+		{"outbound snat", conn("172.17.0.2", "1.1.1.1", "1.1.1.1", "10.0.2.15"), DirectionOutbound},
+		{"local", conn("10.0.2.15", "172.17.0.1", "172.17.0.1", "10.0.2.15"), DirectionLocal},
+		{"transit", conn("192.168.1.10", "1.1.1.1", "1.1.1.1", "192.168.1.10"), DirectionTransit},
+		{"unknown", &Con{}, DirectionUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, ConnectionDirection(tt.conn, localIPs))
+		})
+	}
+
+	assert.True(t, DirectionInbound.IsServer())
+	assert.True(t, DirectionLocal.IsServer())
+	assert.False(t, DirectionOutbound.IsServer())
+	assert.False(t, DirectionTransit.IsServer())
+	assert.Equal(t, "transit", DirectionTransit.String())
+}
@@ -0,0 +1,119 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/vishvananda/netns"
+)
+
+// ErrNamespaceNotFound is returned by DumpNamespace when no process runs in the requested namespace
+var ErrNamespaceNotFound = errors.New("network namespace not found")
+
+// DumpNamespace returns a channel of Event objects containing the entries of the conntrack table
+// of the network namespace with the given inode only, e.g. to inspect the table of a pod. The
+// root namespace isn't dumped unless it's the requested one. The channel is closed once all
+// entries are read. Like DumpTable, it returns ErrDumpInProgress while another dump is running,
+// and records the DumpStats and DumpReport of the dump.
+func (c *Consumer) DumpNamespace(family uint8, inode uint32) (<-chan Event, error) {
+	if !atomic.CompareAndSwapInt32(&c.dumping, 0, 1) {
+		return nil, ErrDumpInProgress
+	}
+
+	ns, err := c.findNamespace(inode)
+	if err != nil {
+		atomic.StoreInt32(&c.dumping, 0)
+		return nil, fmt.Errorf("error dumping conntrack table of namespace %d: %w", inode, err)
+	}
+
+	output := make(chan Event, outputBuffer)
+	go func() {
+		defer func() {
+			close(output)
+			_ = ns.Close()
+			atomic.StoreInt32(&c.dumping, 0)
+		}()
+
+		c.dumpSingleNamespace(family, output, ns, inode)
+	}()
+
+	return output, nil
+}
+
+// findNamespace returns the handle of the network namespace with the given inode. The caller is
+// responsible for closing it.
+func (c *Consumer) findNamespace(inode uint32) (netns.NsHandle, error) {
+	nss, err := c.listNamespaces()
+	if err != nil {
+		return netns.None(), fmt.Errorf("could not get network namespaces: %w", err)
+	}
+
+	found := netns.None()
+	for _, ns := range nss {
+		if !found.IsOpen() {
+			if nsInode, err := namespaceInode(ns); err == nil && nsInode == inode {
+				found = ns
+				continue
+			}
+		}
+		_ = ns.Close()
+	}
+	if !found.IsOpen() {
+		return netns.None(), ErrNamespaceNotFound
+	}
+	return found, nil
+}
+
+// dumpSingleNamespace dumps the table of ns, and records the stats and the report of the dump
+func (c *Consumer) dumpSingleNamespace(family uint8, output chan Event, ns netns.NsHandle, inode uint32) {
+	c.dumpFamily = family
+	c.dumpEntries = 0
+	if c.dumpPacer != nil {
+		c.dumpPacer.reset()
+	}
+
+	ctx, abortErr, cancel := c.withMaxDumpDuration(context.Background())
+	defer cancel()
+
+	start := time.Now()
+	err := c.dumpNS(ctx, family, output, ns)
+	duration := time.Since(start)
+
+	outcome := NamespaceDumped
+	truncated := false
+	switch {
+	case err == nil:
+	case abortErr() == ErrMaxDumpDuration:
+		truncated = true
+		outcome = NamespaceTruncated
+		err = ErrMaxDumpDuration
+	case errors.Is(err, ErrNamespaceGone):
+		atomic.AddInt64(&c.staleNamespacesSkipped, 1)
+		outcome = NamespaceGone
+	case err != nil:
+		log.Printf("error dumping conntrack table for namespace %d: %s", inode, err)
+		outcome = NamespaceFailed
+	}
+
+	c.dumpStatsMutex.Lock()
+	c.dumpStats = DumpStats{
+		Duration:   duration,
+		Namespaces: []NamespaceDumpStats{{NSInode: inode, Duration: duration}},
+	}
+	c.dumpReport = DumpReport{
+		Namespaces: []NamespaceDumpReport{{NSInode: inode, Outcome: outcome, Entries: c.dumpEntries, Err: err}},
+		Truncated:  truncated,
+	}
+	c.dumpStatsMutex.Unlock()
+
+	if c.dumpCompleteMarker && !truncated {
+		output <- Event{dumpComplete: true}
+	}
+}
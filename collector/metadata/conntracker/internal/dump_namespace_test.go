@@ -0,0 +1,66 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+func TestDumpNamespace(t *testing.T) {
+	nss, inodes := newFakeNamespaces(t, 3)
+
+	c := NewConsumer(t.TempDir(), -1, true)
+	defer c.Stop()
+	// The enumerator returns handles of its own, which are closed by DumpNamespace
+	c.listNamespaces = func() ([]netns.NsHandle, error) {
+		var handles []netns.NsHandle
+		for _, ns := range nss {
+			fd, err := unix.Dup(int(ns))
+			require.NoError(t, err)
+			handles = append(handles, netns.NsHandle(fd))
+		}
+		return handles, nil
+	}
+	var dumped []uint32
+	c.dumpNS = func(ctx context.Context, family uint8, output chan Event, ns netns.NsHandle) error {
+		inode, err := namespaceInode(ns)
+		require.NoError(t, err)
+		dumped = append(dumped, inode)
+		c.dumpEntries = 1
+		output <- Event{msgs: []netlink.Message{{}}, netns: int32(ns)}
+		return nil
+	}
+
+	events, err := c.DumpNamespace(unix.AF_INET, inodes[1])
+	require.NoError(t, err)
+	count := 0
+	for range events {
+		count++
+	}
+
+	// Only the requested namespace is dumped, not the root one
+	assert.Equal(t, 1, count)
+	assert.Equal(t, []uint32{inodes[1]}, dumped)
+	report := c.DumpReport()
+	require.Len(t, report.Namespaces, 1)
+	assert.Equal(t, NamespaceDumpReport{NSInode: inodes[1], Outcome: NamespaceDumped, Entries: 1}, report.Namespaces[0])
+
+	_, err = c.DumpNamespace(unix.AF_INET, 0)
+	assert.ErrorIs(t, err, ErrNamespaceNotFound)
+	assert.Len(t, dumped, 1)
+
+	// The dump slot is released after a failed lookup
+	events, err = c.DumpNamespace(unix.AF_INET, inodes[2])
+	require.NoError(t, err)
+	for range events {
+	}
+	assert.Equal(t, []uint32{inodes[1], inodes[2]}, dumped)
+}
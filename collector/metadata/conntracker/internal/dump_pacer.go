@@ -0,0 +1,70 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"context"
+	"time"
+)
+
+// WithDumpRateLimit paces the conntrack table dumps to at most entriesPerSecond entries, across
+// all the namespaces of a dump. A dump of a large table then takes longer, but it doesn't peg a
+// CPU core while racing through the entries, which matters on shared nodes. The kernel only
+// generates the next entries of a dump as they're read, so pacing the reads paces the kernel too.
+// Streaming isn't affected.
+func WithDumpRateLimit(entriesPerSecond int) ConsumerOption {
+	return func(c *Consumer) {
+		if entriesPerSecond > 0 {
+			c.dumpPacer = newDumpPacer(entriesPerSecond)
+		}
+	}
+}
+
+// dumpPacer delays the reads of a dump so that its entries are read at a steady rate
+type dumpPacer struct {
+	rate    int
+	start   time.Time
+	entries int
+
+	// for testing purposes
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func newDumpPacer(rate int) *dumpPacer {
+	return &dumpPacer{
+		rate:  rate,
+		now:   time.Now,
+		sleep: sleepContext,
+	}
+}
+
+// reset starts pacing a new dump
+func (p *dumpPacer) reset() {
+	p.start = p.now()
+	p.entries = 0
+}
+
+// wait accounts for n entries read, and blocks until the rate allows reading the next ones.
+// It returns early with the error of ctx once it's done.
+func (p *dumpPacer) wait(ctx context.Context, n int) error {
+	p.entries += n
+	due := time.Duration(float64(p.entries) / float64(p.rate) * float64(time.Second))
+	if ahead := due - p.now().Sub(p.start); ahead > 0 {
+		return p.sleep(ctx, ahead)
+	}
+	return nil
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,77 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestDumpRateLimit(t *testing.T) {
+	c := NewConsumer(t.TempDir(), -1, false, WithDumpRateLimit(2000))
+	defer c.Stop()
+
+	// A fake clock, which only advances when sleeping
+	now := time.Now()
+	start := now
+	c.dumpPacer.now = func() time.Time { return now }
+	c.dumpPacer.sleep = func(_ context.Context, d time.Duration) error {
+		now = now.Add(d)
+		return nil
+	}
+
+	// A dump of 1000 entries, in batches of 100
+	msg := netlink.Message{Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK << 8)}}
+	batches := 0
+	read := func(b []byte) ([]netlink.Message, int32, error) {
+		batches++
+		msgs := make([]netlink.Message, 100, 101)
+		for i := range msgs {
+			msgs[i] = msg
+		}
+		if batches == 10 {
+			msgs = append(msgs, netlink.Message{Header: netlink.Header{Type: netlink.Done}})
+		}
+		return msgs, 0, nil
+	}
+	c.readFn = read
+	c.dumpMode = true
+
+	c.dumpPacer.reset()
+	output := make(chan Event, outputBuffer)
+	require.NoError(t, c.receive(context.Background(), output))
+	assert.Equal(t, 10, batches)
+	// The last batch ends the dump, so it isn't waited for
+	assert.Equal(t, 450*time.Millisecond, now.Sub(start))
+
+	// Streaming isn't paced
+	c.setStreaming(true)
+	c.dumpMode = false
+	batches, start = 0, now
+	c.readFn = func(b []byte) ([]netlink.Message, int32, error) {
+		if batches == 10 {
+			return nil, 0, errors.New("read netlink: use of closed file")
+		}
+		return read(b)
+	}
+	output = make(chan Event, 2*outputBuffer)
+	require.NoError(t, c.receive(context.Background(), output))
+	assert.Equal(t, start, now)
+}
+
+func TestDumpPacerContext(t *testing.T) {
+	p := newDumpPacer(1)
+	p.reset()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, p.wait(ctx, 100), context.Canceled)
+}
@@ -0,0 +1,85 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+// NamespaceDumpOutcome is what happened to a namespace during a conntrack table dump
+type NamespaceDumpOutcome string
+
+const (
+	// NamespaceDumped means that the table of the namespace was dumped
+	NamespaceDumped NamespaceDumpOutcome = "dumped"
+	// NamespaceFailed means that the dump of the namespace returned an error
+	NamespaceFailed NamespaceDumpOutcome = "failed"
+	// NamespaceGone means that the namespace was deleted before it could be dumped
+	NamespaceGone NamespaceDumpOutcome = "gone"
+	// NamespaceNotPeer means that the namespace was skipped because it has no nsid in the
+	// root namespace, so its streamed events can't be attributed to it
+	NamespaceNotPeer NamespaceDumpOutcome = "not_peer"
+	// NamespaceEmpty means that the namespace was skipped because its table was empty,
+	// see WithSkipEmptyNamespaces
+	NamespaceEmpty NamespaceDumpOutcome = "empty"
+	// NamespaceDeferred means that the namespace was left to the next dumps,
+	// see WithMaxNamespacesPerDump
+	NamespaceDeferred NamespaceDumpOutcome = "deferred"
+	// NamespaceAborted means that the namespace wasn't dumped because the dump was aborted
+	NamespaceAborted NamespaceDumpOutcome = "aborted"
+	// NamespaceExcluded means that the namespace was skipped by the namespace filter,
+	// see WithNamespaceFilter
+	NamespaceExcluded NamespaceDumpOutcome = "excluded"
+	// NamespaceTruncated means that the dump of the namespace was interrupted once the maximum
+	// dump duration was reached, so only part of its entries were emitted, see WithMaxDumpDuration
+	NamespaceTruncated NamespaceDumpOutcome = "truncated"
+)
+
+// DumpReport lists the outcome of each namespace of the last conntrack table dump, so that its
+// completeness can be audited
+type DumpReport struct {
+	// Namespaces holds the report of the root namespace first, then of the other namespaces
+	Namespaces []NamespaceDumpReport
+	// Truncated is set when the dump was stopped by the maximum dump duration, see WithMaxDumpDuration
+	Truncated bool
+}
+
+// NamespaceDumpReport is the outcome of the dump of a single namespace
+type NamespaceDumpReport struct {
+	// NSInode is the inode of the namespace, or 0 if it couldn't be determined
+	NSInode uint32
+	Outcome NamespaceDumpOutcome
+	// Entries is the number of entries emitted by the dump of the namespace
+	Entries int
+	// Err is the error of a failed dump
+	Err error
+}
+
+// Complete reports whether every namespace was dumped, deferred ones aside
+func (r DumpReport) Complete() bool {
+	if r.Truncated {
+		return false
+	}
+	for _, ns := range r.Namespaces {
+		switch ns.Outcome {
+		case NamespaceFailed, NamespaceAborted, NamespaceTruncated:
+			return false
+		}
+	}
+	return true
+}
+
+// Count returns the number of namespaces with the given outcome
+func (r DumpReport) Count(outcome NamespaceDumpOutcome) int {
+	n := 0
+	for _, ns := range r.Namespaces {
+		if ns.Outcome == outcome {
+			n++
+		}
+	}
+	return n
+}
+
+// DumpReport returns the outcome of each namespace of the last completed conntrack table dump
+func (c *Consumer) DumpReport() DumpReport {
+	c.dumpStatsMutex.Lock()
+	defer c.dumpStatsMutex.Unlock()
+	return c.dumpReport
+}
@@ -86,8 +86,19 @@ func marshalIPTuple(ae *netlink.AttributeEncoder, tuple *ct.IPTuple) error {
 func marshalProto(ae *netlink.AttributeEncoder, proto *ct.ProtoTuple) error {
 	ae.ByteOrder = binary.BigEndian
 	ae.Uint8(ctaProtoNum, *proto.Number)
-	ae.Uint16(ctaProtoSrcPort, *proto.SrcPort)
-	ae.Uint16(ctaProtoDstPort, *proto.DstPort)
+	switch {
+	case proto.IcmpType != nil:
+		ae.Uint16(ctaProtoIcmpID, *proto.IcmpID)
+		ae.Uint8(ctaProtoIcmpType, *proto.IcmpType)
+		ae.Uint8(ctaProtoIcmpCode, *proto.IcmpCode)
+	case proto.Icmpv6Type != nil:
+		ae.Uint16(ctaProtoIcmpv6ID, *proto.Icmpv6ID)
+		ae.Uint8(ctaProtoIcmpv6Type, *proto.Icmpv6Type)
+		ae.Uint8(ctaProtoIcmpv6Code, *proto.Icmpv6Code)
+	default:
+		ae.Uint16(ctaProtoSrcPort, *proto.SrcPort)
+		ae.Uint16(ctaProtoDstPort, *proto.DstPort)
+	}
 	ae.ByteOrder = nlenc.NativeEndian()
 	return nil
 }
@@ -0,0 +1,17 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import "sync/atomic"
+
+// countENOBUFSBackpressure records whether the output channel was full when an ENOBUFS error
+// was received. When it was, the receive loop was likely blocked on a slow consumer of the
+// events, which let the socket buffer overflow: the enobufs_while_channel_full / enobufs ratio
+// tells whether the events should be processed faster downstream, rather than the receive
+// buffer be grown to absorb the bursts of the kernel.
+func (c *Consumer) countENOBUFSBackpressure(output chan Event) {
+	if cap(output) > 0 && len(output) == cap(output) {
+		atomic.AddInt64(&c.enobufsWhileChannelFull, 1)
+	}
+}
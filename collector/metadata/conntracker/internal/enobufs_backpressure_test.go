@@ -0,0 +1,45 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestENOBUFSWhileChannelFull(t *testing.T) {
+	// fails a read with ENOBUFS before closing the socket, and returns the stats of the consumer
+	receiveENOBUFS := func(output chan Event) Stats {
+		c := NewConsumer(t.TempDir(), 1000, false)
+		defer c.Stop()
+		c.setStreaming(true)
+		reads := 0
+		c.readFn = func(b []byte) ([]netlink.Message, int32, error) {
+			reads++
+			if reads == 1 {
+				return nil, 0, os.NewSyscallError("recvmsg", unix.ENOBUFS)
+			}
+			return nil, 0, errors.New("read netlink: use of closed file")
+		}
+		require.NoError(t, c.receive(context.Background(), output))
+		return c.Stats()
+	}
+
+	full := make(chan Event, 1)
+	full <- Event{}
+	stats := receiveENOBUFS(full)
+	assert.Equal(t, int64(1), stats.Enobufs)
+	assert.Equal(t, int64(1), stats.EnobufsWhileChannelFull)
+
+	stats = receiveENOBUFS(make(chan Event, 1))
+	assert.Equal(t, int64(1), stats.Enobufs)
+	assert.Equal(t, int64(0), stats.EnobufsWhileChannelFull)
+}
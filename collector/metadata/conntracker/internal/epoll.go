@@ -0,0 +1,295 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// errNamespaceEventsStarted is returned by NamespaceEvents when it was already called
+	errNamespaceEventsStarted = errors.New("conntrack consumer is already streaming namespace events")
+	// errConsumerStopped is returned by NamespaceEvents once the Consumer is stopped
+	errConsumerStopped = errors.New("conntrack consumer is stopped")
+)
+
+// epollReceiver services multiple netlink sockets (typically one per network namespace)
+// from a single goroutine, instead of running one receive loop per socket.
+type epollReceiver struct {
+	epfd int
+	// wakefd is an eventfd used to interrupt epoll_wait when the receiver is closed
+	wakefd  int
+	sockets map[int32]*epollSocket
+	pool    *sync.Pool
+
+	// done is closed by close, to interrupt the loop while it's blocked on the output channel
+	done      chan struct{}
+	closeOnce sync.Once
+	// mu guards wakefd, which mustn't be written once released closed it: its number may
+	// already have been reused by another file
+	mu       sync.Mutex
+	released bool
+}
+
+type epollSocket struct {
+	socket  *Socket
+	nsInode uint32
+}
+
+func newEpollReceiver(pool *sync.Pool) (*epollReceiver, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("epoll_create1", err)
+	}
+
+	wakefd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		unix.Close(epfd)
+		return nil, os.NewSyscallError("eventfd", err)
+	}
+
+	r := &epollReceiver{
+		epfd:    epfd,
+		wakefd:  wakefd,
+		sockets: make(map[int32]*epollSocket),
+		pool:    pool,
+		done:    make(chan struct{}),
+	}
+
+	if err := r.register(wakefd); err != nil {
+		r.release()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// add registers the socket with the receiver. Messages read from it will be tagged with nsInode.
+func (r *epollReceiver) add(s *Socket, nsInode uint32) error {
+	fd := s.rawFD()
+	if err := r.register(fd); err != nil {
+		return err
+	}
+
+	r.sockets[int32(fd)] = &epollSocket{socket: s, nsInode: nsInode}
+	return nil
+}
+
+func (r *epollReceiver) register(fd int) error {
+	event := unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(fd)}
+	if err := unix.EpollCtl(r.epfd, unix.EPOLL_CTL_ADD, fd, &event); err != nil {
+		return os.NewSyscallError("epoll_ctl", err)
+	}
+	return nil
+}
+
+// close wakes up the receive loop, which releases all the sockets. It's a no-op once released.
+func (r *epollReceiver) close() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if !r.released {
+			_, _ = unix.Write(r.wakefd, []byte{1, 0, 0, 0, 0, 0, 0, 0})
+		}
+	})
+}
+
+// release closes the sockets and the descriptors of the receiver. Only the first call has effect.
+func (r *epollReceiver) release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.released {
+		return
+	}
+	r.released = true
+
+	for _, s := range r.sockets {
+		_ = s.socket.Close()
+	}
+	unix.Close(r.wakefd)
+	unix.Close(r.epfd)
+}
+
+// NamespaceEvents returns a channel of Event objects which receives all new connections added
+// to the Conntrack tables of the given network namespaces (or the events of the groups set with WithGroups).
+// Unlike Events(), which relies on NETLINK_LISTEN_ALL_NSID, a dedicated netlink socket is opened
+// within each namespace. All sockets are serviced by a single goroutine using epoll, so the number
+// of goroutines stays constant regardless of how many namespaces are monitored. This saves the
+// goroutines and their stacks, not CPU: the loop blocks a thread in epoll_wait rather than
+// parking in the Go netpoller, so it isn't faster than a goroutine per socket, and may be slower,
+// see the benchmarks of epoll_test.go. It's opt-in, and Events() doesn't use it.
+// Events are tagged with the inode of the namespace they were received from (see Event.NSInode).
+// Throttling and sampling are not applied to these sockets. No socket is opened for the
+// namespaces excluded by WithNamespaceFilter.
+// The caller may close the given handles once this method returns. It can only be called once,
+// and not after Stop.
+func (c *Consumer) NamespaceEvents(nss []netns.NsHandle) (<-chan Event, error) {
+	// the lock is held until the receiver is set, so that Stop closes it
+	c.epollMutex.Lock()
+	defer c.epollMutex.Unlock()
+	if c.epoll != nil {
+		return nil, errNamespaceEventsStarted
+	}
+	if atomic.LoadInt32(&c.stopped) == 1 {
+		return nil, errConsumerStopped
+	}
+
+	receiver, err := newEpollReceiver(c.pool)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize epoll receiver: %w", err)
+	}
+
+	for _, ns := range nss {
+		inode, err := namespaceInode(ns)
+		if err != nil {
+			receiver.release()
+			return nil, fmt.Errorf("could not get inode of net ns %d: %w", int(ns), err)
+		}
+		if !c.includesNamespace(inode) {
+			continue
+		}
+
+		sock, err := newSocketIn(func(fn func() error) error {
+			return c.withNS(ns, fn)
+		})
+		if err != nil {
+			receiver.release()
+			return nil, fmt.Errorf("could not open netlink socket for net ns %d: %w", inode, err)
+		}
+
+		if err := c.joinGroups(sock); err != nil {
+			_ = sock.Close()
+			receiver.release()
+			return nil, fmt.Errorf("could not subscribe net ns %d: %w", inode, err)
+		}
+
+		if err := receiver.add(sock, inode); err != nil {
+			_ = sock.Close()
+			receiver.release()
+			return nil, err
+		}
+	}
+
+	c.epoll = receiver
+	output := make(chan Event, outputBuffer)
+	go func() {
+		defer func() {
+			receiver.release()
+			close(output)
+		}()
+
+		c.receiveEpoll(receiver, output)
+	}()
+
+	return output, nil
+}
+
+// receiveEpoll reads netlink messages off every socket registered with the receiver
+// and flushes them to the Event channel, until the receiver is closed.
+func (c *Consumer) receiveEpoll(r *epollReceiver, output chan Event) {
+	events := make([]unix.EpollEvent, len(r.sockets)+1)
+	local := c.newLocalCounters()
+	defer c.flushCounters(local)
+	for {
+		n, err := unix.EpollWait(r.epfd, events, -1)
+		if err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			log.Printf("exiting conntrack epoll receive loop due to epoll_wait error: %s", err)
+			return
+		}
+
+	EventLoop:
+		for _, event := range events[:n] {
+			if event.Fd == int32(r.wakefd) {
+				return
+			}
+
+			s, ok := r.sockets[event.Fd]
+			if !ok {
+				continue
+			}
+
+			buffer := c.pool.Get().(*[]byte)
+			msgs, _, err := s.socket.TryReceiveInto(*buffer)
+			if err != nil {
+				if errors.Is(err, unix.EAGAIN) {
+					c.pool.Put(buffer)
+					continue
+				}
+
+				switch socketError(err) {
+				case errENOBUF:
+					atomic.AddInt64(&c.enobufs, 1)
+					c.countENOBUFSBackpressure(output)
+				default:
+					atomic.AddInt64(&c.readErrors, 1)
+				}
+			}
+
+			if len(msgs) == 0 {
+				c.pool.Put(buffer)
+				continue
+			}
+
+			// Messages with error codes are simply skipped
+			for i := range msgs {
+				if err := checkMessage(&msgs[i]); err != nil {
+					atomic.AddInt64(&c.msgErrors, 1)
+					c.countMessageError(true)
+					c.pool.Put(buffer)
+					continue EventLoop
+				}
+			}
+			if msgs = c.filterMessageTypes(msgs); len(msgs) == 0 {
+				c.pool.Put(buffer)
+				continue
+			}
+			c.countMessages(local, msgs)
+
+			if msgs = c.filterCIDRs(msgs); len(msgs) == 0 {
+				c.pool.Put(buffer)
+				continue
+			}
+
+			msgs, limitReached := c.limitEvents(msgs, true)
+			if len(msgs) > 0 {
+				e := c.eventFor(msgs, 0, buffer)
+				e.nsInode = s.nsInode
+				c.firstEvent.signal()
+				select {
+				case output <- e:
+				case <-r.done:
+					c.pool.Put(buffer)
+					return
+				}
+			} else {
+				c.pool.Put(buffer)
+			}
+			if limitReached {
+				return
+			}
+		}
+	}
+}
+
+// namespaceInode returns the inode number identifying the given network namespace
+func namespaceInode(ns netns.NsHandle) (uint32, error) {
+	var stat unix.Stat_t
+	if err := unix.Fstat(int(ns), &stat); err != nil {
+		return 0, err
+	}
+	return uint32(stat.Ino), nil
+}
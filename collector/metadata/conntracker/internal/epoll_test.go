@@ -0,0 +1,229 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestEpollReceiver(t *testing.T) {
+	sockets, sender := newUnicastSockets(t, 3)
+	defer unix.Close(sender)
+
+	c := &Consumer{pool: newBufferPool()}
+	r, err := newEpollReceiver(c.pool)
+	require.NoError(t, err)
+	for i, s := range sockets {
+		require.NoError(t, r.add(s, uint32(1000+i)))
+	}
+
+	output := make(chan Event, outputBuffer)
+	done := make(chan struct{})
+	go func() {
+		c.receiveEpoll(r, output)
+		close(done)
+	}()
+
+	for _, s := range sockets {
+		sendTestMessage(t, sender, s)
+	}
+
+	seen := make(map[uint32]int)
+	for i := 0; i < len(sockets); i++ {
+		e := <-output
+		assert.Len(t, e.Messages(), 1)
+		seen[e.NSInode()]++
+		e.Done()
+	}
+	assert.Equal(t, map[uint32]int{1000: 1, 1001: 1, 1002: 1}, seen)
+
+	r.close()
+	<-done
+	r.release()
+}
+
+func TestEpollReceiverCloseWhileBlocked(t *testing.T) {
+	sockets, sender := newUnicastSockets(t, 1)
+	defer unix.Close(sender)
+
+	c := &Consumer{pool: newBufferPool()}
+	r, err := newEpollReceiver(c.pool)
+	require.NoError(t, err)
+	require.NoError(t, r.add(sockets[0], 1000))
+
+	// nobody reads the output, so the loop blocks once it read the message
+	output := make(chan Event)
+	done := make(chan struct{})
+	go func() {
+		c.receiveEpoll(r, output)
+		close(done)
+	}()
+	sendTestMessage(t, sender, sockets[0])
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&c.familyCounters.ipv4.messages) == 1
+	}, time.Second, time.Millisecond)
+
+	r.close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "epoll receive loop blocked on the output channel after close")
+	}
+	r.release()
+
+	// closing a released receiver doesn't write to its closed eventfd
+	r.release()
+	released, err := newEpollReceiver(c.pool)
+	require.NoError(t, err)
+	released.release()
+	released.close()
+	<-released.done
+}
+
+func TestNamespaceEventsOnce(t *testing.T) {
+	c := NewConsumer(t.TempDir(), -1, false)
+	events, err := c.NamespaceEvents(nil)
+	require.NoError(t, err)
+
+	// a second receiver would never be closed by Stop
+	_, err = c.NamespaceEvents(nil)
+	assert.ErrorIs(t, err, errNamespaceEventsStarted)
+
+	c.Stop()
+	for range events {
+	}
+
+	stopped := NewConsumer(t.TempDir(), -1, false)
+	stopped.Stop()
+	_, err = stopped.NamespaceEvents(nil)
+	assert.ErrorIs(t, err, errConsumerStopped)
+}
+
+// The receive benchmarks report the goroutines running for benchmarkSockets sockets, which is
+// what the epoll receiver saves: its latency isn't lower than a goroutine per socket.
+const benchmarkSockets = 100
+
+func BenchmarkReceiveGoroutinePerSocket(b *testing.B) {
+	sockets, sender := newUnicastSockets(b, benchmarkSockets)
+	defer unix.Close(sender)
+
+	pool := newBufferPool()
+	output := make(chan Event, outputBuffer)
+	goroutines := runtime.NumGoroutine()
+	var wg sync.WaitGroup
+	for _, s := range sockets {
+		wg.Add(1)
+		go func(s *Socket) {
+			defer wg.Done()
+			for {
+				buffer := pool.Get().(*[]byte)
+				msgs, _, err := s.ReceiveInto(*buffer)
+				if err != nil {
+					return
+				}
+				output <- Event{msgs: msgs, buffer: buffer, pool: pool}
+			}
+		}(s)
+	}
+	goroutines = runtime.NumGoroutine() - goroutines
+	b.ReportAllocs()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, s := range sockets {
+			sendTestMessage(b, sender, s)
+		}
+		for range sockets {
+			e := <-output
+			e.Done()
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(goroutines), "goroutines")
+
+	closeSockets(sockets)
+	wg.Wait()
+}
+
+func BenchmarkReceiveEpoll(b *testing.B) {
+	sockets, sender := newUnicastSockets(b, benchmarkSockets)
+	defer unix.Close(sender)
+
+	c := &Consumer{pool: newBufferPool()}
+	r, err := newEpollReceiver(c.pool)
+	require.NoError(b, err)
+	for i, s := range sockets {
+		require.NoError(b, r.add(s, uint32(i)))
+	}
+
+	output := make(chan Event, outputBuffer)
+	done := make(chan struct{})
+	goroutines := runtime.NumGoroutine()
+	go func() {
+		c.receiveEpoll(r, output)
+		close(done)
+	}()
+	goroutines = runtime.NumGoroutine() - goroutines
+	b.ReportAllocs()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, s := range sockets {
+			sendTestMessage(b, sender, s)
+		}
+		for range sockets {
+			e := <-output
+			e.Done()
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(goroutines), "goroutines")
+
+	r.close()
+	<-done
+	r.release()
+}
+
+// newUnicastSockets returns n netlink sockets along with the fd of a
+// netlink socket that can be used to send them unicast messages.
+func newUnicastSockets(tb testing.TB, n int) ([]*Socket, int) {
+	sender, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		tb.Skipf("could not create netlink socket: %s", err)
+	}
+
+	sockets := make([]*Socket, 0, n)
+	for i := 0; i < n; i++ {
+		s, err := NewSocket()
+		require.NoError(tb, err)
+		sockets = append(sockets, s)
+	}
+
+	return sockets, sender
+}
+
+func sendTestMessage(tb testing.TB, sender int, to *Socket) {
+	m := netlink.Message{
+		Header: netlink.Header{Length: 20, Type: netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK << 8)},
+		Data:   []byte{unix.AF_INET, unix.NFNETLINK_V0, 0, 0},
+	}
+	b, err := m.MarshalBinary()
+	require.NoError(tb, err)
+	require.NoError(tb, unix.Sendto(sender, b, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Pid: to.pid}))
+}
+
+func closeSockets(sockets []*Socket) {
+	for _, s := range sockets {
+		_ = s.Close()
+	}
+}
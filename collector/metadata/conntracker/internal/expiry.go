@@ -0,0 +1,102 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Conntrack TCP states (enum tcp_conntrack), as decoded in ProtoInfo.TCP.State
+const (
+	tcpStateSynSent     = 1
+	tcpStateSynRecv     = 2
+	tcpStateEstablished = 3
+	tcpStateFinWait     = 4
+	tcpStateCloseWait   = 5
+	tcpStateLastAck     = 6
+	tcpStateTimeWait    = 7
+	tcpStateClose       = 8
+)
+
+// tcpTimeoutSysctls are the sysctls holding the timeout of the TCP states, in seconds
+var tcpTimeoutSysctls = map[uint8]string{
+	tcpStateSynSent:     "nf_conntrack_tcp_timeout_syn_sent",
+	tcpStateSynRecv:     "nf_conntrack_tcp_timeout_syn_recv",
+	tcpStateEstablished: "nf_conntrack_tcp_timeout_established",
+	tcpStateFinWait:     "nf_conntrack_tcp_timeout_fin_wait",
+	tcpStateCloseWait:   "nf_conntrack_tcp_timeout_close_wait",
+	tcpStateLastAck:     "nf_conntrack_tcp_timeout_last_ack",
+	tcpStateTimeWait:    "nf_conntrack_tcp_timeout_time_wait",
+	tcpStateClose:       "nf_conntrack_tcp_timeout_close",
+}
+
+// TCPTimeouts are the timeouts of the conntrack entries of TCP connections configured in the
+// kernel, by TCP state
+type TCPTimeouts map[uint8]time.Duration
+
+// ReadTCPTimeouts reads the TCP timeouts of the root namespace from the
+// nf_conntrack_tcp_timeout_* sysctls under procRoot
+func ReadTCPTimeouts(procRoot string) (TCPTimeouts, error) {
+	timeouts := make(TCPTimeouts, len(tcpTimeoutSysctls))
+	for state, name := range tcpTimeoutSysctls {
+		seconds, err := readConntrackSysctl(procRoot, name)
+		if err != nil {
+			return nil, fmt.Errorf("could not read TCP conntrack timeouts: %w", err)
+		}
+		timeouts[state] = time.Duration(seconds) * time.Second
+	}
+	return timeouts, nil
+}
+
+// ExpiryEstimator estimates whether conntrack entries are still alive, for the connections whose
+// DESTROY event was missed, e.g. dropped by sampling or received before a restart. It relies on
+// the remaining timeout of the entries (CTA_TIMEOUT) as of their last event.
+type ExpiryEstimator struct {
+	timeouts TCPTimeouts
+	now      func() time.Time
+}
+
+// NewExpiryEstimator returns an ExpiryEstimator for the given kernel TCP timeouts, see ReadTCPTimeouts
+func NewExpiryEstimator(timeouts TCPTimeouts) *ExpiryEstimator {
+	return &ExpiryEstimator{
+		timeouts: timeouts,
+		now:      time.Now,
+	}
+}
+
+// LikelyExpired reports whether the entry of the connection has likely expired since it was
+// decoded. Conntrack entries are refreshed by the packets of their connection without emitting
+// events, so the timeout of the last event is a lower bound of the lifetime of the entry. TCP
+// connections which weren't closing yet may have been established since, so they're given the
+// established timeout of the kernel from the time they were decoded.
+//
+// It returns false when the remaining timeout of the entry wasn't decoded (see DecodeTimeout).
+func (e *ExpiryEstimator) LikelyExpired(conn *Con) bool {
+	if conn == nil || conn.Timeout == nil || conn.TimeoutAt.IsZero() {
+		return false
+	}
+
+	deadline := conn.TimeoutAt
+	if state, ok := tcpState(conn); ok && state <= tcpStateEstablished {
+		decodedAt := conn.TimeoutAt.Add(-time.Duration(*conn.Timeout) * time.Second)
+		if established := decodedAt.Add(e.timeouts[tcpStateEstablished]); established.After(deadline) {
+			deadline = established
+		}
+	}
+	return e.now().After(deadline)
+}
+
+// tcpState returns the TCP state of the connection, if it's a TCP connection whose state was decoded
+func tcpState(conn *Con) (uint8, bool) {
+	if conn.Origin == nil || conn.Origin.Proto == nil || conn.Origin.Proto.Number == nil || *conn.Origin.Proto.Number != unix.IPPROTO_TCP {
+		return 0, false
+	}
+	if conn.ProtoInfo == nil || conn.ProtoInfo.TCP == nil || conn.ProtoInfo.TCP.State == nil {
+		return 0, false
+	}
+	return *conn.ProtoInfo.TCP.State, true
+}
@@ -0,0 +1,73 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestReadTCPTimeouts(t *testing.T) {
+	procRoot := t.TempDir()
+	dir := filepath.Join(procRoot, "sys/net/netfilter")
+	require.NoError(t, os.MkdirAll(dir, 0o755))
+
+	_, err := ReadTCPTimeouts(procRoot)
+	assert.Error(t, err)
+
+	for _, name := range tcpTimeoutSysctls {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte("120\n"), 0o644))
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "nf_conntrack_tcp_timeout_established"), []byte("432000\n"), 0o644))
+	timeouts, err := ReadTCPTimeouts(procRoot)
+	require.NoError(t, err)
+	assert.Len(t, timeouts, len(tcpTimeoutSysctls))
+	assert.Equal(t, 5*24*time.Hour, timeouts[tcpStateEstablished])
+	assert.Equal(t, 2*time.Minute, timeouts[tcpStateTimeWait])
+}
+
+func TestLikelyExpired(t *testing.T) {
+	now := time.Now()
+	e := NewExpiryEstimator(TCPTimeouts{tcpStateEstablished: time.Hour})
+	e.now = func() time.Time { return now }
+
+	// conn returns an entry decoded 10 minutes ago with the given remaining timeout
+	conn := func(proto uint8, state uint8, timeout time.Duration) *Con {
+		seconds := uint32(timeout / time.Second)
+		c := &Con{
+			Con: ct.Con{
+				Origin:  newIPTuple("10.0.2.15", "1.1.1.1", 58472, 443, proto),
+				Reply:   newIPTuple("1.1.1.1", "10.0.2.15", 443, 58472, proto),
+				Timeout: &seconds,
+			},
+			TimeoutAt: now.Add(-10 * time.Minute).Add(timeout),
+		}
+		if proto == unix.IPPROTO_TCP {
+			c.ProtoInfo = &ct.ProtoInfo{TCP: &ct.TCPInfo{State: &state}}
+		}
+		return c
+	}
+
+	// The remaining timeout elapsed
+	assert.True(t, e.LikelyExpired(conn(unix.IPPROTO_UDP, 0, 30*time.Second)))
+	assert.True(t, e.LikelyExpired(conn(unix.IPPROTO_TCP, tcpStateTimeWait, 2*time.Minute)))
+	// The remaining timeout didn't elapse
+	assert.False(t, e.LikelyExpired(conn(unix.IPPROTO_UDP, 0, time.Hour)))
+	assert.False(t, e.LikelyExpired(conn(unix.IPPROTO_TCP, tcpStateTimeWait, 20*time.Minute)))
+	// A new TCP connection may have been established since
+	assert.False(t, e.LikelyExpired(conn(unix.IPPROTO_TCP, tcpStateSynSent, 2*time.Minute)))
+
+	// The timeout wasn't decoded
+	noTimeout := conn(unix.IPPROTO_UDP, 0, 30*time.Second)
+	noTimeout.Timeout = nil
+	assert.False(t, e.LikelyExpired(noTimeout))
+}
@@ -0,0 +1,70 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"sync/atomic"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// familyStats are the counters of the messages of a single address family
+type familyStats struct {
+	messages  int64
+	msgErrors int64
+}
+
+// familyCounters breaks the main counters down by address family. Messages are attributed
+// using the family of their nfgenmsg header, which is the family of their tuples.
+type familyCounters struct {
+	ipv4, ipv6, unspec familyStats
+}
+
+func (f *familyCounters) of(family uint8) *familyStats {
+	switch family {
+	case unix.AF_INET:
+		return &f.ipv4
+	case unix.AF_INET6:
+		return &f.ipv6
+	default:
+		return &f.unspec
+	}
+}
+
+// countMessages attributes the received messages to their family
+func (f *familyCounters) countMessages(msgs []netlink.Message) {
+	for i := range msgs {
+		atomic.AddInt64(&f.of(messageFamily(msgs[i].Data)).messages, 1)
+	}
+}
+
+// GetStatsByFamily returns the main counters of the Consumer broken down by address family,
+// under the "ipv4" and "ipv6" keys. Messages whose family is unknown are counted under "unspec":
+// netlink error messages don't carry the family, so errors received while streaming end up there,
+// whereas errors received during a dump are attributed to the dumped family.
+func (c *Consumer) GetStatsByFamily() map[string]map[string]int64 {
+	stats := make(map[string]map[string]int64, 3)
+	for name, s := range map[string]*familyStats{
+		"ipv4":   &c.familyCounters.ipv4,
+		"ipv6":   &c.familyCounters.ipv6,
+		"unspec": &c.familyCounters.unspec,
+	} {
+		stats[name] = map[string]int64{
+			"messages":   atomic.LoadInt64(&s.messages),
+			"msg_errors": atomic.LoadInt64(&s.msgErrors),
+		}
+	}
+	return stats
+}
+
+// countMessageError attributes a netlink error message to the dumped family, unless it was
+// received by the streaming socket
+func (c *Consumer) countMessageError(streaming bool) {
+	family := uint8(unix.AF_UNSPEC)
+	if !streaming {
+		family = c.dumpFamily
+	}
+	atomic.AddInt64(&c.familyCounters.of(family).msgErrors, 1)
+}
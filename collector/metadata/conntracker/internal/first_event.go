@@ -0,0 +1,59 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrNoEventYet is returned by WaitForFirstEvent when no event was streamed before the timeout
+var ErrNoEventYet = errors.New("no conntrack event received yet")
+
+// firstEvent is closed once the first event is streamed
+type firstEvent struct {
+	once sync.Once
+	c    chan struct{}
+}
+
+func newFirstEvent() *firstEvent {
+	return &firstEvent{c: make(chan struct{})}
+}
+
+// signal closes the channel on the first call. It's a no-op on a nil firstEvent, as in Consumers
+// which weren't created with NewConsumer.
+func (f *firstEvent) signal() {
+	if f == nil {
+		return
+	}
+	f.once.Do(func() {
+		close(f.c)
+	})
+}
+
+// WaitForFirstEvent blocks until the Consumer streams its first event, or returns ErrNoEventYet
+// once timeout elapses. It tells a socket which is open but silent apart from one which actually
+// receives events, e.g. for readiness checks. Events are left untouched: the first one is still
+// delivered to the channel returned by Events, NamespaceEvents or to ReceiveNonBlocking.
+// Dumped entries don't count, only streamed ones do. It returns immediately once an event was
+// streamed.
+func (c *Consumer) WaitForFirstEvent(timeout time.Duration) error {
+	select {
+	case <-c.firstEvent.c:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-c.firstEvent.c:
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("%w after %s", ErrNoEventYet, timeout)
+	}
+}
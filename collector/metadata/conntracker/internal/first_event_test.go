@@ -0,0 +1,54 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestWaitForFirstEvent(t *testing.T) {
+	c := NewConsumer(t.TempDir(), -1, false)
+	defer c.Stop()
+
+	assert.ErrorIs(t, c.WaitForFirstEvent(10*time.Millisecond), ErrNoEventYet)
+
+	c.setStreaming(true)
+	msg := netlink.Message{Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK << 8)}}
+	read := make(chan struct{})
+	c.readFn = func(b []byte) ([]netlink.Message, int32, error) {
+		if _, ok := <-read; ok {
+			return []netlink.Message{msg}, 0, nil
+		}
+		return nil, 0, errors.New("read netlink: use of closed file")
+	}
+
+	output := make(chan Event, outputBuffer)
+	done := make(chan error)
+	go func() {
+		done <- c.receive(context.Background(), output)
+	}()
+
+	read <- struct{}{}
+	start := time.Now()
+	require.NoError(t, c.WaitForFirstEvent(5*time.Second))
+	assert.Less(t, time.Since(start), time.Second)
+	// Once an event was received, it returns immediately
+	require.NoError(t, c.WaitForFirstEvent(0))
+
+	// The event is still delivered
+	e := <-output
+	assert.Len(t, e.Messages(), 1)
+	e.Done()
+
+	close(read)
+	require.NoError(t, <-done)
+}
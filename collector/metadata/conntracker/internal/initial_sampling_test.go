@@ -0,0 +1,50 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInitialSamplingRate(t *testing.T) {
+	// starts streaming, and returns the consumer once its receive loop is done
+	events := func(opts ...ConsumerOption) *Consumer {
+		c := NewConsumer(newFakeProcRoot(t, ""), 1000, false, opts...)
+		t.Cleanup(c.Stop)
+		c.readFn = func(b []byte) ([]netlink.Message, int32, error) {
+			return nil, 0, errors.New("read netlink: use of closed file")
+		}
+
+		output, err := c.Events()
+		if err != nil {
+			t.Skipf("could not initialize conntrack netlink socket: %s", err)
+		}
+		for range output {
+		}
+		return c
+	}
+
+	c := events()
+	assert.Equal(t, 1.0, c.samplingRate)
+	assert.Nil(t, c.DumpSamplerProgram())
+
+	c = events(WithInitialSamplingRate(0.25))
+	assert.Equal(t, 0.25, c.samplingRate)
+	assert.Equal(t, int64(25), c.Stats().SamplingPct)
+	require.NotNil(t, c.DumpSamplerProgram())
+
+	c = events(WithInitialSamplingRate(0.25), WithDeterministicSampling())
+	assert.Nil(t, c.DumpSamplerProgram())
+	require.NotNil(t, c.sampler)
+	assert.Equal(t, uint64(4), c.sampler.(*oneInNSampler).n)
+
+	// out of range rates are ignored
+	c = events(WithInitialSamplingRate(1.5))
+	assert.Equal(t, 1.0, c.samplingRate)
+}
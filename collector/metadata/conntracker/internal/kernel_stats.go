@@ -0,0 +1,115 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ConntrackKernelStats holds the conntrack statistics of the kernel, summed over all CPUs. They
+// tell entries the kernel dropped itself apart from events the Consumer failed to keep up with.
+type ConntrackKernelStats struct {
+	// Entries is the number of entries of the conntrack table
+	Entries uint64
+	// Insert is the number of entries inserted in the table
+	Insert uint64
+	// InsertFailed is the number of entries that couldn't be inserted, e.g. on a clash
+	InsertFailed uint64
+	// Drop is the number of packets dropped because no entry could be allocated
+	Drop uint64
+	// EarlyDrop is the number of entries evicted to make room when the table was full
+	EarlyDrop uint64
+	// SearchRestart is the number of table lookups restarted because of a concurrent resize
+	SearchRestart uint64
+}
+
+// KernelConntrackStats returns the conntrack statistics of the root network namespace, read
+// from <procRoot>/net/stat/nf_conntrack.
+func (c *Consumer) KernelConntrackStats() (ConntrackKernelStats, error) {
+	var stats ConntrackKernelStats
+	err := c.withRootNS(func() error {
+		var err error
+		stats, err = readKernelConntrackStats(c.procRoot)
+		return err
+	})
+	return stats, err
+}
+
+// Stats returns the statistics as a telemetry map, with keys prefixed by "kernel_"
+func (s ConntrackKernelStats) Stats() map[string]int64 {
+	return map[string]int64{
+		"kernel_entries":        int64(s.Entries),
+		"kernel_insert":         int64(s.Insert),
+		"kernel_insert_failed":  int64(s.InsertFailed),
+		"kernel_drop":           int64(s.Drop),
+		"kernel_early_drop":     int64(s.EarlyDrop),
+		"kernel_search_restart": int64(s.SearchRestart),
+	}
+}
+
+func readKernelConntrackStats(procRoot string) (ConntrackKernelStats, error) {
+	f, err := os.Open(path.Join(procRoot, "net/stat/nf_conntrack"))
+	if err != nil {
+		return ConntrackKernelStats{}, err
+	}
+	defer f.Close()
+
+	return parseKernelConntrackStats(f)
+}
+
+// parseKernelConntrackStats parses the content of /proc/net/stat/nf_conntrack: a header naming
+// the columns, which vary across kernel versions, followed by one line of hex values per CPU.
+func parseKernelConntrackStats(r io.Reader) (ConntrackKernelStats, error) {
+	var stats ConntrackKernelStats
+
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return stats, err
+		}
+		return stats, fmt.Errorf("missing nf_conntrack stats header")
+	}
+	columns := strings.Fields(scanner.Text())
+
+	for line := 2; scanner.Scan(); line++ {
+		values := strings.Fields(scanner.Text())
+		if len(values) == 0 {
+			continue
+		}
+		if len(values) != len(columns) {
+			return stats, fmt.Errorf("nf_conntrack stats line %d: got %d values for %d columns", line, len(values), len(columns))
+		}
+
+		for i, column := range columns {
+			v, err := strconv.ParseUint(values[i], 16, 64)
+			if err != nil {
+				return stats, fmt.Errorf("nf_conntrack stats line %d, column %s: %w", line, column, err)
+			}
+
+			switch column {
+			case "entries":
+				// the table size is global, so it's repeated on every line
+				stats.Entries = v
+			case "insert":
+				stats.Insert += v
+			case "insert_failed":
+				stats.InsertFailed += v
+			case "drop":
+				stats.Drop += v
+			case "early_drop":
+				stats.EarlyDrop += v
+			case "search_restart":
+				stats.SearchRestart += v
+			}
+		}
+	}
+
+	return stats, scanner.Err()
+}
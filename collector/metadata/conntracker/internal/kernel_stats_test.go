@@ -0,0 +1,60 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A 2 CPUs nf_conntrack stats file, from a 5.15 kernel
+const kernelStatsFixture = `entries  clashres found new invalid ignore delete chainlength insert insert_failed drop early_drop icmp_error  expect_new expect_create expect_delete search_restart
+0000002a  00000001 00000000 00000000 00000005 00000000 00000000 00000000 0000000a 00000002 00000003 00000000 00000000  00000000 00000000 00000000 00000010
+0000002a  00000000 00000000 00000000 00000001 00000000 00000000 00000000 000000f0 00000001 00000000 00000004 00000000  00000000 00000000 00000000 00000001
+`
+
+func TestParseKernelConntrackStats(t *testing.T) {
+	stats, err := parseKernelConntrackStats(strings.NewReader(kernelStatsFixture))
+	require.NoError(t, err)
+	assert.Equal(t, ConntrackKernelStats{
+		Entries:       42,
+		Insert:        250,
+		InsertFailed:  3,
+		Drop:          3,
+		EarlyDrop:     4,
+		SearchRestart: 17,
+	}, stats)
+}
+
+func TestParseKernelConntrackStatsInvalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"empty":          "",
+		"missing values": "entries insert\n0000002a\n",
+		"not hex":        "entries insert\n0000002a lots\n",
+	} {
+		_, err := parseKernelConntrackStats(strings.NewReader(content))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestKernelConntrackStats(t *testing.T) {
+	procRoot := newFakeProcRoot(t, "")
+	require.NoError(t, os.MkdirAll(filepath.Join(procRoot, "net/stat"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(procRoot, "net/stat/nf_conntrack"), []byte(kernelStatsFixture), 0o644))
+	c := NewConsumer(procRoot, -1, false)
+	defer c.Stop()
+
+	stats, err := c.KernelConntrackStats()
+	if err != nil && os.IsPermission(err) {
+		t.Skipf("could not enter the root network namespace: %s", err)
+	}
+	require.NoError(t, err)
+	assert.Equal(t, uint64(250), stats.Insert)
+	assert.Equal(t, int64(42), stats.Stats()["kernel_entries"])
+}
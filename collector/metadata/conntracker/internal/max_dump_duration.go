@@ -0,0 +1,49 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrMaxDumpDuration is the error of the namespaces left undumped once the maximum dump duration
+// is reached, see WithMaxDumpDuration
+var ErrMaxDumpDuration = errors.New("maximum conntrack table dump duration reached")
+
+// WithMaxDumpDuration bounds the duration of each conntrack table dump: once d is elapsed, the
+// namespace being dumped is interrupted, the remaining ones are skipped, and the channel is
+// closed. The entries read until then are kept, and the DumpReport is marked as truncated,
+// with the interrupted namespace reported as NamespaceTruncated and the remaining ones as
+// NamespaceAborted. It bounds the startup time on hosts whose tables take too long to dump.
+func WithMaxDumpDuration(d time.Duration) ConsumerOption {
+	return func(c *Consumer) {
+		if d > 0 {
+			c.maxDumpDuration = d
+		}
+	}
+}
+
+// withMaxDumpDuration returns a context which is done once the maximum dump duration is reached,
+// along with a function returning why the dump must stop, if it must: ErrMaxDumpDuration once the
+// duration is reached, or the error of ctx once it's done.
+func (c *Consumer) withMaxDumpDuration(ctx context.Context) (context.Context, func() error, context.CancelFunc) {
+	if c.maxDumpDuration == 0 {
+		return ctx, ctx.Err, func() {}
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithTimeout(parent, c.maxDumpDuration)
+	abortErr := func() error {
+		if err := parent.Err(); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ErrMaxDumpDuration
+		}
+		return nil
+	}
+	return ctx, abortErr, cancel
+}
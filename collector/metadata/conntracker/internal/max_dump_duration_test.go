@@ -0,0 +1,62 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+func TestMaxDumpDuration(t *testing.T) {
+	rootNS, peerNS, slowNS, lastNS := netns.NsHandle(-2), netns.NsHandle(-3), netns.NsHandle(-4), netns.NsHandle(-5)
+
+	c := NewConsumer(t.TempDir(), -1, true, WithMaxDumpDuration(50*time.Millisecond))
+	defer c.Stop()
+	c.dumpNS = func(ctx context.Context, family uint8, output chan Event, ns netns.NsHandle) error {
+		c.dumpEntries = 5
+		if ns != slowNS {
+			return nil
+		}
+		// The table of the slow namespace is read until the dump is interrupted
+		c.dumpEntries = 3
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			return nil
+		}
+	}
+
+	start := time.Now()
+	c.dumpNamespaces(context.Background(), unix.AF_INET, make(chan Event, outputBuffer), rootNS, []netns.NsHandle{peerNS, slowNS, lastNS}, func(netns.NsHandle) bool { return true })
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	report := c.DumpReport()
+	assert.True(t, report.Truncated)
+	assert.False(t, report.Complete())
+	require.Len(t, report.Namespaces, 4)
+	var outcomes []NamespaceDumpOutcome
+	var entries []int
+	for _, ns := range report.Namespaces {
+		outcomes = append(outcomes, ns.Outcome)
+		entries = append(entries, ns.Entries)
+	}
+	assert.Equal(t, []NamespaceDumpOutcome{NamespaceDumped, NamespaceDumped, NamespaceTruncated, NamespaceAborted}, outcomes)
+	assert.Equal(t, []int{5, 5, 3, 0}, entries)
+	assert.ErrorIs(t, report.Namespaces[2].Err, ErrMaxDumpDuration)
+	assert.ErrorIs(t, report.Namespaces[3].Err, ErrMaxDumpDuration)
+
+	// A dump completed in time isn't truncated
+	c.dumpNS = func(context.Context, uint8, chan Event, netns.NsHandle) error { return nil }
+	c.dumpNamespaces(context.Background(), unix.AF_INET, make(chan Event, outputBuffer), rootNS, []netns.NsHandle{peerNS, slowNS, lastNS}, func(netns.NsHandle) bool { return true })
+	report = c.DumpReport()
+	assert.False(t, report.Truncated)
+	assert.True(t, report.Complete())
+}
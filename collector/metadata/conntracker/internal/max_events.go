@@ -0,0 +1,71 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/mdlayher/netlink"
+)
+
+// ErrMaxEventsReached is reported for the namespaces which weren't dumped because the
+// limit set with WithMaxEvents was reached
+var ErrMaxEventsReached = errors.New("maximum number of conntrack events reached")
+
+// MaxEventsScope defines which events count towards the limit set with WithMaxEvents
+type MaxEventsScope int
+
+const (
+	// MaxEventsStreamed only counts the streamed events: dumps are never stopped
+	MaxEventsStreamed MaxEventsScope = iota
+	// MaxEventsAll counts the events of dumps as well
+	MaxEventsAll
+)
+
+// WithMaxEvents stops the Consumer once n events (conntrack messages) were emitted: the receive
+// loops of Events() and NamespaceEvents() exit and close their channel, and so does DumpTable
+// when the scope includes dumps. The last Event is truncated so that exactly n messages are
+// emitted. It's meant for tests, and for bounded "capture n events and exit" runs.
+func WithMaxEvents(n int, scope MaxEventsScope) ConsumerOption {
+	return func(c *Consumer) {
+		if n > 0 {
+			c.maxEvents = int64(n)
+			c.maxEventsScope = scope
+		}
+	}
+}
+
+// limitEvents truncates msgs to the number of events left before the limit set with WithMaxEvents,
+// and reports whether the limit is reached once they're emitted. streaming is set for the events
+// of the streaming socket, rather than the ones of a dump.
+func (c *Consumer) limitEvents(msgs []netlink.Message, streaming bool) ([]netlink.Message, bool) {
+	if c.maxEvents == 0 || (!streaming && c.maxEventsScope == MaxEventsStreamed) {
+		return msgs, false
+	}
+
+	// the slots are reserved atomically, since the receive loops of Events(), NamespaceEvents()
+	// and the dumps share the limit
+	for {
+		emitted := atomic.LoadInt64(&c.emittedEvents)
+		remaining := c.maxEvents - emitted
+		if remaining <= int64(len(msgs)) {
+			if remaining < 0 {
+				remaining = 0
+			}
+			if atomic.CompareAndSwapInt64(&c.emittedEvents, emitted, c.maxEvents) {
+				return msgs[:remaining], true
+			}
+			continue
+		}
+		if atomic.CompareAndSwapInt64(&c.emittedEvents, emitted, emitted+int64(len(msgs))) {
+			return msgs, false
+		}
+	}
+}
+
+// maxEventsReached reports whether the limit set with WithMaxEvents stops the dumps
+func (c *Consumer) maxEventsReached() bool {
+	return c.maxEvents > 0 && c.maxEventsScope == MaxEventsAll && atomic.LoadInt64(&c.emittedEvents) >= c.maxEvents
+}
@@ -0,0 +1,117 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// endlessReads returns batches of 3 conntrack messages forever
+func endlessReads(b []byte) ([]netlink.Message, int32, error) {
+	msg := netlink.Message{Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK << 8)}}
+	return []netlink.Message{msg, msg, msg}, 0, nil
+}
+
+func TestMaxEvents(t *testing.T) {
+	c := NewConsumer(newFakeProcRoot(t, ""), -1, false, WithMaxEvents(10, MaxEventsStreamed))
+	defer c.Stop()
+	c.readFn = endlessReads
+
+	events, err := c.Events()
+	if err != nil {
+		t.Skipf("could not initialize conntrack netlink socket: %s", err)
+	}
+
+	var sizes []int
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				// The last batch is truncated
+				assert.Equal(t, []int{3, 3, 3, 1}, sizes)
+				return
+			}
+			sizes = append(sizes, len(e.Messages()))
+			e.Done()
+		case <-timeout:
+			t.Fatalf("the channel wasn't closed after %v events", sizes)
+		}
+	}
+}
+
+func TestMaxEventsScope(t *testing.T) {
+	receiveDump := func(c *Consumer) int {
+		c.readFn = func(b []byte) ([]netlink.Message, int32, error) {
+			msgs, _, _ := endlessReads(b)
+			// The dump ends after the 4th batch
+			if c.dumpEntries >= 9 {
+				msgs = append(msgs, netlink.Message{Header: netlink.Header{Type: netlink.Done}})
+			}
+			return msgs, 0, nil
+		}
+		c.dumpMode = true
+		output := make(chan Event, outputBuffer)
+		_ = c.receive(context.Background(), output)
+		close(output)
+		n := 0
+		for e := range output {
+			n += len(e.Messages())
+		}
+		return n
+	}
+
+	// Dumps aren't limited when only counting streamed events
+	c := NewConsumer(t.TempDir(), -1, false, WithMaxEvents(5, MaxEventsStreamed))
+	assert.Equal(t, 12, receiveDump(c))
+	assert.False(t, c.maxEventsReached())
+
+	c = NewConsumer(t.TempDir(), -1, false, WithMaxEvents(5, MaxEventsAll))
+	assert.Equal(t, 5, receiveDump(c))
+	assert.True(t, c.maxEventsReached())
+
+	// The namespaces left are reported as aborted
+	c.dumpNS = func(ctx context.Context, family uint8, output chan Event, ns netns.NsHandle) error {
+		t.Errorf("namespace %d shouldn't be dumped", ns)
+		return nil
+	}
+	c.dumpNamespaces(context.Background(), unix.AF_INET, make(chan Event, outputBuffer), netns.NsHandle(-2), []netns.NsHandle{netns.NsHandle(-3)}, func(netns.NsHandle) bool { return true })
+	report := c.DumpReport()
+	assert.Equal(t, 2, report.Count(NamespaceAborted))
+	for _, ns := range report.Namespaces {
+		assert.ErrorIs(t, ns.Err, ErrMaxEventsReached)
+	}
+}
+
+func TestMaxEventsConcurrentLoops(t *testing.T) {
+	const limit = 1000
+	c := &Consumer{}
+	WithMaxEvents(limit, MaxEventsAll)(c)
+
+	// e.g. the streaming loop and a dump, sharing the limit
+	msgs := make([]netlink.Message, 3)
+	emitted := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		streaming := i == 0
+		go func() {
+			n := 0
+			for {
+				kept, reached := c.limitEvents(msgs, streaming)
+				n += len(kept)
+				if reached {
+					emitted <- n
+					return
+				}
+			}
+		}()
+	}
+	assert.Equal(t, limit, <-emitted+<-emitted)
+}
@@ -18,9 +18,9 @@ import (
 // Copyright (C) 2016-2021 Matt Layher
 // Source https://github.com/mdlayher/netlink/blob/ec511443387bb32b3adcd448828476c83754c8e8/message.go
 // checkMessage checks a single Message for netlink errors.
-func checkMessage(m netlink.Message) error {
-	const success = 0
-
+// It runs for every received message, so it's kept small enough to be inlined in the receive
+// loops: only messages of type error, which are rare, pay for a call to checkErrorMessage.
+func checkMessage(m *netlink.Message) error {
 	// Per libnl documentation, only messages that indicate type error can
 	// contain error codes:
 	// https://www.infradead.org/~tgr/libnl/doc/core.html#core_errmsg.
@@ -33,12 +33,18 @@ func checkMessage(m netlink.Message) error {
 	if m.Header.Type != netlink.Error {
 		return nil
 	}
+	return checkErrorMessage(m.Data)
+}
+
+// checkErrorMessage returns the error carried by the payload of a netlink error message
+func checkErrorMessage(data []byte) error {
+	const success = 0
 
-	if len(m.Data) < 4 {
+	if len(data) < 4 {
 		return errShortErrorMessage
 	}
 
-	if c := nlenc.Int32(m.Data[0:4]); c != success {
+	if c := nlenc.Int32(data[0:4]); c != success {
 		// Error code is a negative integer, convert it into an OS-specific raw
 		// system call error, but do not wrap with os.NewSyscallError to signify
 		// that this error was produced by a netlink message; not a system call.
@@ -0,0 +1,51 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"testing"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestCheckMessage(t *testing.T) {
+	assert.NoError(t, checkMessage(&netlink.Message{Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK << 8)}}))
+	assert.NoError(t, checkMessage(&netlink.Message{Header: netlink.Header{Type: netlink.Error}, Data: nlenc.Int32Bytes(0)}))
+	assert.Equal(t, errShortErrorMessage, checkMessage(&netlink.Message{Header: netlink.Header{Type: netlink.Error}, Data: []byte{0}}))
+	assert.Equal(t, unix.ENOENT, checkMessage(&netlink.Message{Header: netlink.Header{Type: netlink.Error}, Data: nlenc.Int32Bytes(-int32(unix.ENOENT))}))
+}
+
+// BenchmarkCheckMessages checks a batch of messages the way the receive loop does. A 32KB
+// buffer holds about 160 of the messages below, so the batch reflects a busy host.
+func BenchmarkCheckMessages(b *testing.B) {
+	data, err := EncodeConn(&Con{Con: ct.Con{
+		Origin: newIPTuple("10.0.2.15", "2.2.2.2", 58472, 5432, uint8(unix.IPPROTO_TCP)),
+		Reply:  newIPTuple("2.2.2.2", "10.0.2.15", 5432, 58472, uint8(unix.IPPROTO_TCP)),
+	}})
+	require.NoError(b, err)
+	data = append([]byte{unix.AF_INET, unix.NFNETLINK_V0, 0, 0}, data...)
+
+	msgs := make([]netlink.Message, 160)
+	for i := range msgs {
+		msgs[i] = netlink.Message{
+			Header: netlink.Header{Length: uint32(16 + len(data)), Type: netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK << 8)},
+			Data:   data,
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := range msgs {
+			if err := checkMessage(&msgs[j]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"sync/atomic"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// The conntrack messages received from the kernel are either IPCTNL_MSG_CT_NEW, for new and
+// updated entries as well as the entries of a dump, or IPCTNL_MSG_CT_DELETE for destroyed ones.
+// These values are defined in include/uapi/linux/netfilter/nfnetlink_conntrack.h
+const (
+	ipctnlMsgCtNew    = 0
+	ipctnlMsgCtDelete = 2
+
+	ctNewType    = netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK<<8 | ipctnlMsgCtNew)
+	ctDeleteType = netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK<<8 | ipctnlMsgCtDelete)
+)
+
+// WithMessageTypes sets the netlink message types accepted by the receive loops, instead of the
+// conntrack new, update and destroy messages. Messages of any other type are dropped and counted
+// as unexpected_msg_type, which guards against mis-subscribed groups or kernel quirks.
+func WithMessageTypes(types ...netlink.HeaderType) ConsumerOption {
+	return func(c *Consumer) {
+		if len(types) == 0 {
+			return
+		}
+		c.messageTypes = make(map[netlink.HeaderType]struct{}, len(types))
+		for _, t := range types {
+			c.messageTypes[t] = struct{}{}
+		}
+	}
+}
+
+// acceptsMessageType returns whether messages of the given type are passed downstream
+func (c *Consumer) acceptsMessageType(t netlink.HeaderType) bool {
+	if c.messageTypes == nil {
+		return t == ctNewType || t == ctDeleteType
+	}
+	_, ok := c.messageTypes[t]
+	return ok
+}
+
+// filterMessageTypes drops the messages of unexpected types, in place. Error and multi-part
+// "done" messages must have been handled beforehand.
+func (c *Consumer) filterMessageTypes(msgs []netlink.Message) []netlink.Message {
+	for i := range msgs {
+		if c.acceptsMessageType(msgs[i].Header.Type) {
+			continue
+		}
+
+		// slow path, only taken when an unexpected message was received
+		kept := msgs[:i]
+		for _, m := range msgs[i:] {
+			if c.acceptsMessageType(m.Header.Type) {
+				kept = append(kept, m)
+			} else {
+				atomic.AddInt64(&c.unexpectedMsgTypes, 1)
+			}
+		}
+		return kept
+	}
+	return msgs
+}
@@ -0,0 +1,64 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestUnexpectedMessageTypes(t *testing.T) {
+	receive := func(c *Consumer, reads [][]netlink.Message) []netlink.HeaderType {
+		c.setStreaming(true)
+		c.readFn = func(b []byte) ([]netlink.Message, int32, error) {
+			if len(reads) == 0 {
+				return nil, 0, errors.New("read netlink: use of closed file")
+			}
+			// the messages are filtered in place
+			msgs := append([]netlink.Message(nil), reads[0]...)
+			reads = reads[1:]
+			return msgs, 0, nil
+		}
+		output := make(chan Event, outputBuffer)
+		require.NoError(t, c.receive(context.Background(), output))
+		close(output)
+
+		var types []netlink.HeaderType
+		for e := range output {
+			for _, m := range e.Messages() {
+				types = append(types, m.Header.Type)
+			}
+			e.Done()
+		}
+		return types
+	}
+	message := func(typ netlink.HeaderType) netlink.Message {
+		return netlink.Message{Header: netlink.Header{Type: typ}, Data: []byte{unix.AF_INET, unix.NFNETLINK_V0, 0, 0}}
+	}
+	expNew := netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK_EXP<<8 | ipctnlMsgCtNew)
+	reads := [][]netlink.Message{
+		{message(ctNewType), message(expNew), message(ctDeleteType)},
+		// A read without any expected message doesn't produce an event
+		{message(unix.RTM_NEWNSID)},
+	}
+
+	c := NewConsumer(t.TempDir(), -1, false)
+	defer c.Stop()
+	assert.Equal(t, []netlink.HeaderType{ctNewType, ctDeleteType}, receive(c, reads))
+	assert.Equal(t, int64(2), c.Stats().UnexpectedMsgTypes)
+	// Dropped messages aren't counted as received
+	assert.Equal(t, int64(2), c.GetStatsByFamily()["ipv4"]["messages"])
+
+	// The expectation messages can be accepted too
+	c = NewConsumer(t.TempDir(), -1, false, WithMessageTypes(ctNewType, ctDeleteType, expNew))
+	defer c.Stop()
+	assert.Equal(t, []netlink.HeaderType{ctNewType, expNew, ctDeleteType}, receive(c, reads))
+	assert.Equal(t, int64(1), c.Stats().UnexpectedMsgTypes)
+}
@@ -0,0 +1,43 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrConntrackModuleNotLoaded is returned when the kernel doesn't provide conntrack over netlink,
+// which almost always means that the nf_conntrack_netlink module isn't loaded. The original
+// error can still be inspected with errors.Is.
+var ErrConntrackModuleNotLoaded = errors.New("conntrack kernel module not loaded, try running `modprobe nf_conntrack_netlink`")
+
+type moduleNotLoadedError struct {
+	err error
+}
+
+func (e *moduleNotLoadedError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrConntrackModuleNotLoaded, e.err)
+}
+
+func (e *moduleNotLoadedError) Is(target error) bool {
+	return target == ErrConntrackModuleNotLoaded
+}
+
+func (e *moduleNotLoadedError) Unwrap() error {
+	return e.err
+}
+
+// checkModuleError returns an error matching ErrConntrackModuleNotLoaded when err is one of
+// the errnos reported by the kernel when the conntrack netlink subsystem is missing:
+// EPROTONOSUPPORT when opening a NETLINK_NETFILTER socket without nfnetlink, and ENOENT or
+// EOPNOTSUPP when sending conntrack requests without nf_conntrack_netlink.
+func checkModuleError(err error) error {
+	if errors.Is(err, unix.EPROTONOSUPPORT) || errors.Is(err, unix.ENOENT) || errors.Is(err, unix.EOPNOTSUPP) {
+		return &moduleNotLoadedError{err: err}
+	}
+	return err
+}
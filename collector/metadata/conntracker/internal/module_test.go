@@ -0,0 +1,41 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestNewSocketModuleNotLoaded(t *testing.T) {
+	prev := openSocket
+	t.Cleanup(func() { openSocket = prev })
+
+	openSocket = func(domain, typ, proto int) (int, error) {
+		return -1, unix.EPROTONOSUPPORT
+	}
+	_, err := NewSocket()
+	assert.ErrorIs(t, err, ErrConntrackModuleNotLoaded)
+	assert.ErrorIs(t, err, unix.EPROTONOSUPPORT)
+	assert.Contains(t, err.Error(), "modprobe")
+
+	// Other errors are returned as is
+	openSocket = func(domain, typ, proto int) (int, error) {
+		return -1, unix.EMFILE
+	}
+	_, err = NewSocket()
+	assert.ErrorIs(t, err, unix.EMFILE)
+	assert.False(t, errors.Is(err, ErrConntrackModuleNotLoaded))
+}
+
+func TestCheckModuleError(t *testing.T) {
+	for _, errno := range []unix.Errno{unix.EPROTONOSUPPORT, unix.ENOENT, unix.EOPNOTSUPP} {
+		assert.ErrorIs(t, checkModuleError(errno), ErrConntrackModuleNotLoaded, errno.Error())
+	}
+	assert.Nil(t, checkModuleError(nil))
+	assert.Equal(t, unix.EPERM, checkModuleError(unix.EPERM))
+}
@@ -0,0 +1,40 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/vishvananda/netns"
+)
+
+const (
+	// maxEnumerationAttempts bounds the number of times the network namespaces are listed for a
+	// dump. Listing walks /proc, which may fail transiently on hosts with high process churn.
+	maxEnumerationAttempts = 3
+	// enumerationRetryDelay is the delay before listing the network namespaces again
+	enumerationRetryDelay = 50 * time.Millisecond
+)
+
+// listNamespacesWithRetry lists the network namespaces to dump, retrying on errors. Once the
+// attempts are exhausted, only the root namespace is dumped rather than failing the whole dump,
+// and nil is returned. Retries are counted as enumeration_retries.
+func (c *Consumer) listNamespacesWithRetry() []netns.NsHandle {
+	var err error
+	for attempt := 0; attempt < maxEnumerationAttempts; attempt++ {
+		if attempt > 0 {
+			atomic.AddInt64(&c.enumerationRetries, 1)
+			time.Sleep(c.enumerationRetryDelay)
+		}
+
+		var nss []netns.NsHandle
+		if nss, err = c.listNamespaces(); err == nil {
+			return nss
+		}
+	}
+	log.Printf("could not get network namespaces after %d attempts, dumping the root namespace only: %s", maxEnumerationAttempts, err)
+	return nil
+}
@@ -0,0 +1,52 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+func TestDumpTableEnumerationRetries(t *testing.T) {
+	dump := func(failures int) (attempts int, dumped int, c *Consumer) {
+		c = NewConsumer(t.TempDir(), -1, true, WithRootNamespacePath("/proc/self/ns/net"))
+		t.Cleanup(c.Stop)
+		c.enumerationRetryDelay = 0
+		// A process exits while /proc is walked
+		c.listNamespaces = func() ([]netns.NsHandle, error) {
+			attempts++
+			if attempts <= failures {
+				return nil, unix.ENOENT
+			}
+			return nil, nil
+		}
+		c.dumpNS = func(ctx context.Context, family uint8, output chan Event, ns netns.NsHandle) error {
+			dumped++
+			return nil
+		}
+
+		events, err := c.DumpTable(unix.AF_INET)
+		if err != nil {
+			t.Skipf("could not dump the conntrack table: %s", err)
+		}
+		for range events {
+		}
+		return attempts, dumped, c
+	}
+
+	attempts, dumped, c := dump(2)
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, 1, dumped)
+	assert.Equal(t, int64(2), c.Stats().EnumerationRetries)
+
+	// Once the attempts are exhausted, the root namespace is still dumped
+	attempts, dumped, c = dump(maxEnumerationAttempts)
+	assert.Equal(t, maxEnumerationAttempts, attempts)
+	assert.Equal(t, 1, dumped)
+	assert.Equal(t, int64(maxEnumerationAttempts-1), c.Stats().EnumerationRetries)
+}
@@ -0,0 +1,45 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"github.com/vishvananda/netns"
+)
+
+// WithNamespaceFilter restricts the Consumer to the network namespaces whose inode is one of
+// the given ones, e.g. the namespaces of the pods to monitor. Conntrack entries don't carry
+// any cgroup, so mapping cgroups (or pods) to the inodes of their network namespaces is the
+// responsibility of the caller, e.g. by stat'ing /proc/<pid>/ns/net for a process of the pod.
+//
+// The filter applies wherever the namespace of the entries is known: DumpTable skips the
+// namespaces which aren't included (see NamespaceExcluded), the root one included, and
+// NamespaceEvents doesn't open sockets for them. It doesn't apply to Events(), whose events
+// are only tagged with the nsid of their namespace.
+func WithNamespaceFilter(inodes ...uint32) ConsumerOption {
+	return func(c *Consumer) {
+		c.namespaceFilter = make(map[uint32]struct{}, len(inodes))
+		for _, inode := range inodes {
+			c.namespaceFilter[inode] = struct{}{}
+		}
+	}
+}
+
+// includesNamespace reports whether the namespace with the given inode passes the namespace filter
+func (c *Consumer) includesNamespace(inode uint32) bool {
+	if c.namespaceFilter == nil {
+		return true
+	}
+	_, ok := c.namespaceFilter[inode]
+	return ok
+}
+
+// includesNamespaceHandle is like includesNamespace for a namespace handle. Namespaces whose
+// inode can't be determined are excluded when filtering.
+func (c *Consumer) includesNamespaceHandle(ns netns.NsHandle) bool {
+	if c.namespaceFilter == nil {
+		return true
+	}
+	inode, err := namespaceInode(ns)
+	return err == nil && c.includesNamespace(inode)
+}
@@ -0,0 +1,103 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// newFakeNamespaces returns handles with distinct inodes, along with these inodes
+func newFakeNamespaces(t *testing.T, n int) ([]netns.NsHandle, []uint32) {
+	var nss []netns.NsHandle
+	var inodes []uint32
+	for i := 0; i < n; i++ {
+		f, err := os.Create(filepath.Join(t.TempDir(), "ns"))
+		require.NoError(t, err)
+		t.Cleanup(func() { f.Close() })
+
+		ns := netns.NsHandle(f.Fd())
+		inode, err := namespaceInode(ns)
+		require.NoError(t, err)
+		nss = append(nss, ns)
+		inodes = append(inodes, inode)
+	}
+	return nss, inodes
+}
+
+func TestNamespaceFilterDump(t *testing.T) {
+	nss, inodes := newFakeNamespaces(t, 4)
+	rootNS, included, excluded, other := nss[0], nss[1], nss[2], nss[3]
+
+	c := NewConsumer(t.TempDir(), -1, false, WithNamespaceFilter(inodes[0], inodes[1], inodes[3]))
+	defer c.Stop()
+	c.dumpNS = func(ctx context.Context, family uint8, output chan Event, ns netns.NsHandle) error {
+		c.dumpEntries = 1
+		output <- Event{msgs: []netlink.Message{{}}, netns: int32(ns)}
+		return nil
+	}
+
+	output := make(chan Event, outputBuffer)
+	c.dumpNamespaces(context.Background(), unix.AF_INET, output, rootNS, []netns.NsHandle{included, excluded, other}, func(netns.NsHandle) bool { return true })
+	close(output)
+
+	var dumped []netns.NsHandle
+	for e := range output {
+		dumped = append(dumped, netns.NsHandle(e.netns))
+	}
+	assert.Equal(t, []netns.NsHandle{rootNS, included, other}, dumped)
+
+	report := c.DumpReport()
+	assert.Equal(t, 3, report.Count(NamespaceDumped))
+	assert.Equal(t, 1, report.Count(NamespaceExcluded))
+	assert.Equal(t, NamespaceDumpReport{NSInode: inodes[2], Outcome: NamespaceExcluded}, report.Namespaces[1])
+	assert.True(t, report.Complete())
+
+	// The root namespace is filtered as well
+	c.namespaceFilter = map[uint32]struct{}{inodes[1]: {}}
+	output = make(chan Event, outputBuffer)
+	c.dumpNamespaces(context.Background(), unix.AF_INET, output, rootNS, []netns.NsHandle{included, excluded}, func(netns.NsHandle) bool { return true })
+	close(output)
+	dumped = nil
+	for e := range output {
+		dumped = append(dumped, netns.NsHandle(e.netns))
+	}
+	assert.Equal(t, []netns.NsHandle{included}, dumped)
+	assert.Equal(t, NamespaceExcluded, c.DumpReport().Namespaces[0].Outcome)
+}
+
+func TestNamespaceFilterNamespaceEvents(t *testing.T) {
+	self, err := netns.GetFromPath("/proc/self/ns/net")
+	require.NoError(t, err)
+	defer self.Close()
+	inode, err := namespaceInode(self)
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		filter  uint32
+		sockets int
+	}{
+		{inode, 1},
+		{inode + 1, 0},
+	} {
+		c := NewConsumer(newFakeProcRoot(t, ""), -1, false, WithNamespaceFilter(tt.filter))
+		events, err := c.NamespaceEvents([]netns.NsHandle{self})
+		if err != nil {
+			t.Skipf("could not open netlink socket: %s", err)
+		}
+		assert.Len(t, c.epoll.sockets, tt.sockets)
+
+		c.Stop()
+		for range events {
+		}
+	}
+}
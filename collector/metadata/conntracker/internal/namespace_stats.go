@@ -0,0 +1,43 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netns"
+)
+
+// NamespaceConntrackStats returns the number of entries of the conntrack table of the network
+// namespace with the given inode, and its maximum size. Both are per namespace on kernels
+// 4.x and later, whereas reading them from the host only reports those of the root namespace,
+// so they're read from within the namespace. ErrNamespaceNotFound is returned when no process
+// lives in the namespace, and ErrTableSizeUnavailable when the namespace doesn't expose them,
+// e.g. when nf_conntrack isn't loaded.
+func (c *Consumer) NamespaceConntrackStats(inode uint32) (count, max int, err error) {
+	ns, err := c.findNamespace(inode)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer ns.Close()
+
+	count, max, err = c.namespaceStats(ns)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not read the conntrack stats of net ns %d: %w", inode, err)
+	}
+	return count, max, nil
+}
+
+// readNamespaceStats reads nf_conntrack_count and nf_conntrack_max from within the given
+// namespace, since /proc/sys/net reflects the network namespace of the reading thread
+func (c *Consumer) readNamespaceStats(ns netns.NsHandle) (count, max int, err error) {
+	err = c.withNS(ns, func() error {
+		if count, err = readConntrackCount(c.procRoot); err != nil {
+			return err
+		}
+		max, err = readConntrackMax(c.procRoot)
+		return err
+	})
+	return count, max, err
+}
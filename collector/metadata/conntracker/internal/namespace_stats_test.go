@@ -0,0 +1,87 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+func TestNamespaceConntrackStats(t *testing.T) {
+	nss, inodes := newFakeNamespaces(t, 3)
+	withMax := func(procRoot, max string) string {
+		require.NoError(t, os.WriteFile(filepath.Join(procRoot, "sys/net/netfilter/nf_conntrack_max"), []byte(max), 0o644))
+		return procRoot
+	}
+	// A procfs per namespace, the last one without nf_conntrack
+	procRoots := map[uint32]string{
+		inodes[0]: withMax(newFakeProcRoot(t, "120\n"), "262144\n"),
+		inodes[1]: withMax(newFakeProcRoot(t, "7\n"), "65536\n"),
+		inodes[2]: newFakeProcRoot(t, ""),
+	}
+
+	c := NewConsumer(t.TempDir(), -1, true)
+	defer c.Stop()
+	c.listNamespaces = func() ([]netns.NsHandle, error) {
+		var handles []netns.NsHandle
+		for _, ns := range nss {
+			fd, err := unix.Dup(int(ns))
+			require.NoError(t, err)
+			handles = append(handles, netns.NsHandle(fd))
+		}
+		return handles, nil
+	}
+	c.namespaceStats = func(ns netns.NsHandle) (int, int, error) {
+		inode, err := namespaceInode(ns)
+		require.NoError(t, err)
+		procRoot := procRoots[inode]
+		count, err := readConntrackCount(procRoot)
+		if err != nil {
+			return 0, 0, err
+		}
+		max, err := readConntrackMax(procRoot)
+		return count, max, err
+	}
+
+	count, max, err := c.NamespaceConntrackStats(inodes[1])
+	require.NoError(t, err)
+	assert.Equal(t, 7, count)
+	assert.Equal(t, 65536, max)
+
+	count, max, err = c.NamespaceConntrackStats(inodes[0])
+	require.NoError(t, err)
+	assert.Equal(t, 120, count)
+	assert.Equal(t, 262144, max)
+
+	_, _, err = c.NamespaceConntrackStats(inodes[2])
+	assert.ErrorIs(t, err, ErrTableSizeUnavailable)
+
+	_, _, err = c.NamespaceConntrackStats(0)
+	assert.ErrorIs(t, err, ErrNamespaceNotFound)
+}
+
+func TestReadNamespaceStats(t *testing.T) {
+	// Without a namespace switch, the stats of the procfs root are read
+	procRoot := newFakeProcRoot(t, "3\n")
+	c := NewConsumer(procRoot, -1, false)
+	defer c.Stop()
+	current, err := netns.Get()
+	require.NoError(t, err)
+	defer current.Close()
+
+	_, _, err = c.readNamespaceStats(current)
+	assert.ErrorIs(t, err, ErrTableSizeUnavailable)
+
+	require.NoError(t, os.WriteFile(filepath.Join(procRoot, "sys/net/netfilter/nf_conntrack_max"), []byte("1024\n"), 0o644))
+	count, max, err := c.readNamespaceStats(current)
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+	assert.Equal(t, 1024, max)
+}
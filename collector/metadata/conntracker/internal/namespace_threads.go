@@ -0,0 +1,89 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/vishvananda/netns"
+)
+
+// WithMaxNamespaceThreads bounds the number of goroutines of the Consumer running in another
+// network namespace at the same time. Entering a namespace pins the OS thread of the goroutine
+// until it switches back, and namespaces are entered concurrently by dumps (including the
+// periodic ones), EstimateTableSize, NamespaceConntrackStats, the table utilization monitor,
+// NamespaceEvents and the re-creation of the streaming socket, which could otherwise exhaust
+// the thread budget of the process. Goroutines wait for a slot before entering a namespace,
+// unless their context is done first.
+func WithMaxNamespaceThreads(n int) ConsumerOption {
+	return func(c *Consumer) {
+		if n > 0 {
+			c.nsThreads = newNSThreadLimiter(n)
+		}
+	}
+}
+
+// nsThreadLimiter is a semaphore bounding the goroutines running in another network namespace
+type nsThreadLimiter struct {
+	// slots is nil when the number of goroutines isn't bounded
+	slots chan struct{}
+	// active is the number of goroutines currently in a namespace, or waiting to enter it
+	active int64
+}
+
+func newNSThreadLimiter(n int) *nsThreadLimiter {
+	l := &nsThreadLimiter{}
+	if n > 0 {
+		l.slots = make(chan struct{}, n)
+	}
+	return l
+}
+
+// acquire waits for a slot, unless ctx is done first
+func (l *nsThreadLimiter) acquire(ctx context.Context) error {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	atomic.AddInt64(&l.active, 1)
+	return nil
+}
+
+func (l *nsThreadLimiter) release() {
+	atomic.AddInt64(&l.active, -1)
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// current returns the number of goroutines currently in a namespace
+func (l *nsThreadLimiter) current() int64 {
+	if l == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&l.active)
+}
+
+// withNS is like WithNS, once a slot is available, see WithMaxNamespaceThreads
+func (c *Consumer) withNS(ns netns.NsHandle, fn func() error) error {
+	return c.withNSContext(context.Background(), ns, func(context.Context) error {
+		return fn()
+	})
+}
+
+// withNSContext is like WithNSContext, once a slot is available, see WithMaxNamespaceThreads
+func (c *Consumer) withNSContext(ctx context.Context, ns netns.NsHandle, fn func(ctx context.Context) error) error {
+	if c.nsThreads == nil {
+		return WithNSContext(ctx, c.procRoot, ns, fn)
+	}
+	if err := c.nsThreads.acquire(ctx); err != nil {
+		return err
+	}
+	defer c.nsThreads.release()
+	return WithNSContext(ctx, c.procRoot, ns, fn)
+}
@@ -0,0 +1,80 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netns"
+)
+
+func TestMaxNamespaceThreads(t *testing.T) {
+	// An invalid handle is never equal to the current namespace, so every call switches
+	target := netns.None()
+	var calls int64
+	prev := setNS
+	t.Cleanup(func() { setNS = prev })
+	setNS = func(ns netns.NsHandle) error {
+		if ns == target {
+			atomic.AddInt64(&calls, 1)
+		}
+		return nil
+	}
+
+	const limit, namespaces = 2, 10
+	c := NewConsumer(t.TempDir(), -1, true, WithMaxNamespaceThreads(limit))
+	defer c.Stop()
+
+	var inNS, maxInNS int64
+	var mu sync.Mutex
+	var observed []int64
+	var wg sync.WaitGroup
+	for i := 0; i < namespaces; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := c.withNS(target, func() error {
+				n := atomic.AddInt64(&inNS, 1)
+				defer atomic.AddInt64(&inNS, -1)
+				mu.Lock()
+				if n > maxInNS {
+					maxInNS = n
+				}
+				observed = append(observed, c.Stats().NSThreads)
+				mu.Unlock()
+				time.Sleep(5 * time.Millisecond)
+				return nil
+			})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(namespaces), calls)
+	assert.Equal(t, int64(limit), maxInNS)
+	for _, n := range observed {
+		assert.True(t, n >= 1 && n <= limit, "%d goroutines in a namespace", n)
+	}
+	assert.Zero(t, c.Stats().NSThreads)
+
+	// Waiting for a slot is aborted once ctx is done
+	require.NoError(t, c.nsThreads.acquire(context.Background()))
+	require.NoError(t, c.nsThreads.acquire(context.Background()))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := c.withNSContext(ctx, target, func(context.Context) error {
+		t.Error("the namespace shouldn't be entered")
+		return nil
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, int64(limit), c.GetStats()["ns_threads"])
+	c.nsThreads.release()
+	c.nsThreads.release()
+}
@@ -0,0 +1,54 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"log"
+	"sync/atomic"
+
+	"github.com/vishvananda/netns"
+)
+
+// nsidMapping is the nsid to namespace mapping seen by a dump. With NETLINK_LISTEN_ALL_NSID,
+// streamed events are attributed to namespaces by their nsid, which must therefore map to a
+// single namespace, and the other way around.
+type nsidMapping struct {
+	inodes map[int32]uint32
+	nsids  map[uint32]int32
+}
+
+func newNSIDMapping() *nsidMapping {
+	return &nsidMapping{
+		inodes: make(map[int32]uint32),
+		nsids:  make(map[uint32]int32),
+	}
+}
+
+// add records that nsid refers to the namespace with the given inode. It returns false, along
+// with the conflicting mapping, when either was already mapped to something else.
+func (m *nsidMapping) add(nsid int32, inode uint32) (int32, uint32, bool) {
+	if other, ok := m.inodes[nsid]; ok && other != inode {
+		return nsid, other, false
+	}
+	if other, ok := m.nsids[inode]; ok && other != nsid {
+		return other, inode, false
+	}
+	m.inodes[nsid] = inode
+	m.nsids[inode] = nsid
+	return 0, 0, true
+}
+
+// checkNSID records the nsid of ns in mapping, and reports the collisions: events received with
+// an ambiguous nsid may be attributed to the wrong namespace on this host
+func (c *Consumer) checkNSID(mapping *nsidMapping, nsid int32, ns netns.NsHandle) {
+	inode, err := namespaceInode(ns)
+	if err != nil {
+		return
+	}
+	if otherNSID, otherInode, ok := mapping.add(nsid, inode); !ok {
+		atomic.AddInt64(&c.nsidCollisions, 1)
+		log.Printf("nsid %d of network namespace %d collides with nsid %d of network namespace %d, "+
+			"conntrack events may be attributed to the wrong namespace", nsid, inode, otherNSID, otherInode)
+	}
+}
@@ -0,0 +1,30 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckNSID(t *testing.T) {
+	nss, _ := newFakeNamespaces(t, 3)
+	c := NewConsumer(t.TempDir(), -1, true)
+	defer c.Stop()
+
+	mapping := newNSIDMapping()
+	c.checkNSID(mapping, 1, nss[0])
+	c.checkNSID(mapping, 2, nss[1])
+	// The same namespace may be seen again
+	c.checkNSID(mapping, 1, nss[0])
+	assert.Equal(t, int64(0), c.Stats().NSIDCollisions)
+
+	// An nsid mapped to two namespaces
+	c.checkNSID(mapping, 1, nss[2])
+	// A namespace with two nsids
+	c.checkNSID(mapping, 3, nss[1])
+	assert.Equal(t, int64(2), c.Stats().NSIDCollisions)
+	assert.Equal(t, int64(2), c.GetStats()["nsid_collisions"])
+}
@@ -0,0 +1,79 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// WithPeriodicDump makes the Consumer dump the conntrack tables of the given family every
+// interval once Events() is called, and merge the dumped entries into the Events() stream (see
+// Event.FromDump). The dumps correct the drift caused by missed events, e.g. dropped on ENOBUFS
+// or by sampling, without orchestrating DumpTable calls.
+//
+// Each dump reads the whole table of the root namespace, and of its peer namespaces when
+// listening to all of them, so its cost grows with the number of entries: the CPU and the
+// allocations of a dump are paid every interval, and the entries which didn't change are
+// emitted again. Dumps aren't throttled nor sampled, see WithDumpRateLimit to pace them.
+// The interval should be large compared to the duration of a dump (see DumpStats).
+//
+// The dumps are run by the Consumer itself, with its settings, so DumpTable returns
+// ErrDumpInProgress while one of them is running, and DumpStats reports the last one.
+func WithPeriodicDump(interval time.Duration, family uint8) ConsumerOption {
+	return func(c *Consumer) {
+		if interval > 0 {
+			c.periodicDump = &periodicDump{interval: interval, family: family}
+		}
+	}
+}
+
+type periodicDump struct {
+	interval time.Duration
+	family   uint8
+}
+
+// FromDump reports whether the Event was emitted by a periodic dump merged into the Events()
+// stream (see WithPeriodicDump), rather than streamed from the conntrack multicast groups.
+func (e *Event) FromDump() bool {
+	return e.fromDump
+}
+
+// runPeriodicDumps dumps the tables every interval and writes the entries to output, until ctx is done
+func (c *Consumer) runPeriodicDumps(ctx context.Context, output chan Event) {
+	p := c.periodicDump
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// dumps have a socket of their own, so they don't disturb the streaming socket
+		events, err := c.DumpTableContext(ctx, p.family)
+		if err != nil {
+			log.Printf("periodic conntrack table dump failed: %s", err)
+			continue
+		}
+		for e := range events {
+			e.fromDump = true
+			select {
+			case output <- e:
+			case <-ctx.Done():
+				// the dump is being aborted, drain it so it can exit
+				e.Done()
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		atomic.AddInt64(&c.periodicDumps, 1)
+	}
+}
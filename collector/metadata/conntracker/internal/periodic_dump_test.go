@@ -0,0 +1,77 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+func TestPeriodicDump(t *testing.T) {
+	procRoot := newFakeProcRoot(t, "")
+	c := NewConsumer(procRoot, -1, false, WithPeriodicDump(20*time.Millisecond, unix.AF_INET))
+
+	// The streamed events come from the fake socket, until it's closed
+	streamed := netlink.Message{Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK << 8)}}
+	closed := make(chan struct{})
+	reads := 0
+	c.readFn = func(b []byte) ([]netlink.Message, int32, error) {
+		if reads++; reads == 1 {
+			return []netlink.Message{streamed}, 0, nil
+		}
+		<-closed
+		return nil, 0, errors.New("read netlink: use of closed file")
+	}
+
+	var dumps int32
+	c.dumpNS = func(ctx context.Context, family uint8, output chan Event, ns netns.NsHandle) error {
+		assert.Equal(t, uint8(unix.AF_INET), family)
+		atomic.AddInt32(&dumps, 1)
+		output <- Event{msgs: []netlink.Message{{}, {}}}
+		return nil
+	}
+
+	events, err := c.Events()
+	if err != nil {
+		t.Skipf("could not initialize conntrack netlink socket: %s", err)
+	}
+
+	fromStream, fromDumps := 0, 0
+	timeout := time.After(5 * time.Second)
+	for fromDumps < 3 {
+		select {
+		case e := <-events:
+			if e.FromDump() {
+				assert.Len(t, e.Messages(), 2)
+				fromDumps++
+			} else {
+				fromStream++
+			}
+			e.Done()
+		case <-timeout:
+			t.Fatalf("only %d periodic dumps were received", fromDumps)
+		}
+	}
+	assert.Equal(t, 1, fromStream)
+
+	// Stopping the receive loop stops the periodic dumps, then closes the channel
+	close(closed)
+	for e := range events {
+		e.Done()
+	}
+	n := atomic.LoadInt32(&dumps)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, n, atomic.LoadInt32(&dumps))
+	assert.GreaterOrEqual(t, c.GetStats()["periodic_dumps"], int64(3))
+	assert.Equal(t, 1, c.DumpReport().Count(NamespaceDumped))
+	c.Stop()
+}
@@ -0,0 +1,40 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	ct "github.com/florianl/go-conntrack"
+)
+
+// CanonicalizeNAT makes the decoder emit the entries in their pre-NAT form: the reply tuple of
+// a translated entry is replaced by the inverse of its original tuple, so both tuples carry the
+// logical addresses the initiator used, e.g. the cluster IP of a service rather than the pod
+// it was DNATed to. Translated entries have NATApplied set, and their actual reply tuple in
+// PostNATReply. It's disabled by default, for the consumers needing the post-NAT view.
+func (d *Decoder) CanonicalizeNAT(enabled bool) {
+	d.canonicalizeNAT = enabled
+}
+
+// canonicalize rewrites a translated entry in its pre-NAT form, see CanonicalizeNAT
+func canonicalize(c *Con) {
+	if !IsNAT(*c) {
+		return
+	}
+	c.NATApplied = true
+	c.PostNATReply = c.Reply
+	c.Reply = invertTuple(c.Origin)
+}
+
+// invertTuple returns the tuple of the other direction of a connection
+func invertTuple(t *ct.IPTuple) *ct.IPTuple {
+	return &ct.IPTuple{
+		Src: t.Dst,
+		Dst: t.Src,
+		Proto: &ct.ProtoTuple{
+			Number:  t.Proto.Number,
+			SrcPort: t.Proto.DstPort,
+			DstPort: t.Proto.SrcPort,
+		},
+	}
+}
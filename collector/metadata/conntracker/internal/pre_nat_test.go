@@ -0,0 +1,52 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"testing"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestCanonicalizeNAT(t *testing.T) {
+	// 10.0.2.15:58472 -> 2.2.2.2:5432, DNATed to 1.1.1.1:5432
+	dnat := netlink.Message{Data: encodeTestConn(t, nil)}
+	origin := newIPTuple("10.0.2.15", "2.2.2.2", 58472, 5432, uint8(unix.IPPROTO_TCP))
+	reply := newIPTuple("2.2.2.2", "10.0.2.15", 5432, 58472, uint8(unix.IPPROTO_TCP))
+	data, err := EncodeConn(&Con{Con: ct.Con{Origin: origin, Reply: reply}})
+	require.NoError(t, err)
+	untranslated := netlink.Message{Data: append([]byte{unix.AF_INET, unix.NFNETLINK_V0, 0, 0}, data...)}
+
+	decoder := NewDecoder()
+	decoder.CanonicalizeNAT(true)
+	conns := decoder.DecodeAndReleaseEvent(Event{msgs: []netlink.Message{dnat, untranslated}})
+	require.Len(t, conns, 2)
+
+	// The reply tuple shows the original destination, not the pod it was DNATed to
+	conn := conns[0]
+	assert.True(t, conn.NATApplied)
+	assert.Equal(t, "2.2.2.2", conn.Origin.Dst.String())
+	assert.Equal(t, "2.2.2.2", conn.Reply.Src.String())
+	assert.Equal(t, "10.0.2.15", conn.Reply.Dst.String())
+	assert.Equal(t, uint16(5432), *conn.Reply.Proto.SrcPort)
+	assert.Equal(t, uint16(58472), *conn.Reply.Proto.DstPort)
+	assert.False(t, IsNAT(conn))
+	require.NotNil(t, conn.PostNATReply)
+	assert.Equal(t, "1.1.1.1", conn.PostNATReply.Src.String())
+
+	assert.False(t, conns[1].NATApplied)
+	assert.Nil(t, conns[1].PostNATReply)
+	assert.Equal(t, "2.2.2.2", conns[1].Reply.Src.String())
+
+	// The post-NAT view is kept when disabled
+	decoder.CanonicalizeNAT(false)
+	conns = decoder.DecodeAndReleaseEvent(Event{msgs: []netlink.Message{dnat}})
+	require.Len(t, conns, 1)
+	assert.False(t, conns[0].NATApplied)
+	assert.Equal(t, "1.1.1.1", conns[0].Reply.Src.String())
+}
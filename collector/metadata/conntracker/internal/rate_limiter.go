@@ -0,0 +1,29 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+// RateLimiter decides when the streaming socket is throttled. Once it's open, the socket is
+// re-created with a sampling rate derived from Rate and the targetRateLimit of the Consumer,
+// and the limiter is Reset. CircuitBreaker is the default implementation.
+type RateLimiter interface {
+	// Tick accounts for n messages read off the socket
+	Tick(n int)
+	// IsOpen reports whether the rate of messages is over the limit
+	IsOpen() bool
+	// Rate returns the current rate of messages, per second
+	Rate() int64
+	// Reset closes the limiter and resets its state
+	Reset()
+}
+
+var _ RateLimiter = &CircuitBreaker{}
+
+// WithRateLimiter replaces the CircuitBreaker of the Consumer by the given RateLimiter, e.g. a
+// token bucket, or a limiter shared by several Consumers. The Consumer doesn't stop it: its
+// lifecycle is the responsibility of the caller.
+func WithRateLimiter(limiter RateLimiter) ConsumerOption {
+	return func(c *Consumer) {
+		c.limiter = limiter
+	}
+}
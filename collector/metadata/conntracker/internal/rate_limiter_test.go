@@ -0,0 +1,64 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+type fakeRateLimiter struct {
+	open   bool
+	ticks  int
+	resets int
+}
+
+func (l *fakeRateLimiter) Tick(n int)   { l.ticks += n }
+func (l *fakeRateLimiter) IsOpen() bool { return l.open }
+func (l *fakeRateLimiter) Rate() int64  { return 0 }
+func (l *fakeRateLimiter) Reset()       { l.resets++ }
+
+func TestWithRateLimiter(t *testing.T) {
+	// Throttling only resets the limiter on old kernels, instead of re-creating the socket
+	prev := pre315Kernel
+	pre315Kernel = true
+	defer func() { pre315Kernel = prev }()
+
+	receive := func(limiter RateLimiter) *Consumer {
+		c := NewConsumer(t.TempDir(), 100, false, WithRateLimiter(limiter))
+		assert.Nil(t, c.breaker)
+		c.setStreaming(true)
+		msg := netlink.Message{Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK << 8)}}
+		reads := 3
+		c.readFn = func(b []byte) ([]netlink.Message, int32, error) {
+			if reads == 0 {
+				return nil, 0, errors.New("read netlink: use of closed file")
+			}
+			reads--
+			return []netlink.Message{msg, msg}, 0, nil
+		}
+		output := make(chan Event, outputBuffer)
+		require.NoError(t, c.receive(context.Background(), output))
+		c.Stop()
+		return c
+	}
+
+	never := &fakeRateLimiter{}
+	c := receive(never)
+	assert.Equal(t, 6, never.ticks)
+	assert.Zero(t, never.resets)
+	assert.Zero(t, c.Stats().Throttles)
+
+	always := &fakeRateLimiter{open: true}
+	c = receive(always)
+	assert.Equal(t, 6, always.ticks)
+	assert.Equal(t, 3, always.resets)
+	assert.Equal(t, int64(3), c.Stats().Throttles)
+}
@@ -0,0 +1,57 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// This package is purely observational: it reads the conntrack tables, but must never create,
+// update or delete an entry (IPCTNL_MSG_CT_NEW, IPCTNL_MSG_CT_DELETE, ...) since it runs
+// alongside production traffic. Every request is built by one of the constructors below and is
+// checked by checkReadOnly right before being sent, so that a mutating message can't reach the
+// kernel by accident. Only conntrack GET/DUMP and RTM_GETNSID requests are allowed.
+
+// errMutatingRequest is returned when trying to send a message which could modify kernel state
+var errMutatingRequest = errors.New("refusing to send a mutating netlink request")
+
+const ctGetType = netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK<<8 | ipctnlMsgCtGet)
+
+// checkReadOnly returns an error unless the message is one of the read-only requests we issue
+func checkReadOnly(m netlink.Message) error {
+	switch m.Header.Type {
+	case ctGetType, unix.RTM_GETNSID:
+		return nil
+	default:
+		return fmt.Errorf("%w: message type %#x", errMutatingRequest, uint16(m.Header.Type))
+	}
+}
+
+// newCtGetRequest returns a conntrack GET request for the given family.
+// Adding netlink.Dump to the flags turns it into a dump of the whole table.
+func newCtGetRequest(family uint8, flags netlink.HeaderFlags) netlink.Message {
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:  ctGetType,
+			Flags: flags,
+		},
+		Data: []byte{family, unix.NFNETLINK_V0, 0, 0},
+	}
+}
+
+// newGetNSIDRequest returns a RTM_GETNSID request carrying the given encoded attributes
+func newGetNSIDRequest(sequence uint32, attrs []byte) netlink.Message {
+	return netlink.Message{
+		Header: netlink.Header{
+			Flags:    netlink.Request,
+			Type:     unix.RTM_GETNSID,
+			Sequence: sequence,
+		},
+		Data: append([]byte{unix.AF_UNSPEC, 0, 0, 0}, attrs...),
+	}
+}
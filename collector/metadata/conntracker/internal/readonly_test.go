@@ -0,0 +1,56 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// ipctnlMsgCtGetCtrZero is a mutating message type, from include/uapi/linux/netfilter/nfnetlink_conntrack.h
+const ipctnlMsgCtGetCtrZero = 3
+
+func TestRequestsAreReadOnly(t *testing.T) {
+	requests := []netlink.Message{
+		newCtGetRequest(unix.AF_INET, netlink.Request|netlink.Dump),
+		newCtGetRequest(unix.AF_INET6, netlink.Request|netlink.Dump),
+		newCtGetRequest(unix.AF_INET, netlink.Request|netlink.Acknowledge),
+		newGetNSIDRequest(1, nil),
+	}
+	for _, req := range requests {
+		assert.NoError(t, checkReadOnly(req), "request of type %#x should be allowed", uint16(req.Header.Type))
+	}
+}
+
+func TestMutatingRequestsAreRejected(t *testing.T) {
+	types := []netlink.HeaderType{
+		unix.NFNL_SUBSYS_CTNETLINK<<8 | ipctnlMsgCtNew,
+		unix.NFNL_SUBSYS_CTNETLINK<<8 | ipctnlMsgCtDelete,
+		unix.NFNL_SUBSYS_CTNETLINK<<8 | ipctnlMsgCtGetCtrZero,
+		unix.NFNL_SUBSYS_CTNETLINK_EXP<<8 | ipctnlMsgCtNew,
+		unix.NFNL_SUBSYS_CTNETLINK_EXP<<8 | ipctnlMsgCtDelete,
+		unix.RTM_NEWNSID,
+		unix.RTM_DELNSID,
+	}
+	for _, typ := range types {
+		m := netlink.Message{Header: netlink.Header{Type: typ, Flags: netlink.Request}}
+		assert.ErrorIs(t, checkReadOnly(m), errMutatingRequest, "request of type %#x should be rejected", uint16(typ))
+	}
+}
+
+func TestSocketRefusesMutatingRequests(t *testing.T) {
+	s, err := NewSocket()
+	if err != nil {
+		t.Skipf("could not create netlink socket: %s", err)
+	}
+	defer s.Close()
+
+	m := newCtGetRequest(unix.AF_INET, netlink.Request|netlink.Acknowledge)
+	m.Header.Type = unix.NFNL_SUBSYS_CTNETLINK<<8 | ipctnlMsgCtDelete
+	require.ErrorIs(t, s.Send(m), errMutatingRequest)
+}
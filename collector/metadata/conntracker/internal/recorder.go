@@ -0,0 +1,253 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// ConnectionSummary is a decoded summary of a conntrack event, kept for post-mortem inspection
+type ConnectionSummary struct {
+	Time  time.Time
+	NetNS int32
+	Proto uint8
+
+	Src, Dst         net.IP
+	SrcPort, DstPort uint16
+
+	ReplySrc, ReplyDst         net.IP
+	ReplySrcPort, ReplyDstPort uint16
+
+	// ICMP holds the identifiers of ICMP and ICMPv6 connections, which have no ports
+	ICMP *ICMPSummary
+
+	// TCPState is the conntrack state of TCP connections, e.g. 3 for ESTABLISHED
+	TCPState *uint8
+	Mark     uint32
+	Zone     uint16
+}
+
+// ICMPSummary holds the identifiers of an ICMP or ICMPv6 connection
+type ICMPSummary struct {
+	Type, Code uint8
+	ID         uint16
+}
+
+// String returns a one-line representation of the connection, meant to be grepped and parsed:
+//
+//	proto src:port -> dst:port [natted dst':port'] state mark=N zone=Z
+//
+// The natted part is only present when the reply tuple isn't the inverse of the original one,
+// and holds the destination of the connection after NAT, i.e. the source of the reply tuple.
+// ICMP connections have no ports, and are formatted like Con.String:
+//
+//	proto src -> dst type=T code=C id=I [natted dst'] state mark=N zone=Z
+//
+// state is the TCP state, or "-" for other protocols. IPv6 addresses are bracketed.
+func (s ConnectionSummary) String() string {
+	var b strings.Builder
+	if s.ICMP != nil {
+		fmt.Fprintf(&b, "%s %s -> %s type=%d code=%d id=%d", protocolName(s.Proto), address(s.Src), address(s.Dst), s.ICMP.Type, s.ICMP.Code, s.ICMP.ID)
+		if s.natted() {
+			fmt.Fprintf(&b, " natted %s", address(s.ReplySrc))
+		}
+	} else {
+		fmt.Fprintf(&b, "%s %s -> %s", protocolName(s.Proto), endpoint(s.Src, s.SrcPort), endpoint(s.Dst, s.DstPort))
+		if s.natted() {
+			fmt.Fprintf(&b, " natted %s", endpoint(s.ReplySrc, s.ReplySrcPort))
+		}
+	}
+	state := "-"
+	if s.TCPState != nil {
+		state = tcpStateName(*s.TCPState)
+	}
+	fmt.Fprintf(&b, " %s mark=%d zone=%d", state, s.Mark, s.Zone)
+	return b.String()
+}
+
+// natted reports whether the reply tuple differs from the inverse of the original tuple
+func (s ConnectionSummary) natted() bool {
+	if s.ReplySrc == nil && s.ReplyDst == nil {
+		return false
+	}
+	return !s.ReplySrc.Equal(s.Dst) || !s.ReplyDst.Equal(s.Src) || s.ReplySrcPort != s.DstPort || s.ReplyDstPort != s.SrcPort
+}
+
+func endpoint(ip net.IP, port uint16) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+// address formats the IP like endpoint, without a port
+func address(ip net.IP) string {
+	if addr := ip.String(); strings.Contains(addr, ":") {
+		return "[" + addr + "]"
+	}
+	return ip.String()
+}
+
+var protocolNames = map[uint8]string{
+	unix.IPPROTO_ICMP:    "icmp",
+	unix.IPPROTO_TCP:     "tcp",
+	unix.IPPROTO_UDP:     "udp",
+	unix.IPPROTO_DCCP:    "dccp",
+	unix.IPPROTO_GRE:     "gre",
+	unix.IPPROTO_ICMPV6:  "icmpv6",
+	unix.IPPROTO_SCTP:    "sctp",
+	unix.IPPROTO_UDPLITE: "udplite",
+}
+
+// protocolName returns the name of the IP protocol, or its number if it's unknown
+func protocolName(proto uint8) string {
+	if name, ok := protocolNames[proto]; ok {
+		return name
+	}
+	return strconv.Itoa(int(proto))
+}
+
+// tcpStateNames are the names of the conntrack TCP states, indexed by state
+var tcpStateNames = [...]string{
+	"NONE", "SYN_SENT", "SYN_RECV", "ESTABLISHED", "FIN_WAIT", "CLOSE_WAIT", "LAST_ACK", "TIME_WAIT", "CLOSE", "SYN_SENT2",
+}
+
+// tcpStateName returns the name of the conntrack TCP state, or its number if it's unknown
+func tcpStateName(state uint8) string {
+	if int(state) < len(tcpStateNames) {
+		return tcpStateNames[state]
+	}
+	return strconv.Itoa(int(state))
+}
+
+// flightRecorder is a fixed-size ring retaining the most recent event messages, overwriting the
+// oldest ones once full. Messages are copied as is, and only decoded when read by recent, to keep
+// the cost of recording low on the receive path.
+type flightRecorder struct {
+	mutex   sync.Mutex
+	decoder *Decoder
+	ring    []recordedMessage
+	// next is the index of the next slot to write, and full is set once the ring wrapped
+	next int
+	full bool
+}
+
+// recordedMessage is a copy of a streamed message, with the time and netns of its event
+type recordedMessage struct {
+	time  time.Time
+	netns int32
+	msg   netlink.Message
+}
+
+func newFlightRecorder(size int) *flightRecorder {
+	return &flightRecorder{
+		decoder: NewDecoder(),
+		ring:    make([]recordedMessage, size),
+	}
+}
+
+// record copies the messages to the ring. The data of the slots being overwritten is reused.
+func (r *flightRecorder) record(msgs []netlink.Message, netns int32) {
+	if len(r.ring) == 0 {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	for _, m := range msgs {
+		slot := &r.ring[r.next]
+		slot.time = now
+		slot.netns = netns
+		slot.msg.Header = m.Header
+		slot.msg.Data = append(slot.msg.Data[:0], m.Data...)
+
+		r.next = (r.next + 1) % len(r.ring)
+		if r.next == 0 {
+			r.full = true
+		}
+	}
+}
+
+// recent decodes the retained messages and returns their summaries, from the oldest to the
+// most recent. Messages which can't be decoded are skipped.
+func (r *flightRecorder) recent() []ConnectionSummary {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var recorded []recordedMessage
+	if r.full {
+		recorded = append(recorded, r.ring[r.next:]...)
+	}
+	recorded = append(recorded, r.ring[:r.next]...)
+
+	summaries := make([]ConnectionSummary, 0, len(recorded))
+	for _, m := range recorded {
+		for _, c := range r.decoder.DecodeAndReleaseEvent(Event{msgs: []netlink.Message{m.msg}, netns: m.netns}) {
+			s := summaryOf(c)
+			s.Time = m.time
+			summaries = append(summaries, s)
+		}
+	}
+	return summaries
+}
+
+func summaryOf(c Con) ConnectionSummary {
+	s := ConnectionSummary{NetNS: c.NetNS}
+	if t := c.Origin; t != nil {
+		s.Src, s.Dst, s.SrcPort, s.DstPort = tupleEndpoints(t.Src, t.Dst, t.Proto)
+		if t.Proto != nil && t.Proto.Number != nil {
+			s.Proto = *t.Proto.Number
+		}
+		if isICMPTuple(t) {
+			s.ICMP = icmpSummaryOf(t.Proto)
+		}
+	}
+	if t := c.Reply; t != nil {
+		s.ReplySrc, s.ReplyDst, s.ReplySrcPort, s.ReplyDstPort = tupleEndpoints(t.Src, t.Dst, t.Proto)
+	}
+	if c.ProtoInfo != nil && c.ProtoInfo.TCP != nil {
+		s.TCPState = c.ProtoInfo.TCP.State
+	}
+	if c.Mark != nil {
+		s.Mark = *c.Mark
+	}
+	if c.Zone != nil {
+		s.Zone = *c.Zone
+	}
+	return s
+}
+
+func tupleEndpoints(src, dst *net.IP, proto *ct.ProtoTuple) (srcIP, dstIP net.IP, srcPort, dstPort uint16) {
+	if src != nil {
+		srcIP = *src
+	}
+	if dst != nil {
+		dstIP = *dst
+	}
+	if proto != nil {
+		if proto.SrcPort != nil {
+			srcPort = *proto.SrcPort
+		}
+		if proto.DstPort != nil {
+			dstPort = *proto.DstPort
+		}
+	}
+	return
+}
+
+// icmpSummaryOf returns the identifiers of an ICMP tuple, see isICMPTuple
+func icmpSummaryOf(p *ct.ProtoTuple) *ICMPSummary {
+	if p.IcmpType != nil {
+		return &ICMPSummary{Type: *p.IcmpType, Code: *p.IcmpCode, ID: *p.IcmpID}
+	}
+	return &ICMPSummary{Type: *p.Icmpv6Type, Code: *p.Icmpv6Code, ID: *p.Icmpv6ID}
+}
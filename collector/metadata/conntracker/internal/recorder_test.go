@@ -0,0 +1,122 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"testing"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestFlightRecorder(t *testing.T) {
+	c := &Consumer{}
+	assert.Nil(t, c.RecentEvents())
+
+	WithFlightRecorder(3)(c)
+	assert.Empty(t, c.RecentEvents())
+
+	// Events are told apart by their netns
+	for netns := int32(1); netns <= 2; netns++ {
+		c.recorder.record([]netlink.Message{{Data: encodeTestConn(t, nil)}}, netns)
+	}
+	recent := c.RecentEvents()
+	require.Len(t, recent, 2)
+	assert.Equal(t, int32(1), recent[0].NetNS)
+	assert.Equal(t, int32(2), recent[1].NetNS)
+
+	for netns := int32(3); netns <= 7; netns++ {
+		c.recorder.record([]netlink.Message{{Data: encodeTestConn(t, nil)}}, netns)
+	}
+	recent = c.RecentEvents()
+	require.Len(t, recent, 3)
+	for i, s := range recent {
+		assert.Equal(t, int32(5+i), s.NetNS)
+		assert.Equal(t, "10.0.2.15", s.Src.String())
+		assert.Equal(t, uint16(5432), s.DstPort)
+		assert.Equal(t, "1.1.1.1", s.ReplySrc.String())
+		assert.False(t, s.Time.IsZero())
+	}
+}
+
+func TestFlightRecorderMultipleMessages(t *testing.T) {
+	r := newFlightRecorder(4)
+	m := netlink.Message{Data: encodeTestConn(t, nil)}
+
+	r.record([]netlink.Message{m, m, m}, 1)
+	r.record([]netlink.Message{m, m}, 2)
+
+	recent := r.recent()
+	require.Len(t, recent, 4)
+	assert.Equal(t, []int32{1, 1, 2, 2}, []int32{recent[0].NetNS, recent[1].NetNS, recent[2].NetNS, recent[3].NetNS})
+}
+
+func TestFlightRecorderCopiesMessages(t *testing.T) {
+	r := newFlightRecorder(4)
+	data := encodeTestConn(t, nil)
+
+	r.record([]netlink.Message{{Data: data}, {Data: []byte{1, 2}}}, 1)
+	// the receive buffer is reused once the event is released
+	for i := range data {
+		data[i] = 0
+	}
+
+	// the malformed message is left out
+	recent := r.recent()
+	require.Len(t, recent, 1)
+	assert.Equal(t, "10.0.2.15", recent[0].Src.String())
+}
+
+func TestConnectionSummaryString(t *testing.T) {
+	established, mark, zone := uint8(3), uint32(16), uint16(2)
+
+	// A connection masqueraded to the address of the host
+	snat := summaryOf(Con{Con: ct.Con{
+		Origin:    newIPTuple("172.17.0.2", "1.1.1.1", 58472, 443, unix.IPPROTO_TCP),
+		Reply:     newIPTuple("1.1.1.1", "10.0.2.15", 443, 61000, unix.IPPROTO_TCP),
+		ProtoInfo: &ct.ProtoInfo{TCP: &ct.TCPInfo{State: &established}},
+		Mark:      &mark,
+		Zone:      &zone,
+	}})
+	assert.Equal(t, "tcp 172.17.0.2:58472 -> 1.1.1.1:443 natted 1.1.1.1:443 ESTABLISHED mark=16 zone=2", snat.String())
+
+	// A connection to a service address, redirected to one of its backends
+	dnat := summaryOf(Con{Con: ct.Con{
+		Origin: newIPTuple("10.0.2.15", "10.96.0.10", 40000, 53, unix.IPPROTO_UDP),
+		Reply:  newIPTuple("172.17.0.5", "10.0.2.15", 5353, 40000, unix.IPPROTO_UDP),
+	}})
+	assert.Equal(t, "udp 10.0.2.15:40000 -> 10.96.0.10:53 natted 172.17.0.5:5353 - mark=0 zone=0", dnat.String())
+
+	v6 := summaryOf(Con{Con: ct.Con{
+		Origin: newIPTuple("fd00::1", "2001:db8::53", 40000, 53, unix.IPPROTO_UDP),
+		Reply:  newIPTuple("2001:db8::53", "fd00::1", 53, 40000, unix.IPPROTO_UDP),
+	}})
+	assert.Equal(t, "udp [fd00::1]:40000 -> [2001:db8::53]:53 - mark=0 zone=0", v6.String())
+
+	// ICMP tuples have identifiers instead of ports
+	icmpTuple := func(src, dst string, proto uint8, typ, code uint8, id uint16) *ct.IPTuple {
+		tuple := newIPTuple(src, dst, 0, 0, proto)
+		tuple.Proto.SrcPort, tuple.Proto.DstPort = nil, nil
+		if proto == unix.IPPROTO_ICMP {
+			tuple.Proto.IcmpType, tuple.Proto.IcmpCode, tuple.Proto.IcmpID = &typ, &code, &id
+		} else {
+			tuple.Proto.Icmpv6Type, tuple.Proto.Icmpv6Code, tuple.Proto.Icmpv6ID = &typ, &code, &id
+		}
+		return tuple
+	}
+	ping := summaryOf(Con{Con: ct.Con{
+		Origin: icmpTuple("172.17.0.2", "2.2.2.2", unix.IPPROTO_ICMP, 8, 0, 1234),
+		Reply:  icmpTuple("2.2.2.2", "10.0.2.15", unix.IPPROTO_ICMP, 0, 0, 1234),
+	}})
+	assert.Equal(t, "icmp 172.17.0.2 -> 2.2.2.2 type=8 code=0 id=1234 natted 2.2.2.2 - mark=0 zone=0", ping.String())
+
+	ping6 := summaryOf(Con{Con: ct.Con{
+		Origin: icmpTuple("fd00::1", "2001:db8::1", unix.IPPROTO_ICMPV6, 128, 0, 7),
+		Reply:  icmpTuple("2001:db8::1", "fd00::1", unix.IPPROTO_ICMPV6, 129, 0, 7),
+	}})
+	assert.Equal(t, "icmpv6 [fd00::1] -> [2001:db8::1] type=128 code=0 id=7 - mark=0 zone=0", ping6.String())
+}
@@ -0,0 +1,77 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vishvananda/netns"
+)
+
+// WithRootNamespacePath makes the Consumer use the network namespace at path, e.g.
+// /proc/<pid>/ns/net or a bind mount under /run/netns, as its root namespace. By default, the
+// root namespace is the namespace of pid 1 under procRoot, which isn't the host's in some
+// topologies, e.g. in nested containers or CI runners. The root namespace is the one in which
+// events are streamed and whose table is dumped first.
+func WithRootNamespacePath(path string) ConsumerOption {
+	return func(c *Consumer) {
+		c.rootNSPath = path
+	}
+}
+
+// WithRootNamespaceInode is like WithRootNamespacePath, but the root namespace is the network
+// namespace with the given inode, among the namespaces of the processes under procRoot.
+func WithRootNamespaceInode(inode uint32) ConsumerOption {
+	return func(c *Consumer) {
+		c.rootNSInode = inode
+	}
+}
+
+// rootNamespace returns the handle of the root namespace of the Consumer, see
+// WithRootNamespacePath and WithRootNamespaceInode. The caller is responsible for closing it.
+func (c *Consumer) rootNamespace() (netns.NsHandle, error) {
+	switch {
+	case c.rootNSPath != "":
+		return netns.GetFromPath(c.rootNSPath)
+	case c.rootNSInode != 0:
+		ns, err := c.findNamespace(c.rootNSInode)
+		if err != nil {
+			return netns.None(), fmt.Errorf("root namespace %d: %w", c.rootNSInode, err)
+		}
+		return ns, nil
+	default:
+		return GetRootNetNamespace(c.procRoot)
+	}
+}
+
+// withRootNS is like WithRootNS, in the root namespace of the Consumer
+func (c *Consumer) withRootNS(fn func() error) error {
+	rootNS, err := c.rootNamespace()
+	if err != nil {
+		return err
+	}
+	defer rootNS.Close()
+
+	return c.withNS(rootNS, fn)
+}
+
+// newSocketIn opens a netlink socket from within the namespace entered by withNS, e.g.
+// c.withRootNS. The socket is closed if the previous namespace couldn't be restored, since
+// the error is returned to callers which don't expect a socket then, see ErrNamespaceRestore.
+func newSocketIn(withNS func(fn func() error) error) (*Socket, error) {
+	var sock *Socket
+	err := withNS(func() error {
+		var err error
+		sock, err = NewSocket()
+		return err
+	})
+	if errors.Is(err, ErrNamespaceRestore) && sock != nil {
+		_ = sock.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sock, nil
+}
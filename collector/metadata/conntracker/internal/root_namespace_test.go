@@ -0,0 +1,88 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+func TestRootNamespaceOverride(t *testing.T) {
+	// pid 1 isn't in the network namespace of the host, pid 2 is
+	procRoot := t.TempDir()
+	for pid, target := range map[string]string{"1": "/proc/self/ns/uts", "2": "/proc/self/ns/net"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(procRoot, pid, "ns"), 0o755))
+		require.NoError(t, os.Symlink(target, filepath.Join(procRoot, pid, "ns/net")))
+	}
+	hostNS, err := netns.Get()
+	require.NoError(t, err)
+	defer hostNS.Close()
+	hostInode, err := namespaceInode(hostNS)
+	require.NoError(t, err)
+
+	for name, opt := range map[string]ConsumerOption{
+		"path":  WithRootNamespacePath("/proc/self/ns/net"),
+		"inode": WithRootNamespaceInode(hostInode),
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := NewConsumer(procRoot, -1, false, opt)
+			defer c.Stop()
+			var dumped []uint32
+			c.dumpNS = func(ctx context.Context, family uint8, output chan Event, ns netns.NsHandle) error {
+				inode, err := namespaceInode(ns)
+				require.NoError(t, err)
+				dumped = append(dumped, inode)
+				return nil
+			}
+
+			events, err := c.DumpTable(unix.AF_INET)
+			if err != nil {
+				t.Skipf("could not dump the conntrack table: %s", err)
+			}
+			for range events {
+			}
+			assert.Equal(t, []uint32{hostInode}, dumped)
+		})
+	}
+
+	// By default, the namespace of pid 1 is the root one
+	c := NewConsumer(procRoot, -1, false)
+	defer c.Stop()
+	rootNS, err := c.rootNamespace()
+	require.NoError(t, err)
+	defer rootNS.Close()
+	assert.False(t, rootNS.Equal(hostNS))
+
+	c = NewConsumer(procRoot, -1, false, WithRootNamespaceInode(1))
+	defer c.Stop()
+	_, err = c.DumpTable(unix.AF_INET)
+	assert.ErrorIs(t, err, ErrNamespaceNotFound)
+}
+
+func TestNewSocketInRestoreFailure(t *testing.T) {
+	openFiles := func() int {
+		entries, err := os.ReadDir("/proc/self/fd")
+		require.NoError(t, err)
+		return len(entries)
+	}
+
+	before := openFiles()
+	sock, err := newSocketIn(func(fn func() error) error {
+		if err := fn(); err != nil {
+			t.Skipf("could not open netlink socket: %s", err)
+		}
+		// the socket was created, but the thread was left in the namespace afterwards
+		return ErrNamespaceRestore
+	})
+	assert.ErrorIs(t, err, ErrNamespaceRestore)
+	assert.Nil(t, sock)
+	assert.Equal(t, before, openFiles())
+}
@@ -0,0 +1,73 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// samplerEffectivenessWindow is how long the received rate is measured after a sampler change
+const samplerEffectivenessWindow = tickInterval
+
+// samplerCheck measures whether the received rate dropped as expected after the sampling rate
+// of the streaming socket was changed. A sampler which doesn't drop anything, e.g. a BPF filter
+// silently ignored by the kernel, shows up as a low sampler_effectiveness.
+type samplerCheck struct {
+	// preRate is the received rate before the change
+	preRate float64
+	// intendedDrop is the fraction of the messages the new sampling rate should drop
+	intendedDrop float64
+	start        time.Time
+	received     int64
+	pending      bool
+
+	now func() time.Time
+}
+
+func newSamplerCheck() *samplerCheck {
+	return &samplerCheck{now: time.Now}
+}
+
+// reset starts measuring the effect of a sampling rate change from prevRate to rate, while
+// preRate messages per second were received
+func (s *samplerCheck) reset(preRate int64, prevRate, rate float64) {
+	s.pending = preRate > 0 && prevRate > 0 && rate < prevRate
+	if !s.pending {
+		return
+	}
+	s.preRate = float64(preRate)
+	s.intendedDrop = 1 - rate/prevRate
+	s.start = s.now()
+	s.received = 0
+}
+
+// observe counts n received messages. Once the measurement window is elapsed, it returns the
+// observed drop of the received rate divided by the intended one, in percent, and true.
+func (s *samplerCheck) observe(n int) (int64, bool) {
+	if !s.pending {
+		return 0, false
+	}
+	s.received += int64(n)
+	elapsed := s.now().Sub(s.start)
+	if elapsed < samplerEffectivenessWindow {
+		return 0, false
+	}
+
+	s.pending = false
+	postRate := float64(s.received) / elapsed.Seconds()
+	observedDrop := 1 - postRate/s.preRate
+	if observedDrop < 0 {
+		observedDrop = 0
+	}
+	return int64(math.Round(observedDrop / s.intendedDrop * 100)), true
+}
+
+// checkSampler accounts for n received messages in the measurement of the sampler effectiveness
+func (c *Consumer) checkSampler(n int) {
+	if effectiveness, ok := c.samplerCheck.observe(n); ok {
+		atomic.StoreInt64(&c.samplerEffectiveness, effectiveness)
+	}
+}
@@ -0,0 +1,53 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestSamplerEffectiveness(t *testing.T) {
+	// receives msgsPerSec for the measurement window, after the sampling rate was halved while
+	// 1000 messages per second were received
+	measure := func(msgsPerSec int) int64 {
+		c := NewConsumer(t.TempDir(), 100, false, WithRateLimiter(&fakeRateLimiter{}))
+		defer c.Stop()
+		c.setStreaming(true)
+		now := time.Now()
+		c.samplerCheck.now = func() time.Time { return now }
+		c.samplerCheck.reset(1000, 1, 0.5)
+
+		msg := netlink.Message{Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK << 8)}}
+		seconds := int(samplerEffectivenessWindow / time.Second)
+		c.readFn = func(b []byte) ([]netlink.Message, int32, error) {
+			if seconds == 0 {
+				return nil, 0, errors.New("read netlink: use of closed file")
+			}
+			seconds--
+			now = now.Add(time.Second)
+			msgs := make([]netlink.Message, msgsPerSec)
+			for i := range msgs {
+				msgs[i] = msg
+			}
+			return msgs, 0, nil
+		}
+		require.NoError(t, c.receive(context.Background(), make(chan Event, outputBuffer)))
+		return c.Stats().SamplerEffectiveness
+	}
+
+	// The received rate dropped as intended
+	assert.Equal(t, int64(100), measure(500))
+	// The rate only dropped by a fifth of what was intended
+	assert.Equal(t, int64(20), measure(900))
+	// The sampler had no effect
+	assert.Equal(t, int64(0), measure(1000))
+}
@@ -0,0 +1,25 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// FreezeSampling stops or resumes the adjustment of the sampling rate of the streaming socket.
+// While frozen, exceeding the target rate limit is still counted in the throttles stat, but the
+// socket isn't re-created with a lower sampling rate, and the rate limiter is reset instead.
+// It's meant for maintenance windows with known transient bursts of events, which would
+// otherwise leave the consumer sampled at a low rate after the burst. It's safe to call while
+// streaming.
+func (c *Consumer) FreezeSampling(frozen bool) {
+	var value int32
+	if frozen {
+		value = 1
+	}
+	if atomic.SwapInt32(&c.samplingFrozen, value) != value {
+		log.Printf("conntrack sampling rate adjustment frozen: %t", frozen)
+	}
+}
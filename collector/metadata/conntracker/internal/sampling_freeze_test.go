@@ -0,0 +1,45 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFreezeSampling(t *testing.T) {
+	prev := pre315Kernel
+	pre315Kernel = false
+	defer func() { pre315Kernel = prev }()
+
+	// the rate limit is always exceeded, like during a burst
+	limiter := &fakeRateLimiter{open: true}
+	c := NewConsumer(newFakeProcRoot(t, ""), 100, false, WithRateLimiter(limiter))
+	defer c.Stop()
+	if err := c.initNetlinkSocket(1.0); err != nil {
+		t.Skipf("could not initialize conntrack netlink socket: %s", err)
+	}
+	c.setStreaming(true)
+	defer func() { c.conn.Close() }()
+
+	c.FreezeSampling(true)
+	socket := c.socket
+	for i := 0; i < 3; i++ {
+		require.NoError(t, c.throttle(1000))
+	}
+	assert.Same(t, socket, c.socket)
+	assert.Equal(t, 1.0, c.samplingRate)
+	assert.Equal(t, 3, limiter.resets)
+	assert.Equal(t, int64(3), c.Stats().Throttles)
+
+	c.FreezeSampling(false)
+	require.NoError(t, c.throttle(1000))
+	assert.NotSame(t, socket, c.socket)
+	// the limiter doesn't report its rate, so the sampling rate can't be computed
+	assert.Equal(t, 1.0, c.samplingRate)
+	assert.Equal(t, 4, limiter.resets)
+	assert.Equal(t, int64(4), c.Stats().Throttles)
+}
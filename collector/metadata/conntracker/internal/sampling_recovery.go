@@ -0,0 +1,49 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// samplingRecoveryHeadroom is the part of the target rate limit below which the rate of
+	// messages must be for recoverSamplingRate to raise the sampling rate
+	samplingRecoveryHeadroom = 0.5
+)
+
+// samplingRecoveryInterval is the interval at which recoverSamplingRate checks the rate of messages
+var samplingRecoveryInterval = time.Minute
+
+// recoverSamplingRate raises the sampling rate of the streaming socket when the rate of messages
+// stays below the target rate limit. The limiter only lowers the sampling rate when it trips, so
+// without it a socket sampled after a burst, or started WithInitialSamplingRate on a quiet host,
+// would stay sampled until the next trip. It's called on every read the limiter doesn't trip,
+// and checks the rate every samplingRecoveryInterval: when it's below samplingRecoveryHeadroom
+// of the target, the socket is re-created with the sampling rate reaching the target, up to 1.
+// Limiters which don't report their rate are left alone.
+func (c *Consumer) recoverSamplingRate(now time.Time) error {
+	if c.samplingRate >= 1 || c.targetRateLimit <= 0 || atomic.LoadInt32(&c.samplingFrozen) == 1 {
+		return nil
+	}
+	if c.lastSamplingRecovery.IsZero() {
+		c.lastSamplingRecovery = now
+		return nil
+	}
+	if now.Sub(c.lastSamplingRecovery) < samplingRecoveryInterval {
+		return nil
+	}
+	c.lastSamplingRecovery = now
+
+	rate := c.limiter.Rate()
+	if rate <= 0 || float64(rate) >= float64(c.targetRateLimit)*samplingRecoveryHeadroom {
+		return nil
+	}
+	samplingRate := c.nextSamplingRate()
+	if samplingRate <= c.samplingRate {
+		return nil
+	}
+	return c.resample(samplingRate)
+}
@@ -0,0 +1,55 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoverSamplingRate(t *testing.T) {
+	prev := pre315Kernel
+	pre315Kernel = false
+	defer func() { pre315Kernel = prev }()
+
+	c := NewConsumer(newFakeProcRoot(t, ""), 100, false, WithInitialSamplingRate(0.1))
+	defer c.Stop()
+	if err := c.initNetlinkSocket(c.startSamplingRate()); err != nil {
+		t.Skipf("could not initialize conntrack netlink socket: %s", err)
+	}
+	c.setStreaming(true)
+	defer func() { c.conn.Close() }()
+
+	// 10 sampled messages/s, i.e. ~100 messages/s before sampling: the target is reached
+	// without sampling as much
+	atomic.StoreInt64(&c.breaker.eventRate, 10)
+	start := time.Now()
+	socket := c.socket
+	require.NoError(t, c.recoverSamplingRate(start))
+	require.NoError(t, c.recoverSamplingRate(start.Add(samplingRecoveryInterval/2)))
+	assert.Same(t, socket, c.socket, "the rate is only checked every interval")
+
+	require.NoError(t, c.recoverSamplingRate(start.Add(samplingRecoveryInterval)))
+	assert.NotSame(t, socket, c.socket)
+	assert.InDelta(t, 0.95, c.samplingRate, 0.001)
+
+	// a rate close to the target is left alone
+	atomic.StoreInt64(&c.breaker.eventRate, 80)
+	c.samplingRate = 0.5
+	socket = c.socket
+	require.NoError(t, c.recoverSamplingRate(start))
+	require.NoError(t, c.recoverSamplingRate(start.Add(samplingRecoveryInterval)))
+	assert.Same(t, socket, c.socket)
+	assert.Equal(t, 0.5, c.samplingRate)
+
+	// and so is a frozen one
+	atomic.StoreInt64(&c.breaker.eventRate, 10)
+	c.FreezeSampling(true)
+	require.NoError(t, c.recoverSamplingRate(start.Add(2*samplingRecoveryInterval)))
+	assert.Same(t, socket, c.socket)
+}
@@ -0,0 +1,123 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// estimateScale is the fixed-point scale of Consumer.streamedEstimate, which accumulates
+// fractional message counts since each sampled message stands for 1/samplingRate messages
+const estimateScale = 1000
+
+var (
+	errNotStreaming = errors.New("conntrack consumer is not streaming events")
+	// errShadowOverrun is returned by ShadowSample when the shadow socket dropped messages,
+	// in which case the full count is only a lower bound
+	errShadowOverrun = errors.New("shadow socket dropped messages")
+)
+
+// messageReceiver is the subset of Socket used by ShadowSample
+type messageReceiver interface {
+	ReceiveInto(b []byte) ([]netlink.Message, int32, error)
+	Close() error
+}
+
+// ShadowSample validates the sampling of the streaming socket: for the given duration, an
+// unsampled socket subscribed to the same groups is read alongside the streaming one. It returns
+// the number of messages received by the unsampled socket, and the number of messages estimated
+// from the sampled socket (each sampled message standing for 1/samplingRate messages).
+// The two should be close when sampling is unbiased. It's a diagnostic, meant to be run
+// occasionally since the shadow socket doubles the cost of receiving events while it's open.
+// Events() must be running.
+func (c *Consumer) ShadowSample(duration time.Duration) (fullCount, sampledEstimate int64, err error) {
+	if !c.isStreaming() {
+		return 0, 0, errNotStreaming
+	}
+
+	shadow, err := c.openShadowSocket()
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not open shadow netlink socket: %w", err)
+	}
+	return c.shadowSample(shadow, duration)
+}
+
+func (c *Consumer) shadowSample(shadow messageReceiver, duration time.Duration) (fullCount, sampledEstimate int64, err error) {
+	start := atomic.LoadInt64(&c.streamedEstimate)
+
+	var overrun bool
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		buffer := c.pool.Get().(*[]byte)
+		defer c.pool.Put(buffer)
+		for {
+			msgs, _, err := shadow.ReceiveInto(*buffer)
+			if err != nil {
+				if socketError(err) == errENOBUF {
+					overrun = true
+					continue
+				}
+				return
+			}
+			for i := range msgs {
+				if msgs[i].Header.Type != netlink.Error && msgs[i].Header.Type != netlink.Done {
+					fullCount++
+				}
+			}
+		}
+	}()
+
+	time.Sleep(duration)
+	// closing the socket interrupts the receive loop
+	_ = shadow.Close()
+	<-done
+
+	sampledEstimate = (atomic.LoadInt64(&c.streamedEstimate) - start) / estimateScale
+	if overrun {
+		return fullCount, sampledEstimate, errShadowOverrun
+	}
+	return fullCount, sampledEstimate, nil
+}
+
+// newShadowSocket opens an unsampled socket configured like the streaming one
+func (c *Consumer) newShadowSocket() (messageReceiver, error) {
+	sock, err := newSocketIn(c.withRootNS)
+	if err != nil {
+		return nil, err
+	}
+
+	bufferSize := netlinkBufferSize
+	if c.rcvBufGrowth != nil {
+		bufferSize = c.rcvBufGrowth.size
+	}
+	_ = sock.SetSockoptInt(syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, bufferSize)
+	if c.listenAllNamespaces {
+		_ = sock.SetSockoptInt(unix.SOL_NETLINK, unix.NETLINK_LISTEN_ALL_NSID, 1)
+	}
+
+	if err := c.joinGroups(sock); err != nil {
+		_ = sock.Close()
+		return nil, err
+	}
+	return sock, nil
+}
+
+// recordStreamed accounts for n messages which went through the sampling of the streaming
+// socket. It must be called from the receive loop, which owns samplingRate.
+func (c *Consumer) recordStreamed(n int) {
+	rate := c.samplingRate
+	if rate <= 0 || rate > 1 {
+		rate = 1
+	}
+	atomic.AddInt64(&c.streamedEstimate, int64(float64(n)*estimateScale/rate))
+}
@@ -0,0 +1,90 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// fakeShadowSocket delivers batches of messages to ShadowSample, and calls onBatch
+// for each of them so that tests can simulate what the sampled socket receives
+type fakeShadowSocket struct {
+	batches chan []netlink.Message
+	closed  chan struct{}
+	onBatch func(n int)
+}
+
+func newFakeShadowSocket(batchSize, batches int, onBatch func(n int)) *fakeShadowSocket {
+	f := &fakeShadowSocket{
+		batches: make(chan []netlink.Message, batches),
+		closed:  make(chan struct{}),
+		onBatch: onBatch,
+	}
+	for i := 0; i < batches; i++ {
+		msgs := make([]netlink.Message, batchSize)
+		for j := range msgs {
+			msgs[j].Header.Type = netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK << 8)
+		}
+		f.batches <- msgs
+	}
+	return f
+}
+
+func (f *fakeShadowSocket) ReceiveInto(b []byte) ([]netlink.Message, int32, error) {
+	select {
+	case msgs := <-f.batches:
+		f.onBatch(len(msgs))
+		return msgs, 0, nil
+	case <-f.closed:
+		return nil, 0, os.ErrClosed
+	}
+}
+
+func (f *fakeShadowSocket) Close() error {
+	close(f.closed)
+	return nil
+}
+
+func TestShadowSample(t *testing.T) {
+	c := NewConsumer(t.TempDir(), -1, false)
+	defer c.Stop()
+
+	_, _, err := c.ShadowSample(time.Millisecond)
+	assert.ErrorIs(t, err, errNotStreaming)
+
+	c.setStreaming(true)
+	c.samplingRate = 0.25
+
+	// The sampled socket receives a quarter of the 1000 messages: the estimate is unbiased
+	full, estimate, err := c.shadowSample(newFakeShadowSocket(100, 10, func(n int) {
+		c.recordStreamed(n / 4)
+	}), 50*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), full)
+	assert.Equal(t, int64(1000), estimate)
+
+	// The sampled socket only receives a fifth of the messages: the discrepancy shows
+	full, estimate, err = c.shadowSample(newFakeShadowSocket(100, 10, func(n int) {
+		c.recordStreamed(n / 5)
+	}), 50*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), full)
+	assert.Equal(t, int64(800), estimate)
+}
+
+func TestRecordStreamedUnsampled(t *testing.T) {
+	c := NewConsumer(t.TempDir(), -1, false)
+	defer c.Stop()
+
+	c.samplingRate = 1.0
+	c.recordStreamed(42)
+	assert.Equal(t, int64(42*estimateScale), c.streamedEstimate)
+}
@@ -0,0 +1,57 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"net"
+)
+
+// ShardKey maps the flow of the connection to a shard in [0, n), e.g. the worker goroutine
+// processing its events, so that the NEW, UPDATE and DESTROY events of a flow are processed in
+// order by the same worker. The key is an FNV-1a hash of the protocol and the endpoints of the
+// original tuple, ordered so that both directions of the flow map to the same shard. It doesn't
+// depend on the process, so shards are consistent across restarts and hosts.
+//
+// 0 is returned when n is lower than 2, or when the original tuple wasn't decoded.
+func (c *Con) ShardKey(n int) int {
+	if n < 2 || c == nil {
+		return 0
+	}
+	tuple := c.Origin
+	if tuple == nil || tuple.Src == nil || tuple.Dst == nil || tuple.Proto == nil || tuple.Proto.Number == nil {
+		return 0
+	}
+
+	var srcPort, dstPort uint16
+	if tuple.Proto.SrcPort != nil {
+		srcPort = *tuple.Proto.SrcPort
+	}
+	if tuple.Proto.DstPort != nil {
+		dstPort = *tuple.Proto.DstPort
+	}
+	a, b := shardEndpoint(*tuple.Src, srcPort), shardEndpoint(*tuple.Dst, dstPort)
+	if bytes.Compare(a[:], b[:]) > 0 {
+		a, b = b, a
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte{*tuple.Proto.Number})
+	_, _ = h.Write(a[:])
+	_, _ = h.Write(b[:])
+	// the high bits of FNV hashes are better distributed than the low ones, so they pick the
+	// shard rather than a modulo
+	return int(uint64(h.Sum32()) * uint64(n) >> 32)
+}
+
+// shardEndpoint encodes an address, in its 16 bytes form so that both representations of an
+// IPv4 address are equal, followed by a port in network byte order
+func shardEndpoint(ip net.IP, port uint16) [net.IPv6len + 2]byte {
+	var e [net.IPv6len + 2]byte
+	copy(e[:], ip.To16())
+	binary.BigEndian.PutUint16(e[net.IPv6len:], port)
+	return e
+}
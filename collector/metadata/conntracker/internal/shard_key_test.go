@@ -0,0 +1,46 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"fmt"
+	"testing"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestShardKey(t *testing.T) {
+	const shards = 8
+	conn := func(src, dst string, sport, dport uint16) *Con {
+		return &Con{Con: ct.Con{Origin: newIPTuple(src, dst, sport, dport, unix.IPPROTO_TCP)}}
+	}
+
+	// The events of a flow always map to the same shard, whichever its direction
+	flow := conn("10.0.2.15", "2.2.2.2", 58472, 5432)
+	shard := flow.ShardKey(shards)
+	assert.Equal(t, shard, conn("10.0.2.15", "2.2.2.2", 58472, 5432).ShardKey(shards))
+	assert.Equal(t, shard, conn("2.2.2.2", "10.0.2.15", 5432, 58472).ShardKey(shards))
+	// The hash is stable across processes
+	assert.Equal(t, 2, shard)
+
+	// Across many flows, the shards are evenly used
+	counts := make([]int, shards)
+	const flows = 8000
+	for i := 0; i < flows; i++ {
+		c := conn(fmt.Sprintf("10.0.%d.%d", i/250, i%250+1), "10.96.0.10", uint16(30000+i), 80)
+		s := c.ShardKey(shards)
+		assert.True(t, s >= 0 && s < shards)
+		counts[s]++
+	}
+	for s, count := range counts {
+		assert.InDelta(t, flows/shards, count, flows/shards/5, "shard %d", s)
+	}
+
+	assert.Zero(t, flow.ShardKey(1))
+	assert.Zero(t, flow.ShardKey(0))
+	assert.Zero(t, (&Con{}).ShardKey(shards))
+	assert.Zero(t, (*Con)(nil).ShardKey(shards))
+}
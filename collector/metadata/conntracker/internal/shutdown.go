@@ -0,0 +1,57 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"context"
+	"errors"
+)
+
+var errNotReceiving = errors.New("conntrack consumer has no receive loop running")
+
+// recvLoop is the receive loop started by Events
+type recvLoop struct {
+	// cancel abandons the event being emitted, if any
+	cancel context.CancelFunc
+	// done is closed once the loop exited and the output channel was closed
+	done chan struct{}
+}
+
+// startReceive runs the receive loop of Events in its own goroutine. exit is called once the
+// loop returns, and must close the output channel.
+func (c *Consumer) startReceive(output chan Event, exit func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	loop := &recvLoop{cancel: cancel, done: make(chan struct{})}
+	c.recvLoop = loop
+
+	go func() {
+		defer func() {
+			exit()
+			cancel()
+			close(loop.done)
+		}()
+
+		_ = c.receive(ctx, output)
+	}()
+}
+
+// Shutdown stops the consumer like Stop, but drains it: no new messages are read, while the
+// batch already read is processed and emitted before the channel returned by Events is closed.
+// It returns once the channel is closed, or ctx.Err() when ctx is done first, in which case the
+// batch being emitted, if any, is dropped. The channel must keep being read until it's closed.
+func (c *Consumer) Shutdown(ctx context.Context) error {
+	loop := c.recvLoop
+	c.Stop()
+	if loop == nil {
+		return errNotReceiving
+	}
+
+	select {
+	case <-loop.done:
+		return nil
+	case <-ctx.Done():
+		loop.cancel()
+		return ctx.Err()
+	}
+}
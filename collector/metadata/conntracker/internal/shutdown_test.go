@@ -0,0 +1,87 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdownEmitsInFlightBatch(t *testing.T) {
+	c := NewConsumer(t.TempDir(), -1, false)
+	c.setStreaming(true)
+
+	msg := netlink.Message{Header: netlink.Header{Type: ctNewType}}
+	reading, release := make(chan struct{}), make(chan struct{})
+	reads := 0
+	c.readFn = func(b []byte) ([]netlink.Message, int32, error) {
+		reads++
+		if reads == 2 {
+			// The second batch is being read when the consumer is shut down
+			close(reading)
+			<-release
+			return []netlink.Message{msg, msg}, 0, nil
+		}
+		return []netlink.Message{msg}, 0, nil
+	}
+
+	output := make(chan Event, outputBuffer)
+	c.startReceive(output, func() { close(output) })
+	<-reading
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- c.Shutdown(context.Background())
+	}()
+	// Shutdown waits for the batch being read
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned before the last batch was emitted: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	require.NoError(t, <-shutdown)
+
+	var sizes []int
+	for e := range output {
+		sizes = append(sizes, len(e.Messages()))
+		e.Done()
+	}
+	assert.Equal(t, []int{1, 2}, sizes)
+	assert.Equal(t, 2, reads)
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	c := NewConsumer(t.TempDir(), -1, false)
+	c.setStreaming(true)
+	msg := netlink.Message{Header: netlink.Header{Type: ctNewType}}
+	read := make(chan struct{})
+	c.readFn = func(b []byte) ([]netlink.Message, int32, error) {
+		close(read)
+		return []netlink.Message{msg}, 0, nil
+	}
+
+	// Nobody reads the events
+	output := make(chan Event)
+	done := make(chan struct{})
+	c.startReceive(output, func() { close(done) })
+	<-read
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, c.Shutdown(ctx), context.DeadlineExceeded)
+	// The pending event is dropped, and the loop exits
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the receive loop didn't exit")
+	}
+
+	assert.ErrorIs(t, NewConsumer(t.TempDir(), -1, false).Shutdown(context.Background()), errNotReceiving)
+}
@@ -0,0 +1,232 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Snapshot files hold the raw payload of conntrack netlink messages, each one prefixed by its
+// length as a little-endian uint32. They can be replayed into the decoder with ReadSnapshot, or
+// through the receive loop with ReplayDumpFile, which turns a production conntrack table into a
+// reproducible test fixture.
+
+// DumpTableToFile dumps the conntrack table for the given family and writes it to a snapshot file
+func (c *Consumer) DumpTableToFile(family uint8, path string) error {
+	events, err := c.DumpTable(family)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		drainEvents(events)
+		return fmt.Errorf("could not create conntrack snapshot: %w", err)
+	}
+
+	w := bufio.NewWriter(f)
+	err = writeSnapshot(w, events)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not write conntrack snapshot: %w", err)
+	}
+	return nil
+}
+
+// writeSnapshot writes the messages of all the events to w. The channel is always drained,
+// so that the buffers are released and the dump can complete even when writing fails.
+func writeSnapshot(w io.Writer, events <-chan Event) error {
+	defer drainEvents(events)
+
+	size := make([]byte, 4)
+	for e := range events {
+		for _, m := range e.Messages() {
+			binary.LittleEndian.PutUint32(size, uint32(len(m.Data)))
+			if _, err := w.Write(size); err != nil {
+				e.Done()
+				return err
+			}
+			if _, err := w.Write(m.Data); err != nil {
+				e.Done()
+				return err
+			}
+		}
+		e.Done()
+	}
+	return nil
+}
+
+func drainEvents(events <-chan Event) {
+	for e := range events {
+		e.Done()
+	}
+}
+
+// ReadSnapshot reads the messages of a snapshot file written by DumpTableToFile
+func ReadSnapshot(path string) ([]netlink.Message, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return readSnapshot(bufio.NewReader(f))
+}
+
+func readSnapshot(r io.Reader) ([]netlink.Message, error) {
+	var messages []netlink.Message
+	sizeBuffer := make([]byte, 4)
+	// the messages were received in the buffers of the pool, see newBufferPool
+	maxSize := os.Getpagesize()
+	for {
+		_, err := io.ReadFull(r, sizeBuffer)
+		if err != nil {
+			break
+		}
+
+		size := binary.LittleEndian.Uint32(sizeBuffer)
+		if size > uint32(maxSize) {
+			return nil, fmt.Errorf("%w: %d bytes", errSnapshotMessageTooLarge, size)
+		}
+		m := netlink.Message{Data: make([]byte, size)}
+		_, err = io.ReadFull(r, m.Data)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read enough data")
+		}
+
+		messages = append(messages, m)
+	}
+
+	return messages, nil
+}
+
+// ReplayDumpFile emits the messages of a snapshot file written by DumpTableToFile as if they were
+// dumped from the kernel: they go through the receive loop of a dump, so the CIDR filter and the
+// WithMaxEvents limit of dumps apply, and they're emitted in Events backed by the buffers of the Consumer,
+// which must be released with Done. The channel is closed once the whole file is replayed.
+// It's meant to test the processing of the events offline, and to reprocess captured tables.
+func (c *Consumer) ReplayDumpFile(path string) (<-chan Event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open conntrack snapshot: %w", err)
+	}
+
+	reader := &snapshotReader{r: bufio.NewReader(f)}
+	replayer := c.newReplayer(reader)
+	output := make(chan Event, outputBuffer)
+	go func() {
+		defer func() {
+			replayer.Stop()
+			_ = f.Close()
+			close(output)
+		}()
+
+		if err := replayer.receive(context.Background(), output); err != nil {
+			log.Printf("error replaying conntrack snapshot %s: %s", path, err)
+		}
+		if reader.err != nil {
+			log.Printf("error replaying conntrack snapshot %s: %s", path, reader.err)
+		}
+	}()
+
+	return output, nil
+}
+
+// newReplayer returns the Consumer replaying the messages of reader with the settings of c
+func (c *Consumer) newReplayer(reader *snapshotReader) *Consumer {
+	r := NewConsumer(c.procRoot, -1, false)
+	r.pool = c.pool
+	r.cidrFilter = c.cidrFilter
+	r.bootIDOnEvents = c.bootIDOnEvents
+	r.maxEvents = c.maxEvents
+	r.maxEventsScope = c.maxEventsScope
+	r.readFn = reader.read
+	r.dumpMode = true
+	return r
+}
+
+var errSnapshotMessageTooLarge = errors.New("snapshot message larger than the receive buffer")
+
+// snapshotReader reads the messages of a snapshot file into receive buffers, like a netlink
+// socket reading a dump. The last read ends with a multi-part "done" message.
+type snapshotReader struct {
+	r io.Reader
+	// pending is the message read from the file which didn't fit in the last buffer
+	pending []byte
+	// err is the error which ended the replay, if the file couldn't be read entirely
+	err error
+}
+
+func (s *snapshotReader) read(b []byte) ([]netlink.Message, int32, error) {
+	var msgs []netlink.Message
+	offset := 0
+	for s.err == nil {
+		if s.pending == nil {
+			data, err := s.next(len(b))
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				s.err = err
+				break
+			}
+			s.pending = data
+		}
+
+		if offset+len(s.pending) > len(b) {
+			// the message is emitted with the next read
+			return msgs, 0, nil
+		}
+		n := copy(b[offset:], s.pending)
+		msgs = append(msgs, netlink.Message{
+			Header: netlink.Header{
+				Length: uint32(unix.NLMSG_HDRLEN + n),
+				Type:   netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK << 8),
+			},
+			Data: b[offset : offset+n],
+		})
+		offset += n
+		s.pending = nil
+	}
+
+	return append(msgs, netlink.Message{Header: netlink.Header{Type: netlink.Done}}), 0, nil
+}
+
+// next reads the next message of the snapshot, or returns io.EOF at the end of the file.
+// Messages larger than maxSize, the size of the receive buffers, are rejected before being
+// allocated, since the size is read from the file.
+func (s *snapshotReader) next(maxSize int) ([]byte, error) {
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(s.r, size); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("truncated message size")
+		}
+		return nil, err
+	}
+
+	n := binary.LittleEndian.Uint32(size)
+	if n > uint32(maxSize) {
+		return nil, fmt.Errorf("%w: %d bytes", errSnapshotMessageTooLarge, n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(s.r, data); err != nil {
+		return nil, fmt.Errorf("couldn't read enough data")
+	}
+	return data, nil
+}
@@ -0,0 +1,114 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	pool := newBufferPool()
+	events := make(chan Event, 2)
+	events <- Event{msgs: []netlink.Message{{Data: encodeTestConn(t, nil)}}, pool: pool}
+	events <- Event{msgs: []netlink.Message{{Data: encodeTestConn(t, nil)}, {Data: encodeTestConn(t, nil)}}, pool: pool}
+	close(events)
+
+	path := filepath.Join(t.TempDir(), "conntrack.snapshot")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	w := bufio.NewWriter(f)
+	require.NoError(t, writeSnapshot(w, events))
+	require.NoError(t, w.Flush())
+	require.NoError(t, f.Close())
+
+	messages, err := ReadSnapshot(path)
+	require.NoError(t, err)
+	require.Len(t, messages, 3)
+	assert.Equal(t, encodeTestConn(t, nil), messages[0].Data)
+
+	connections := NewDecoder().DecodeAndReleaseEvent(Event{msgs: messages})
+	require.Len(t, connections, 3)
+	for _, c := range connections {
+		assert.Equal(t, uint16(58472), *c.Origin.Proto.SrcPort)
+		assert.Equal(t, uint16(5432), *c.Reply.Proto.SrcPort)
+		assert.True(t, IsNAT(c))
+	}
+}
+
+func TestReadSnapshotTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conntrack.snapshot")
+	require.NoError(t, os.WriteFile(path, []byte{10, 0, 0, 0, 1, 2}, 0o600))
+
+	_, err := ReadSnapshot(path)
+	assert.Error(t, err)
+}
+
+func TestReadSnapshotTooLarge(t *testing.T) {
+	// the size of the message is read from the file, and isn't trusted
+	data := []byte{0xf0, 0xff, 0xff, 0xff, 1, 2}
+	path := filepath.Join(t.TempDir(), "conntrack.snapshot")
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+
+	_, err := ReadSnapshot(path)
+	assert.ErrorIs(t, err, errSnapshotMessageTooLarge)
+
+	reader := &snapshotReader{r: bytes.NewReader(data)}
+	msgs, _, err := reader.read(make([]byte, os.Getpagesize()))
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, netlink.Done, msgs[0].Header.Type)
+	assert.ErrorIs(t, reader.err, errSnapshotMessageTooLarge)
+}
+
+func TestReplayDumpFile(t *testing.T) {
+	// More messages than fit in a single receive buffer
+	var data [][]byte
+	events := make(chan Event, 1)
+	var msgs []netlink.Message
+	for i := 0; i < 2000; i++ {
+		m := encodeTestConn(t, func(ae *netlink.AttributeEncoder) {
+			ae.Uint32(ctaID, uint32(i))
+		})
+		data = append(data, m)
+		msgs = append(msgs, netlink.Message{Data: m})
+	}
+	events <- Event{msgs: msgs}
+	close(events)
+
+	path := filepath.Join(t.TempDir(), "conntrack.snapshot")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	w := bufio.NewWriter(f)
+	require.NoError(t, writeSnapshot(w, events))
+	require.NoError(t, w.Flush())
+	require.NoError(t, f.Close())
+
+	c := NewConsumer(t.TempDir(), -1, false)
+	defer c.Stop()
+	replayed, err := c.ReplayDumpFile(path)
+	require.NoError(t, err)
+
+	var replayedData [][]byte
+	batches := 0
+	for e := range replayed {
+		batches++
+		for _, m := range e.Messages() {
+			replayedData = append(replayedData, append([]byte(nil), m.Data...))
+		}
+		e.Done()
+	}
+	assert.Greater(t, batches, 1)
+	assert.Equal(t, data, replayedData)
+
+	_, err = c.ReplayDumpFile(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
@@ -42,16 +42,19 @@ type Socket struct {
 	recvbuf []byte
 }
 
+// openSocket creates a socket file descriptor. It's a variable for testing purposes.
+var openSocket = unix.Socket
+
 // NewSocket creates a new NETLINK socket
 func NewSocket() (*Socket, error) {
-	fd, err := unix.Socket(
+	fd, err := openSocket(
 		unix.AF_NETLINK,
 		unix.SOCK_RAW|unix.SOCK_CLOEXEC,
 		unix.NETLINK_NETFILTER,
 	)
 
 	if err != nil {
-		return nil, err
+		return nil, checkModuleError(os.NewSyscallError("socket", err))
 	}
 
 	err = unix.SetNonblock(fd, true)
@@ -90,8 +93,12 @@ func NewSocket() (*Socket, error) {
 	return socket, nil
 }
 
-// Send a netlink.Message
+// Send a netlink.Message. Only read-only requests can be sent, see checkReadOnly.
 func (s *Socket) Send(m netlink.Message) error {
+	if err := checkReadOnly(m); err != nil {
+		return err
+	}
+
 	b, err := m.MarshalBinary()
 	if err != nil {
 		return err
@@ -119,8 +126,18 @@ func (s *Socket) Receive() ([]netlink.Message, error) {
 
 // ReceiveInto reads one or more netlink.Messages off the socket
 func (s *Socket) ReceiveInto(b []byte) ([]netlink.Message, int32, error) {
+	return s.receiveInto(b, s.recvmsg)
+}
+
+// TryReceiveInto is the non-blocking version of ReceiveInto: it returns unix.EAGAIN
+// (wrapped in an *os.SyscallError) instead of waiting when no data is available.
+func (s *Socket) TryReceiveInto(b []byte) ([]netlink.Message, int32, error) {
+	return s.receiveInto(b, s.tryRecvmsg)
+}
+
+func (s *Socket) receiveInto(b []byte, recvmsg func(b []byte, oob []byte, flags int) (int, int, error)) ([]netlink.Message, int32, error) {
 	oob := make([]byte, unix.CmsgSpace(24))
-	n, oobn, err := s.recvmsg(s.recvbuf, oob, 0)
+	n, oobn, err := recvmsg(s.recvbuf, oob, 0)
 	if err != nil {
 		return nil, 0, os.NewSyscallError("recvmsg", err)
 	}
@@ -179,6 +196,16 @@ func (s *Socket) File() *os.File {
 	return s.fd
 }
 
+// rawFD returns the file descriptor of the socket. Unlike File().Fd(), it doesn't
+// put the socket in blocking mode.
+func (s *Socket) rawFD() int {
+	var fd int
+	_ = s.conn.Control(func(f uintptr) {
+		fd = int(f)
+	})
+	return fd
+}
+
 // Close the socket
 func (s *Socket) Close() error {
 	return s.fd.Close()
@@ -259,6 +286,23 @@ func (s *Socket) SetBPF(filter []bpf.RawInstruction) error {
 	return err
 }
 
+// filterLen returns the number of instructions of the BPF filter attached to the socket, 0 if none
+func (s *Socket) filterLen() (int, error) {
+	var n uint32
+	var errno unix.Errno
+	ctrlErr := s.conn.Control(func(fd uintptr) {
+		// With a zero length, SO_GET_FILTER reports the filter length without copying it
+		_, _, errno = unix.Syscall6(unix.SYS_GETSOCKOPT, fd, unix.SOL_SOCKET, unix.SO_GET_FILTER, 0, uintptr(unsafe.Pointer(&n)), 0)
+	})
+	if ctrlErr != nil {
+		return 0, ctrlErr
+	}
+	if errno != 0 {
+		return 0, os.NewSyscallError("getsockopt", errno)
+	}
+	return int(n), nil
+}
+
 func (s *Socket) recvmsg(b []byte, oob []byte, flags int) (int, int, error) {
 	var (
 		n    int
@@ -278,6 +322,25 @@ func (s *Socket) recvmsg(b []byte, oob []byte, flags int) (int, int, error) {
 	return n, oobn, err
 }
 
+// tryRecvmsg reads from the socket without waiting for it to become readable
+func (s *Socket) tryRecvmsg(b []byte, oob []byte, flags int) (int, int, error) {
+	var (
+		n    int
+		oobn int
+		err  error
+	)
+
+	ctrlErr := s.conn.Control(func(fd uintptr) {
+		n, oobn, _, _, err = unix.Recvmsg(int(fd), b, oob, flags|unix.MSG_DONTWAIT)
+	})
+
+	if ctrlErr != nil {
+		return 0, 0, ctrlErr
+	}
+
+	return n, oobn, err
+}
+
 // Copied from github.com/mdlayher/netlink
 // ready indicates readiness based on the value of err.
 func ready(err error) bool {
@@ -0,0 +1,101 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netns"
+)
+
+// ErrTableSizeUnavailable is returned by EstimateTableSize when the kernel doesn't expose
+// nf_conntrack_count, e.g. on minimal kernels or when nf_conntrack isn't loaded.
+var ErrTableSizeUnavailable = errors.New("conntrack table size unavailable")
+
+// EstimateTableSize returns the current number of entries of the conntrack table, which is
+// cheap to read and lets callers decide how to dump the table. When listening to all
+// namespaces, the entries of every network namespace are counted.
+func (c *Consumer) EstimateTableSize() (int, error) {
+	rootNS, err := c.rootNamespace()
+	if err != nil {
+		return 0, fmt.Errorf("could not get root namespace: %w", err)
+	}
+	defer rootNS.Close()
+
+	total, err := c.namespaceTableSize(rootNS)
+	if err != nil {
+		return 0, err
+	}
+
+	if !c.listenAllNamespaces {
+		return total, nil
+	}
+
+	nss, err := GetNetNamespaces(c.procRoot)
+	if err != nil {
+		return 0, fmt.Errorf("could not get network namespaces: %w", err)
+	}
+	defer closeNamespaces(nss)
+
+	for _, ns := range nss {
+		if rootNS.Equal(ns) {
+			continue
+		}
+
+		n, err := c.namespaceTableSize(ns)
+		if err != nil {
+			if errors.Is(err, ErrNamespaceGone) {
+				continue
+			}
+			return 0, err
+		}
+		total += n
+	}
+
+	return total, nil
+}
+
+// namespaceTableSize returns the number of conntrack entries of the given namespace.
+// /proc/sys/net reflects the network namespace of the reading thread, so the count is read
+// from within the namespace.
+func (c *Consumer) namespaceTableSize(ns netns.NsHandle) (int, error) {
+	var n int
+	err := c.withNS(ns, func() error {
+		var err error
+		n, err = readConntrackCount(c.procRoot)
+		return err
+	})
+	return n, err
+}
+
+func readConntrackCount(procRoot string) (int, error) {
+	return readConntrackSysctl(procRoot, "nf_conntrack_count")
+}
+
+// readConntrackMax returns the maximum number of entries of the conntrack table
+func readConntrackMax(procRoot string) (int, error) {
+	return readConntrackSysctl(procRoot, "nf_conntrack_max")
+}
+
+func readConntrackSysctl(procRoot, name string) (int, error) {
+	content, err := ioutil.ReadFile(path.Join(procRoot, "sys/net/netfilter", name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, fmt.Errorf("%w: %s", ErrTableSizeUnavailable, err)
+		}
+		return 0, err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0, fmt.Errorf("could not parse %s: %w", name, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,85 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// newFakeProcRoot returns a procfs root whose pid 1 lives in the current network namespace,
+// with the given nf_conntrack_count content, if any.
+func newFakeProcRoot(t *testing.T, count string) string {
+	procRoot := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(procRoot, "1/ns"), 0o755))
+	require.NoError(t, os.Symlink("/proc/self/ns/net", filepath.Join(procRoot, "1/ns/net")))
+
+	if count != "" {
+		dir := filepath.Join(procRoot, "sys/net/netfilter")
+		require.NoError(t, os.MkdirAll(dir, 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "nf_conntrack_count"), []byte(count), 0o644))
+	}
+	return procRoot
+}
+
+func TestEstimateTableSize(t *testing.T) {
+	c := NewConsumer(newFakeProcRoot(t, "1234\n"), -1, false)
+	defer c.Stop()
+
+	n, err := c.EstimateTableSize()
+	require.NoError(t, err)
+	assert.Equal(t, 1234, n)
+}
+
+func TestEstimateTableSizeUnavailable(t *testing.T) {
+	c := NewConsumer(newFakeProcRoot(t, ""), -1, false)
+	defer c.Stop()
+
+	_, err := c.EstimateTableSize()
+	assert.ErrorIs(t, err, ErrTableSizeUnavailable)
+}
+
+func TestReadConntrackCountInvalid(t *testing.T) {
+	_, err := readConntrackCount(newFakeProcRoot(t, "lots"))
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrTableSizeUnavailable)
+}
+
+func TestSkipEmptyNamespaces(t *testing.T) {
+	rootNS, emptyNS, busyNS, unknownNS := netns.NsHandle(-2), netns.NsHandle(-3), netns.NsHandle(-4), netns.NsHandle(-5)
+	procRoots := map[netns.NsHandle]string{
+		emptyNS:   newFakeProcRoot(t, "0\n"),
+		busyNS:    newFakeProcRoot(t, "12\n"),
+		unknownNS: newFakeProcRoot(t, ""),
+	}
+
+	c := NewConsumer(t.TempDir(), -1, false, WithSkipEmptyNamespaces())
+	defer c.Stop()
+	c.tableSize = func(ns netns.NsHandle) (int, error) {
+		return readConntrackCount(procRoots[ns])
+	}
+	var dumped []netns.NsHandle
+	c.dumpNS = func(ctx context.Context, family uint8, output chan Event, ns netns.NsHandle) error {
+		dumped = append(dumped, ns)
+		return nil
+	}
+
+	isPeer := func(netns.NsHandle) bool { return true }
+	nss := []netns.NsHandle{rootNS, emptyNS, busyNS, unknownNS}
+	c.dumpNamespaces(context.Background(), unix.AF_INET, make(chan Event, outputBuffer), rootNS, nss, isPeer)
+	// Namespaces are dumped when their count can't be read
+	assert.Equal(t, []netns.NsHandle{rootNS, busyNS, unknownNS}, dumped)
+
+	c.skipEmptyNamespaces = false
+	dumped = nil
+	c.dumpNamespaces(context.Background(), unix.AF_INET, make(chan Event, outputBuffer), rootNS, nss, isPeer)
+	assert.Equal(t, nss, dumped)
+}
@@ -0,0 +1,88 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// WithTableUtilizationMonitor makes the Consumer check the utilization of the conntrack table of
+// the root namespace (nf_conntrack_count / nf_conntrack_max) every interval, and log a warning
+// once it reaches threshold, e.g. 0.9. When the table is full, the kernel drops new connections
+// or evicts entries (see KernelConntrackStats), whatever the Consumer does, so the warning gives
+// a heads-up before the collected data becomes unreliable. The utilization is reported as the
+// conntrack_table_utilization stat, in percent. The monitor runs until Stop is called.
+func WithTableUtilizationMonitor(interval time.Duration, threshold float64) ConsumerOption {
+	return func(c *Consumer) {
+		if interval > 0 && threshold > 0 {
+			c.tableMonitor = newTableMonitor(interval, threshold)
+		}
+	}
+}
+
+type tableMonitor struct {
+	interval  time.Duration
+	threshold float64
+	warnf     func(format string, args ...interface{})
+	// nearCapacity is set while the utilization is above the threshold, so that the warning
+	// is logged once each time the threshold is crossed
+	nearCapacity bool
+
+	done chan struct{}
+}
+
+func newTableMonitor(interval time.Duration, threshold float64) *tableMonitor {
+	return &tableMonitor{
+		interval:  interval,
+		threshold: threshold,
+		warnf:     log.Printf,
+		done:      make(chan struct{}),
+	}
+}
+
+// monitorTableUtilization checks the table utilization every interval, until the monitor is stopped
+func (c *Consumer) monitorTableUtilization() {
+	ticker := time.NewTicker(c.tableMonitor.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.checkTableUtilization()
+		case <-c.tableMonitor.done:
+			return
+		}
+	}
+}
+
+// checkTableUtilization updates the utilization of the conntrack table, and warns when it's
+// above the threshold
+func (c *Consumer) checkTableUtilization() {
+	var count, max int
+	err := c.withRootNS(func() error {
+		var err error
+		if count, err = readConntrackCount(c.procRoot); err != nil {
+			return err
+		}
+		max, err = readConntrackMax(c.procRoot)
+		return err
+	})
+	if err != nil || max <= 0 {
+		return
+	}
+
+	utilization := float64(count) / float64(max)
+	atomic.StoreInt64(&c.tableUtilization, int64(utilization*100))
+
+	m := c.tableMonitor
+	if utilization < m.threshold {
+		m.nearCapacity = false
+		return
+	}
+	if !m.nearCapacity {
+		m.nearCapacity = true
+		m.warnf("conntrack table is near capacity: %d/%d entries (%.0f%%), the kernel may start dropping connections", count, max, utilization*100)
+	}
+}
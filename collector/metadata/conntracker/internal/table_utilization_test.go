@@ -0,0 +1,65 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTableUtilizationWarning(t *testing.T) {
+	procRoot := newFakeProcRoot(t, "")
+	setSysctl := func(name string, value int) {
+		path := filepath.Join(procRoot, "sys/net/netfilter", name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf("%d\n", value)), 0o644))
+	}
+	setSysctl("nf_conntrack_max", 1000)
+
+	c := NewConsumer(procRoot, -1, false)
+	defer c.Stop()
+	c.tableMonitor = newTableMonitor(time.Second, 0.9)
+	var warnings []string
+	c.tableMonitor.warnf = func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+
+	setSysctl("nf_conntrack_count", 500)
+	c.checkTableUtilization()
+	assert.Empty(t, warnings)
+	assert.Equal(t, int64(50), c.GetStats()["conntrack_table_utilization"])
+
+	setSysctl("nf_conntrack_count", 950)
+	c.checkTableUtilization()
+	require.Len(t, warnings, 1)
+	assert.Contains(t, warnings[0], "950/1000")
+	assert.Equal(t, int64(95), c.Stats().TableUtilization)
+
+	// The warning isn't repeated until the utilization goes below the threshold again
+	c.checkTableUtilization()
+	assert.Len(t, warnings, 1)
+	setSysctl("nf_conntrack_count", 100)
+	c.checkTableUtilization()
+	setSysctl("nf_conntrack_count", 1000)
+	c.checkTableUtilization()
+	assert.Len(t, warnings, 2)
+	assert.Equal(t, int64(100), c.Stats().TableUtilization)
+}
+
+func TestTableUtilizationMonitor(t *testing.T) {
+	procRoot := newFakeProcRoot(t, "800")
+	require.NoError(t, os.WriteFile(filepath.Join(procRoot, "sys/net/netfilter/nf_conntrack_max"), []byte("1000"), 0o644))
+
+	c := NewConsumer(procRoot, -1, false, WithTableUtilizationMonitor(10*time.Millisecond, 0.9))
+	defer c.Stop()
+	assert.Eventually(t, func() bool {
+		return c.Stats().TableUtilization == 80
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,63 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// teeJSONBuffer is the number of entries queued for the writer of TeeJSON before dropping them
+const teeJSONBuffer = 1024
+
+// jsonTee writes the decoded entries to a writer, as newline-delimited JSON, from its own goroutine
+type jsonTee struct {
+	entries chan Con
+	dropped int64
+	done    sync.WaitGroup
+}
+
+// TeeJSON makes the decoder write every entry it returns to w as a line of JSON, e.g. to a file
+// or os.Stderr, to debug what's decoded on a host without running the whole pipeline. Entries
+// are written by another goroutine, and dropped when w can't keep up, so that decoding never
+// blocks on w. The returned function stops the tee once the queued entries are written; it
+// must not be called concurrently with decoding. Write errors stop the output, but not decoding.
+func (d *Decoder) TeeJSON(w io.Writer) (stop func()) {
+	tee := &jsonTee{entries: make(chan Con, teeJSONBuffer)}
+	tee.done.Add(1)
+	go func() {
+		defer tee.done.Done()
+		enc := json.NewEncoder(w)
+		var err error
+		for c := range tee.entries {
+			if err != nil {
+				continue
+			}
+			if err = enc.Encode(&c); err != nil {
+				d.logf("could not write decoded conntrack entries: %s", err)
+			}
+		}
+	}()
+
+	d.tee = tee
+	return func() {
+		d.tee = nil
+		close(tee.entries)
+		tee.done.Wait()
+		if dropped := atomic.LoadInt64(&tee.dropped); dropped > 0 {
+			d.logf("dropped %d decoded conntrack entries the JSON writer couldn't keep up with", dropped)
+		}
+	}
+}
+
+// send queues the entry for writing, or drops it if the queue is full
+func (t *jsonTee) send(c *Con) {
+	select {
+	case t.entries <- *c:
+	default:
+		atomic.AddInt64(&t.dropped, 1)
+	}
+}
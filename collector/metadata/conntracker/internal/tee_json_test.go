@@ -0,0 +1,102 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// blockingWriter blocks every write until release is closed
+type blockingWriter struct {
+	release chan struct{}
+	io.Writer
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	<-w.release
+	return w.Writer.Write(b)
+}
+
+func teeTestEvent(t *testing.T, n int) Event {
+	msg := netlink.Message{
+		Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK << 8)},
+		Data:   encodeTestConn(t, nil),
+	}
+	msgs := make([]netlink.Message, n)
+	for i := range msgs {
+		msgs[i] = msg
+	}
+	return Event{msgs: msgs, netns: 7}
+}
+
+func TestTeeJSON(t *testing.T) {
+	var out bytes.Buffer
+	decoder := NewDecoder()
+	stop := decoder.TeeJSON(&out)
+	connections := decoder.DecodeAndReleaseEvent(teeTestEvent(t, 3))
+	require.Len(t, connections, 3)
+	stop()
+
+	// entries aren't written anymore once stopped
+	decoder.DecodeAndReleaseEvent(teeTestEvent(t, 1))
+
+	scanner := bufio.NewScanner(&out)
+	lines := 0
+	for scanner.Scan() {
+		lines++
+		var entry struct {
+			NetNS  int32
+			Origin struct {
+				Src   string
+				Proto struct {
+					SrcPort uint16
+				}
+			}
+		}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry), scanner.Text())
+		assert.Equal(t, int32(7), entry.NetNS)
+		assert.Equal(t, "10.0.2.15", entry.Origin.Src)
+		assert.Equal(t, uint16(58472), entry.Origin.Proto.SrcPort)
+	}
+	assert.Equal(t, 3, lines)
+}
+
+func TestTeeJSONDropsWhenSlow(t *testing.T) {
+	var out bytes.Buffer
+	writer := &blockingWriter{release: make(chan struct{}), Writer: &out}
+	var logs []string
+	decoder := NewDecoder()
+	decoder.logf = func(format string, args ...interface{}) {
+		logs = append(logs, format)
+	}
+	stop := decoder.TeeJSON(writer)
+
+	decoded := make(chan int)
+	go func() {
+		decoded <- len(decoder.DecodeAndReleaseEvent(teeTestEvent(t, 2*teeJSONBuffer)))
+	}()
+	select {
+	case n := <-decoded:
+		assert.Equal(t, 2*teeJSONBuffer, n)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "decoding blocked on the JSON writer")
+	}
+
+	dropped := decoder.tee.dropped
+	assert.GreaterOrEqual(t, dropped, int64(teeJSONBuffer-1))
+	close(writer.release)
+	stop()
+	assert.Equal(t, int64(2*teeJSONBuffer)-dropped, int64(bytes.Count(out.Bytes(), []byte("\n"))))
+	assert.Len(t, logs, 1)
+}
@@ -8,6 +8,7 @@
 package internal
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/DataDog/ebpf"
@@ -19,8 +20,29 @@ import (
 	"path"
 	"runtime"
 	"strconv"
+	"time"
 )
 
+// ErrNamespaceGone is returned by WithNS when the network namespace was torn down
+// before we could enter it.
+var ErrNamespaceGone = errors.New("network namespace no longer exists")
+
+// ErrNamespaceRestore is returned by WithNS when switching back to the previous network
+// namespace failed. The function passed to WithNS runs on a goroutine of its own, whose OS thread
+// is then left in the wrong namespace: the goroutine exits while still locked to the thread, so
+// the Go runtime terminates the thread instead of scheduling other goroutines on it. The calling
+// goroutine is never moved to another namespace.
+var ErrNamespaceRestore = errors.New("could not restore the previous network namespace")
+
+const (
+	// setNSRetries is the number of attempts made to enter a namespace on transient setns errors
+	setNSRetries       = 3
+	setNSRetryInterval = 10 * time.Millisecond
+)
+
+// setNS switches the network namespace of the current thread. It's a variable for testing purposes.
+var setNS = netns.Set
+
 // GetNetNamespaces returns a list of network namespaces on the machine. The caller
 // is responsible for calling Close() on each of the returned NsHandle's.
 func GetNetNamespaces(procRoot string) ([]netns.NsHandle, error) {
@@ -85,7 +107,7 @@ func WithAllProcs(procRoot string, fn func(int) error) error {
 	return nil
 }
 
-// GetRootNetNamespace gets the root network namespace
+// GetRootNetNamespace gets the root network namespace, which is the namespace of pid 1 under procRoot
 func GetRootNetNamespace(procRoot string) (netns.NsHandle, error) {
 	return GetNetNamespaceFromPid(procRoot, 1)
 }
@@ -96,30 +118,104 @@ func GetNetNamespaceFromPid(procRoot string, pid int) (netns.NsHandle, error) {
 }
 
 // WithNS executes the given function in the given network namespace, and then
-// switches back to the previous namespace.
+// switches back to the previous namespace. fn runs on a dedicated goroutine locked to its
+// thread, so that a thread left in the namespace is discarded, see ErrNamespaceRestore.
 func WithNS(procRoot string, ns netns.NsHandle, fn func() error) error {
-	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
+	var err error
+	returned := false
+	done := make(chan interface{}, 1)
+	go func() {
+		runtime.LockOSThread()
+		defer func() {
+			// when fn panics or exits the goroutine, the thread may be in the namespace and stays
+			// locked, while the panic or the exit is forwarded to the caller
+			done <- recover()
+		}()
+
+		var restored bool
+		restored, err = withNSLocked(ns, fn)
+		returned = true
+		// the thread of a goroutine exiting while locked is terminated instead of being reused
+		if restored {
+			runtime.UnlockOSThread()
+		}
+	}()
 
+	if r := <-done; r != nil {
+		panic(r)
+	}
+	if !returned {
+		runtime.Goexit()
+	}
+	return err
+}
+
+// withNSLocked runs fn in the given namespace from the current thread, which must be locked.
+// restored is false when the thread was left in another namespace.
+func withNSLocked(ns netns.NsHandle, fn func() error) (restored bool, err error) {
 	prevNS, err := netns.Get()
 	if err != nil {
-		return err
+		return true, err
 	}
+	defer prevNS.Close()
 
 	if ns.Equal(prevNS) {
-		return fn()
+		return true, fn()
 	}
 
-	if err := netns.Set(ns); err != nil {
-		return err
+	if err := enterNS(ns); err != nil {
+		return true, err
 	}
 
 	fnErr := fn()
-	nsErr := netns.Set(prevNS)
-	if fnErr != nil {
-		return fnErr
+	if err := setNS(prevNS); err != nil {
+		return false, fmt.Errorf("%w: %s", ErrNamespaceRestore, err)
+	}
+	return true, fnErr
+}
+
+// WithNSContext is like WithNS, but the namespace isn't entered if ctx is already done,
+// and ctx is passed to fn so that it can be cancelled from within the namespace.
+func WithNSContext(ctx context.Context, procRoot string, ns netns.NsHandle, fn func(ctx context.Context) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	return nsErr
+	return WithNS(procRoot, ns, func() error {
+		return fn(ctx)
+	})
+}
+
+// enterNS switches to the given namespace, retrying on the transient errors returned by setns
+// when the namespace is being torn down concurrently (ESRCH, ENOENT). If these errors persist,
+// the namespace is considered gone and ErrNamespaceGone is returned. A stale handle, whose
+// namespace was released since it was listed, is gone as well, without retrying. Other errors,
+// such as EACCES, are permanent and returned right away.
+func enterNS(ns netns.NsHandle) error {
+	var err error
+	for i := 0; i < setNSRetries; i++ {
+		if i > 0 {
+			time.Sleep(setNSRetryInterval)
+		}
+
+		err = setNS(ns)
+		if isStaleHandleError(err) {
+			return fmt.Errorf("%w: stale handle: %s", ErrNamespaceGone, err)
+		}
+		if err == nil || !isTransientSetNSError(err) {
+			return err
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrNamespaceGone, err)
+}
+
+func isTransientSetNSError(err error) bool {
+	return errors.Is(err, unix.ESRCH) || errors.Is(err, unix.ENOENT)
+}
+
+// isStaleHandleError reports whether setns failed because the handle no longer refers to a
+// network namespace: its file descriptor was closed (EBADF), or reused for another file (EINVAL).
+func isStaleHandleError(err error) bool {
+	return errors.Is(err, unix.EBADF) || errors.Is(err, unix.EINVAL)
 }
 
 // WithRootNS executes a function within root network namespace and then switch back
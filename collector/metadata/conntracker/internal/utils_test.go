@@ -0,0 +1,116 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// fakeSetNS replaces setNS with a function failing with the given errors before succeeding.
+// It returns a pointer to the number of calls made to enter the target namespace.
+func fakeSetNS(t *testing.T, target netns.NsHandle, errs ...error) *int {
+	calls := 0
+	prev := setNS
+	t.Cleanup(func() { setNS = prev })
+
+	setNS = func(ns netns.NsHandle) error {
+		if ns != target {
+			// switching back to the previous namespace
+			return nil
+		}
+		calls++
+		if calls <= len(errs) {
+			return errs[calls-1]
+		}
+		return nil
+	}
+	return &calls
+}
+
+func TestWithNSRetriesTransientErrors(t *testing.T) {
+	// An invalid handle is never equal to the current namespace, so WithNS always switches
+	target := netns.None()
+	calls := fakeSetNS(t, target, unix.ESRCH, unix.ENOENT)
+
+	ran := false
+	err := WithNS("/proc", target, func() error {
+		ran = true
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.True(t, ran)
+	assert.Equal(t, 3, *calls)
+}
+
+func TestWithNSNamespaceGone(t *testing.T) {
+	target := netns.None()
+	calls := fakeSetNS(t, target, unix.ESRCH, unix.ESRCH, unix.ESRCH, unix.ESRCH)
+
+	err := WithNS("/proc", target, func() error {
+		t.Fatal("function should not run outside of the namespace")
+		return nil
+	})
+	assert.ErrorIs(t, err, ErrNamespaceGone)
+	assert.Equal(t, setNSRetries, *calls)
+}
+
+func TestWithNSPermanentError(t *testing.T) {
+	target := netns.None()
+	calls := fakeSetNS(t, target, unix.EACCES)
+
+	err := WithNS("/proc", target, func() error {
+		t.Fatal("function should not run outside of the namespace")
+		return nil
+	})
+	assert.ErrorIs(t, err, unix.EACCES)
+	assert.NotErrorIs(t, err, ErrNamespaceGone)
+	assert.Equal(t, 1, *calls)
+}
+
+func TestWithNSRestoreFailure(t *testing.T) {
+	target := netns.None()
+	prev := setNS
+	t.Cleanup(func() { setNS = prev })
+	setNS = func(ns netns.NsHandle) error {
+		if ns == target {
+			return nil
+		}
+		// switching back to the previous namespace
+		return unix.EPERM
+	}
+
+	// fn runs on a goroutine of its own, whose thread is discarded once it exits
+	err := WithNS("/proc", target, func() error {
+		return nil
+	})
+	assert.ErrorIs(t, err, ErrNamespaceRestore)
+	assert.Contains(t, err.Error(), unix.EPERM.Error())
+}
+
+func TestWithNSPanic(t *testing.T) {
+	target := netns.None()
+	fakeSetNS(t, target)
+
+	assert.PanicsWithValue(t, "boom", func() {
+		_ = WithNS("/proc", target, func() error {
+			panic("boom")
+		})
+	})
+}
+
+func TestWithNSStaleHandle(t *testing.T) {
+	target := netns.None()
+	calls := fakeSetNS(t, target, unix.EBADF)
+
+	err := WithNS("/proc", target, func() error {
+		t.Fatal("function should not run outside of the namespace")
+		return nil
+	})
+	assert.ErrorIs(t, err, ErrNamespaceGone)
+	assert.Equal(t, 1, *calls)
+}
@@ -0,0 +1,51 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	ct "github.com/florianl/go-conntrack"
+
+	"github.com/Kindling-project/kindling/collector/model/constlabels"
+	"github.com/Kindling-project/kindling/collector/model/constvalues"
+)
+
+// VolumeMetric is the number of bytes of a connection, named as a Kindling metric
+type VolumeMetric struct {
+	Identity constlabels.MetricIdentity
+	Bytes    uint64
+}
+
+// VolumeMetrics maps the byte counters of the connection to the request and response io
+// metrics. The original direction of the connection carries the requests, from the initiator to
+// the responder, and the reply direction the responses. The metrics are named as entity metrics
+// when the host serves the connection (see Direction.IsServer), e.g. receive_bytes_total for the
+// requests, and as topology metrics otherwise.
+//
+// Nothing is returned for transit and unknown connections, nor when the counters weren't
+// decoded, e.g. with nf_conntrack_acct disabled.
+func VolumeMetrics(conn *Con, direction Direction) []VolumeMetric {
+	if conn == nil || direction == DirectionUnknown || direction == DirectionTransit {
+		return nil
+	}
+
+	isServer := direction.IsServer()
+	var metrics []VolumeMetric
+	for _, m := range []struct {
+		origName string
+		counter  *ct.Counter
+	}{
+		{constvalues.RequestIo, conn.CounterOrigin},
+		{constvalues.ResponseIo, conn.CounterReply},
+	} {
+		if m.counter == nil || m.counter.Bytes == nil {
+			continue
+		}
+		identity, err := constlabels.MetricIdentityFor(m.origName, isServer, "")
+		if err != nil {
+			continue
+		}
+		metrics = append(metrics, VolumeMetric{Identity: identity, Bytes: *m.counter.Bytes})
+	}
+	return metrics
+}
@@ -0,0 +1,42 @@
+//go:build linux && !android
+// +build linux,!android
+
+package internal
+
+import (
+	"testing"
+
+	ct "github.com/florianl/go-conntrack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/Kindling-project/kindling/collector/model/constlabels"
+)
+
+func TestVolumeMetrics(t *testing.T) {
+	requestBytes, responseBytes := uint64(1200), uint64(64000)
+	conn := &Con{Con: ct.Con{
+		Origin:        newIPTuple("2.2.2.2", "10.0.2.15", 58472, 80, unix.IPPROTO_TCP),
+		Reply:         newIPTuple("10.0.2.15", "2.2.2.2", 80, 58472, unix.IPPROTO_TCP),
+		CounterOrigin: &ct.Counter{Bytes: &requestBytes},
+		CounterReply:  &ct.Counter{Bytes: &responseBytes},
+	}}
+
+	// The host receives the requests of an inbound connection
+	metrics := VolumeMetrics(conn, DirectionInbound)
+	require.Len(t, metrics, 2)
+	assert.Equal(t, constlabels.MetricPrefix()+"_entity_request_receive_bytes_total", metrics[0].Identity.Name)
+	assert.Equal(t, requestBytes, metrics[0].Bytes)
+	assert.Equal(t, constlabels.MetricPrefix()+"_entity_request_send_bytes_total", metrics[1].Identity.Name)
+	assert.Equal(t, responseBytes, metrics[1].Bytes)
+
+	metrics = VolumeMetrics(conn, DirectionOutbound)
+	require.Len(t, metrics, 2)
+	assert.Equal(t, constlabels.MetricPrefix()+"_topology_request_request_bytes_total", metrics[0].Identity.Name)
+	assert.Equal(t, constlabels.MetricPrefix()+"_topology_request_response_bytes_total", metrics[1].Identity.Name)
+
+	assert.Nil(t, VolumeMetrics(conn, DirectionTransit))
+	assert.Nil(t, VolumeMetrics(conn, DirectionUnknown))
+	assert.Nil(t, VolumeMetrics(&Con{Con: ct.Con{Origin: conn.Origin, Reply: conn.Reply}}, DirectionInbound))
+}
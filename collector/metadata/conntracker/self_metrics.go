@@ -2,20 +2,27 @@ package conntracker
 
 import (
 	"context"
+	"github.com/Kindling-project/kindling/collector/model/constlabels"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/metric"
 	"sync"
 )
 
+// The metric names are rendered with selfMetricName, so that they share the configurable
+// prefix of the application metrics, e.g. "kindling_telemetry_conntracker_cache_size".
 const (
-	cacheSizeMetric     = "kindling_telemetry_conntracker_cache_size"
-	cacheMaxSizeMetric  = "kindling_telemetry_conntracker_cache_max_size"
-	operationTimesTotal = "kindling_telemetry_conntracker_operation_times_total"
-	errorsTotal         = "kindling_telemetry_conntracker_errors_total"
-	samplingRate        = "kindling_telemetry_conntracker_sampling_rate"
-	throttlesTotal      = "kindling_telemetry_conntracker_throttles_total"
+	cacheSizeMetric     = "cache_size"
+	cacheMaxSizeMetric  = "cache_max_size"
+	operationTimesTotal = "operation_times_total"
+	errorsTotal         = "errors_total"
+	samplingRate        = "sampling_rate"
+	throttlesTotal      = "throttles_total"
 )
 
+func selfMetricName(name string) string {
+	return constlabels.ToKindlingTelemetryMetricName("conntracker", name)
+}
+
 var (
 	selfTelemetryOnce        sync.Once
 	cacheSizeInstrument      metric.Int64GaugeObserver
@@ -34,17 +41,17 @@ var conntrackerStaticStates map[string]int64
 func newSelfMetrics(meterProvider metric.MeterProvider, conntracker Conntracker) {
 	selfTelemetryOnce.Do(func() {
 		meter := metric.Must(meterProvider.Meter("kindling"))
-		cacheSizeInstrument = meter.NewInt64GaugeObserver(cacheSizeMetric,
+		cacheSizeInstrument = meter.NewInt64GaugeObserver(selfMetricName(cacheSizeMetric),
 			func(ctx context.Context, result metric.Int64ObserverResult) {
 				conntrackerStaticStates = conntracker.GetStats()
 				result.Observe(conntrackerStaticStates["state_size"], attribute.String("type", "general"))
 				result.Observe(conntrackerStaticStates["orphan_size"], attribute.String("type", "orphan"))
 			})
-		cacheMaxSizeInstrument = meter.NewInt64GaugeObserver(cacheMaxSizeMetric,
+		cacheMaxSizeInstrument = meter.NewInt64GaugeObserver(selfMetricName(cacheMaxSizeMetric),
 			func(ctx context.Context, result metric.Int64ObserverResult) {
 				result.Observe(conntrackerStaticStates["cache_max_size"])
 			})
-		operationTimesInstrument = meter.NewInt64CounterObserver(operationTimesTotal,
+		operationTimesInstrument = meter.NewInt64CounterObserver(selfMetricName(operationTimesTotal),
 			func(ctx context.Context, result metric.Int64ObserverResult) {
 				result.Observe(conntrackerStaticStates["registers_total"], attribute.String("op", "add"))
 				result.Observe(conntrackerStaticStates["registers_dropped"], attribute.String("op", "drop"))
@@ -52,17 +59,17 @@ func newSelfMetrics(meterProvider metric.MeterProvider, conntracker Conntracker)
 				result.Observe(conntrackerStaticStates["gets_total"], attribute.String("op", "get"))
 				result.Observe(conntrackerStaticStates["evicts_total"], attribute.String("op", "evict"))
 			})
-		errorsTotalInstrument = meter.NewInt64CounterObserver(errorsTotal,
+		errorsTotalInstrument = meter.NewInt64CounterObserver(selfMetricName(errorsTotal),
 			func(ctx context.Context, result metric.Int64ObserverResult) {
 				result.Observe(conntrackerStaticStates["enobufs"], attribute.String("type", "enobuf"))
 				result.Observe(conntrackerStaticStates["read_errors"], attribute.String("type", "read_errors"))
 				result.Observe(conntrackerStaticStates["msg_errors"], attribute.String("type", "msg_errors"))
 			})
-		samplingRateInstrument = meter.NewInt64GaugeObserver(samplingRate,
+		samplingRateInstrument = meter.NewInt64GaugeObserver(selfMetricName(samplingRate),
 			func(ctx context.Context, result metric.Int64ObserverResult) {
 				result.Observe(conntrackerStaticStates["sampling_pct"])
 			})
-		throttlesTotalInstrument = meter.NewInt64CounterObserver(throttlesTotal,
+		throttlesTotalInstrument = meter.NewInt64CounterObserver(selfMetricName(throttlesTotal),
 			func(ctx context.Context, result metric.Int64ObserverResult) {
 				result.Observe(conntrackerStaticStates["throttles"])
 			})
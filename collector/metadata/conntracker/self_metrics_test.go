@@ -2,6 +2,7 @@ package conntracker
 
 import (
 	"context"
+	"github.com/Kindling-project/kindling/collector/model/constlabels"
 	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
 	controller "go.opentelemetry.io/otel/sdk/metric/controller/basic"
 	otelprocessor "go.opentelemetry.io/otel/sdk/metric/processor/basic"
@@ -45,3 +46,19 @@ func TestNewSelfMetric(t *testing.T) {
 	time.Sleep(time.Second * 5)
 	_ = cont.Stop(context.Background())
 }
+
+func TestSelfMetricNamePrefix(t *testing.T) {
+	if got := selfMetricName(errorsTotal); got != "kindling_telemetry_conntracker_errors_total" {
+		t.Errorf("unexpected metric name %q", got)
+	}
+
+	defer func() {
+		_ = constlabels.SetMetricPrefix(constlabels.NPMPrefixKindling)
+	}()
+	if err := constlabels.SetMetricPrefix("acme"); err != nil {
+		t.Fatal(err)
+	}
+	if got := selfMetricName(errorsTotal); got != "acme_telemetry_conntracker_errors_total" {
+		t.Errorf("unexpected metric name %q", got)
+	}
+}
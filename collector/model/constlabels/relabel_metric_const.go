@@ -1,6 +1,12 @@
 package constlabels
 
-import "github.com/Kindling-project/kindling/collector/model/constvalues"
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/Kindling-project/kindling/collector/model/constvalues"
+)
 
 // key1: originName key2: isServer
 var metricNameDictionary = map[string]map[bool]string{
@@ -9,8 +15,54 @@ var metricNameDictionary = map[string]map[bool]string{
 	constvalues.RequestTotalTime:          {true: EntityRequestLatencyTotalMetric, false: TopologyRequestLatencyTotalMetric},
 	constvalues.RequestCount:              {true: EntityRequestCountMetric, false: TopologyRequestCountMetric},
 	constvalues.RequestTotalTime + "_avg": {true: EntityRequestLatencyAverageMetric, false: TopologyRequestLatencyAverageMetric},
+	constvalues.RequestIoRate:             {true: EntityRequestIoRateMetric, false: TopologyRequestIoRateMetric},
+	constvalues.ResponseIoRate:            {true: EntityResponseIoRateMetric, false: TopologyResponseIoRateMetric},
+	constvalues.ConnectionAge:             {true: EntityConnectionAgeMetric, false: TopologyConnectionAgeMetric},
+}
+
+// key: originName. Metrics not listed here are request metrics.
+var metricSubjectDictionary = map[string]string{
+	constvalues.ConnectionAge: connectionSubject,
+}
+
+const (
+	requestSubject    = "request_"
+	connectionSubject = "connection_"
+)
+
+// MetricKind is the type of instrument a Kindling metric should be exported as
+type MetricKind int
+
+const (
+	MetricKindCounter MetricKind = iota
+	MetricKindGauge
+	MetricKindHistogram
+)
+
+// key: originName
+var metricKindDictionary = map[string]MetricKind{
+	constvalues.RequestIo:                 MetricKindCounter,
+	constvalues.ResponseIo:                MetricKindCounter,
+	constvalues.RequestTotalTime:          MetricKindCounter,
+	constvalues.RequestCount:              MetricKindCounter,
+	constvalues.RequestTotalTime + "_avg": MetricKindHistogram,
+	constvalues.RequestIoRate:             MetricKindGauge,
+	constvalues.ResponseIoRate:            MetricKindGauge,
+	constvalues.ConnectionAge:             MetricKindHistogram,
+
+	constvalues.ConntrackQueueDepth:    MetricKindGauge,
+	constvalues.ConntrackDroppedEvents: MetricKindCounter,
 }
 
+// key: originName. The internal metrics report the health of Kindling itself, see
+// ToKindlingInternalMetricName.
+var internalMetricNameDictionary = map[string]string{
+	constvalues.ConntrackQueueDepth:    conntrackSubsystem + ConntrackQueueDepthMetric,
+	constvalues.ConntrackDroppedEvents: conntrackSubsystem + ConntrackDroppedEventsMetric,
+}
+
+const conntrackSubsystem = "conntrack_"
+
 const (
 	TopologyRequestIoMetric  = "request_bytes_total"
 	TopologyResponseIoMetric = "response_bytes_total"
@@ -18,6 +70,11 @@ const (
 	TopologyRequestLatencyAverageMetric = "average_duration_nanoseconds"
 	TopologyRequestLatencyTotalMetric   = "duration_nanoseconds_total"
 	TopologyRequestCountMetric          = "total"
+	// TopologyRequestIoRateMetric is a gauge
+	TopologyRequestIoRateMetric  = "request_bytes_per_second"
+	TopologyResponseIoRateMetric = "response_bytes_per_second"
+	// TopologyConnectionAgeMetric is a histogram
+	TopologyConnectionAgeMetric = "age_nanoseconds"
 
 	EntityRequestIoMetric  = "receive_bytes_total"
 	EntityResponseIoMetric = "send_bytes_total"
@@ -25,6 +82,15 @@ const (
 	EntityRequestLatencyAverageMetric = "average_duration_nanoseconds"
 	EntityRequestLatencyTotalMetric   = "duration_nanoseconds_total"
 	EntityRequestCountMetric          = "total"
+	// EntityRequestIoRateMetric is a gauge
+	EntityRequestIoRateMetric  = "receive_bytes_per_second"
+	EntityResponseIoRateMetric = "send_bytes_per_second"
+	// EntityConnectionAgeMetric is a histogram
+	EntityConnectionAgeMetric = "age_nanoseconds"
+
+	// ConntrackQueueDepthMetric is a gauge
+	ConntrackQueueDepthMetric    = "queue_depth"
+	ConntrackDroppedEventsMetric = "dropped_events_total"
 )
 
 const (
@@ -34,20 +100,160 @@ const (
 	TopologyPrefix = "topology"
 )
 
+// metricPrefix is the first segment of every metric name. It defaults to NPMPrefixKindling.
+var (
+	metricPrefixMutex sync.RWMutex
+	metricPrefix      = NPMPrefixKindling
+)
+
+// SetMetricPrefix overrides the prefix of the metric names, e.g. to export "acme_entity_request_total"
+// instead of "kindling_entity_request_total". Internal telemetry (see ToKindlingTelemetryMetricName)
+// uses the same prefix. It's safe to call concurrently with rendering, but names rendered before
+// keep the previous prefix, so it should be called during initialization.
+func SetMetricPrefix(prefix string) error {
+	if prefix == "" {
+		return errors.New("the metric prefix can't be empty")
+	}
+	metricPrefixMutex.Lock()
+	defer metricPrefixMutex.Unlock()
+	metricPrefix = prefix
+	return nil
+}
+
+// MetricPrefix returns the prefix of the metric names
+func MetricPrefix() string {
+	metricPrefixMutex.RLock()
+	defer metricPrefixMutex.RUnlock()
+	return metricPrefix
+}
+
+// ToKindlingTelemetryMetricName returns the name of a metric of the internal telemetry of the given
+// component, e.g. "kindling_telemetry_conntracker_errors_total" for ("conntracker", "errors_total").
+func ToKindlingTelemetryMetricName(component string, name string) string {
+	return MetricPrefix() + "_telemetry_" + component + "_" + name
+}
+
+// requestLatencyHistogramMetric is the base name of the request latency histogram.
+// Exporters emitting a true histogram derive the `_bucket`, `_sum` and `_count` series
+// from it. It defaults to the name of the average latency metric, which has historically
+// been exported as a histogram itself.
+var (
+	requestLatencyHistogramMutex  sync.RWMutex
+	requestLatencyHistogramMetric = EntityRequestLatencyAverageMetric
+)
+
+// SetRequestLatencyHistogramName overrides the base name of the request latency histogram,
+// so that an exporter emitting both a true histogram and the derived average latency
+// (see EntityRequestLatencyAverageMetric) doesn't produce colliding names. The formatting
+// processor exports the average latency under this name, which the metric_aggregation_map
+// of the exporter must then map to a histogram.
+// It's safe to call concurrently with rendering, but names rendered before keep the previous
+// name, so it should be called during initialization.
+func SetRequestLatencyHistogramName(name string) error {
+	if name == "" {
+		return errors.New("the name of the request latency histogram can't be empty")
+	}
+	requestLatencyHistogramMutex.Lock()
+	defer requestLatencyHistogramMutex.Unlock()
+	requestLatencyHistogramMetric = name
+	return nil
+}
+
+// RequestLatencyHistogramName returns the base name of the request latency histogram
+func RequestLatencyHistogramName() string {
+	requestLatencyHistogramMutex.RLock()
+	defer requestLatencyHistogramMutex.RUnlock()
+	return requestLatencyHistogramMetric
+}
+
+// ToKindlingHistogramMetricName returns the name of the request latency histogram.
+// Unless overridden by SetRequestLatencyHistogramName, it's the same as the name of
+// the average latency metric.
+func ToKindlingHistogramMetricName(isServer bool) string {
+	return getKindlingPrefix(isServer) + "request_" + RequestLatencyHistogramName()
+}
+
+// ToKindlingInternalMetricName returns the name of an internal metric, e.g.
+// "kindling_conntrack_queue_depth" for constvalues.ConntrackQueueDepth. Unlike the telemetry of
+// ToKindlingTelemetryMetricName, internal metrics are logical metrics with a MetricKind, named
+// after their subsystem. An empty name is returned for unknown metrics.
+func ToKindlingInternalMetricName(origName string) string {
+	name, ok := internalMetricNameDictionary[origName]
+	if !ok {
+		return ""
+	}
+	return MetricPrefix() + "_" + name
+}
+
 func ToKindlingTraceAsMetricName() string {
-	return NPMPrefixKindling + "_trace_request_" + "duration_nanoseconds"
+	return MetricPrefix() + "_trace_request_" + "duration_nanoseconds"
 }
 
 func ToKindlingMetricName(origName string, isServer bool) string {
 	if names, ok := metricNameDictionary[origName]; !ok {
 		return ""
 	} else {
-		return getKindlingPrefix(isServer) + "request_" + names[isServer]
+		return getKindlingPrefix(isServer) + metricSubject(origName) + names[isServer]
+	}
+}
+
+// metricSubject returns what the metric with origName measures, requests unless
+// listed in metricSubjectDictionary
+func metricSubject(origName string) string {
+	if subject, ok := metricSubjectDictionary[origName]; ok {
+		return subject
+	}
+	return requestSubject
+}
+
+// ToKindlingMetricKind returns the MetricKind of the metric with origName
+func ToKindlingMetricKind(origName string) (MetricKind, bool) {
+	kind, ok := metricKindDictionary[origName]
+	return kind, ok
+}
+
+// detailProtocols is the allow-list of protocols for which detail metrics are emitted.
+// Until a protocol is enabled there is no restriction, and every protocol is allowed.
+var (
+	detailProtocolsMutex sync.RWMutex
+	detailProtocols      map[string]struct{}
+)
+
+// EnableDetailProtocol adds the protocol to the allow-list of detail metrics.
+// Once a protocol is enabled, detail metrics of protocols not in the list are dropped.
+func EnableDetailProtocol(protocol string) {
+	detailProtocolsMutex.Lock()
+	defer detailProtocolsMutex.Unlock()
+	if detailProtocols == nil {
+		detailProtocols = make(map[string]struct{})
+	}
+	detailProtocols[protocol] = struct{}{}
+}
+
+// ResetDetailProtocols clears the allow-list, so detail metrics of every protocol are emitted again.
+func ResetDetailProtocols() {
+	detailProtocolsMutex.Lock()
+	defer detailProtocolsMutex.Unlock()
+	detailProtocols = nil
+}
+
+// IsDetailProtocolEnabled returns whether detail metrics should be emitted for the protocol
+func IsDetailProtocolEnabled(protocol string) bool {
+	detailProtocolsMutex.RLock()
+	defer detailProtocolsMutex.RUnlock()
+	if detailProtocols == nil {
+		return true
 	}
+	_, ok := detailProtocols[protocol]
+	return ok
 }
 
-//ToKindlingDetailMetricName For ServerDetail Metric
+// ToKindlingDetailMetricName For ServerDetail Metric.
+// An empty name is returned if the protocol is not enabled, see EnableDetailProtocol.
 func ToKindlingDetailMetricName(origName string, protocol string) string {
+	if !IsDetailProtocolEnabled(protocol) {
+		return ""
+	}
 	if names, ok := metricNameDictionary[origName]; !ok {
 		return ""
 	} else {
@@ -55,6 +261,56 @@ func ToKindlingDetailMetricName(origName string, protocol string) string {
 	}
 }
 
+var (
+	ErrUnknownMetric          = errors.New("unknown metric")
+	ErrDetailMetricNotServer  = errors.New("detail metrics are only available for server side")
+	ErrDetailProtocolDisabled = errors.New("detail metrics are disabled for the protocol")
+)
+
+// MetricIdentity is the canonical identity of a Kindling metric. It's comparable,
+// so it can be used as a map key instead of the rendered name.
+type MetricIdentity struct {
+	// OrigName is the name of the logical metric, e.g. constvalues.RequestIo
+	OrigName string
+	IsServer bool
+	// Protocol is only set for detail metrics
+	Protocol string
+	// Name is the rendered Kindling metric name
+	Name string
+}
+
+// MetricIdentityFor validates the inputs and returns the identity of the metric.
+// A non-empty protocol refers to the server detail metric of that protocol, and
+// ErrDetailProtocolDisabled is returned if the protocol isn't enabled, see EnableDetailProtocol.
+func MetricIdentityFor(origName string, isServer bool, protocol string) (MetricIdentity, error) {
+	if _, ok := metricNameDictionary[origName]; !ok {
+		return MetricIdentity{}, fmt.Errorf("%w: %s", ErrUnknownMetric, origName)
+	}
+
+	identity := MetricIdentity{
+		OrigName: origName,
+		IsServer: isServer,
+		Protocol: protocol,
+	}
+	if protocol == "" {
+		identity.Name = ToKindlingMetricName(origName, isServer)
+		return identity, nil
+	}
+
+	if !isServer {
+		return MetricIdentity{}, fmt.Errorf("%w: %s of protocol %s", ErrDetailMetricNotServer, origName, protocol)
+	}
+	identity.Name = ToKindlingDetailMetricName(origName, protocol)
+	if identity.Name == "" {
+		return MetricIdentity{}, fmt.Errorf("%w: %s of protocol %s", ErrDetailProtocolDisabled, origName, protocol)
+	}
+	return identity, nil
+}
+
+func (m MetricIdentity) String() string {
+	return m.Name
+}
+
 func getKindlingPrefix(isServer bool) string {
 	var kindMark string
 	if isServer {
@@ -62,5 +318,5 @@ func getKindlingPrefix(isServer bool) string {
 	} else {
 		kindMark = TopologyPrefix
 	}
-	return NPMPrefixKindling + "_" + kindMark + "_"
+	return MetricPrefix() + "_" + kindMark + "_"
 }
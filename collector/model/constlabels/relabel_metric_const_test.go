@@ -0,0 +1,295 @@
+package constlabels
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/Kindling-project/kindling/collector/model/constvalues"
+)
+
+func TestToKindlingMetricNameRate(t *testing.T) {
+	tests := []struct {
+		origName string
+		isServer bool
+		want     string
+	}{
+		{constvalues.RequestIoRate, true, "kindling_entity_request_receive_bytes_per_second"},
+		{constvalues.ResponseIoRate, true, "kindling_entity_request_send_bytes_per_second"},
+		{constvalues.RequestIoRate, false, "kindling_topology_request_request_bytes_per_second"},
+		{constvalues.ResponseIoRate, false, "kindling_topology_request_response_bytes_per_second"},
+	}
+	for _, tt := range tests {
+		if got := ToKindlingMetricName(tt.origName, tt.isServer); got != tt.want {
+			t.Errorf("ToKindlingMetricName(%q, %v) = %q, want %q", tt.origName, tt.isServer, got, tt.want)
+		}
+	}
+}
+
+func TestToKindlingMetricNameConnectionAge(t *testing.T) {
+	if got, want := ToKindlingMetricName(constvalues.ConnectionAge, true), "kindling_entity_connection_age_nanoseconds"; got != want {
+		t.Errorf("ToKindlingMetricName(%q, true) = %q, want %q", constvalues.ConnectionAge, got, want)
+	}
+	if got, want := ToKindlingMetricName(constvalues.ConnectionAge, false), "kindling_topology_connection_age_nanoseconds"; got != want {
+		t.Errorf("ToKindlingMetricName(%q, false) = %q, want %q", constvalues.ConnectionAge, got, want)
+	}
+	if kind, ok := ToKindlingMetricKind(constvalues.ConnectionAge); !ok || kind != MetricKindHistogram {
+		t.Errorf("ToKindlingMetricKind(%q) = %v, %v, want %v", constvalues.ConnectionAge, kind, ok, MetricKindHistogram)
+	}
+}
+
+func TestToKindlingMetricKind(t *testing.T) {
+	tests := []struct {
+		origName string
+		want     MetricKind
+	}{
+		{constvalues.RequestIo, MetricKindCounter},
+		{constvalues.RequestTotalTime + "_avg", MetricKindHistogram},
+		{constvalues.RequestIoRate, MetricKindGauge},
+		{constvalues.ResponseIoRate, MetricKindGauge},
+	}
+	for _, tt := range tests {
+		got, ok := ToKindlingMetricKind(tt.origName)
+		if !ok || got != tt.want {
+			t.Errorf("ToKindlingMetricKind(%q) = %v, %v, want %v", tt.origName, got, ok, tt.want)
+		}
+	}
+
+	if _, ok := ToKindlingMetricKind("unknown"); ok {
+		t.Errorf("ToKindlingMetricKind(\"unknown\") should not be found")
+	}
+}
+
+func TestMetricIdentityFor(t *testing.T) {
+	server, err := MetricIdentityFor(constvalues.RequestIo, true, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if server.String() != ToKindlingMetricName(constvalues.RequestIo, true) {
+		t.Errorf("unexpected name %q", server.Name)
+	}
+
+	again, _ := MetricIdentityFor(constvalues.RequestIo, true, "")
+	if server != again {
+		t.Errorf("identities of the same metric should be equal: %+v != %+v", server, again)
+	}
+
+	client, _ := MetricIdentityFor(constvalues.RequestIo, false, "")
+	if server == client {
+		t.Errorf("server and client identities should differ")
+	}
+
+	detail, err := MetricIdentityFor(constvalues.RequestCount, true, "http")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if detail.Name != "kindling_entity_http_total" {
+		t.Errorf("unexpected detail name %q", detail.Name)
+	}
+
+	if _, err := MetricIdentityFor("unknown", true, ""); !errors.Is(err, ErrUnknownMetric) {
+		t.Errorf("expected ErrUnknownMetric, got %v", err)
+	}
+	if _, err := MetricIdentityFor(constvalues.RequestCount, false, "http"); !errors.Is(err, ErrDetailMetricNotServer) {
+		t.Errorf("expected ErrDetailMetricNotServer, got %v", err)
+	}
+
+	EnableDetailProtocol("dns")
+	defer ResetDetailProtocols()
+	if _, err := MetricIdentityFor(constvalues.RequestCount, true, "http"); !errors.Is(err, ErrDetailProtocolDisabled) {
+		t.Errorf("expected ErrDetailProtocolDisabled, got %v", err)
+	}
+	if identity, err := MetricIdentityFor(constvalues.RequestCount, true, "dns"); err != nil || identity.Name == "" {
+		t.Errorf("unexpected identity %+v for an enabled protocol: %v", identity, err)
+	}
+}
+
+func TestSetRequestLatencyHistogramName(t *testing.T) {
+	defer func() {
+		_ = SetRequestLatencyHistogramName(EntityRequestLatencyAverageMetric)
+	}()
+
+	avgName := constvalues.RequestTotalTime + "_avg"
+	for _, isServer := range []bool{true, false} {
+		if ToKindlingHistogramMetricName(isServer) != ToKindlingMetricName(avgName, isServer) {
+			t.Errorf("histogram and average names should be the same by default")
+		}
+	}
+
+	if err := SetRequestLatencyHistogramName(""); err == nil {
+		t.Errorf("expected an error for an empty name")
+	}
+
+	if err := SetRequestLatencyHistogramName("duration_nanoseconds"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := ToKindlingHistogramMetricName(true); got != "kindling_entity_request_duration_nanoseconds" {
+		t.Errorf("unexpected histogram name %q", got)
+	}
+	if got := ToKindlingHistogramMetricName(false); got != "kindling_topology_request_duration_nanoseconds" {
+		t.Errorf("unexpected histogram name %q", got)
+	}
+	for _, isServer := range []bool{true, false} {
+		if ToKindlingHistogramMetricName(isServer) == ToKindlingMetricName(avgName, isServer) {
+			t.Errorf("histogram and average names should differ once configured")
+		}
+	}
+}
+
+func TestDetailProtocolRegistry(t *testing.T) {
+	defer ResetDetailProtocols()
+
+	if !IsDetailProtocolEnabled("kafka") || ToKindlingDetailMetricName(constvalues.RequestCount, "kafka") == "" {
+		t.Errorf("every protocol should be enabled until the allow-list is configured")
+	}
+
+	EnableDetailProtocol("http")
+	if !IsDetailProtocolEnabled("http") || ToKindlingDetailMetricName(constvalues.RequestCount, "http") != "kindling_entity_http_total" {
+		t.Errorf("http should be enabled")
+	}
+	if IsDetailProtocolEnabled("kafka") || ToKindlingDetailMetricName(constvalues.RequestCount, "kafka") != "" {
+		t.Errorf("kafka should be disabled")
+	}
+
+	ResetDetailProtocols()
+	if !IsDetailProtocolEnabled("kafka") {
+		t.Errorf("every protocol should be enabled after a reset")
+	}
+}
+
+func TestDetailProtocolRegistryConcurrency(t *testing.T) {
+	defer ResetDetailProtocols()
+
+	protocols := []string{"http", "mysql", "redis", "kafka", "dns"}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		protocol := protocols[i%len(protocols)]
+		go func() {
+			defer wg.Done()
+			EnableDetailProtocol(protocol)
+		}()
+		go func() {
+			defer wg.Done()
+			_ = ToKindlingDetailMetricName(constvalues.RequestIo, protocol)
+		}()
+	}
+	wg.Wait()
+
+	for _, protocol := range protocols {
+		if !IsDetailProtocolEnabled(protocol) {
+			t.Errorf("%s should be enabled", protocol)
+		}
+	}
+	if IsDetailProtocolEnabled("grpc") {
+		t.Errorf("grpc should be disabled")
+	}
+}
+
+func TestSetMetricPrefix(t *testing.T) {
+	defer func() {
+		_ = SetMetricPrefix(NPMPrefixKindling)
+	}()
+
+	if got := ToKindlingTelemetryMetricName("conntracker", "errors_total"); got != "kindling_telemetry_conntracker_errors_total" {
+		t.Errorf("unexpected telemetry name %q", got)
+	}
+
+	if err := SetMetricPrefix(""); err == nil {
+		t.Errorf("expected an error for an empty prefix")
+	}
+	if err := SetMetricPrefix("acme"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if MetricPrefix() != "acme" {
+		t.Errorf("unexpected prefix %q", MetricPrefix())
+	}
+
+	tests := []struct {
+		got  string
+		want string
+	}{
+		{ToKindlingMetricName(constvalues.RequestCount, true), "acme_entity_request_total"},
+		{ToKindlingMetricName(constvalues.RequestCount, false), "acme_topology_request_total"},
+		{ToKindlingDetailMetricName(constvalues.RequestCount, "http"), "acme_entity_http_total"},
+		{ToKindlingTraceAsMetricName(), "acme_trace_request_duration_nanoseconds"},
+		{ToKindlingTelemetryMetricName("conntracker", "errors_total"), "acme_telemetry_conntracker_errors_total"},
+		{ToKindlingInternalMetricName(constvalues.ConntrackQueueDepth), "acme_conntrack_queue_depth"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("got %q, want %q", tt.got, tt.want)
+		}
+	}
+}
+
+func TestSetRequestLatencyHistogramNameConcurrently(t *testing.T) {
+	defer func() {
+		_ = SetRequestLatencyHistogramName(EntityRequestLatencyAverageMetric)
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			_ = SetRequestLatencyHistogramName("duration_nanoseconds")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if got := ToKindlingHistogramMetricName(true); got != "kindling_entity_request_average_duration_nanoseconds" && got != "kindling_entity_request_duration_nanoseconds" {
+				t.Errorf("unexpected name %q", got)
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+func TestSetMetricPrefixConcurrently(t *testing.T) {
+	defer func() {
+		_ = SetMetricPrefix(NPMPrefixKindling)
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			_ = SetMetricPrefix("acme")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if got := ToKindlingTraceAsMetricName(); got != "kindling_trace_request_duration_nanoseconds" && got != "acme_trace_request_duration_nanoseconds" {
+				t.Errorf("unexpected name %q", got)
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+func TestToKindlingInternalMetricName(t *testing.T) {
+	tests := []struct {
+		origName string
+		want     string
+		kind     MetricKind
+	}{
+		{constvalues.ConntrackQueueDepth, "kindling_conntrack_queue_depth", MetricKindGauge},
+		{constvalues.ConntrackDroppedEvents, "kindling_conntrack_dropped_events_total", MetricKindCounter},
+	}
+	for _, tt := range tests {
+		if got := ToKindlingInternalMetricName(tt.origName); got != tt.want {
+			t.Errorf("ToKindlingInternalMetricName(%q) = %q, want %q", tt.origName, got, tt.want)
+		}
+		if kind, ok := ToKindlingMetricKind(tt.origName); !ok || kind != tt.kind {
+			t.Errorf("ToKindlingMetricKind(%q) = %v, %v, want %v", tt.origName, kind, ok, tt.kind)
+		}
+	}
+
+	if got := ToKindlingInternalMetricName(constvalues.RequestCount); got != "" {
+		t.Errorf("application metrics have no internal name, got %q", got)
+	}
+}
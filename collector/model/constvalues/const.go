@@ -11,5 +11,18 @@ const (
 	RequestIo  = "request_io"
 	ResponseIo = "response_io"
 
+	// RequestIoRate and ResponseIoRate are pre-computed by the edge aggregation
+	RequestIoRate  = "request_io_rate"
+	ResponseIoRate = "response_io_rate"
+
+	// ConnectionAge is the lifetime of a L4 connection, from its NEW to its DESTROY conntrack event
+	ConnectionAge = "connection_age"
+
+	// ConntrackQueueDepth and ConntrackDroppedEvents are internal metrics of the conntrack
+	// consumer: the number of events waiting in its output channel, and the number of events
+	// dropped before reaching it
+	ConntrackQueueDepth    = "conntrack_queue_depth"
+	ConntrackDroppedEvents = "conntrack_dropped_events"
+
 	SpanInfo = "KSpanInfo"
 )